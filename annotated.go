@@ -0,0 +1,192 @@
+package merkletree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"math/bits"
+)
+
+// A ProofNode is a proof hash annotated with the position of the subtree it
+// represents: the subtree of 2^Height leaves beginning at LeafIndex. The
+// final subtree of a tree may contain fewer than 2^Height leaves.
+type ProofNode struct {
+	Hash      []byte
+	Height    int
+	LeafIndex uint64
+}
+
+// An annotatingSubtreeHasher wraps a SubtreeHasher, recording the position
+// of each subtree root it returns.
+type annotatingSubtreeHasher struct {
+	sh        SubtreeHasher
+	leafIndex uint64
+	nodes     []ProofNode
+}
+
+func (ash *annotatingSubtreeHasher) NextSubtreeRoot(n int) ([]byte, error) {
+	root, err := ash.sh.NextSubtreeRoot(n)
+	if err == nil {
+		ash.nodes = append(ash.nodes, ProofNode{
+			Hash:      root,
+			Height:    bits.TrailingZeros64(uint64(n)), // log2
+			LeafIndex: ash.leafIndex,
+		})
+	}
+	ash.leafIndex += uint64(n)
+	return root, err
+}
+
+func (ash *annotatingSubtreeHasher) Skip(n int) error {
+	ash.leafIndex += uint64(n)
+	return ash.sh.Skip(n)
+}
+
+// BuildMultiRangeProofAnnotated is like BuildMultiRangeProof, but annotates
+// each proof hash with the position of the subtree it represents.
+func BuildMultiRangeProofAnnotated(ranges []LeafRange, h SubtreeHasher) (nodes []ProofNode, err error) {
+	// ash hides h's Close method from BuildMultiRangeProof, so h must be
+	// closed here
+	defer func() {
+		if err = closeOnFinish(h, err); err != nil {
+			nodes = nil
+		}
+	}()
+	ash := &annotatingSubtreeHasher{sh: h}
+	if _, err := BuildMultiRangeProof(ranges, ash); err != nil {
+		return nil, err
+	}
+	return ash.nodes, nil
+}
+
+// StripAnnotations returns the proof hashes of an annotated proof, in the
+// form produced by BuildMultiRangeProof.
+func StripAnnotations(nodes []ProofNode) [][]byte {
+	if len(nodes) == 0 {
+		return nil
+	}
+	proof := make([][]byte, len(nodes))
+	for i, n := range nodes {
+		proof[i] = n.Hash
+	}
+	return proof
+}
+
+// checkAnnotations checks that the annotations of nodes match the subtrees
+// that BuildMultiRangeProof would produce for ranges.
+func checkAnnotations(ranges []LeafRange, nodes []ProofNode) error {
+	var leafIndex uint64
+	consumeUntil := func(end uint64) error {
+		for leafIndex != end && len(nodes) > 0 {
+			subtreeSize := nextSubtreeSize(leafIndex, end)
+			height := bits.TrailingZeros64(uint64(subtreeSize))
+			if nodes[0].LeafIndex != leafIndex || nodes[0].Height != height {
+				return fmt.Errorf("proof node at leaf %v (height %v) does not match expected subtree at leaf %v (height %v)",
+					nodes[0].LeafIndex, nodes[0].Height, leafIndex, height)
+			}
+			nodes = nodes[1:]
+			leafIndex += uint64(subtreeSize)
+		}
+		return nil
+	}
+	for _, r := range ranges {
+		if err := consumeUntil(r.Start); err != nil {
+			return err
+		}
+		leafIndex = r.End
+	}
+	return consumeUntil(math.MaxUint64)
+}
+
+// VerifyAnnotated verifies an annotated proof produced by
+// BuildMultiRangeProofAnnotated. In addition to the checks performed by
+// VerifyMultiRangeProof, it returns an error if the annotations do not match
+// the subtrees expected for the given ranges.
+func VerifyAnnotated(lh LeafHasher, h hash.Hash, ranges []LeafRange, nodes []ProofNode, root []byte) (bool, error) {
+	if !validRangeSet(ranges) {
+		panic("VerifyAnnotated: illegal set of proof ranges")
+	}
+	if err := checkAnnotations(ranges, nodes); err != nil {
+		return false, err
+	}
+	return VerifyMultiRangeProof(lh, h, ranges, StripAnnotations(nodes), root)
+}
+
+// MarshalAnnotatedProof encodes an annotated proof. The encoding consists of
+// the number of nodes, followed by the height, leaf index, hash length, and
+// hash of each node; all integers are encoded as uvarints.
+func MarshalAnnotatedProof(nodes []ProofNode) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(nodes)*(3*binary.MaxVarintLen64+32))
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+	}
+	putUvarint(uint64(len(nodes)))
+	for _, n := range nodes {
+		putUvarint(uint64(n.Height))
+		putUvarint(n.LeafIndex)
+		putUvarint(uint64(len(n.Hash)))
+		buf = append(buf, n.Hash...)
+	}
+	return buf
+}
+
+// UnmarshalAnnotatedProof decodes an annotated proof encoded by
+// MarshalAnnotatedProof. In addition to checking the encoding, it checks that
+// the annotations are consistent: each node must cover a subtree aligned to
+// its height, and the nodes must be in order and must not overlap. This allows
+// a verifier to sanity-check the shape of a proof without knowing the size of
+// the tree.
+func UnmarshalAnnotatedProof(b []byte) ([]ProofNode, error) {
+	var err error
+	uvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			err = errors.New("invalid uvarint")
+			return 0
+		}
+		b = b[n:]
+		return x
+	}
+	numNodes := uvarint()
+	if err != nil {
+		return nil, err
+	} else if numNodes > uint64(len(b))/3 {
+		// each node occupies at least three bytes
+		return nil, fmt.Errorf("encoded proof is too short for %v nodes", numNodes)
+	}
+	nodes := make([]ProofNode, numNodes)
+	var nextLeaf uint64 // the first leaf not covered by the previous node
+	for i := range nodes {
+		height, leafIndex, hashLen := uvarint(), uvarint(), uvarint()
+		if err != nil {
+			return nil, err
+		} else if height >= 64 {
+			return nil, fmt.Errorf("node %v has invalid height %v", i, height)
+		} else if leafIndex&(1<<height-1) != 0 {
+			return nil, fmt.Errorf("node %v at leaf %v is not aligned to its height %v", i, leafIndex, height)
+		} else if i > 0 && (leafIndex < nextLeaf || nextLeaf == 0) {
+			return nil, fmt.Errorf("node %v at leaf %v overlaps or precedes the previous node", i, leafIndex)
+		} else if hashLen > uint64(len(b)) {
+			return nil, fmt.Errorf("node %v has a truncated hash", i)
+		}
+		nodes[i] = ProofNode{
+			Hash:      append([]byte(nil), b[:hashLen]...),
+			Height:    int(height),
+			LeafIndex: leafIndex,
+		}
+		b = b[hashLen:]
+		// nextLeaf wraps to zero if the node ends at the last possible leaf,
+		// in which case no further nodes are allowed
+		nextLeaf = leafIndex + 1<<height
+	}
+	if len(b) != 0 {
+		return nil, errors.New("encoded proof has trailing bytes")
+	}
+	return nodes, nil
+}
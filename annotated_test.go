@@ -0,0 +1,176 @@
+package merkletree
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestBuildVerifyAnnotated tests the BuildMultiRangeProofAnnotated and
+// VerifyAnnotated functions.
+func TestBuildVerifyAnnotated(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 12
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	root := recNodeRoot(leafHashes, blake)
+
+	//               ┌────────┴────────┐
+	//         ┌─────┴─────┐           │
+	//      *──┴──┐     ┌──┴──*     ┌──┴──*
+	//    ┌─┴─┐ *─┴─┐ ┌─┴─* ┌─┴─┐ *─┴─┐ ┌─┴─┐
+	//    0   1 2   3 4   5 6   7 8   9 10  11
+	//              ^^^               ^
+	ranges := []LeafRange{{3, 5}, {9, 10}}
+	nodes, err := BuildMultiRangeProofAnnotated(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expPositions := []ProofNode{
+		{Height: 1, LeafIndex: 0},
+		{Height: 0, LeafIndex: 2},
+		{Height: 0, LeafIndex: 5},
+		{Height: 1, LeafIndex: 6},
+		{Height: 0, LeafIndex: 8},
+		{Height: 1, LeafIndex: 10},
+	}
+	if len(nodes) != len(expPositions) {
+		t.Fatalf("expected %v proof nodes, got %v", len(expPositions), len(nodes))
+	}
+	for i := range nodes {
+		if nodes[i].Height != expPositions[i].Height || nodes[i].LeafIndex != expPositions[i].LeafIndex {
+			t.Errorf("node %v: expected height %v at leaf %v, got height %v at leaf %v", i,
+				expPositions[i].Height, expPositions[i].LeafIndex, nodes[i].Height, nodes[i].LeafIndex)
+		}
+	}
+
+	// stripping the annotations should yield the normal proof
+	proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(StripAnnotations(nodes), proof) {
+		t.Error("stripped annotated proof does not match BuildMultiRangeProof")
+	}
+
+	verify := func(nodes []ProofNode) (bool, error) {
+		var hashes [][]byte
+		for _, r := range ranges {
+			hashes = append(hashes, leafHashes[r.Start:r.End]...)
+		}
+		return VerifyAnnotated(NewCachedLeafHasher(hashes), blake, ranges, nodes, root)
+	}
+	if ok, err := verify(nodes); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("failed to verify valid annotated proof")
+	}
+
+	// tampering with the annotations should be detected
+	bad := append([]ProofNode(nil), nodes...)
+	bad[3].Height = 2
+	if _, err := verify(bad); err == nil {
+		t.Error("expected error for incorrect height")
+	}
+	bad = append([]ProofNode(nil), nodes...)
+	bad[1].LeafIndex = 3
+	if _, err := verify(bad); err == nil {
+		t.Error("expected error for incorrect leaf index")
+	}
+
+	// stripping annotations should match BuildMultiRangeProof for every
+	// range set of a small tree
+	for i := uint64(0); i < numLeaves; i++ {
+		for j := i + 1; j <= numLeaves; j++ {
+			ranges := []LeafRange{{i, j}}
+			nodes, err := BuildMultiRangeProofAnnotated(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(StripAnnotations(nodes), proof) {
+				t.Errorf("stripped annotated proof does not match BuildMultiRangeProof for %v", ranges)
+			}
+			if ok, err := VerifyAnnotated(NewCachedLeafHasher(leafHashes[i:j]), blake, ranges, nodes, root); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Errorf("failed to verify annotated proof for %v", ranges)
+			}
+		}
+	}
+}
+
+// TestMarshalAnnotatedProof tests the MarshalAnnotatedProof and
+// UnmarshalAnnotatedProof functions.
+func TestMarshalAnnotatedProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 12
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	root := recNodeRoot(leafHashes, blake)
+	ranges := []LeafRange{{3, 5}, {9, 10}}
+	nodes, err := BuildMultiRangeProofAnnotated(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip
+	b := MarshalAnnotatedProof(nodes)
+	decoded, err := UnmarshalAnnotatedProof(b)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(decoded, nodes) {
+		t.Fatalf("expected %v, got %v", nodes, decoded)
+	}
+	hashes := append(append([][]byte(nil), leafHashes[3:5]...), leafHashes[9])
+	if ok, err := VerifyAnnotated(NewCachedLeafHasher(hashes), blake, ranges, decoded, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("failed to verify decoded proof")
+	}
+
+	// an empty proof should round trip too
+	if decoded, err := UnmarshalAnnotatedProof(MarshalAnnotatedProof(nil)); err != nil {
+		t.Fatal(err)
+	} else if len(decoded) != 0 {
+		t.Fatalf("expected empty proof, got %v", decoded)
+	}
+
+	// truncated or padded encodings should be rejected
+	for i := 0; i < len(b); i++ {
+		if _, err := UnmarshalAnnotatedProof(b[:i]); err == nil {
+			t.Fatalf("expected error for encoding truncated to %v bytes", i)
+		}
+	}
+	if _, err := UnmarshalAnnotatedProof(append(b[:len(b):len(b)], 0)); err == nil {
+		t.Error("expected error for trailing bytes")
+	}
+
+	// inconsistent annotations should be rejected
+	tamper := func(fn func(nodes []ProofNode) []ProofNode) []byte {
+		bad := append([]ProofNode(nil), nodes...)
+		return MarshalAnnotatedProof(fn(bad))
+	}
+	tests := []struct {
+		desc string
+		b    []byte
+	}{
+		{"swapped nodes", tamper(func(n []ProofNode) []ProofNode { n[1], n[2] = n[2], n[1]; return n })},
+		{"duplicate node", tamper(func(n []ProofNode) []ProofNode { n[2] = n[1]; return n })},
+		{"overlapping node", tamper(func(n []ProofNode) []ProofNode { n[1].LeafIndex = 1; n[1].Height = 0; return n })},
+		{"misaligned node", tamper(func(n []ProofNode) []ProofNode { n[3].LeafIndex = 7; return n })},
+		{"invalid height", tamper(func(n []ProofNode) []ProofNode { n[5].Height = 64; return n })},
+	}
+	for _, test := range tests {
+		if _, err := UnmarshalAnnotatedProof(test.b); err == nil {
+			t.Errorf("expected error for %v", test.desc)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// A nodeKey identifies a node of a Merkle tree by its height and the index of
+// its first leaf.
+type nodeKey struct {
+	height int
+	start  uint64
+}
+
+// A memoNode records the children of a node along with the node's hash.
+type memoNode struct {
+	left, right []byte
+	sum         []byte
+}
+
+// A batchNode is a subtree root in the stack of a batchVerifier.
+type batchNode struct {
+	height int
+	start  uint64
+	sum    []byte
+}
+
+// A batchVerifier reconstructs Merkle roots from range proofs, memoizing the
+// nodes it computes so that nodes shared between proofs are hashed only once.
+type batchVerifier struct {
+	th   TreeHasher
+	memo map[nodeKey]memoNode
+}
+
+// hashNode returns the hash of the node identified by key with the given
+// children. Since the memoized children must match exactly, a node
+// reconstructed from an invalid proof never affects the result of another
+// proof.
+func (bv *batchVerifier) hashNode(key nodeKey, left, right []byte) []byte {
+	if m, ok := bv.memo[key]; ok && bytes.Equal(m.left, left) && bytes.Equal(m.right, right) {
+		return m.sum
+	}
+	sum := bv.th.HashNode(left, right)
+	// copy the children, since a LeafHasher may reuse its buffers
+	buf := append(append(make([]byte, 0, len(left)+len(right)), left...), right...)
+	bv.memo[key] = memoNode{buf[:len(left)], buf[len(left):], sum}
+	return sum
+}
+
+// reconstructRoot is equivalent to reconstructRangeRoot, but hashes nodes
+// using bv.hashNode.
+func (bv *batchVerifier) reconstructRoot(lh LeafHasher, ranges []LeafRange, proof [][]byte) ([]byte, error) {
+	var stack []batchNode
+	var leafIndex uint64
+	pushSubTree := func(height int, sum []byte) error {
+		// We can only add the subtree if its height is <= the height of the
+		// smallest subtree.
+		if len(stack) != 0 && height > stack[len(stack)-1].height {
+			return fmt.Errorf("can't add a subtree that is larger than the smallest subtree %v > %v", height, stack[len(stack)-1].height)
+		}
+		n := batchNode{height, leafIndex, sum}
+		for len(stack) != 0 && stack[len(stack)-1].height == n.height {
+			left := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			key := nodeKey{left.height + 1, left.start}
+			n = batchNode{key.height, key.start, bv.hashNode(key, left.sum, n.sum)}
+		}
+		stack = append(stack, n)
+		leafIndex += 1 << uint(height)
+		return nil
+	}
+
+	consumeUntil := func(end uint64) error {
+		for leafIndex != end && len(proof) > 0 {
+			subtreeSize := nextSubtreeSize(leafIndex, end)
+			if err := pushSubTree(bits.TrailingZeros64(uint64(subtreeSize)), proof[0]); err != nil {
+				return err
+			}
+			proof = proof[1:]
+		}
+		return nil
+	}
+	for _, r := range ranges {
+		if err := consumeUntil(r.Start); err != nil {
+			return nil, err
+		}
+		for i := r.Start; i < r.End; i++ {
+			leafHash, err := lh.NextLeafHash()
+			if err == io.EOF {
+				return nil, ErrUnexpectedLeafCount
+			} else if err != nil {
+				return nil, err
+			}
+			if err := pushSubTree(0, leafHash); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err := consumeUntil(math.MaxUint64); err != nil {
+		return nil, err
+	}
+
+	// Fold the remaining subtrees from smallest to largest, as in Tree.Root.
+	if len(stack) == 0 {
+		return nil, nil
+	}
+	current := stack[len(stack)-1].sum
+	for i := len(stack) - 2; i >= 0; i-- {
+		key := nodeKey{stack[i].height + 1, stack[i].start}
+		current = bv.hashNode(key, stack[i].sum, current)
+	}
+	return current, nil
+}
+
+// BatchVerify verifies a set of proofs produced by BuildMultiRangeProof for
+// the same tree, returning one result per proof. The i'th proof is verified
+// using the leaf hashes produced by lhs[i] and the ranges in ranges[i], exactly
+// as VerifyMultiRangeProof would. However, nodes that are shared between
+// proofs, such as the upper levels of neighboring single-leaf proofs, are
+// hashed only once across the batch.
+func BatchVerify(lhs []LeafHasher, h hash.Hash, ranges [][]LeafRange, proofs [][][]byte, root []byte) ([]bool, error) {
+	if len(lhs) != len(ranges) || len(proofs) != len(ranges) {
+		return nil, errors.New("BatchVerify: lhs, ranges, and proofs must have the same length")
+	}
+	bv := &batchVerifier{
+		th:   NewDefaultHasher(h),
+		memo: make(map[nodeKey]memoNode),
+	}
+	results := make([]bool, len(ranges))
+	for i := range ranges {
+		if len(ranges[i]) == 0 {
+			results[i] = true
+			continue
+		}
+		if !validRangeSet(ranges[i]) {
+			panic("BatchVerify: illegal set of proof ranges")
+		}
+		reconstructed, err := bv.reconstructRoot(lhs[i], ranges[i], proofs[i])
+		if err != nil {
+			return nil, fmt.Errorf("BatchVerify: proof %v: %w", i, err)
+		}
+		results[i] = bytes.Equal(reconstructed, root)
+	}
+	return results, nil
+}
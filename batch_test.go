@@ -0,0 +1,132 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestBatchVerify tests that BatchVerify produces the same results as
+// verifying each proof individually.
+func TestBatchVerify(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const leafSize = 64
+	const numLeaves = 77
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
+
+	// prove every leaf, a few multi-range sets, and an empty set
+	var ranges [][]LeafRange
+	for i := uint64(0); i < numLeaves; i++ {
+		ranges = append(ranges, []LeafRange{{i, i + 1}})
+	}
+	ranges = append(ranges,
+		[]LeafRange{{0, numLeaves}},
+		[]LeafRange{{3, 5}, {9, 10}},
+		[]LeafRange{{1, 2}, {50, 70}, {76, 77}},
+		nil,
+	)
+	proofs := make([][][]byte, len(ranges))
+	for i := range ranges {
+		proof, err := BuildMultiRangeProof(ranges[i], NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proofs[i] = proof
+	}
+	// corrupt some of the proofs; corrupting a shared upper node of one proof
+	// must not affect the others
+	for _, i := range []int{5, 40, len(ranges) - 2} {
+		proofs[i] = append([][]byte(nil), proofs[i]...)
+		last := len(proofs[i]) - 1
+		proofs[i][last] = append([]byte(nil), proofs[i][last]...)
+		proofs[i][last][0] ^= 1
+	}
+
+	leafHashers := func() []LeafHasher {
+		lhs := make([]LeafHasher, len(ranges))
+		for i := range ranges {
+			var hashes [][]byte
+			for _, r := range ranges[i] {
+				hashes = append(hashes, leafHashes[r.Start:r.End]...)
+			}
+			lhs[i] = NewCachedLeafHasher(hashes)
+		}
+		return lhs
+	}
+	results, err := BatchVerify(leafHashers(), blake, ranges, proofs, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lhs := leafHashers()
+	for i := range ranges {
+		exp, err := VerifyMultiRangeProof(lhs[i], blake, ranges[i], proofs[i], root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[i] != exp {
+			t.Errorf("proof %v (ranges %v): expected %v, got %v", i, ranges[i], exp, results[i])
+		}
+	}
+	if results[5] || results[40] || results[len(ranges)-2] {
+		t.Error("BatchVerify accepted a corrupted proof")
+	}
+
+	// mismatched inputs should be rejected
+	if _, err := BatchVerify(leafHashers()[1:], blake, ranges, proofs, root); err == nil {
+		t.Error("BatchVerify accepted mismatched inputs")
+	}
+	// leaf hasher errors should be reported
+	lhs = leafHashers()
+	lhs[3] = NewCachedLeafHasher(nil)
+	if _, err := BatchVerify(lhs, blake, ranges, proofs, root); err == nil {
+		t.Error("BatchVerify did not report a short LeafHasher")
+	}
+}
+
+// BenchmarkBatchVerify compares verifying a proof for every leaf of a tree
+// individually against verifying them with BatchVerify.
+func BenchmarkBatchVerify(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const numLeaves = 1 << 10
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(fastrand.Bytes(64))
+	}
+	root := recNodeRoot(leafHashes, blake)
+	ranges := make([][]LeafRange, numLeaves)
+	proofs := make([][][]byte, numLeaves)
+	for i := range ranges {
+		ranges[i] = []LeafRange{{uint64(i), uint64(i + 1)}}
+		proofs[i], _ = BuildMultiRangeProof(ranges[i], NewCachedSubtreeHasher(leafHashes, blake))
+	}
+	leafHashers := func() []LeafHasher {
+		lhs := make([]LeafHasher, numLeaves)
+		for i := range lhs {
+			lhs[i] = NewCachedLeafHasher(leafHashes[i : i+1])
+		}
+		return lhs
+	}
+
+	b.Run("individual", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			lhs := leafHashers()
+			for j := range ranges {
+				_, _ = VerifyMultiRangeProof(lhs[j], blake, ranges[j], proofs[j], root)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = BatchVerify(leafHashers(), blake, ranges, proofs, root)
+		}
+	})
+}
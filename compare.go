@@ -0,0 +1,66 @@
+package merkletree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ProofsEqual reports whether two proofs contain the same hashes in the same
+// order. A nil proof is equal to an empty proof.
+func ProofsEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ProofEqualityReport returns a human-readable description of the first
+// difference between two proofs, or the empty string if the proofs are equal.
+func ProofEqualityReport(a, b [][]byte) string {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if !bytes.Equal(a[i], b[i]) {
+			return fmt.Sprintf("proofs differ at index %v: %x != %x", i, a[i], b[i])
+		}
+	}
+	if len(a) != len(b) {
+		return fmt.Sprintf("proofs differ in length: %v != %v", len(a), len(b))
+	}
+	return ""
+}
+
+// SanityCheckProof returns a list of warnings about anomalies in proof that
+// usually indicate a bug, such as an uninitialized buffer, rather than a
+// legitimate proof: hashes that are all zeros, hashes whose length differs
+// from that of most other hashes in the proof, and identical hashes at
+// adjacent positions. Since a legitimate proof could contain such hashes,
+// SanityCheckProof does not reject the proof; it is intended to be used as a
+// lint before verification. It returns nil if no anomalies are found.
+func SanityCheckProof(proof [][]byte) []string {
+	// determine the expected hash length by majority
+	counts := make(map[int]int)
+	var hashLen int
+	for _, p := range proof {
+		counts[len(p)]++
+		if counts[len(p)] > counts[hashLen] {
+			hashLen = len(p)
+		}
+	}
+
+	var warnings []string
+	for i, p := range proof {
+		if len(p) != hashLen {
+			warnings = append(warnings, fmt.Sprintf("hash %v has length %v, expected %v", i, len(p), hashLen))
+		} else if len(p) > 0 && bytes.Count(p, []byte{0}) == len(p) {
+			warnings = append(warnings, fmt.Sprintf("hash %v is all zeros", i))
+		}
+		if i > 0 && bytes.Equal(p, proof[i-1]) {
+			warnings = append(warnings, fmt.Sprintf("hash %v is identical to hash %v", i, i-1))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,93 @@
+package merkletree
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestProofsEqual tests the ProofsEqual and ProofEqualityReport functions.
+func TestProofsEqual(t *testing.T) {
+	tests := []struct {
+		a, b   [][]byte
+		equal  bool
+		report string
+	}{
+		{
+			a:      nil,
+			b:      [][]byte{},
+			equal:  true,
+			report: "",
+		},
+		{
+			a:      [][]byte{{1, 2}, {3, 4}},
+			b:      [][]byte{{1, 2}, {3, 4}},
+			equal:  true,
+			report: "",
+		},
+		{
+			a:      [][]byte{{1, 2}, {3, 4}},
+			b:      [][]byte{{1, 2}},
+			equal:  false,
+			report: "proofs differ in length: 2 != 1",
+		},
+		{
+			a:      [][]byte{{1, 2}, {3, 4}},
+			b:      [][]byte{{1, 2}, {3, 5}},
+			equal:  false,
+			report: "proofs differ at index 1: 0304 != 0305",
+		},
+		{
+			a:      [][]byte{{1, 2}, {3, 4}},
+			b:      [][]byte{{1, 3}},
+			equal:  false,
+			report: "proofs differ at index 0: 0102 != 0103",
+		},
+		{
+			a:      [][]byte{{1, 2}},
+			b:      [][]byte{{1, 2, 3}},
+			equal:  false,
+			report: "proofs differ at index 0: 0102 != 010203",
+		},
+	}
+	for _, test := range tests {
+		if ProofsEqual(test.a, test.b) != test.equal {
+			t.Errorf("ProofsEqual(%v, %v): expected %v", test.a, test.b, test.equal)
+		}
+		if ProofsEqual(test.b, test.a) != test.equal {
+			t.Errorf("ProofsEqual(%v, %v): expected %v", test.b, test.a, test.equal)
+		}
+		if report := ProofEqualityReport(test.a, test.b); report != test.report {
+			t.Errorf("ProofEqualityReport(%v, %v): expected %q, got %q", test.a, test.b, test.report, report)
+		}
+	}
+}
+
+// TestSanityCheckProof tests that SanityCheckProof reports suspicious hashes
+// without flagging ordinary proofs.
+func TestSanityCheckProof(t *testing.T) {
+	a := []byte{1, 2, 3, 4}
+	b := []byte{5, 6, 7, 8}
+	zero := make([]byte, 4)
+	tests := []struct {
+		proof    [][]byte
+		warnings []string
+	}{
+		{nil, nil},
+		{[][]byte{a, b, a}, nil},
+		{[][]byte{a, zero, b}, []string{"hash 1 is all zeros"}},
+		{[][]byte{a, b, b}, []string{"hash 2 is identical to hash 1"}},
+		{[][]byte{a, b, {1, 2, 3}}, []string{"hash 2 has length 3, expected 4"}},
+		{[][]byte{{9}, a, b}, []string{"hash 0 has length 1, expected 4"}},
+		{[][]byte{a, nil, b}, []string{"hash 1 has length 0, expected 4"}},
+		{[][]byte{zero, zero, a}, []string{
+			"hash 0 is all zeros",
+			"hash 1 is all zeros",
+			"hash 1 is identical to hash 0",
+		}},
+	}
+	for _, test := range tests {
+		if warnings := SanityCheckProof(test.proof); !reflect.DeepEqual(warnings, test.warnings) {
+			t.Errorf("%v: expected %q, got %q", test.proof, test.warnings, warnings)
+		}
+	}
+}
@@ -2,31 +2,55 @@ package merkletree
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"math/bits"
+	"runtime"
+	"sync"
 )
 
 // BuildDiffProof constructs a Merkle diff for the specified leaf ranges, using
 // the provided SubtreeHasher. The ranges must be sorted and non-overlapping.
 func BuildDiffProof(ranges []LeafRange, h SubtreeHasher, numLeaves uint64) (proof [][]byte, err error) {
+	return BuildDiffProofWithProgress(ranges, h, numLeaves, nil)
+}
+
+// BuildDiffProofWithProgress is like BuildDiffProof, but calls progress with
+// the index of the next unprocessed leaf each time a subtree has been hashed
+// or skipped, which is useful for reporting the progress of proofs over very
+// large trees. The indices passed to progress are strictly increasing, ending
+// at numLeaves if the proof is built successfully. progress may be nil.
+func BuildDiffProofWithProgress(ranges []LeafRange, h SubtreeHasher, numLeaves uint64, progress func(leafIndex uint64)) (proof [][]byte, err error) {
 	// This code is a direct copy of the BuildMultiRangeProof code, except that
 	// it ends by consuming until numLeaves instead of math.MaxUint64. This can
 	// result in a larger proof, but the extra proof hashes are required for
 	// certain diffs.
+	defer func() {
+		if err = closeOnFinish(h, err); err != nil {
+			proof = nil
+		}
+	}()
 	if !validRangeSet(ranges) {
 		panic("BuildDiffProof: illegal set of proof ranges")
 	}
 	var leafIndex uint64
 	consumeUntil := func(end uint64) error {
 		for leafIndex != end {
-			subtreeSize := nextSubtreeSize(leafIndex, end)
+			subtreeSize, err := checkedSubtreeSize(leafIndex, end)
+			if err != nil {
+				return err
+			}
 			root, err := h.NextSubtreeRoot(subtreeSize)
 			if err != nil {
 				return err
 			}
 			proof = append(proof, root)
 			leafIndex += uint64(subtreeSize)
+			if progress != nil {
+				progress(leafIndex)
+			}
 		}
 		return nil
 	}
@@ -35,13 +59,24 @@ func BuildDiffProof(ranges []LeafRange, h SubtreeHasher, numLeaves uint64) (proo
 			return nil, err
 		}
 		for leafIndex != r.End {
-			subtreeSize := nextSubtreeSize(leafIndex, r.End)
+			subtreeSize, err := checkedSubtreeSize(leafIndex, r.End)
+			if err != nil {
+				return nil, err
+			}
 			if err := h.Skip(subtreeSize); err != nil {
 				return nil, err
 			}
 			leafIndex += uint64(subtreeSize)
+			if progress != nil {
+				progress(leafIndex)
+			}
 		}
 	}
+	if leafIndex > numLeaves {
+		// the ranges extend beyond the tree; consuming until numLeaves would
+		// wrap around past 2^64
+		return proof, nil
+	}
 	err = consumeUntil(numLeaves)
 	if err == io.EOF {
 		err = nil
@@ -54,12 +89,20 @@ func BuildDiffProof(ranges []LeafRange, h SubtreeHasher, numLeaves uint64) (proo
 // the leaf hashes into subtrees where possible. These compressed leaf hashes
 // can be used as the 'rangeHashes' input to VerifyDiffProof.
 func CompressLeafHashes(ranges []LeafRange, h SubtreeHasher) (compressed [][]byte, err error) {
+	defer func() {
+		if err = closeOnFinish(h, err); err != nil {
+			compressed = nil
+		}
+	}()
 	if !validRangeSet(ranges) {
-		panic("BuildDiffProof: illegal set of proof ranges")
+		return nil, invalidRangeSet("CompressLeafHashes: illegal set of proof ranges")
 	}
 	for _, r := range ranges {
 		for leafIndex := r.Start; leafIndex != r.End; {
-			subtreeSize := nextSubtreeSize(leafIndex, r.End)
+			subtreeSize, err := checkedSubtreeSize(leafIndex, r.End)
+			if err != nil {
+				return nil, err
+			}
 			root, err := h.NextSubtreeRoot(subtreeSize)
 			if err != nil {
 				return nil, err
@@ -71,12 +114,112 @@ func CompressLeafHashes(ranges []LeafRange, h SubtreeHasher) (compressed [][]byt
 	return
 }
 
-// VerifyDiffProof verifies a proof produced by BuildDiffProof using subtree
-// hashes produced by sh, which must contain the concatenation of the subtree
-// hashes within the proof ranges.
-func VerifyDiffProof(rangeHashes [][]byte, numLeaves uint64, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte) (bool, error) {
+// CompressLeafHashesParallel is like CompressLeafHashes, but compresses the
+// leaf hashes of each range concurrently using numWorkers goroutines, or one
+// per CPU if numWorkers is not positive. shFactory is called once per range,
+// possibly concurrently, and must return a SubtreeHasher that produces the
+// leaf hashes of that range only. The returned hashes are identical to those
+// produced by CompressLeafHashes; each is checked against the output size of
+// h, which is not otherwise used. Each SubtreeHasher returned by shFactory is
+// closed once its range has been compressed if it implements Closer and
+// CloseOnFinish returns true.
+func CompressLeafHashesParallel(ranges []LeafRange, shFactory func(LeafRange) SubtreeHasher, numWorkers int, h hash.Hash) ([][]byte, error) {
 	if !validRangeSet(ranges) {
-		panic("VerifyDiffProof: illegal set of proof ranges")
+		return nil, invalidRangeSet("CompressLeafHashesParallel: illegal set of proof ranges")
+	}
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	results := make([][][]byte, len(ranges))
+	errs := make([]error, len(ranges))
+	compressRange := func(i int) {
+		r := ranges[i]
+		sh := shFactory(r)
+		defer func() { errs[i] = closeOnFinish(sh, errs[i]) }()
+		for leafIndex := r.Start; leafIndex != r.End; {
+			subtreeSize, err := checkedSubtreeSize(leafIndex, r.End)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			root, err := sh.NextSubtreeRoot(subtreeSize)
+			if err != nil {
+				errs[i] = err
+				return
+			} else if len(root) != h.Size() {
+				errs[i] = ErrHashSizeMismatch
+				return
+			}
+			results[i] = append(results[i], root)
+			leafIndex += uint64(subtreeSize)
+		}
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				compressRange(i)
+			}
+		}()
+	}
+	for i := range ranges {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	var compressed [][]byte
+	for i := range ranges {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("range %v: %w", ranges[i], errs[i])
+		}
+		compressed = append(compressed, results[i]...)
+	}
+	return compressed, nil
+}
+
+// ValidateCompressedHashes checks that compressed contains the number of
+// hashes that CompressLeafHashes produces for ranges. Since VerifyDiffProof
+// cannot distinguish a mismatched pairing of range hashes and ranges from an
+// invalid proof, a verifier that receives the two separately can use
+// ValidateCompressedHashes to detect the mismatch early.
+func ValidateCompressedHashes(ranges []LeafRange, compressed [][]byte) error {
+	if !validRangeSet(ranges) {
+		return ErrInvalidRangeSet
+	} else if n := compressedSize(ranges); len(compressed) != n {
+		return fmt.Errorf("%v compressed hashes supplied for ranges %v, expected %v", len(compressed), ranges, n)
+	}
+	return nil
+}
+
+// ErrHashSizeMismatch is returned when verifying a diff proof if the proof or
+// range hashes are not the same size as the output of the hash function.
+var ErrHashSizeMismatch = errors.New("hash size does not match the size of the hash function")
+
+// ErrProofExtendsBeyondTree is returned when verifying a diff proof if the
+// proof contains hashes beyond those covering the last leaf of the tree, e.g.
+// trailing hashes for a padded tree.
+var ErrProofExtendsBeyondTree = errors.New("proof extends beyond the last leaf of the tree")
+
+// ReconstructDiffRoot reconstructs the Merkle root of a tree of numLeaves
+// leaves from a proof produced by BuildDiffProof and the subtree hashes
+// within the proof ranges, which must be the concatenation of the subtree
+// hashes produced by CompressLeafHashes. The reconstructed root can then be
+// compared against any number of candidate roots.
+func ReconstructDiffRoot(rangeHashes [][]byte, numLeaves uint64, h hash.Hash, ranges []LeafRange, proof [][]byte) ([]byte, error) {
+	if !validRangeSet(ranges) {
+		panic("ReconstructDiffRoot: illegal set of proof ranges")
+	}
+	for _, hashes := range [][][]byte{rangeHashes, proof} {
+		for _, sum := range hashes {
+			if len(sum) != h.Size() {
+				return nil, ErrHashSizeMismatch
+			}
+		}
 	}
 	tree := New(h)
 	var leafIndex uint64
@@ -94,12 +237,192 @@ func VerifyDiffProof(rangeHashes [][]byte, numLeaves uint64, h hash.Hash, ranges
 	}
 	for _, r := range ranges {
 		if err := consumeUntil(r.Start, &proof); err != nil {
-			return false, err
+			return nil, err
 		}
 		if err := consumeUntil(r.End, &rangeHashes); err != nil {
-			return false, err
+			return nil, err
+		}
+	}
+	if leafIndex > numLeaves && len(proof) > 0 {
+		// the ranges cover leaves that were appended to the tree, so any
+		// remaining proof hashes lie beyond them
+		return nil, ErrProofExtendsBeyondTree
+	} else if err := consumeUntil(numLeaves, &proof); err != nil {
+		return nil, err
+	} else if len(proof) > 0 {
+		// any remaining hashes would cover leaves beyond numLeaves
+		return nil, ErrProofExtendsBeyondTree
+	}
+	return tree.Root(), nil
+}
+
+// VerifyDiffProof verifies a proof produced by BuildDiffProof using subtree
+// hashes produced by sh, which must contain the concatenation of the subtree
+// hashes within the proof ranges. If any proof or range hash is not h.Size()
+// bytes long, ErrHashSizeMismatch is returned.
+func VerifyDiffProof(rangeHashes [][]byte, numLeaves uint64, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte) (bool, error) {
+	if !validRangeSet(ranges) {
+		panic("VerifyDiffProof: illegal set of proof ranges")
+	}
+	reconstructed, err := ReconstructDiffRoot(rangeHashes, numLeaves, h, ranges, proof)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(reconstructed, root), nil
+}
+
+// diffProofSize returns the number of hashes in the proof produced by
+// BuildDiffProof for the specified ranges in a tree of numLeaves leaves.
+func diffProofSize(ranges []LeafRange, numLeaves uint64) int {
+	var size int
+	var leafIndex uint64
+	consumeUntil := func(end uint64) {
+		for leafIndex < end {
+			leafIndex += uint64(nextSubtreeSize(leafIndex, end))
+			size++
 		}
 	}
-	err := consumeUntil(numLeaves, &proof)
-	return bytes.Equal(tree.Root(), root), err
+	for _, r := range ranges {
+		consumeUntil(r.Start)
+		leafIndex = r.End
+	}
+	consumeUntil(numLeaves)
+	return size
+}
+
+// compressedSize returns the number of hashes produced by CompressLeafHashes
+// for the specified ranges.
+func compressedSize(ranges []LeafRange) int {
+	var size int
+	for _, r := range ranges {
+		for leafIndex := r.Start; leafIndex != r.End; size++ {
+			leafIndex += uint64(nextSubtreeSize(leafIndex, r.End))
+		}
+	}
+	return size
+}
+
+// ApplyModifications computes the root of a tree after modifying the leaves
+// within a diff proof. proof must be produced by BuildDiffProof for ranges in
+// the original tree of oldNumLeaves leaves, and rangeHashes must be the
+// compressed hashes (see CompressLeafHashes) of the original leaves within
+// ranges. newRanges and newRangeHashes describe the same leaves after the
+// modifications, and newNumLeaves is the number of leaves in the modified
+// tree. The old state is only used to check that the proof has the expected
+// shape; to check it against the original root, use VerifyDiffProof.
+//
+// Since the leaves outside of ranges are fixed by the proof, only the leaves
+// within ranges may be modified:
+//
+//   - To update or swap leaves, keep the ranges and supply the new hashes in
+//     newRangeHashes.
+//   - To trim leaves from the end of the tree, the trimmed leaves must lie
+//     within the final ranges; omit them from newRanges and reduce
+//     newNumLeaves.
+//   - To append leaves, add ranges beyond oldNumLeaves to newRanges and
+//     increase newNumLeaves.
+func ApplyModifications(proof, rangeHashes [][]byte, ranges []LeafRange, oldNumLeaves, newNumLeaves uint64, newRanges []LeafRange, newRangeHashes [][]byte, h hash.Hash) (newRoot []byte, err error) {
+	if !validRangeSet(ranges) || !validRangeSet(newRanges) {
+		panic("ApplyModifications: illegal set of proof ranges")
+	}
+	if len(ranges) > 0 && ranges[len(ranges)-1].End > oldNumLeaves {
+		return nil, fmt.Errorf("ApplyModifications: range %v extends beyond tree of %v leaves", ranges[len(ranges)-1], oldNumLeaves)
+	} else if len(newRanges) > 0 && newRanges[len(newRanges)-1].End > newNumLeaves {
+		return nil, fmt.Errorf("ApplyModifications: range %v extends beyond tree of %v leaves", newRanges[len(newRanges)-1], newNumLeaves)
+	}
+	if n := diffProofSize(ranges, oldNumLeaves); len(proof) != n {
+		return nil, fmt.Errorf("ApplyModifications: proof contains %v hashes, expected %v", len(proof), n)
+	} else if n := compressedSize(ranges); len(rangeHashes) != n {
+		return nil, fmt.Errorf("ApplyModifications: %v range hashes supplied, expected %v", len(rangeHashes), n)
+	} else if n := compressedSize(newRanges); len(newRangeHashes) != n {
+		return nil, fmt.Errorf("ApplyModifications: %v new range hashes supplied, expected %v", len(newRangeHashes), n)
+	}
+	return ReconstructDiffRoot(newRangeHashes, newNumLeaves, h, newRanges, proof)
+}
+
+// AffectedSubtrees returns the indices of the subtrees of 2^cacheHeight leaves
+// whose roots change when the leaves within ranges are modified, in ascending
+// order. numLeaves is the number of leaves in the modified tree; ranges may
+// extend beyond it to describe trimmed leaves, in which case the subtree that
+// contained both trimmed and remaining leaves is affected, while subtrees that
+// were trimmed entirely are omitted. A storage layer that caches subtree roots
+// at cacheHeight can use the result to invalidate exactly the stale entries.
+func AffectedSubtrees(ranges []LeafRange, numLeaves uint64, cacheHeight int) []uint64 {
+	if !validRangeSet(ranges) {
+		panic("AffectedSubtrees: illegal set of proof ranges")
+	} else if cacheHeight < 0 || cacheHeight >= 64 {
+		panic("AffectedSubtrees: illegal cache height")
+	}
+	var affected []uint64
+	for _, r := range ranges {
+		for i := r.Start >> uint(cacheHeight); i <= (r.End-1)>>uint(cacheHeight); i++ {
+			if i<<uint(cacheHeight) >= numLeaves {
+				break // the remaining subtrees were trimmed
+			} else if len(affected) == 0 || affected[len(affected)-1] != i {
+				affected = append(affected, i)
+			}
+		}
+	}
+	return affected
+}
+
+// InferNumLeaves determines the number of leaves in the tree for which proof
+// was produced by BuildDiffProof with the specified ranges. Since the proof
+// hashes after the last range cover the remaining leaves using as few
+// subtrees as possible, the proof length often, but not always, determines
+// the size of the tree. InferNumLeaves returns the smallest tree size
+// consistent with the proof length, along with whether it is the only such
+// size. If no tree size is consistent with the proof length, it returns 0 and
+// false.
+func InferNumLeaves(ranges []LeafRange, proof [][]byte) (uint64, bool) {
+	if !validRangeSet(ranges) {
+		panic("InferNumLeaves: illegal set of proof ranges")
+	}
+	var end uint64
+	if len(ranges) > 0 {
+		end = ranges[len(ranges)-1].End
+	}
+	tail := len(proof) - diffProofSize(ranges, end)
+	if tail < 0 {
+		return 0, false
+	} else if tail == 0 {
+		return end, true
+	}
+
+	// The leaves [end, numLeaves) are covered by ascending subtrees up to a
+	// leaf index m, followed by descending subtrees. m is numLeaves with all
+	// bits below the highest bit d that differs from end cleared, so the
+	// number of subtrees is popcount(m-end) + popcount(numLeaves-m). For each
+	// possible d, count the number of values of numLeaves-m < 2^d that yield
+	// the right number of subtrees, and track the smallest numLeaves.
+	var smallest uint64
+	var candidates uint64
+	for d := uint(0); d < 64; d++ {
+		if end&(1<<d) != 0 {
+			continue
+		}
+		m := end>>(d+1)<<(d+1) | 1<<d
+		if m < end {
+			break // overflow
+		}
+		down := tail - bits.OnesCount64(m-end)
+		if down < 0 || down > int(d) {
+			continue
+		}
+		// the smallest remainder with 'down' bits set is 2^down-1
+		if n := m + (1<<uint(down) - 1); candidates == 0 || n < smallest {
+			smallest = n
+		}
+		// the number of remainders with 'down' bits set is (d choose down),
+		// but all that matters is whether the total exceeds 1
+		if down == 0 || down == int(d) {
+			candidates++
+		} else {
+			candidates += 2
+		}
+	}
+	if candidates == 0 {
+		return 0, false
+	}
+	return smallest, candidates == 1
 }
@@ -5,6 +5,7 @@ package merkletree
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"math"
 )
 
@@ -75,6 +76,91 @@ func FuzzReadSubTreesNoProof(data []byte) int {
 	return 0
 }
 
+// FuzzDiffProofExtraHashes can be used by go-fuzz to check that appending
+// hashes to a valid diff proof always causes verification to fail.
+func FuzzDiffProofExtraHashes(data []byte) int {
+	// We want 1 byte for the number of leaves, 2 for the range, and 1 for the
+	// number of extra hashes.
+	if len(data) < 4 {
+		return -1
+	}
+	numLeaves := uint64(data[0]) + 1
+	start := uint64(data[1]) % numLeaves
+	end := start + 1 + uint64(data[2])%(numLeaves-start)
+	extra := int(data[3]%4) + 1
+	data = data[4:]
+
+	hash := sha256.New()
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = hash.Sum([]byte{byte(i)})
+	}
+	ranges := []LeafRange{{start, end}}
+	proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, hash), numLeaves)
+	if err != nil {
+		panic(err)
+	}
+	compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(leafHashes[start:end], hash))
+	if err != nil {
+		panic(err)
+	}
+	root, _ := NewCachedSubtreeHasher(leafHashes, hash).NextSubtreeRoot(int(numLeaves))
+
+	// Append the extra hashes, using the remaining data where possible.
+	for i := 0; i < extra; i++ {
+		sum := make([]byte, hash.Size())
+		data = data[copy(sum, data):]
+		proof = append(proof, sum)
+	}
+	if ok, _ := VerifyDiffProof(compressed, numLeaves, hash, ranges, proof, root); ok {
+		panic("verified proof with extra hashes")
+	}
+	return 1
+}
+
+// FuzzRangeBounds can be used by go-fuzz to check that arbitrary proof ranges,
+// including those near the limits of uint64, never cause a panic, and that
+// ranges extending beyond the tree are always rejected.
+func FuzzRangeBounds(data []byte) int {
+	// We want 8 bytes each for the start and end of the range.
+	if len(data) < 16 {
+		return -1
+	}
+	r := LeafRange{binary.LittleEndian.Uint64(data[:8]), binary.LittleEndian.Uint64(data[8:16])}
+	data = data[16:]
+	if r.Start >= r.End {
+		return -1
+	}
+	const leafSize = 64
+	numLeaves := uint64(len(data)+leafSize-1) / leafSize
+
+	ranges := []LeafRange{r}
+	proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, sha256.New()))
+	if r.End > numLeaves {
+		if err == nil {
+			panic("built proof for range beyond the tree")
+		}
+		return 0
+	} else if err != nil {
+		panic(err)
+	}
+	root, err := ReaderRoot(bytes.NewReader(data), sha256.New(), leafSize)
+	if err != nil {
+		panic(err)
+	}
+	rangeData := data[r.Start*leafSize:]
+	if uint64(len(rangeData)) > (r.End-r.Start)*leafSize {
+		rangeData = rangeData[:(r.End-r.Start)*leafSize]
+	}
+	lh := NewReaderLeafHasher(bytes.NewReader(rangeData), sha256.New(), leafSize)
+	if ok, err := VerifyMultiRangeProof(lh, sha256.New(), ranges, proof, root); err != nil {
+		panic(err)
+	} else if !ok {
+		panic("verification failed!")
+	}
+	return 1
+}
+
 // buildAndCompareTreesFromFuzz will read the input data and create a subTree
 // or leaf for each byte of the input data. It returns the cached tree.
 func buildAndCompareTreesFromFuzz(data []byte, proofIndex uint64) (cachedTree *Tree, numLeaves uint64) {
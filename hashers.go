@@ -0,0 +1,831 @@
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+// BufferedReaderSubtreeHasher implements SubtreeHasher by reading leaf data
+// from an underlying stream through an internal buffer. This is considerably
+// faster than ReaderSubtreeHasher when leaves are small and the underlying
+// stream is expensive to read from, e.g. an unbuffered *os.File.
+type BufferedReaderSubtreeHasher struct {
+	r        io.Reader
+	h        hash.Hash
+	leafSize int
+
+	// unread data is stored in buf[pos:end]. err is the first error returned
+	// by r; once set, no further reads are attempted.
+	buf      []byte
+	pos, end int
+	err      error
+}
+
+// maxConsecutiveEmptyReads is the number of consecutive zero-length reads
+// without an error after which a BufferedReaderSubtreeHasher gives up, as in
+// package bufio.
+const maxConsecutiveEmptyReads = 100
+
+// fill reads from the underlying stream until at least n bytes are buffered
+// or an error is encountered. If the stream repeatedly returns no data and no
+// error, fill fails with io.ErrNoProgress.
+func (b *BufferedReaderSubtreeHasher) fill(n int) {
+	empty := 0
+	for b.end-b.pos < n && b.err == nil {
+		if b.end == len(b.buf) {
+			// slide unread data to the front of the buffer
+			b.end = copy(b.buf, b.buf[b.pos:b.end])
+			b.pos = 0
+		}
+		var read int
+		read, b.err = b.r.Read(b.buf[b.end:])
+		b.end += read
+		if read > 0 {
+			empty = 0
+		} else if empty++; empty == maxConsecutiveEmptyReads && b.err == nil {
+			b.err = io.ErrNoProgress
+		}
+	}
+}
+
+// nextLeaf returns the next leaf. The leaf is only valid until the next call
+// to nextLeaf. If the leaf is shorter than leafSize, the error that caused the
+// short read is returned as well.
+func (b *BufferedReaderSubtreeHasher) nextLeaf() ([]byte, error) {
+	b.fill(b.leafSize)
+	n := b.end - b.pos
+	if n >= b.leafSize {
+		n = b.leafSize
+	}
+	leaf := b.buf[b.pos : b.pos+n]
+	b.pos += n
+	if n < b.leafSize {
+		return leaf, b.err
+	}
+	return leaf, nil
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (b *BufferedReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	tree := New(b.h)
+	for i := 0; i < subtreeSize; i++ {
+		leaf, err := b.nextLeaf()
+		if len(leaf) > 0 {
+			tree.Push(leaf)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // reading a partial leaf is normal at the end of the stream
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	root := tree.Root()
+	if root == nil {
+		// we didn't read anything; return EOF to signal that there are no
+		// more subtrees to hash.
+		return nil, io.EOF
+	}
+	return root, nil
+}
+
+// Skip implements SubtreeHasher. Buffered data is discarded first; the
+// underlying stream is only read once the buffer has been exhausted.
+func (b *BufferedReaderSubtreeHasher) Skip(n int) error {
+	// if the size overflows, skip as much as possible; see
+	// ReaderSubtreeHasher.Skip
+	remaining := maxInt
+	if n <= maxInt/b.leafSize {
+		remaining = n * b.leafSize
+	}
+	for remaining > 0 {
+		if b.pos == b.end {
+			if b.err != nil {
+				break
+			}
+			b.pos, b.end = 0, 0
+			b.fill(1)
+			continue
+		}
+		skipped := b.end - b.pos
+		if skipped > remaining {
+			skipped = remaining
+		}
+		b.pos += skipped
+		remaining -= skipped
+	}
+	if remaining > 0 {
+		if b.err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return b.err
+	}
+	return nil
+}
+
+// NewBufferedReaderSubtreeHasher returns a new BufferedReaderSubtreeHasher
+// that reads leaf data from r in chunks of up to bufSize bytes. If bufSize is
+// smaller than leafSize, leafSize is used instead.
+func NewBufferedReaderSubtreeHasher(r io.Reader, leafSize, bufSize int, h hash.Hash) *BufferedReaderSubtreeHasher {
+	if leafSize <= 0 {
+		panic("NewBufferedReaderSubtreeHasher: leafSize must be positive")
+	}
+	if bufSize < leafSize {
+		bufSize = leafSize
+	}
+	return &BufferedReaderSubtreeHasher{
+		r:        r,
+		h:        h,
+		leafSize: leafSize,
+		buf:      make([]byte, bufSize),
+	}
+}
+
+var (
+	// leafBufPool holds *[]byte leaf buffers for PooledReaderSubtreeHashers.
+	leafBufPool = sync.Pool{
+		New: func() interface{} { return new([]byte) },
+	}
+	// stackPool holds Stacks for PooledReaderSubtreeHashers.
+	stackPool = sync.Pool{
+		New: func() interface{} { return new(Stack) },
+	}
+)
+
+// PooledReaderSubtreeHasher implements SubtreeHasher by reading leaf data from
+// an underlying stream, like ReaderSubtreeHasher. However, its leaf buffer and
+// the Stack used to compute subtree roots are borrowed from a pool shared by
+// all PooledReaderSubtreeHashers, which reduces allocations when many proofs
+// are built concurrently. Close must be called when the hasher is no longer
+// needed, returning its resources to the pool; the hasher must not be used
+// after Close is called.
+type PooledReaderSubtreeHasher struct {
+	r     io.Reader
+	leaf  *[]byte
+	stack *Stack
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (psh *PooledReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	defer psh.stack.Reset()
+	leaf := *psh.leaf
+	for i := 0; i < subtreeSize; i++ {
+		n, err := io.ReadFull(psh.r, leaf)
+		if n > 0 {
+			psh.stack.AppendLeaf(leaf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // reading a partial leaf is normal at the end of the stream
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	root := psh.stack.Root()
+	if root == nil {
+		// we didn't read anything; return EOF to signal that there are no
+		// more subtrees to hash.
+		return nil, io.EOF
+	}
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (psh *PooledReaderSubtreeHasher) Skip(n int) error {
+	skipSize := int64(math.MaxInt64) // see ReaderSubtreeHasher.Skip
+	if int64(n) <= math.MaxInt64/int64(len(*psh.leaf)) {
+		skipSize = int64(len(*psh.leaf)) * int64(n)
+	}
+	skipped, err := io.CopyN(ioutil.Discard, psh.r, skipSize)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if skipped == skipSize {
+			return nil
+		}
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Close returns the hasher's leaf buffer and Stack to the pool. It always
+// returns nil.
+func (psh *PooledReaderSubtreeHasher) Close() error {
+	if psh.stack != nil {
+		psh.stack.treeHasher = nil
+		stackPool.Put(psh.stack)
+		leafBufPool.Put(psh.leaf)
+		psh.stack, psh.leaf = nil, nil
+	}
+	return nil
+}
+
+// NewPooledReaderSubtreeHasher returns a new PooledReaderSubtreeHasher that
+// reads leaf data from r. Close must be called when the hasher is no longer
+// needed.
+func NewPooledReaderSubtreeHasher(r io.Reader, leafSize int, h hash.Hash) *PooledReaderSubtreeHasher {
+	if leafSize <= 0 {
+		panic("NewPooledReaderSubtreeHasher: leafSize must be positive")
+	}
+	leaf := leafBufPool.Get().(*[]byte)
+	if cap(*leaf) < leafSize {
+		*leaf = make([]byte, leafSize)
+	}
+	*leaf = (*leaf)[:leafSize]
+	stack := stackPool.Get().(*Stack)
+	stack.Reset()
+	stack.treeHasher = NewDefaultHasher(h)
+	return &PooledReaderSubtreeHasher{
+		r:     r,
+		leaf:  leaf,
+		stack: stack,
+	}
+}
+
+// ErrNotCached may be returned by the NextSubtreeRoot method of a SubtreeHasher
+// that serves precomputed roots, such as the primary SubtreeHasher of a
+// FallbackSubtreeHasher, to indicate that it does not have the requested
+// root. A SubtreeHasher returning ErrNotCached must not advance past the
+// requested leaves; the caller remains responsible for calling Skip.
+var ErrNotCached = errors.New("subtree root is not cached")
+
+// FallbackSubtreeHasher implements SubtreeHasher using a primary
+// SubtreeHasher, e.g. a cache of subtree roots that may contain gaps, and a
+// secondary SubtreeHasher, e.g. a reader over the full leaf data, which is
+// consulted whenever the primary returns ErrNotCached. The two hashers are
+// kept in lockstep: whichever hasher does not produce a given root is advanced
+// past it with Skip.
+type FallbackSubtreeHasher struct {
+	primary   SubtreeHasher
+	secondary SubtreeHasher
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (fsh *FallbackSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	// If the tree is not a power of two, the final subtree may contain fewer
+	// than subtreeSize leaves, in which case the hasher that did not produce
+	// its root cannot skip all of them. This is only benign if the other
+	// hasher has reached the end of the tree as well; otherwise, the hasher
+	// that could not skip is truncated.
+	root, err := fsh.primary.NextSubtreeRoot(subtreeSize)
+	if err == ErrNotCached {
+		skipErr := fsh.primary.Skip(subtreeSize)
+		if skipErr != nil && skipErr != io.ErrUnexpectedEOF {
+			return nil, skipErr
+		}
+		root, err := fsh.secondary.NextSubtreeRoot(subtreeSize)
+		if err == nil && skipErr != nil && !exhausted(fsh.secondary) {
+			return nil, skipErr
+		}
+		return root, err
+	} else if err != nil {
+		return nil, err
+	}
+	if err := fsh.secondary.Skip(subtreeSize); err == io.ErrUnexpectedEOF {
+		if !exhausted(fsh.primary) {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// exhausted reports whether sh has no leaves remaining. If it does have leaves
+// remaining, one of them is skipped.
+func exhausted(sh SubtreeHasher) bool {
+	err := sh.Skip(1)
+	return err == io.ErrUnexpectedEOF || err == io.EOF
+}
+
+// Skip implements SubtreeHasher.
+func (fsh *FallbackSubtreeHasher) Skip(n int) error {
+	if err := fsh.primary.Skip(n); err != nil {
+		return err
+	}
+	return fsh.secondary.Skip(n)
+}
+
+// NewFallbackSubtreeHasher returns a new FallbackSubtreeHasher that uses
+// secondary to compute any subtree roots that primary reports as
+// ErrNotCached.
+func NewFallbackSubtreeHasher(primary, secondary SubtreeHasher) *FallbackSubtreeHasher {
+	return &FallbackSubtreeHasher{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+// SliceSubtreeHasher implements SubtreeHasher over a slice of raw leaf data,
+// hashing each leaf on demand. Unlike ReaderSubtreeHasher, skipping leaves
+// does not require reading them.
+type SliceSubtreeHasher struct {
+	leaves [][]byte
+	stack  *Stack
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (ssh *SliceSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if len(ssh.leaves) == 0 {
+		return nil, io.EOF
+	}
+	ssh.stack.Reset()
+	for i := 0; i < subtreeSize && len(ssh.leaves) > 0; i++ {
+		ssh.stack.AppendLeaf(ssh.leaves[0])
+		ssh.leaves = ssh.leaves[1:]
+	}
+	return ssh.stack.Root(), nil
+}
+
+// Skip implements SubtreeHasher.
+func (ssh *SliceSubtreeHasher) Skip(n int) error {
+	if n > len(ssh.leaves) {
+		return io.ErrUnexpectedEOF
+	}
+	ssh.leaves = ssh.leaves[n:]
+	return nil
+}
+
+// NewSliceSubtreeHasher returns a new SliceSubtreeHasher that hashes the
+// provided leaves.
+func NewSliceSubtreeHasher(leaves [][]byte, h hash.Hash) *SliceSubtreeHasher {
+	return &SliceSubtreeHasher{
+		leaves: leaves,
+		stack:  NewStack(h),
+	}
+}
+
+// SliceLeafHasher implements LeafHasher over a slice of raw leaf data,
+// hashing each leaf on demand.
+type SliceLeafHasher struct {
+	leaves [][]byte
+	lh     LeafHasherz
+}
+
+// NextLeafHash implements LeafHasher.
+func (slh *SliceLeafHasher) NextLeafHash() ([]byte, error) {
+	if len(slh.leaves) == 0 {
+		return nil, io.EOF
+	}
+	leaf := slh.leaves[0]
+	slh.leaves = slh.leaves[1:]
+	return slh.lh.HashLeaf(leaf), nil
+}
+
+// NewSliceLeafHasher returns a new SliceLeafHasher that hashes the provided
+// leaves.
+func NewSliceLeafHasher(leaves [][]byte, h hash.Hash) *SliceLeafHasher {
+	return &SliceLeafHasher{
+		leaves: leaves,
+		lh:     NewDefaultHasher(h),
+	}
+}
+
+// MemoizingSubtreeHasher wraps a SubtreeHasher, caching the subtree roots it
+// produces under a caller-supplied content key. When a later subtree has the
+// same key, the cached root is returned and the underlying SubtreeHasher is
+// advanced with Skip rather than rehashing the subtree. This is useful when
+// many subtrees have identical contents, e.g. in deduplicated storage.
+type MemoizingSubtreeHasher struct {
+	sh        SubtreeHasher
+	keyFn     func(leafIndex uint64, n int) (string, bool)
+	roots     map[string][]byte
+	leafIndex uint64
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (msh *MemoizingSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	key, ok := msh.keyFn(msh.leafIndex, subtreeSize)
+	if ok {
+		if root, cached := msh.roots[key]; cached {
+			if err := msh.sh.Skip(subtreeSize); err != nil {
+				return nil, err
+			}
+			msh.leafIndex += uint64(subtreeSize)
+			return append([]byte(nil), root...), nil
+		}
+	}
+	root, err := msh.sh.NextSubtreeRoot(subtreeSize)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		msh.roots[key] = append([]byte(nil), root...)
+	}
+	msh.leafIndex += uint64(subtreeSize)
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (msh *MemoizingSubtreeHasher) Skip(n int) error {
+	msh.leafIndex += uint64(n)
+	return msh.sh.Skip(n)
+}
+
+// NewMemoizingSubtreeHasher returns a new MemoizingSubtreeHasher wrapping sh.
+// keyFn is called with the index of the first leaf and the size of each
+// requested subtree, and returns a key identifying the subtree's contents, or
+// false if the subtree should not be cached. Subtrees with equal keys must
+// have equal roots. keyFn should only report keys for subtrees that lie
+// entirely within the tree, since a cached root is only valid if the
+// underlying SubtreeHasher can skip the full subtree.
+func NewMemoizingSubtreeHasher(sh SubtreeHasher, keyFn func(leafIndex uint64, n int) (string, bool)) *MemoizingSubtreeHasher {
+	return &MemoizingSubtreeHasher{
+		sh:    sh,
+		keyFn: keyFn,
+		roots: make(map[string][]byte),
+	}
+}
+
+// switchTeeReader is like the io.Reader returned by io.TeeReader, but only
+// writes to w while enabled is set. Since io.ReadFull discards errors that
+// accompany a full read, the first write error is also stored in err.
+type switchTeeReader struct {
+	r       io.Reader
+	w       io.Writer
+	enabled bool
+	err     error
+}
+
+// Read implements io.Reader.
+func (t *switchTeeReader) Read(p []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	n, err := t.r.Read(p)
+	if n > 0 && t.enabled {
+		if _, t.err = t.w.Write(p[:n]); t.err != nil {
+			return n, t.err
+		}
+	}
+	return n, err
+}
+
+// TeeReaderSubtreeHasher implements SubtreeHasher by reading leaf data from
+// an underlying stream, like ReaderSubtreeHasher, while writing the data it
+// reads to an io.Writer. This allows a stream to be hashed and persisted in a
+// single pass.
+type TeeReaderSubtreeHasher struct {
+	rsh        *ReaderSubtreeHasher
+	tee        *switchTeeReader
+	teeSkipped bool
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (tsh *TeeReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	root, err := tsh.rsh.NextSubtreeRoot(subtreeSize)
+	if tsh.tee.err != nil {
+		return nil, tsh.tee.err
+	}
+	return root, err
+}
+
+// Skip implements SubtreeHasher.
+func (tsh *TeeReaderSubtreeHasher) Skip(n int) error {
+	tsh.tee.enabled = tsh.teeSkipped
+	defer func() { tsh.tee.enabled = true }()
+	err := tsh.rsh.Skip(n)
+	if tsh.tee.err != nil {
+		return tsh.tee.err
+	}
+	return err
+}
+
+// SetTeeSkipped controls whether the data of skipped leaves is written to the
+// underlying io.Writer. By default, it is.
+func (tsh *TeeReaderSubtreeHasher) SetTeeSkipped(tee bool) {
+	tsh.teeSkipped = tee
+}
+
+// NewTeeReaderSubtreeHasher returns a new TeeReaderSubtreeHasher that reads
+// leaf data from r, writing it to w as it is read. If writing to w fails, the
+// error is returned by the method that read the data.
+func NewTeeReaderSubtreeHasher(r io.Reader, w io.Writer, leafSize int, h hash.Hash) *TeeReaderSubtreeHasher {
+	tee := &switchTeeReader{r: r, w: w, enabled: true}
+	return &TeeReaderSubtreeHasher{
+		rsh:        NewReaderSubtreeHasher(tee, leafSize, h),
+		tee:        tee,
+		teeSkipped: true,
+	}
+}
+
+// decompressingReader lazily wraps an underlying stream in a decompressor on
+// the first call to Read. Any error other than io.EOF reported by the
+// decompressor is recorded, since a ReaderSubtreeHasher would otherwise treat
+// an io.ErrUnexpectedEOF from a truncated stream as a short final leaf.
+type decompressingReader struct {
+	r          io.Reader
+	decompress func(io.Reader) (io.Reader, error)
+	dr         io.Reader
+	err        error
+}
+
+// Read implements io.Reader.
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.dr == nil {
+		if d.dr, d.err = d.decompress(d.r); d.err != nil {
+			d.err = fmt.Errorf("could not initialize decompressor: %w", d.err)
+			return 0, d.err
+		}
+	}
+	n, err := d.dr.Read(p)
+	if err != nil && err != io.EOF {
+		d.err = fmt.Errorf("decompression failed: %w", err)
+		return n, d.err
+	}
+	return n, err
+}
+
+// DecompressingSubtreeHasher implements SubtreeHasher by reading leaf data
+// from a compressed stream, like a ReaderSubtreeHasher reading the
+// decompressed data. The data is decompressed as it is read, so the
+// decompressed stream is never held in memory. Since compressed data cannot be
+// seeked, Skip decompresses and discards the skipped leaves.
+type DecompressingSubtreeHasher struct {
+	rsh *ReaderSubtreeHasher
+	dr  *decompressingReader
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (dsh *DecompressingSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	root, err := dsh.rsh.NextSubtreeRoot(subtreeSize)
+	if dsh.dr.err != nil {
+		return nil, dsh.dr.err
+	}
+	return root, err
+}
+
+// Skip implements SubtreeHasher.
+func (dsh *DecompressingSubtreeHasher) Skip(n int) error {
+	err := dsh.rsh.Skip(n)
+	if dsh.dr.err != nil {
+		return dsh.dr.err
+	}
+	return err
+}
+
+// NewDecompressingSubtreeHasher returns a new DecompressingSubtreeHasher that
+// reads leaf data from the stream returned by decompress(r), e.g.
+// gzip.NewReader. decompress is not called until the first leaf is read; if
+// it fails, or if the decompressor later reports an error, the error is
+// returned by the method that read the data.
+func NewDecompressingSubtreeHasher(r io.Reader, decompress func(io.Reader) (io.Reader, error), leafSize int, h hash.Hash) *DecompressingSubtreeHasher {
+	dr := &decompressingReader{r: r, decompress: decompress}
+	return &DecompressingSubtreeHasher{
+		rsh: NewReaderSubtreeHasher(dr, leafSize, h),
+		dr:  dr,
+	}
+}
+
+// SegmentedReaderSubtreeHasher implements SubtreeHasher by reading leaf data
+// from a sequence of streams, each containing a known number of leaves. Unlike
+// a ReaderSubtreeHasher reading from an io.MultiReader, it begins a new leaf at
+// the start of each stream, so the final leaf of each stream may be short
+// without the following stream's data bleeding into it.
+type SegmentedReaderSubtreeHasher struct {
+	segments   []io.Reader
+	leafCounts []int
+	leaf       []byte
+	th         TreeHasher
+	stack      *Stack
+}
+
+// ErrSegmentTooLong is returned by a SegmentedReaderSubtreeHasher if a segment
+// contains data beyond its final leaf. Such data would otherwise be ignored,
+// allowing the same data to produce the same root under different
+// segmentations.
+var ErrSegmentTooLong = errors.New("segment contains more data than its leaf count allows")
+
+// checkSegmentEnd returns ErrSegmentTooLong if r contains any more data.
+func checkSegmentEnd(r io.Reader) error {
+	var b [1]byte
+	n, err := io.ReadFull(r, b[:])
+	if n > 0 {
+		return ErrSegmentTooLong
+	} else if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// nextLeaf reads and hashes the next leaf, advancing to the next segment if
+// necessary. It returns io.EOF if all segments have been consumed,
+// io.ErrUnexpectedEOF if a segment contains fewer leaves than expected, and
+// ErrSegmentTooLong if it contains more.
+func (ssh *SegmentedReaderSubtreeHasher) nextLeaf() ([]byte, error) {
+	for len(ssh.leafCounts) > 0 && ssh.leafCounts[0] == 0 {
+		if err := checkSegmentEnd(ssh.segments[0]); err != nil {
+			return nil, err
+		}
+		ssh.segments, ssh.leafCounts = ssh.segments[1:], ssh.leafCounts[1:]
+	}
+	if len(ssh.leafCounts) == 0 {
+		return nil, io.EOF
+	}
+	n, err := io.ReadFull(ssh.segments[0], ssh.leaf)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && ssh.leafCounts[0] > 1) {
+		// only the final leaf of a segment may be short
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if ssh.leafCounts[0]--; ssh.leafCounts[0] == 0 {
+		// a short leaf means the segment has already ended
+		if n == len(ssh.leaf) {
+			if err := checkSegmentEnd(ssh.segments[0]); err != nil {
+				return nil, err
+			}
+		}
+		ssh.segments, ssh.leafCounts = ssh.segments[1:], ssh.leafCounts[1:]
+	}
+	return ssh.th.HashLeaf(ssh.leaf[:n]), nil
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (ssh *SegmentedReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	ssh.stack.Reset()
+	for i := 0; i < subtreeSize; i++ {
+		leafHash, err := ssh.nextLeaf()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		ssh.stack.AppendNode(leafHash)
+	}
+	root := ssh.stack.Root()
+	if root == nil {
+		// we didn't read anything; return EOF to signal that there are no
+		// more subtrees to hash.
+		return nil, io.EOF
+	}
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (ssh *SegmentedReaderSubtreeHasher) Skip(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := ssh.nextLeaf(); err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSegmentedReaderSubtreeHasher returns a new SegmentedReaderSubtreeHasher
+// that reads leafCounts[i] leaves from segments[i], for each i in turn. All
+// leaves are leafSize bytes except the final leaf of each segment, which may
+// be shorter.
+func NewSegmentedReaderSubtreeHasher(segments []io.Reader, leafCounts []int, leafSize int, h hash.Hash) *SegmentedReaderSubtreeHasher {
+	if len(segments) != len(leafCounts) {
+		panic("NewSegmentedReaderSubtreeHasher: number of segments does not match number of leaf counts")
+	} else if leafSize <= 0 {
+		panic("NewSegmentedReaderSubtreeHasher: leafSize must be positive")
+	}
+	for _, c := range leafCounts {
+		if c < 0 {
+			panic("NewSegmentedReaderSubtreeHasher: leaf counts must be non-negative")
+		}
+	}
+	return &SegmentedReaderSubtreeHasher{
+		segments:   append([]io.Reader(nil), segments...),
+		leafCounts: append([]int(nil), leafCounts...),
+		leaf:       make([]byte, leafSize),
+		th:         NewDefaultHasher(h),
+		stack:      NewStack(h),
+	}
+}
+
+// reorderingReader implements io.Reader by presenting chunks of leaf data,
+// which may be added in any order, in leaf order. Read blocks until the next
+// chunk is available.
+type reorderingReader struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	leafSize  int
+	numLeaves int
+	pending   map[int][]byte
+	next      int // index of the first leaf not yet moved into buf
+	buf       []byte
+	err       error
+}
+
+// chunkLeaves returns the number of leaves in a chunk of data.
+func (rr *reorderingReader) chunkLeaves(data []byte) int {
+	return (len(data) + rr.leafSize - 1) / rr.leafSize
+}
+
+// Read implements io.Reader.
+func (rr *reorderingReader) Read(p []byte) (int, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for len(rr.buf) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		} else if rr.next >= rr.numLeaves {
+			return 0, io.EOF
+		} else if chunk, ok := rr.pending[rr.next]; ok {
+			delete(rr.pending, rr.next)
+			rr.buf = chunk
+			rr.next += rr.chunkLeaves(chunk)
+		} else {
+			rr.cond.Wait()
+		}
+	}
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
+
+// addChunk adds a chunk of leaf data beginning at leaf index.
+func (rr *reorderingReader) addChunk(index int, data []byte) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	n := rr.chunkLeaves(data)
+	end := index + n
+	if n == 0 {
+		return errors.New("chunk is empty")
+	} else if index < 0 || end > rr.numLeaves {
+		return fmt.Errorf("chunk [%v,%v) extends beyond tree of %v leaves", index, end, rr.numLeaves)
+	} else if len(data)%rr.leafSize != 0 && end != rr.numLeaves {
+		return errors.New("only the final leaf of the tree may be short")
+	} else if index < rr.next {
+		return fmt.Errorf("chunk [%v,%v) overlaps data that has already been read", index, end)
+	}
+	for i, c := range rr.pending {
+		if index < i+rr.chunkLeaves(c) && i < end {
+			return fmt.Errorf("chunk [%v,%v) overlaps chunk [%v,%v)", index, end, i, i+rr.chunkLeaves(c))
+		}
+	}
+	rr.pending[index] = data
+	rr.cond.Broadcast()
+	return nil
+}
+
+// abort causes all pending and future reads to return err.
+func (rr *reorderingReader) abort(err error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.err = err
+	rr.cond.Broadcast()
+}
+
+// ReorderingSubtreeHasher implements SubtreeHasher for leaf data that arrives
+// out of order, e.g. from a network protocol that delivers chunks with
+// explicit offsets. Chunks are buffered until all preceding leaves have
+// arrived, at which point they are hashed by an underlying ReaderSubtreeHasher.
+// NextSubtreeRoot and Skip block until the leaves they need are available, so
+// chunks must be added from a different goroutine.
+type ReorderingSubtreeHasher struct {
+	rr  *reorderingReader
+	rsh *ReaderSubtreeHasher
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (rsh *ReorderingSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	return rsh.rsh.NextSubtreeRoot(subtreeSize)
+}
+
+// Skip implements SubtreeHasher.
+func (rsh *ReorderingSubtreeHasher) Skip(n int) error {
+	return rsh.rsh.Skip(n)
+}
+
+// AddChunk adds a chunk of leaf data beginning at the leaf with the specified
+// index. A chunk may contain any number of leaves, but only the final leaf of
+// the tree may be short. AddChunk returns an error if the chunk overlaps a
+// previously added chunk or extends beyond the end of the tree. The data must
+// not be modified until it has been hashed.
+func (rsh *ReorderingSubtreeHasher) AddChunk(index int, data []byte) error {
+	return rsh.rr.addChunk(index, data)
+}
+
+// Abort causes any blocked or future calls to NextSubtreeRoot and Skip to
+// return err. It is useful when chunk delivery fails.
+func (rsh *ReorderingSubtreeHasher) Abort(err error) {
+	rsh.rr.abort(err)
+}
+
+// NewReorderingSubtreeHasher returns a new ReorderingSubtreeHasher for a tree
+// of numLeaves leaves of leafSize bytes each.
+func NewReorderingSubtreeHasher(numLeaves, leafSize int, h hash.Hash) *ReorderingSubtreeHasher {
+	if leafSize <= 0 {
+		panic("NewReorderingSubtreeHasher: leafSize must be positive")
+	}
+	rr := &reorderingReader{
+		leafSize:  leafSize,
+		numLeaves: numLeaves,
+		pending:   make(map[int][]byte),
+	}
+	rr.cond = sync.NewCond(&rr.mu)
+	return &ReorderingSubtreeHasher{
+		rr:  rr,
+		rsh: NewReaderSubtreeHasher(rr, leafSize, h),
+	}
+}
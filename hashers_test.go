@@ -0,0 +1,712 @@
+package merkletree
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestBufferedReaderSubtreeHasher tests that BufferedReaderSubtreeHasher
+// produces the same proofs as ReaderSubtreeHasher.
+func TestBufferedReaderSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize*numLeaves + leafSize/2)
+
+	for _, bufSize := range []int{1, leafSize, leafSize + 1, 1000, 1 << 16} {
+		for _, ranges := range [][]LeafRange{
+			{{0, 1}},
+			{{37, 38}},
+			{{3, 5}, {9, 40}, {98, 100}},
+			{{99, 100}},
+		} {
+			exp, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// use a reader that returns one byte at a time to stress the
+			// buffering logic
+			r := iotest.OneByteReader(bytes.NewReader(leafData))
+			proof, err := BuildMultiRangeProof(ranges, NewBufferedReaderSubtreeHasher(r, leafSize, bufSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(proof, exp) {
+				t.Errorf("BufferedReaderSubtreeHasher (bufSize %v) produced wrong proof for ranges %v", bufSize, ranges)
+			}
+		}
+	}
+
+	// skipping past the end of the stream should return io.ErrUnexpectedEOF
+	sh := NewBufferedReaderSubtreeHasher(bytes.NewReader(leafData[:leafSize*4]), leafSize, 100, blake)
+	if err := sh.Skip(4); err != nil {
+		t.Fatal(err)
+	} else if _, err := sh.NextSubtreeRoot(1); err != io.EOF {
+		t.Fatal("expected io.EOF, got", err)
+	}
+	sh = NewBufferedReaderSubtreeHasher(bytes.NewReader(leafData[:leafSize*4]), leafSize, 100, blake)
+	if err := sh.Skip(5); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	// as should skipping a number of leaves whose size overflows
+	sh = NewBufferedReaderSubtreeHasher(bytes.NewReader(leafData[:leafSize*4]), leafSize, 100, blake)
+	if err := sh.Skip(maxInt/2 + 1); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+
+	// a stream that never returns any data should not spin
+	sh = NewBufferedReaderSubtreeHasher(emptyReader{}, leafSize, 100, blake)
+	if _, err := sh.NextSubtreeRoot(4); err != io.ErrNoProgress {
+		t.Fatalf("expected %v, got %v", io.ErrNoProgress, err)
+	}
+}
+
+// emptyReader is an io.Reader whose Read always returns 0, nil.
+type emptyReader struct{}
+
+func (emptyReader) Read([]byte) (int, error) { return 0, nil }
+
+// TestPooledReaderSubtreeHasher tests that PooledReaderSubtreeHasher produces
+// the same proofs as ReaderSubtreeHasher, including when hashers with
+// different leaf sizes share the pool.
+func TestPooledReaderSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for _, leafSize := range []int{64, 7, 128, 64} {
+		const numLeaves = 100
+		leafData := fastrand.Bytes(leafSize*numLeaves + leafSize/2)
+		for _, ranges := range [][]LeafRange{
+			{{0, 1}},
+			{{37, 38}},
+			{{3, 5}, {9, 40}, {98, 100}},
+		} {
+			exp, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sh := NewPooledReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+			proof, err := BuildMultiRangeProof(ranges, sh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sh.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(proof, exp) {
+				t.Errorf("PooledReaderSubtreeHasher (leafSize %v) produced wrong proof for ranges %v", leafSize, ranges)
+			}
+		}
+	}
+
+	// skipping a number of leaves whose size overflows should return
+	// io.ErrUnexpectedEOF
+	sh := NewPooledReaderSubtreeHasher(bytes.NewReader(fastrand.Bytes(256)), 64, blake)
+	defer sh.Close()
+	if err := sh.Skip(maxInt/2 + 1); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+// BenchmarkPooledReaderSubtreeHasher compares the performance of
+// PooledReaderSubtreeHasher against ReaderSubtreeHasher when building many
+// proofs concurrently.
+func BenchmarkPooledReaderSubtreeHasher(b *testing.B) {
+	const leafSize = 64
+	leafData := fastrand.Bytes(1 << 16)
+	numLeaves := len(leafData) / leafSize
+
+	// benchProofs builds proofs concurrently, reporting allocations and the
+	// number of garbage collections per proof as a measure of heap pressure
+	benchProofs := func(newSH func(h hash.Hash) SubtreeHasher) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.RunParallel(func(pb *testing.PB) {
+				blake, _ := blake2b.New256(nil)
+				for pb.Next() {
+					sh := newSH(blake)
+					_, _ = BuildRangeProof(numLeaves/2, numLeaves/2+1, sh)
+					if c, ok := sh.(io.Closer); ok {
+						c.Close()
+					}
+				}
+			})
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "GCs/op")
+		}
+	}
+	b.Run("reader", benchProofs(func(h hash.Hash) SubtreeHasher {
+		return NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, h)
+	}))
+	b.Run("pooled", benchProofs(func(h hash.Hash) SubtreeHasher {
+		return NewPooledReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, h)
+	}))
+}
+
+// BenchmarkBufferedReaderSubtreeHasher compares the performance of
+// BufferedReaderSubtreeHasher against a ReaderSubtreeHasher reading from a
+// file directly and through a bufio.Reader.
+func BenchmarkBufferedReaderSubtreeHasher(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(1 << 22)
+	numLeaves := len(leafData) / leafSize
+
+	f, err := ioutil.TempFile("", "merkletree")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(leafData); err != nil {
+		b.Fatal(err)
+	}
+
+	benchRange := func(start, end int, newSH func(io.Reader) SubtreeHasher) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(leafData)))
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				_, _ = BuildRangeProof(start, end, newSH(f))
+			}
+		}
+	}
+	bufio := func(r io.Reader) SubtreeHasher {
+		return NewReaderSubtreeHasher(bufio.NewReaderSize(r, 1<<16), leafSize, blake)
+	}
+	buffered := func(r io.Reader) SubtreeHasher {
+		return NewBufferedReaderSubtreeHasher(r, leafSize, 1<<16, blake)
+	}
+
+	naive := func(r io.Reader) SubtreeHasher {
+		return NewReaderSubtreeHasher(r, leafSize, blake)
+	}
+
+	b.Run("naive-single", benchRange(0, 1, naive))
+	b.Run("bufio-single", benchRange(0, 1, bufio))
+	b.Run("buffered-single", benchRange(0, 1, buffered))
+	b.Run("naive-mid", benchRange(numLeaves/2, 1+numLeaves/2, naive))
+	b.Run("bufio-mid", benchRange(numLeaves/2, 1+numLeaves/2, bufio))
+	b.Run("buffered-mid", benchRange(numLeaves/2, 1+numLeaves/2, buffered))
+}
+
+// A holeyCacheSubtreeHasher serves precomputed subtree roots of a tree with
+// numLeaves leaves, some of which are missing.
+type holeyCacheSubtreeHasher struct {
+	roots     map[LeafRange][]byte
+	numLeaves uint64
+	pos       uint64
+	hits      int
+}
+
+func (h *holeyCacheSubtreeHasher) NextSubtreeRoot(n int) ([]byte, error) {
+	if h.pos >= h.numLeaves {
+		return nil, io.EOF
+	}
+	end := h.pos + uint64(n)
+	if end > h.numLeaves {
+		end = h.numLeaves
+	}
+	root, ok := h.roots[LeafRange{h.pos, end}]
+	if !ok {
+		return nil, ErrNotCached
+	}
+	h.pos = end
+	h.hits++
+	return root, nil
+}
+
+func (h *holeyCacheSubtreeHasher) Skip(n int) error {
+	h.pos += uint64(n)
+	if h.pos > h.numLeaves {
+		h.pos = h.numLeaves
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// TestFallbackSubtreeHasher tests that a FallbackSubtreeHasher backed by a
+// cache with holes produces the same proofs as a ReaderSubtreeHasher, including
+// for trees whose size is not a power of two.
+func TestFallbackSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	for _, numLeaves := range []uint64{64, 10, 100} {
+		leafData := fastrand.Bytes(leafSize * int(numLeaves))
+
+		// cache roughly half of the aligned subtrees of every size, including
+		// the truncated subtrees at the end of the tree
+		roots := make(map[LeafRange][]byte)
+		for size := uint64(1); size < 2*numLeaves; size *= 2 {
+			for start := uint64(0); start < numLeaves; start += size {
+				end := start + size
+				if end > numLeaves {
+					end = numLeaves
+				}
+				if fastrand.Intn(2) == 0 {
+					roots[LeafRange{start, end}] = bytesRoot(leafData[start*leafSize:end*leafSize], blake, leafSize)
+				}
+			}
+		}
+
+		var hits int
+		for _, ranges := range [][]LeafRange{
+			{{0, 1}},
+			{{numLeaves - 1, numLeaves}},
+			{{3, 5}, {numLeaves / 2, numLeaves/2 + 1}},
+			{{1, 2}, {numLeaves / 4, numLeaves / 2}, {numLeaves - 2, numLeaves - 1}},
+			{{0, numLeaves}},
+		} {
+			expected, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// try the cache as both the primary and, with a cache that
+			// never hits, the secondary
+			for i := 0; i < 2; i++ {
+				cache := &holeyCacheSubtreeHasher{roots: roots, numLeaves: numLeaves}
+				sh := NewFallbackSubtreeHasher(cache, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+				if i == 1 {
+					sh = NewFallbackSubtreeHasher(&holeyCacheSubtreeHasher{numLeaves: numLeaves}, sh)
+				}
+				proof, err := BuildMultiRangeProof(ranges, sh)
+				if err != nil {
+					t.Fatalf("%v leaves, ranges %v: %v", numLeaves, ranges, err)
+				} else if !reflect.DeepEqual(proof, expected) {
+					t.Fatalf("proofs for ranges %v differ: %v", ranges, ProofEqualityReport(proof, expected))
+				}
+				hits += cache.hits
+			}
+		}
+		if hits == 0 {
+			t.Errorf("cache was never used for %v leaves", numLeaves)
+		}
+	}
+
+	// a truncated primary or secondary should be reported rather than
+	// producing a short proof
+	leafData := fastrand.Bytes(leafSize * 100)
+	truncated := &holeyCacheSubtreeHasher{numLeaves: 50}
+	sh := NewFallbackSubtreeHasher(truncated, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if _, err := BuildMultiRangeProof([]LeafRange{{0, 1}}, sh); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	roots := map[LeafRange][]byte{{32, 64}: fastrand.Bytes(32)}
+	sh = NewFallbackSubtreeHasher(&holeyCacheSubtreeHasher{roots: roots, numLeaves: 100}, NewReaderSubtreeHasher(bytes.NewReader(leafData[:40*leafSize]), leafSize, blake))
+	if _, err := BuildMultiRangeProof([]LeafRange{{0, 1}}, sh); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+// TestSliceHashers tests that SliceSubtreeHasher and SliceLeafHasher produce
+// the same proofs and verification results as their reader-based
+// counterparts.
+func TestSliceHashers(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	leaves := make([][]byte, numLeaves)
+	for i := range leaves {
+		leaves[i] = leafData[i*leafSize:][:leafSize]
+	}
+
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{numLeaves - 1, numLeaves}},
+		{{0, numLeaves}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {50, 70}, {98, 99}},
+	} {
+		expected, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := BuildMultiRangeProof(ranges, NewSliceSubtreeHasher(leaves, blake))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, expected) {
+			t.Fatalf("proofs for ranges %v differ: %v", ranges, ProofEqualityReport(proof, expected))
+		}
+
+		var rangeLeaves [][]byte
+		for _, r := range ranges {
+			rangeLeaves = append(rangeLeaves, leaves[r.Start:r.End]...)
+		}
+		if ok, err := VerifyMultiRangeProof(NewSliceLeafHasher(rangeLeaves, blake), blake, ranges, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof for ranges %v", ranges)
+		}
+	}
+
+	// skipping past the end should fail
+	sh := NewSliceSubtreeHasher(leaves, blake)
+	if err := sh.Skip(numLeaves + 1); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+// A countingSubtreeHasher counts the calls made to NextSubtreeRoot.
+type countingSubtreeHasher struct {
+	SubtreeHasher
+	calls int
+}
+
+func (c *countingSubtreeHasher) NextSubtreeRoot(n int) ([]byte, error) {
+	c.calls++
+	return c.SubtreeHasher.NextSubtreeRoot(n)
+}
+
+// TestMemoizingSubtreeHasher tests that MemoizingSubtreeHasher reuses roots
+// for subtrees with identical contents and still produces correct proofs.
+func TestMemoizingSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 64
+	// every leaf is identical, so every subtree of a given size is too
+	leafData := bytes.Repeat(fastrand.Bytes(leafSize), numLeaves)
+	keyFn := func(leafIndex uint64, n int) (string, bool) {
+		if leafIndex+uint64(n) > numLeaves {
+			return "", false
+		}
+		return fmt.Sprint(n), true
+	}
+
+	ranges := []LeafRange{{0, 1}, {32, 33}}
+	expected, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csh := &countingSubtreeHasher{SubtreeHasher: NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)}
+	msh := NewMemoizingSubtreeHasher(csh, keyFn)
+	proof, err := BuildMultiRangeProof(ranges, msh)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, expected) {
+		t.Fatalf("proofs differ: %v", ProofEqualityReport(proof, expected))
+	}
+	// the subtrees following each range have sizes 1, 2, 4, 8 and 16, so the
+	// second set should be served from the cache; the final call returns EOF
+	if csh.calls != 6 {
+		t.Errorf("expected 6 calls to the underlying SubtreeHasher, got %v", csh.calls)
+	}
+
+	// a keyFn that never reports a key should not affect the proof
+	proof, err = BuildMultiRangeProof(ranges, NewMemoizingSubtreeHasher(NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake), func(uint64, int) (string, bool) {
+		return "", false
+	}))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, expected) {
+		t.Fatalf("proofs differ: %v", ProofEqualityReport(proof, expected))
+	}
+}
+
+// TestTeeReaderSubtreeHasher tests that TeeReaderSubtreeHasher produces the
+// same proofs as ReaderSubtreeHasher while writing the leaf data it reads.
+func TestTeeReaderSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize*numLeaves + leafSize/2)
+	ranges := []LeafRange{{3, 5}, {9, 40}, {98, 100}}
+	exp, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	proof, err := BuildMultiRangeProof(ranges, NewTeeReaderSubtreeHasher(bytes.NewReader(leafData), &buf, leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, exp) {
+		t.Fatal("TeeReaderSubtreeHasher produced wrong proof")
+	} else if !bytes.Equal(buf.Bytes(), leafData) {
+		t.Fatal("TeeReaderSubtreeHasher did not write the input data")
+	}
+
+	// the root should match as well
+	buf.Reset()
+	root, err := NewTeeReaderSubtreeHasher(bytes.NewReader(leafData), &buf, leafSize, blake).NextSubtreeRoot(numLeaves + 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(root, bytesRoot(leafData, blake, leafSize)) {
+		t.Fatal("TeeReaderSubtreeHasher produced wrong root")
+	} else if !bytes.Equal(buf.Bytes(), leafData) {
+		t.Fatal("TeeReaderSubtreeHasher did not write the input data")
+	}
+
+	// with SetTeeSkipped(false), the skipped ranges should be omitted
+	buf.Reset()
+	sh := NewTeeReaderSubtreeHasher(bytes.NewReader(leafData), &buf, leafSize, blake)
+	sh.SetTeeSkipped(false)
+	if _, err := BuildMultiRangeProof(ranges, sh); err != nil {
+		t.Fatal(err)
+	}
+	var expData []byte
+	var leafIndex uint64
+	for _, r := range ranges {
+		expData = append(expData, leafData[leafIndex*leafSize:r.Start*leafSize]...)
+		leafIndex = r.End
+	}
+	expData = append(expData, leafData[leafIndex*leafSize:]...)
+	if !bytes.Equal(buf.Bytes(), expData) {
+		t.Fatal("TeeReaderSubtreeHasher wrote skipped data")
+	}
+
+	// write errors should be reported
+	sh = NewTeeReaderSubtreeHasher(bytes.NewReader(leafData), errWriter{}, leafSize, blake)
+	if _, err := sh.NextSubtreeRoot(1); err != errWrite {
+		t.Fatalf("expected %v, got %v", errWrite, err)
+	}
+}
+
+// TestDecompressingSubtreeHasher tests that DecompressingSubtreeHasher
+// produces the same proofs for gzip-compressed data as ReaderSubtreeHasher
+// produces for the uncompressed data.
+func TestDecompressingSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize*numLeaves + leafSize/2)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(leafData); err != nil {
+		t.Fatal(err)
+	} else if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gunzip := func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{3, 5}, {9, 40}, {98, 100}},
+		{{numLeaves, numLeaves + 1}},
+	} {
+		exp, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dsh := NewDecompressingSubtreeHasher(bytes.NewReader(compressed.Bytes()), gunzip, leafSize, blake)
+		proof, err := BuildMultiRangeProof(ranges, dsh)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, exp) {
+			t.Fatalf("DecompressingSubtreeHasher produced wrong proof for %v", ranges)
+		}
+	}
+	dsh := NewDecompressingSubtreeHasher(bytes.NewReader(compressed.Bytes()), gunzip, leafSize, blake)
+	if root, err := dsh.NextSubtreeRoot(numLeaves + 1); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(root, bytesRoot(leafData, blake, leafSize)) {
+		t.Fatal("DecompressingSubtreeHasher produced wrong root")
+	}
+
+	// a truncated stream should be reported, rather than treated as a short
+	// final leaf
+	truncated := compressed.Bytes()[:compressed.Len()/2]
+	dsh = NewDecompressingSubtreeHasher(bytes.NewReader(truncated), gunzip, leafSize, blake)
+	if _, err := dsh.NextSubtreeRoot(numLeaves + 1); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	dsh = NewDecompressingSubtreeHasher(bytes.NewReader(truncated), gunzip, leafSize, blake)
+	if err := dsh.Skip(numLeaves); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	// as should an invalid header
+	dsh = NewDecompressingSubtreeHasher(bytes.NewReader(leafData), gunzip, leafSize, blake)
+	if _, err := dsh.NextSubtreeRoot(1); !errors.Is(err, gzip.ErrHeader) {
+		t.Fatalf("expected %v, got %v", gzip.ErrHeader, err)
+	}
+}
+
+// TestSegmentedReaderSubtreeHasher tests that SegmentedReaderSubtreeHasher
+// starts a new leaf at the beginning of each segment.
+func TestSegmentedReaderSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	// segments whose lengths are not multiples of the leaf size
+	segLens := []int{3*leafSize + leafSize/2, 2 * leafSize, 10, 17*leafSize + 1}
+	var segments [][]byte
+	var leafCounts []int
+	var leafHashes [][]byte
+	th := NewDefaultHasher(blake)
+	for _, n := range segLens {
+		seg := fastrand.Bytes(n)
+		segments = append(segments, seg)
+		leafCounts = append(leafCounts, (n+leafSize-1)/leafSize)
+		for buf := bytes.NewBuffer(seg); buf.Len() > 0; {
+			leafHashes = append(leafHashes, th.HashLeaf(buf.Next(leafSize)))
+		}
+	}
+	readers := func() []io.Reader {
+		var rs []io.Reader
+		for _, seg := range segments {
+			rs = append(rs, bytes.NewReader(seg))
+		}
+		return rs
+	}
+
+	numLeaves := uint64(len(leafHashes))
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{3, 4}},
+		{{2, 7}},
+		{{0, numLeaves}},
+		{{1, 3}, {5, 6}, {numLeaves - 1, numLeaves}},
+	} {
+		exp, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := BuildMultiRangeProof(ranges, NewSegmentedReaderSubtreeHasher(readers(), leafCounts, leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, exp) {
+			t.Errorf("ranges %v: proofs differ: %v", ranges, ProofEqualityReport(proof, exp))
+		}
+	}
+
+	// an io.MultiReader would produce a different root
+	root, _ := NewSegmentedReaderSubtreeHasher(readers(), leafCounts, leafSize, blake).NextSubtreeRoot(int(numLeaves))
+	if bytes.Equal(root, bytesRoot(bytes.Join(segments, nil), blake, leafSize)) {
+		t.Error("segment boundaries were ignored")
+	} else if !bytes.Equal(root, recNodeRoot(leafHashes, blake)) {
+		t.Error("wrong root")
+	}
+
+	// a segment with fewer leaves than expected should be rejected
+	leafCounts[0]++
+	if _, err := NewSegmentedReaderSubtreeHasher(readers(), leafCounts, leafSize, blake).NextSubtreeRoot(int(numLeaves)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	// as should a segment with trailing data after its final leaf, including
+	// the final segment and a segment that should contain no leaves
+	for i, n := range segLens {
+		counts := make([]int, len(segLens))
+		for j, n := range segLens {
+			counts[j] = (n + leafSize - 1) / leafSize
+		}
+		counts[i]--
+		_, err := NewSegmentedReaderSubtreeHasher(readers(), counts, leafSize, blake).NextSubtreeRoot(int(numLeaves))
+		if err != ErrSegmentTooLong {
+			t.Errorf("segment of %v bytes: expected %v, got %v", n, ErrSegmentTooLong, err)
+		}
+	}
+}
+
+// errWriter is an io.Writer that always fails.
+type errWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (errWriter) Write([]byte) (int, error) { return 0, errWrite }
+
+// TestReorderingSubtreeHasher tests that ReorderingSubtreeHasher produces the
+// same proofs as ReaderSubtreeHasher when chunks arrive in random order.
+func TestReorderingSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize*(numLeaves-1) + 10) // final leaf is short
+
+	// split the data into chunks of 1-5 leaves
+	type chunk struct {
+		index int
+		data  []byte
+	}
+	var chunks []chunk
+	for i := 0; i < numLeaves; {
+		n := 1 + fastrand.Intn(5)
+		if i+n > numLeaves {
+			n = numLeaves - i
+		}
+		end := (i + n) * leafSize
+		if end > len(leafData) {
+			end = len(leafData)
+		}
+		chunks = append(chunks, chunk{i, leafData[i*leafSize : end]})
+		i += n
+	}
+
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{numLeaves - 2, numLeaves - 1}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {50, 70}, {98, 99}},
+	} {
+		expected, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsh := NewReorderingSubtreeHasher(numLeaves, leafSize, blake)
+		errs := make(chan error, 1)
+		go func() {
+			for _, i := range fastrand.Perm(len(chunks)) {
+				if err := rsh.AddChunk(chunks[i].index, chunks[i].data); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		proof, err := BuildMultiRangeProof(ranges, rsh)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := <-errs; err != nil {
+			t.Fatal(err)
+		} else if !ProofsEqual(proof, expected) {
+			t.Fatalf("proofs for ranges %v differ: %v", ranges, ProofEqualityReport(proof, expected))
+		}
+	}
+
+	// invalid chunks should be rejected
+	rsh := NewReorderingSubtreeHasher(numLeaves, leafSize, blake)
+	if err := rsh.AddChunk(2, leafData[:3*leafSize]); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []chunk{
+		{4, leafData[:leafSize]},               // overlaps [2,5)
+		{0, leafData[:3*leafSize]},             // overlaps [2,5)
+		{6, leafData[:leafSize+1]},             // short leaf in the middle
+		{numLeaves - 1, leafData[:2*leafSize]}, // beyond the end
+		{-1, leafData[:leafSize]},              // negative index
+		{7, nil},                               // empty
+	} {
+		if err := rsh.AddChunk(c.index, c.data); err == nil {
+			t.Errorf("expected error adding chunk of %v bytes at %v", len(c.data), c.index)
+		}
+	}
+
+	// Abort should unblock a pending call
+	errAborted := errors.New("aborted")
+	done := make(chan error)
+	go func() {
+		_, err := rsh.NextSubtreeRoot(1)
+		done <- err
+	}()
+	rsh.Abort(errAborted)
+	if err := <-done; err != errAborted {
+		t.Fatalf("expected %v, got %v", errAborted, err)
+	}
+}
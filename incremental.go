@@ -0,0 +1,108 @@
+package merkletree
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// An IncrementalVerifier verifies a multi-range proof whose hashes arrive
+// piecemeal, e.g. in network packets. Rather than collecting the entire proof,
+// the caller pushes each proof hash and leaf hash in traversal order, i.e. the
+// order of the leaves they cover; this is the order in which
+// VerifyInterleavedProof consumes them. Only O(log n) hashes are retained.
+type IncrementalVerifier struct {
+	tree      *Stack
+	ranges    []LeafRange
+	root      []byte
+	leafIndex uint64
+	empty     bool
+	err       error
+}
+
+// append appends hash to the tree as the root of a subtree of 2^height leaves.
+// The hash is copied, so the caller may reuse its buffer.
+func (iv *IncrementalVerifier) append(hash []byte, height uint64) error {
+	if err := iv.tree.checkAppend(height); err != nil {
+		return err
+	}
+	iv.tree.appendNodeAtHeight(append([]byte(nil), hash...), height)
+	iv.leafIndex += 1 << height
+	return nil
+}
+
+// inRange reports whether the next hash must be a leaf hash.
+func (iv *IncrementalVerifier) inRange() bool {
+	return len(iv.ranges) > 0 && iv.leafIndex >= iv.ranges[0].Start
+}
+
+// PushProofHash pushes the next proof hash. It returns an error if a leaf hash
+// was expected instead. Once an error has occurred, all subsequent calls
+// return it.
+func (iv *IncrementalVerifier) PushProofHash(hash []byte) error {
+	if iv.err != nil {
+		return iv.err
+	} else if iv.inRange() {
+		iv.err = fmt.Errorf("expected leaf hash at leaf %v, got proof hash", iv.leafIndex)
+		return iv.err
+	}
+	end := uint64(math.MaxUint64)
+	if len(iv.ranges) > 0 {
+		end = iv.ranges[0].Start
+	}
+	height := uint64(bits.TrailingZeros64(uint64(nextSubtreeSize(iv.leafIndex, end))))
+	iv.err = iv.append(hash, height)
+	return iv.err
+}
+
+// PushLeafHash pushes the hash of the next leaf within the proof ranges. It
+// returns an error if a proof hash was expected instead. Once an error has
+// occurred, all subsequent calls return it.
+func (iv *IncrementalVerifier) PushLeafHash(hash []byte) error {
+	if iv.err != nil {
+		return iv.err
+	} else if !iv.inRange() {
+		iv.err = fmt.Errorf("expected proof hash at leaf %v, got leaf hash", iv.leafIndex)
+		return iv.err
+	}
+	if iv.err = iv.append(hash, 0); iv.err != nil {
+		return iv.err
+	}
+	if iv.leafIndex == iv.ranges[0].End {
+		iv.ranges = iv.ranges[1:]
+	}
+	return nil
+}
+
+// Done reports whether the pushed hashes form a valid proof for the root. It
+// returns an error if any push failed or if hashes are missing.
+func (iv *IncrementalVerifier) Done() (bool, error) {
+	if iv.err != nil {
+		return false, iv.err
+	} else if iv.empty {
+		return true, nil
+	} else if iv.inRange() {
+		return false, ErrUnexpectedLeafCount
+	} else if len(iv.ranges) > 0 {
+		return false, io.ErrUnexpectedEOF
+	}
+	return bytes.Equal(iv.tree.Root(), iv.root), nil
+}
+
+// NewIncrementalVerifier returns an IncrementalVerifier for a proof of the
+// specified ranges. The ranges must be sorted and non-overlapping. As with
+// VerifyMultiRangeProof, a proof with no ranges is always valid.
+func NewIncrementalVerifier(h hash.Hash, ranges []LeafRange, root []byte) *IncrementalVerifier {
+	if !validRangeSet(ranges) {
+		panic("NewIncrementalVerifier: illegal set of proof ranges")
+	}
+	return &IncrementalVerifier{
+		tree:   NewStack(h),
+		ranges: append([]LeafRange(nil), ranges...),
+		root:   append([]byte(nil), root...),
+		empty:  len(ranges) == 0,
+	}
+}
@@ -0,0 +1,160 @@
+package merkletree
+
+import (
+	"io"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestIncrementalVerifier tests that IncrementalVerifier agrees with
+// VerifyMultiRangeProof when hashes are pushed in packets.
+func TestIncrementalVerifier(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 37
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	root := recNodeRoot(leafHashes, blake)
+
+	// a hash along with whether it is a leaf hash
+	type item struct {
+		leaf bool
+		hash []byte
+	}
+	// interleave returns the proof hashes and the leaf hashes within ranges
+	// in traversal order.
+	interleave := func(ranges []LeafRange, proof [][]byte) []item {
+		var items []item
+		coverage := ProofCoverage(ranges, numLeaves)
+		for leafIndex := uint64(0); leafIndex < numLeaves; {
+			if len(ranges) > 0 && leafIndex == ranges[0].Start {
+				for ; leafIndex < ranges[0].End; leafIndex++ {
+					items = append(items, item{true, leafHashes[leafIndex]})
+				}
+				ranges = ranges[1:]
+			} else {
+				items = append(items, item{false, proof[0]})
+				leafIndex = coverage[0].End
+				proof, coverage = proof[1:], coverage[1:]
+			}
+		}
+		return items
+	}
+	// push pushes items in packets of random size, reusing the packet buffer
+	// to ensure that the verifier copies each hash.
+	push := func(iv *IncrementalVerifier, items []item) error {
+		packet := make([][]byte, 8)
+		for i := range packet {
+			packet[i] = make([]byte, 32)
+		}
+		for len(items) > 0 {
+			n := 1 + fastrand.Intn(len(packet))
+			if n > len(items) {
+				n = len(items)
+			}
+			for i := range items[:n] {
+				copy(packet[i], items[i].hash)
+			}
+			for i := range items[:n] {
+				var err error
+				if items[i].leaf {
+					err = iv.PushLeafHash(packet[i])
+				} else {
+					err = iv.PushProofHash(packet[i])
+				}
+				if err != nil {
+					return err
+				}
+			}
+			items = items[n:]
+		}
+		return nil
+	}
+
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{numLeaves - 1, numLeaves}},
+		{{0, numLeaves}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {16, 30}, {35, 36}},
+	} {
+		proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hashes [][]byte
+		for _, r := range ranges {
+			hashes = append(hashes, leafHashes[r.Start:r.End]...)
+		}
+		expected, err := VerifyMultiRangeProof(NewCachedLeafHasher(hashes), blake, ranges, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !expected {
+			t.Fatalf("VerifyMultiRangeProof rejected valid proof for %v", ranges)
+		}
+
+		items := interleave(ranges, proof)
+		iv := NewIncrementalVerifier(blake, ranges, root)
+		if err := push(iv, items); err != nil {
+			t.Fatal(err)
+		} else if ok, err := iv.Done(); err != nil {
+			t.Fatal(err)
+		} else if ok != expected {
+			t.Fatalf("expected %v, got %v", expected, ok)
+		}
+
+		// a modified hash should be rejected
+		bad := append([]item(nil), items...)
+		i := fastrand.Intn(len(bad))
+		bad[i].hash = fastrand.Bytes(32)
+		iv = NewIncrementalVerifier(blake, ranges, root)
+		if err := push(iv, bad); err != nil {
+			t.Fatal(err)
+		} else if ok, err := iv.Done(); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Errorf("verifier accepted proof for %v with bad hash %v", ranges, i)
+		}
+
+		// a missing hash should be detected
+		iv = NewIncrementalVerifier(blake, ranges, root)
+		if err := push(iv, items[:len(items)-1]); err != nil {
+			t.Fatal(err)
+		} else if ok, _ := iv.Done(); ok {
+			t.Errorf("verifier accepted truncated proof for %v", ranges)
+		}
+
+		// pushing a hash of the wrong kind should fail, and the error should
+		// persist
+		bad = append([]item(nil), items...)
+		bad[0].leaf = !bad[0].leaf
+		iv = NewIncrementalVerifier(blake, ranges, root)
+		if err := push(iv, bad); err == nil {
+			t.Errorf("verifier accepted misplaced hash for %v", ranges)
+		} else if _, doneErr := iv.Done(); doneErr != err {
+			t.Errorf("expected %v, got %v", err, doneErr)
+		}
+	}
+
+	// missing leaf hashes and missing proof hashes before the final range
+	// should be reported
+	ranges := []LeafRange{{3, 5}, {9, 10}}
+	iv := NewIncrementalVerifier(blake, ranges, root)
+	if _, err := iv.Done(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	_ = iv.PushProofHash(leafHashes[0])
+	_ = iv.PushProofHash(leafHashes[0])
+	_ = iv.PushLeafHash(leafHashes[3])
+	if _, err := iv.Done(); err != ErrUnexpectedLeafCount {
+		t.Fatalf("expected %v, got %v", ErrUnexpectedLeafCount, err)
+	}
+
+	// an empty set of ranges is always valid
+	if ok, err := NewIncrementalVerifier(blake, nil, root).Done(); err != nil || !ok {
+		t.Fatalf("expected true, got %v (%v)", ok, err)
+	}
+}
@@ -0,0 +1,38 @@
+package merkletree
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+// A ManifestEntry describes a single file in a content-addressed manifest.
+type ManifestEntry struct {
+	Path string
+	Hash []byte
+}
+
+// manifestLeaf returns the leaf preimage of e, which is the length of the path
+// as an 8-byte little-endian integer, followed by the path and the hash.
+func manifestLeaf(buf []byte, e ManifestEntry) []byte {
+	buf = buf[:0]
+	var lenBuf [8]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(e.Path)))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, e.Path...)
+	return append(buf, e.Hash...)
+}
+
+// ManifestRoot returns the Merkle root of a manifest, treating the serialized
+// form of each entry as a leaf. The length prefix prevents ambiguity between
+// the path and the hash. Entries should be sorted by path; the root depends on
+// the order of the entries, and ManifestRoot does not sort them. If entries is
+// empty, ManifestRoot returns nil.
+func ManifestRoot(entries []ManifestEntry, h hash.Hash) []byte {
+	s := NewStack(h)
+	var buf []byte
+	for _, e := range entries {
+		buf = manifestLeaf(buf, e)
+		s.AppendLeaf(buf)
+	}
+	return s.Root()
+}
@@ -0,0 +1,53 @@
+package merkletree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// TestManifestRoot tests ManifestRoot against a golden root, and checks that
+// the root depends on the order and serialization of the entries.
+func TestManifestRoot(t *testing.T) {
+	hashOf := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+	entries := []ManifestEntry{
+		{Path: "README.md", Hash: hashOf("readme")},
+		{Path: "cmd/main.go", Hash: hashOf("main")},
+		{Path: "go.mod", Hash: hashOf("module")},
+	}
+	root := ManifestRoot(entries, sha256.New())
+	if got := hex.EncodeToString(root); got != "8756fed87e12da976e0e97a67e7aab14127b450493fd4cf8a36d90249b8490a5" {
+		t.Errorf("wrong golden root: %v", got)
+	}
+
+	// the root should match a manual computation
+	var leaves [][]byte
+	th := NewDefaultHasher(sha256.New())
+	for _, e := range entries {
+		leaves = append(leaves, th.HashLeaf(manifestLeaf(nil, e)))
+	}
+	if exp := recNodeRoot(leaves, sha256.New()); !bytes.Equal(root, exp) {
+		t.Fatalf("expected %x, got %x", exp, root)
+	}
+
+	// reordering the entries should change the root
+	swapped := []ManifestEntry{entries[1], entries[0], entries[2]}
+	if bytes.Equal(ManifestRoot(swapped, sha256.New()), root) {
+		t.Error("root did not change when entries were reordered")
+	}
+
+	// moving bytes between the path and the hash should change the root
+	a := []ManifestEntry{{Path: "ab", Hash: []byte("c")}}
+	b := []ManifestEntry{{Path: "a", Hash: []byte("bc")}}
+	if bytes.Equal(ManifestRoot(a, sha256.New()), ManifestRoot(b, sha256.New())) {
+		t.Error("root is ambiguous between path and hash")
+	}
+
+	if ManifestRoot(nil, sha256.New()) != nil {
+		t.Error("expected nil root for an empty manifest")
+	}
+}
@@ -0,0 +1,55 @@
+package merkletree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MergeProofs combines proofs for rangesA and rangesB, both produced by
+// BuildMultiRangeProof for the same tree of numLeaves leaves, into a proof for
+// the union of the ranges, without reading any leaf data. The merged ranges
+// are returned in coalesced form, so adjacent or overlapping ranges become a
+// single range, and the merged proof is identical to the one that
+// BuildMultiRangeProof would produce for them.
+//
+// Every hash in a proof covers a maximal subtree that lies outside its
+// ranges, so each subtree in the merged proof is covered by a hash in one of
+// the two proofs. Hashes that cover the same subtree in both proofs must be
+// equal; otherwise, an error is returned. No other consistency checks are
+// possible without leaf hashes, so the merged proof should still be verified.
+func MergeProofs(rangesA []LeafRange, proofA [][]byte, rangesB []LeafRange, proofB [][]byte, numLeaves uint64) (mergedRanges []LeafRange, mergedProof [][]byte, err error) {
+	// index the hashes of both proofs by the leaves they cover
+	hashes := make(map[LeafRange][]byte)
+	for _, p := range []struct {
+		ranges []LeafRange
+		proof  [][]byte
+	}{
+		{rangesA, proofA},
+		{rangesB, proofB},
+	} {
+		if err := ValidateRanges(p.ranges, numLeaves); err != nil {
+			return nil, nil, err
+		}
+		coverage := ProofCoverage(p.ranges, numLeaves)
+		if len(p.proof) != len(coverage) {
+			return nil, nil, fmt.Errorf("proof for ranges %v contains %v hashes, expected %v", p.ranges, len(p.proof), len(coverage))
+		}
+		for i, r := range coverage {
+			if prev, ok := hashes[r]; ok && !bytes.Equal(prev, p.proof[i]) {
+				return nil, nil, fmt.Errorf("proofs contain different hashes for leaves %v", r)
+			}
+			hashes[r] = p.proof[i]
+		}
+	}
+
+	mergedRanges = CoalesceRanges(append(append([]LeafRange(nil), rangesA...), rangesB...))
+	for _, r := range ProofCoverage(mergedRanges, numLeaves) {
+		hash, ok := hashes[r]
+		if !ok {
+			// should be unreachable; see above
+			return nil, nil, fmt.Errorf("neither proof contains a hash for leaves %v", r)
+		}
+		mergedProof = append(mergedProof, hash)
+	}
+	return mergedRanges, mergedProof, nil
+}
@@ -0,0 +1,101 @@
+package merkletree
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestMergeProofs tests that MergeProofs produces the same proof as
+// BuildMultiRangeProof for the union of the ranges.
+func TestMergeProofs(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	buildProof := func(leafHashes [][]byte, ranges []LeafRange) [][]byte {
+		proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	randomLeaves := func(n uint64) [][]byte {
+		leafHashes := make([][]byte, n)
+		for i := range leafHashes {
+			leafHashes[i] = fastrand.Bytes(32)
+		}
+		return leafHashes
+	}
+
+	tests := []struct {
+		numLeaves      uint64
+		rangesA        []LeafRange
+		rangesB        []LeafRange
+		expectedRanges []LeafRange
+	}{
+		// disjoint
+		{16, []LeafRange{{0, 4}}, []LeafRange{{8, 12}}, []LeafRange{{0, 4}, {8, 12}}},
+		{13, []LeafRange{{1, 2}}, []LeafRange{{9, 13}}, []LeafRange{{1, 2}, {9, 13}}},
+		{16, []LeafRange{{0, 2}, {10, 11}}, []LeafRange{{4, 6}}, []LeafRange{{0, 2}, {4, 6}, {10, 11}}},
+		// adjacent
+		{16, []LeafRange{{0, 4}}, []LeafRange{{4, 6}}, []LeafRange{{0, 6}}},
+		{11, []LeafRange{{7, 10}}, []LeafRange{{3, 7}}, []LeafRange{{3, 10}}},
+		// overlapping
+		{16, []LeafRange{{2, 9}}, []LeafRange{{5, 12}}, []LeafRange{{2, 12}}},
+		// empty
+		{16, nil, []LeafRange{{5, 12}}, []LeafRange{{5, 12}}},
+	}
+	for _, test := range tests {
+		leafHashes := randomLeaves(test.numLeaves)
+		proofA := buildProof(leafHashes, test.rangesA)
+		proofB := buildProof(leafHashes, test.rangesB)
+		ranges, proof, err := MergeProofs(test.rangesA, proofA, test.rangesB, proofB, test.numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(ranges, test.expectedRanges) {
+			t.Fatalf("expected %v, got %v", test.expectedRanges, ranges)
+		} else if expected := buildProof(leafHashes, ranges); !reflect.DeepEqual(proof, expected) {
+			t.Fatalf("merged proof for %v and %v differs: %v", test.rangesA, test.rangesB, ProofEqualityReport(proof, expected))
+		}
+	}
+
+	// random ranges
+	for i := 0; i < 100; i++ {
+		numLeaves := uint64(fastrand.Intn(64) + 1)
+		leafHashes := randomLeaves(numLeaves)
+		randomRanges := func() []LeafRange {
+			var ranges []LeafRange
+			for start := uint64(fastrand.Intn(int(numLeaves))); start < numLeaves; {
+				end := start + uint64(fastrand.Intn(int(numLeaves-start))) + 1
+				ranges = append(ranges, LeafRange{start, end})
+				start = end + uint64(fastrand.Intn(10))
+			}
+			return ranges
+		}
+		rangesA, rangesB := randomRanges(), randomRanges()
+		ranges, proof, err := MergeProofs(rangesA, buildProof(leafHashes, rangesA), rangesB, buildProof(leafHashes, rangesB), numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		} else if expected := buildProof(leafHashes, ranges); !reflect.DeepEqual(proof, expected) {
+			t.Fatalf("merged proof for %v and %v differs: %v", rangesA, rangesB, ProofEqualityReport(proof, expected))
+		}
+	}
+
+	// proofs that disagree on a shared hash should be rejected; here, both
+	// proofs contain the root of leaves [8,16)
+	leafHashes := randomLeaves(16)
+	rangesA, rangesB := []LeafRange{{0, 2}}, []LeafRange{{4, 6}}
+	proofA, proofB := buildProof(leafHashes, rangesA), buildProof(leafHashes, rangesB)
+	badB := append([][]byte(nil), proofB...)
+	badB[len(badB)-1] = fastrand.Bytes(32)
+	if _, _, err := MergeProofs(rangesA, proofA, rangesB, badB, 16); err == nil {
+		t.Error("expected error for inconsistent proofs")
+	}
+	// as should proofs of the wrong length, or ranges beyond the tree
+	if _, _, err := MergeProofs(rangesA, proofA[1:], rangesB, proofB, 16); err == nil {
+		t.Error("expected error for short proof")
+	}
+	if _, _, err := MergeProofs(rangesA, proofA, []LeafRange{{4, 17}}, proofB, 16); err == nil {
+		t.Error("expected error for range beyond the tree")
+	}
+}
@@ -20,6 +20,8 @@ func NewCachedTree(cachedNodeHeight uint64) *CachedTree {
 		cachedNodeHeight: cachedNodeHeight,
 		Tree: Tree{
 			cachedTree: true,
+			leafHash:   LeafSum,
+			nodeHash:   nodeSum,
 		},
 	}
 }
@@ -64,3 +66,10 @@ func (ct *CachedTree) SetIndex(i uint64) error {
 	ct.trueProofIndex = i
 	return ct.Tree.SetIndex(i / (1 << ct.cachedNodeHeight))
 }
+
+// Reset returns the CachedTree to its initial, empty state, retaining its
+// cached node height and allocated memory so that it can be reused.
+func (ct *CachedTree) Reset() {
+	ct.trueProofIndex = 0
+	ct.Tree.Reset()
+}
@@ -0,0 +1,58 @@
+package merkletree
+
+import (
+	"errors"
+)
+
+// A CachedTree512 is the BLAKE2b-512 counterpart of CachedTree.
+type CachedTree512 struct {
+	cachedNodeHeight uint64
+	trueProofIndex   uint64
+	Tree512
+}
+
+// NewCachedTree512 initializes a CachedTree512 with the specified node height.
+func NewCachedTree512(cachedNodeHeight uint64) *CachedTree512 {
+	return &CachedTree512{
+		cachedNodeHeight: cachedNodeHeight,
+		Tree512: Tree512{
+			cachedTree: true,
+		},
+	}
+}
+
+// Prove will create a proof that the leaf at the indicated index is a part of
+// the data represented by the Merkle root of the CachedTree512. See
+// CachedTree.Prove.
+func (ct *CachedTree512) Prove(cachedProofSet [][64]byte) (merkleRoot [64]byte, proofSet [][64]byte, proofIndex uint64, numLeaves uint64) {
+	// Determine the proof index within the full tree, and the number of leaves
+	// within the full tree.
+	leavesPerCachedNode := uint64(1) << ct.cachedNodeHeight
+	numLeaves = leavesPerCachedNode * ct.currentIndex
+
+	// Get the proof set tail, which is generated based entirely on cached
+	// nodes.
+	merkleRoot, _, proofSetTail, _, _ := ct.Tree512.Prove()
+	if len(proofSetTail) < 1 {
+		// The proof was invalid, return 'nil' for the proof set but accurate
+		// values for everything else.
+		return merkleRoot, nil, ct.trueProofIndex, numLeaves
+	}
+
+	// The first element of the tail is the cached node containing the proof
+	// index, which the verifier reconstructs from cachedProofSet.
+	proofSet = append(cachedProofSet, proofSetTail[1:]...)
+	return merkleRoot, proofSet, ct.trueProofIndex, numLeaves
+}
+
+// SetIndex will inform the CachedTree512 of the index of the leaf for which a
+// storage proof is being created. The index should be the index of the actual
+// leaf, and not the index of the cached element containing the leaf. SetIndex
+// must be called on empty CachedTree512.
+func (ct *CachedTree512) SetIndex(i uint64) error {
+	if len(ct.stack) != 0 {
+		return errors.New("cannot call SetIndex on Tree if Tree has not been reset")
+	}
+	ct.trueProofIndex = i
+	return ct.Tree512.SetIndex(i / (1 << ct.cachedNodeHeight))
+}
@@ -0,0 +1,203 @@
+package merkletree
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// addSubTree512 is the Tree512 counterpart of addSubTree.
+func addSubTree512(height uint64, dataSeed []byte, subtreeProveIndex uint64, fullTree *Tree512) (subTree *Tree512) {
+	data := blake2b.Sum512(dataSeed)
+	leaves := 1 << height
+
+	subTree = New512()
+	err := subTree.SetIndex(subtreeProveIndex)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < leaves; i++ {
+		subTree.Push(data[:])
+		fullTree.Push(data[:])
+		data = blake2b.Sum512(data[:])
+	}
+	return subTree
+}
+
+// TestCachedTree512Construction checks that a CachedTree512 will correctly
+// build to the same merkle root as the Tree512 when using caches at various
+// heights and lengths.
+func TestCachedTree512Construction(t *testing.T) {
+	arbData := [][]byte{
+		{1},
+		{2},
+		{3},
+		{4},
+		{5},
+		{6},
+		{7},
+		{8},
+	}
+
+	// Test that a CachedTree512 with no elements will return the same value
+	// as a tree with no elements.
+	tree := New512()
+	cachedTree := NewCachedTree512(0)
+	if tree.Root() != cachedTree.Root() {
+		t.Error("empty Tree512 and empty CachedTree512 do not match")
+	}
+
+	// Try comparing the root of a cached tree where the cache height is 0, and
+	// there are 3 cached elements.
+	tree = New512()
+	cachedTree = NewCachedTree512(0)
+	for _, d := range arbData[:3] {
+		subTree := New512()
+		subTree.Push(d)
+		cachedTree.PushSubTree(0, subTree.Root())
+		tree.Push(d)
+	}
+	if tree.Root() != cachedTree.Root() {
+		t.Error("adding 3 len cacheing is causing problems")
+	}
+
+	// Try comparing the root of a cached tree where the cache height is 1, and
+	// there is 1 cached element, then attempt a mutation, which should cause a
+	// failure.
+	tree = New512()
+	subTree1 := New512()
+	cachedTree = NewCachedTree512(1)
+	subTree1.Push(arbData[0])
+	subTree1.Push(arbData[1])
+	cachedTree.PushSubTree(0, subTree1.Root())
+	tree.Push(arbData[0])
+	tree.Push(arbData[1])
+	if cachedTree.Root() != tree.Root() {
+		t.Error("comparison has failed")
+	}
+	tree = New512()
+	tree.Push(arbData[1]) // Intentional mistake.
+	tree.Push(arbData[1])
+	if cachedTree.Root() == tree.Root() {
+		t.Error("comparison has succeeded despite mutation")
+	}
+
+	// The 512-bit root must not simply be an extension of the 256-bit root.
+	tree256 := New()
+	tree256.Push(arbData[0])
+	tree256.Push(arbData[1])
+	root256 := tree256.Root()
+	root512 := cachedTree.Root()
+	if string(root256[:]) == string(root512[:32]) {
+		t.Error("512-bit root shares a prefix with 256-bit root")
+	}
+
+	// Try proving on an uninitialized cached tree.
+	for h := uint64(0); h < 3; h++ {
+		cachedTree = NewCachedTree512(h)
+		if err := cachedTree.SetIndex(0); err != nil {
+			t.Fatal(err)
+		}
+		_, proofSet, _, _ := cachedTree.Prove(nil)
+		if proofSet != nil {
+			t.Error("proving an empty set resulted in a valid proof?")
+		}
+	}
+
+	// Try creating a cached proof with cache height 2, 3 cached nodes, index
+	// 6.
+	tree = New512()
+	subTree1 = New512()
+	subTree2 := New512()
+	err := subTree2.SetIndex(2) // subtree index 1-2, corresponding to index 6.
+	if err != nil {
+		t.Fatal(err)
+	}
+	subTree3 := New512()
+	cachedTree = NewCachedTree512(2)
+	err = cachedTree.SetIndex(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		subTree1.Push(arbData[i])
+		subTree2.Push(arbData[4+i])
+		subTree3.Push(arbData[2*i+1])
+	}
+	cachedTree.PushSubTree(0, subTree1.Root())
+	cachedTree.PushSubTree(0, subTree2.Root())
+	cachedTree.PushSubTree(0, subTree3.Root())
+	for i := 0; i < 8; i++ {
+		tree.Push(arbData[i])
+	}
+	for i := 0; i < 4; i++ {
+		tree.Push(arbData[2*i+1])
+	}
+	root := tree.Root()
+	_, _, subTreeProofSet, _, _ := subTree2.Prove()
+	_, proofSet, proofIndex, numLeaves := cachedTree.Prove(subTreeProofSet)
+	if !VerifyProof512(root, proofSet, proofIndex, numLeaves) {
+		t.Error("proof was unsuccessful")
+	}
+	proofSet[len(proofSet)-1][0] ^= 1
+	if VerifyProof512(root, proofSet, proofIndex, numLeaves) {
+		t.Error("corrupted proof was successful")
+	}
+}
+
+// TestCachedTree512ConstructionAuto is the CachedTree512 counterpart of
+// TestCachedTreeConstructionAuto.
+func TestCachedTree512ConstructionAuto(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// Build out cached trees with up to 17 cached elements, each height 'h'.
+	for h := uint64(0); h < 4; h++ {
+		n := uint64(1) << h
+		for i := uint64(0); i < 17; i++ {
+			// Try creating a proof at each index.
+			for j := uint64(0); j < i*n; j++ {
+				tree := New512()
+				err := tree.SetIndex(j)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cachedTree := NewCachedTree512(h)
+				err = cachedTree.SetIndex(j)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var subProof [][64]byte
+
+				// Build out 'i' subtrees that form the components of the cached
+				// tree.
+				for k := uint64(0); k < i; k++ {
+					subtree := addSubTree512(uint64(h), []byte{byte(k)}, j%n, tree)
+					cachedTree.PushSubTree(0, subtree.Root())
+					if tree.Root() != cachedTree.Root() {
+						t.Error("naive 1-height Tree512 and CachedTree512 roots do not match")
+					}
+
+					// Get the proof of the subtree
+					if k == j/n {
+						_, _, subProof, _, _ = subtree.Prove()
+					}
+				}
+
+				// Verify that the tree was built correctly.
+				treeRoot, _, treeProof, treeProofIndex, treeLeaves := tree.Prove()
+				if !VerifyProof512(treeRoot, treeProof, treeProofIndex, treeLeaves) {
+					t.Error("tree problems", i, j)
+				}
+
+				// Verify that the cached tree was built correctly.
+				cachedRoot, cachedProof, cachedProofIndex, cachedLeaves := cachedTree.Prove(subProof)
+				if !VerifyProof512(cachedRoot, cachedProof, cachedProofIndex, cachedLeaves) {
+					t.Error("cached tree problems", i, j)
+				}
+			}
+		}
+	}
+}
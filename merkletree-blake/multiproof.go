@@ -0,0 +1,151 @@
+package merkletree
+
+import (
+	"errors"
+)
+
+// A MultiProofTree is a Tree that constructs proofs for several leaves during
+// a single pass over the data. Each call to 'Push' adds one leaf to the Merkle
+// tree, and the leaves to prove are chosen with 'SetIndices'. The memory
+// footprint of a MultiProofTree grows in O(k*log(n)) for k proof indices.
+type MultiProofTree struct {
+	tree   Tree
+	proofs []proofState
+}
+
+// proofState holds the proof bookkeeping for a single proof index. See the
+// corresponding fields of Tree.
+type proofState struct {
+	proofIndex uint64
+	proofBase  []byte
+	proofSet   [][32]byte
+}
+
+// A LeafProof is a proof that a single leaf is an element of a Merkle tree, as
+// produced by MultiProofTree.ProveMulti. ProofSet and ProofIndex are suitable
+// for use with VerifyProof.
+type LeafProof struct {
+	ProofIndex uint64
+	Base       []byte
+	ProofSet   [][32]byte
+}
+
+// NewMultiProofTree creates a new MultiProofTree. BLAKE2b will be used for all
+// hashing operations within the MultiProofTree.
+func NewMultiProofTree() *MultiProofTree {
+	return &MultiProofTree{
+		tree: *New(),
+	}
+}
+
+// SetIndices will tell the MultiProofTree to create storage proofs for the
+// leaves at each of the input indices. SetIndices must be called on an empty
+// tree.
+func (t *MultiProofTree) SetIndices(indices []uint64) error {
+	if len(t.tree.stack) != 0 {
+		return errors.New("cannot call SetIndices on MultiProofTree if MultiProofTree has not been reset")
+	}
+	t.proofs = make([]proofState, len(indices))
+	for i, index := range indices {
+		t.proofs[i].proofIndex = index
+	}
+	return nil
+}
+
+// Push will add data to the set, building out the Merkle tree and Root, and
+// retaining the elements necessary to prove each of the leaves at the indices
+// established by SetIndices.
+func (t *MultiProofTree) Push(data []byte) {
+	leafHash := t.tree.leafHash(data)
+	for i := range t.proofs {
+		if t.tree.currentIndex == t.proofs[i].proofIndex {
+			t.proofs[i].proofBase = data
+			t.proofs[i].proofSet = append(t.proofs[i].proofSet, leafHash)
+		}
+	}
+
+	t.tree.stack = append(t.tree.stack, subTree{
+		height: 0,
+		sum:    leafHash,
+	})
+
+	// Join subTrees if possible.
+	t.joinAllSubTrees()
+
+	// Update the index.
+	t.tree.currentIndex++
+}
+
+// Root returns the Merkle root of the data that has been pushed. If no data
+// has been pushed, Root returns the zero hash.
+func (t *MultiProofTree) Root() [32]byte {
+	return t.tree.Root()
+}
+
+// ProveMulti creates a proof for each of the indices established by
+// SetIndices, in the same order. The ProofSet of a proof is nil if its index
+// has not yet been reached. ProveMulti does not modify the MultiProofTree.
+func (t *MultiProofTree) ProveMulti() (merkleRoot [32]byte, proofs []LeafProof, numLeaves uint64) {
+	proofs = make([]LeafProof, len(t.proofs))
+	for i, ps := range t.proofs {
+		proofs[i] = LeafProof{
+			ProofIndex: ps.proofIndex,
+			Base:       ps.proofBase,
+			ProofSet:   t.prove(ps),
+		}
+	}
+	return t.tree.Root(), proofs, t.tree.currentIndex
+}
+
+// prove completes the proof set of ps using the current subtrees. See
+// Tree.Prove for a description of the algorithm.
+func (t *MultiProofTree) prove(ps proofState) [][32]byte {
+	stack := t.tree.stack
+	if len(stack) == 0 || len(ps.proofSet) == 0 {
+		return nil
+	}
+	proofSet := append([][32]byte(nil), ps.proofSet...)
+
+	i := len(stack) - 1
+	current := stack[i]
+	for i--; i >= 0 && stack[i].height < len(proofSet)-1; i-- {
+		current = t.tree.joinSubTrees(stack[i], current)
+	}
+	if i >= 0 && stack[i].height == len(proofSet)-1 {
+		proofSet = append(proofSet, current.sum)
+		i--
+	}
+	for ; i >= 0; i-- {
+		proofSet = append(proofSet, stack[i].sum)
+	}
+	return proofSet
+}
+
+// joinAllSubTrees combines the smallest subTrees of the tree while they have
+// the same height, adding subtree hashes to each proof set as necessary. See
+// Tree.joinAllSubTrees.
+func (t *MultiProofTree) joinAllSubTrees() {
+	stack := t.tree.stack
+	for len(stack) > 1 && stack[len(stack)-1].height == stack[len(stack)-2].height {
+		i := len(stack) - 1
+		j := len(stack) - 2
+
+		for k := range t.proofs {
+			ps := &t.proofs[k]
+			if stack[i].height != len(ps.proofSet)-1 {
+				continue
+			}
+			leaves := uint64(1 << uint(stack[i].height))
+			mid := (t.tree.currentIndex / leaves) * leaves
+			if ps.proofIndex < mid {
+				ps.proofSet = append(ps.proofSet, stack[i].sum)
+			} else {
+				ps.proofSet = append(ps.proofSet, stack[j].sum)
+			}
+		}
+
+		// Join the two subTrees into one subTree with a greater height.
+		stack = append(stack[:j], t.tree.joinSubTrees(stack[j], stack[i]))
+	}
+	t.tree.stack = stack
+}
@@ -0,0 +1,72 @@
+package merkletree
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+)
+
+// TestMultiProofTree checks that the proofs produced by a MultiProofTree match
+// the proofs produced by separate single-index Trees.
+func TestMultiProofTree(t *testing.T) {
+	for n := 0; n < 70; n++ {
+		leaves := make([][]byte, n)
+		for i := range leaves {
+			leaves[i] = fastrand.Bytes(1 + fastrand.Intn(64))
+		}
+		// prove every third leaf, plus an index beyond the end of the tree
+		var indices []uint64
+		for i := n - 1; i >= 0; i -= 3 {
+			indices = append(indices, uint64(i))
+		}
+		indices = append(indices, uint64(n))
+
+		mpt := NewMultiProofTree()
+		if err := mpt.SetIndices(indices); err != nil {
+			t.Fatal(err)
+		}
+		for _, leaf := range leaves {
+			mpt.Push(leaf)
+		}
+		root, proofs, numLeaves := mpt.ProveMulti()
+		if root != mpt.Root() {
+			t.Fatal("ProveMulti returned the wrong root")
+		} else if numLeaves != uint64(n) {
+			t.Fatalf("expected %v leaves, got %v", n, numLeaves)
+		} else if len(proofs) != len(indices) {
+			t.Fatalf("expected %v proofs, got %v", len(indices), len(proofs))
+		}
+
+		for i, index := range indices {
+			tree := New()
+			if err := tree.SetIndex(index); err != nil {
+				t.Fatal(err)
+			}
+			for _, leaf := range leaves {
+				tree.Push(leaf)
+			}
+			expRoot, expBase, expProof, _, _ := tree.Prove()
+			p := proofs[i]
+			if root != expRoot {
+				t.Fatalf("n=%v: expected root %x, got %x", n, expRoot, root)
+			} else if p.ProofIndex != index {
+				t.Fatalf("n=%v: expected proof index %v, got %v", n, index, p.ProofIndex)
+			} else if !reflect.DeepEqual(p.Base, expBase) {
+				t.Fatalf("n=%v, index=%v: expected base %x, got %x", n, index, expBase, p.Base)
+			} else if !reflect.DeepEqual(p.ProofSet, expProof) {
+				t.Fatalf("n=%v, index=%v: expected proof %x, got %x", n, index, expProof, p.ProofSet)
+			}
+			if index < uint64(n) && !VerifyProof(root, p.ProofSet, index, numLeaves) {
+				t.Fatalf("n=%v, index=%v: proof did not verify", n, index)
+			}
+		}
+	}
+
+	// SetIndices must be called on an empty tree
+	mpt := NewMultiProofTree()
+	mpt.Push([]byte{1})
+	if err := mpt.SetIndices([]uint64{0}); err == nil {
+		t.Error("SetIndices succeeded on a non-empty tree")
+	}
+}
@@ -1,6 +1,7 @@
 package merkletree
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"math"
@@ -294,6 +295,75 @@ func BuildRangeProof(proofStart, proofEnd int, h SubtreeHasher) (proof [][32]byt
 	return BuildMultiRangeProof([]LeafRange{{uint64(proofStart), uint64(proofEnd)}}, h)
 }
 
+// stackSubtreeHasher implements SubtreeHasher using the roots of the complete
+// subtrees of a Tree. Since the leaves within each subtree are unknown, a
+// subtree can only be hashed or skipped in its entirety.
+type stackSubtreeHasher struct {
+	roots   [][32]byte
+	heights []int
+}
+
+// consume removes the subtrees covering the next n leaves, or fewer if the
+// stack is exhausted, and returns their root. The subtrees must not be split.
+func (ssh *stackSubtreeHasher) consume(n int) ([32]byte, error) {
+	tree := New()
+	var leaves int
+	for len(ssh.roots) > 0 && leaves+1<<uint(ssh.heights[0]) <= n {
+		if err := tree.PushSubTree(ssh.heights[0], ssh.roots[0]); err != nil {
+			return [32]byte{}, err
+		}
+		leaves += 1 << uint(ssh.heights[0])
+		ssh.roots, ssh.heights = ssh.roots[1:], ssh.heights[1:]
+	}
+	if leaves != n && len(ssh.roots) > 0 {
+		return [32]byte{}, errors.New("proof range does not begin and end at subtree boundaries")
+	}
+	return tree.Root(), nil
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (ssh *stackSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([32]byte, error) {
+	if len(ssh.roots) == 0 {
+		return [32]byte{}, io.EOF
+	}
+	return ssh.consume(subtreeSize)
+}
+
+// Skip implements SubtreeHasher.
+func (ssh *stackSubtreeHasher) Skip(n int) error {
+	_, err := ssh.consume(n)
+	return err
+}
+
+// BuildRangeProofFromStack constructs a proof for the leaf range [start, end)
+// of a Tree using only the roots and heights of its subtrees, as returned by
+// SubtreeRoots and SubtreeHeights. Since the leaves within each subtree are
+// unknown, start and end must lie on subtree boundaries; for example, in a
+// Tree of 13 leaves, made up of subtrees of 8, 4, and 1 leaves, the supported
+// ranges are those between 0, 8, 12, and 13. The Tree must use the default
+// hashers.
+func BuildRangeProofFromStack(roots [][32]byte, heights []int, start, end int) ([][32]byte, error) {
+	if len(roots) != len(heights) {
+		return nil, errors.New("roots and heights must have the same length")
+	}
+	for i := range heights {
+		if heights[i] < 0 || heights[i] >= 64 || (i > 0 && heights[i] >= heights[i-1]) {
+			return nil, errors.New("subtree heights must be strictly decreasing")
+		}
+	}
+	if start < 0 || start > end {
+		panic("BuildRangeProofFromStack: illegal proof range")
+	}
+	var numLeaves int
+	for _, height := range heights {
+		numLeaves += 1 << uint(height)
+	}
+	if end > numLeaves {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return BuildRangeProof(start, end, &stackSubtreeHasher{roots, heights})
+}
+
 // A LeafHasher returns the leaves of a Merkle tree in sequential order. When
 // no more leaves are available, NextLeafHash must return io.EOF.
 type LeafHasher interface {
@@ -486,8 +556,28 @@ func proofMapping(proofSize, proofIndex int) (mapping []int) {
 	return append(mapping, right...)
 }
 
-// ConvertSingleProofToRangeProof converts a proof produced by (*Tree).Prove
-// to a single-leaf range proof. proofIndex must be >= 0.
+// SplitSingleProof splits a proof set produced by (*Tree).Prove into the hash
+// of the proven leaf, which is always its first element, and the sibling
+// hashes that follow it. If proofSet is empty, the zero hash and a nil slice
+// are returned. The returned siblings share memory with proofSet.
+func SplitSingleProof(proofSet [][32]byte) (leafHash [32]byte, siblings [][32]byte) {
+	if len(proofSet) == 0 {
+		return [32]byte{}, nil
+	}
+	return proofSet[0], proofSet[1:]
+}
+
+// JoinSingleProof is the inverse of SplitSingleProof: it returns the proof set
+// consisting of leafHash followed by siblings, as expected by VerifyProof.
+func JoinSingleProof(leafHash [32]byte, siblings [][32]byte) [][32]byte {
+	proofSet := make([][32]byte, 0, 1+len(siblings))
+	proofSet = append(proofSet, leafHash)
+	return append(proofSet, siblings...)
+}
+
+// ConvertSingleProofToRangeProof converts the sibling hashes of a proof
+// produced by (*Tree).Prove, as returned by SplitSingleProof, to a single-leaf
+// range proof. proofIndex must be >= 0.
 func ConvertSingleProofToRangeProof(proof [][32]byte, proofIndex int) [][32]byte {
 	newproof := make([][32]byte, len(proof))
 	mapping := proofMapping(len(proof), proofIndex)
@@ -498,7 +588,8 @@ func ConvertSingleProofToRangeProof(proof [][32]byte, proofIndex int) [][32]byte
 }
 
 // ConvertRangeProofToSingleProof converts a single-leaf range proof to the
-// equivalent proof produced by (*Tree).Prove. proofIndex must be >= 0.
+// sibling hashes of the equivalent proof produced by (*Tree).Prove. The full
+// proof set can be obtained with JoinSingleProof. proofIndex must be >= 0.
 func ConvertRangeProofToSingleProof(proof [][32]byte, proofIndex int) [][32]byte {
 	oldproof := make([][32]byte, len(proof))
 	mapping := proofMapping(len(proof), proofIndex)
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"math/bits"
 	"reflect"
 	"testing"
 
@@ -762,6 +763,62 @@ func TestBuildProofRangeEOF(t *testing.T) {
 	}
 }
 
+// TestBuildRangeProofFromStack tests that proofs built from the subtree roots
+// of a Tree match those built by BuildRangeProof.
+func TestBuildRangeProofFromStack(t *testing.T) {
+	for _, numLeaves := range []int{1, 8, 13, 22, 31} {
+		tree := New()
+		leafHashes := make([][32]byte, numLeaves)
+		for i := range leafHashes {
+			data := fastrand.Bytes(64)
+			tree.Push(data)
+			leafHashes[i] = LeafSum(data)
+		}
+		roots, heights := tree.SubtreeRoots(), tree.SubtreeHeights()
+		if len(roots) != bits.OnesCount(uint(numLeaves)) || len(heights) != len(roots) {
+			t.Fatalf("expected %v subtrees, got %v roots and %v heights", bits.OnesCount(uint(numLeaves)), len(roots), len(heights))
+		}
+		root := tree.Root()
+
+		boundaries := []int{0}
+		for _, height := range heights {
+			boundaries = append(boundaries, boundaries[len(boundaries)-1]+1<<uint(height))
+		}
+		for i, start := range boundaries {
+			for _, end := range boundaries[i+1:] {
+				proof, err := BuildRangeProofFromStack(roots, heights, start, end)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expProof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(proof, expProof) {
+					t.Fatalf("%v leaves, range [%v,%v): proofs differ", numLeaves, start, end)
+				}
+				lh := NewCachedLeafHasher(leafHashes[start:end])
+				if ok, err := VerifyRangeProof(lh, start, end, proof, root); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatalf("%v leaves, range [%v,%v): proof did not verify", numLeaves, start, end)
+				}
+			}
+		}
+	}
+
+	// ranges that split a subtree are not supported
+	tree := New()
+	for i := 0; i < 13; i++ {
+		tree.Push([]byte{byte(i)})
+	}
+	for _, r := range [][2]int{{1, 8}, {0, 9}, {4, 12}, {12, 14}} {
+		if _, err := BuildRangeProofFromStack(tree.SubtreeRoots(), tree.SubtreeHeights(), r[0], r[1]); err == nil {
+			t.Errorf("BuildRangeProofFromStack accepted range %v", r)
+		}
+	}
+}
+
 // TestProofConversion tests that "old" single-leaf Merkle proofs can be
 // converted into "new" single-leaf Merkle range proofs, and vice versa.
 func TestProofConversion(t *testing.T) {
@@ -781,6 +838,10 @@ func TestProofConversion(t *testing.T) {
 	}
 	for _, test := range tests {
 		leafData := fastrand.Bytes(test.leafSize * test.numLeaves)
+		root, err := ReaderRoot(bytes.NewReader(leafData), test.leafSize)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		buildOldProof := func(proofIndex int) [][32]byte {
 			t := New()
@@ -790,7 +851,7 @@ func TestProofConversion(t *testing.T) {
 				t.Push(buf.Next(test.leafSize))
 			}
 			_, _, proof, _, _ := t.Prove()
-			return proof[1:]
+			return proof
 		}
 
 		buildNewProof := func(proofIndex int) [][32]byte {
@@ -803,7 +864,11 @@ func TestProofConversion(t *testing.T) {
 		}
 
 		for proofIndex := 0; proofIndex < test.numLeaves; proofIndex++ {
-			oldproof := buildOldProof(proofIndex)
+			proofSet := buildOldProof(proofIndex)
+			leafHash, oldproof := SplitSingleProof(proofSet)
+			if exp := LeafSum(leafData[proofIndex*test.leafSize:][:test.leafSize]); leafHash != exp {
+				t.Fatalf("SplitSingleProof returned the wrong leaf hash for index %v", proofIndex)
+			}
 			newproof := buildNewProof(proofIndex)
 			if !reflect.DeepEqual(ConvertSingleProofToRangeProof(oldproof, proofIndex), newproof) {
 				t.Fatalf("Failed to convert old->new for index %v", proofIndex)
@@ -811,9 +876,20 @@ func TestProofConversion(t *testing.T) {
 			if !reflect.DeepEqual(ConvertRangeProofToSingleProof(newproof, proofIndex), oldproof) {
 				t.Errorf("Failed to convert new->old for index %v", proofIndex)
 			}
+			rejoined := JoinSingleProof(leafHash, ConvertRangeProofToSingleProof(newproof, proofIndex))
+			if !reflect.DeepEqual(rejoined, proofSet) {
+				t.Errorf("JoinSingleProof did not invert SplitSingleProof for index %v", proofIndex)
+			}
+			if !VerifyProof(root, rejoined, uint64(proofIndex), uint64(test.numLeaves)) {
+				t.Errorf("rejoined proof failed to verify for index %v", proofIndex)
+			}
 		}
 	}
 
+	if leafHash, siblings := SplitSingleProof(nil); leafHash != ([32]byte{}) || siblings != nil {
+		t.Error("SplitSingleProof of an empty proof set should return nothing")
+	}
+
 	// test invalid/untrusted inputs to ensure that they do not panic
 	proof := make([][32]byte, 1000)
 	for i := 0; i < 1000; i++ {
@@ -8,7 +8,9 @@ import (
 // ReadAll will read segments of size 'segmentSize' and push them into the tree
 // until EOF is reached. Success will return 'err == nil', not 'err == EOF'. No
 // padding is added to the data, so the last element may be smaller than
-// 'segmentSize'.
+// 'segmentSize'. Short reads are handled with io.ReadFull semantics: a segment
+// is only pushed once 'segmentSize' bytes have been read or EOF is reached,
+// regardless of how many bytes each call to r.Read returns.
 func (t *Tree) ReadAll(r io.Reader, segmentSize int) error {
 	for {
 		segment := make([]byte, segmentSize)
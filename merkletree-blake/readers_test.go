@@ -3,7 +3,9 @@ package merkletree
 import (
 	"bytes"
 	"testing"
+	"testing/iotest"
 
+	"gitlab.com/NebulousLabs/fastrand"
 	"golang.org/x/crypto/blake2b"
 )
 
@@ -52,6 +54,47 @@ func TestReaderRootPadding(t *testing.T) {
 	}
 }
 
+// TestReaderRootShortReads passes ReaderRoot and BuildReaderProof a reader
+// that returns one byte per call to Read. The results should match those of a
+// reader that returns all of the requested bytes at once.
+func TestReaderRootShortReads(t *testing.T) {
+	const segmentSize = 64
+	for _, size := range []int{1, segmentSize - 1, segmentSize, 10*segmentSize + 7} {
+		data := fastrand.Bytes(size)
+		expectedRoot, err := ReaderRoot(bytes.NewReader(data), segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := ReaderRoot(iotest.OneByteReader(bytes.NewReader(data)), segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		} else if root != expectedRoot {
+			t.Errorf("ReaderRoot returned the wrong root for %v bytes", size)
+		}
+
+		index := uint64(size / segmentSize / 2)
+		_, expectedProof, expectedLeaves, err := BuildReaderProof(bytes.NewReader(data), segmentSize, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, proofSet, numLeaves, err := BuildReaderProof(iotest.OneByteReader(bytes.NewReader(data)), segmentSize, index)
+		if err != nil {
+			t.Fatal(err)
+		} else if root != expectedRoot {
+			t.Errorf("BuildReaderProof returned the wrong root for %v bytes", size)
+		} else if numLeaves != expectedLeaves {
+			t.Errorf("BuildReaderProof returned the wrong number of leaves for %v bytes", size)
+		} else if len(proofSet) != len(expectedProof) {
+			t.Fatalf("BuildReaderProof returned a proof with the wrong length for %v bytes", size)
+		}
+		for i := range proofSet {
+			if proofSet[i] != expectedProof[i] {
+				t.Errorf("BuildReaderProof returned an incorrect proof for %v bytes", size)
+			}
+		}
+	}
+}
+
 // TestBuildReaderProof calls BuildReaderProof on a manually crafted dataset
 // and checks the output.
 func TestBuildReaderProof(t *testing.T) {
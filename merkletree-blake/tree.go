@@ -38,8 +38,29 @@ type Tree struct {
 	// this flag is somewhat gross, but eliminates needing to duplicate the
 	// entire 'Push' function when writing the cached tree.
 	cachedTree bool
+
+	// leafHash and nodeHash are used to compute leaf and node sums,
+	// respectively. By default, they are LeafSum and nodeSum.
+	leafHash func([]byte) [32]byte
+	nodeHash func(a, b [32]byte) [32]byte
+
+	// padding determines how unbalanced trees are hashed.
+	padding TreePaddingMode
 }
 
+// A TreePaddingMode determines how the root of an unbalanced tree, i.e. a tree
+// whose number of leaves is not a power of two, is computed.
+type TreePaddingMode int
+
+const (
+	// PadNone promotes a node without a sibling to the next level without
+	// hashing it, as specified by RFC 6962. This is the default.
+	PadNone TreePaddingMode = iota
+	// PadDuplicate pairs a node without a sibling with a copy of itself, as
+	// in Bitcoin's transaction Merkle trees.
+	PadDuplicate
+)
+
 // A subTree contains the Merkle root of a complete (2^height leaves) subTree
 // of the Tree. 'sum' is the Merkle root of the subTree.
 type subTree struct {
@@ -69,7 +90,7 @@ func nodeSum(a, b [32]byte) [32]byte {
 }
 
 // joinSubTrees combines two equal sized subTrees into a larger subTree.
-func joinSubTrees(a, b subTree) subTree {
+func (t *Tree) joinSubTrees(a, b subTree) subTree {
 	if DEBUG {
 		if a.height < b.height {
 			panic("invalid subtree presented - height mismatch")
@@ -78,16 +99,33 @@ func joinSubTrees(a, b subTree) subTree {
 
 	return subTree{
 		height: a.height + 1,
-		sum:    nodeSum(a.sum, b.sum),
+		sum:    t.nodeHash(a.sum, b.sum),
 	}
 }
 
 // New creates a new Tree. BLAKE2b will be used for all hashing operations
 // within the Tree.
 func New() *Tree {
+	return NewWithHashers(LeafSum, nodeSum)
+}
+
+// NewWithHashers creates a new Tree that uses leafHash to compute leaf sums
+// and nodeHash to combine sibling nodes. This allows the Tree to be used with
+// schemes other than the prefixed BLAKE2b scheme used by New, e.g. a tree that
+// hashes concatenated children without a domain-separating prefix. If either
+// function is nil, the corresponding default is used.
+func NewWithHashers(leafHash func([]byte) [32]byte, nodeHash func(a, b [32]byte) [32]byte) *Tree {
+	if leafHash == nil {
+		leafHash = LeafSum
+	}
+	if nodeHash == nil {
+		nodeHash = nodeSum
+	}
 	return &Tree{
 		// preallocate a stack large enough for most trees
-		stack: make([]subTree, 0, 32),
+		stack:    make([]subTree, 0, 32),
+		leafHash: leafHash,
+		nodeHash: nodeHash,
 	}
 }
 
@@ -99,6 +137,9 @@ func (t *Tree) Prove() (merkleRoot [32]byte, base []byte, proofSet [][32]byte, p
 	if !t.proofTree {
 		panic("wrong usage: can't call prove on a tree if SetIndex wasn't called")
 	}
+	if t.padding != PadNone {
+		panic("wrong usage: can't call prove on a tree that uses PadDuplicate")
+	}
 
 	// Return nil if the Tree is empty, or if the proofIndex hasn't yet been
 	// reached.
@@ -126,7 +167,7 @@ func (t *Tree) Prove() (merkleRoot [32]byte, base []byte, proofSet [][32]byte, p
 	i := len(t.stack) - 1
 	current := t.stack[i]
 	for i--; i >= 0 && t.stack[i].height < len(proofSet)-1; i-- {
-		current = joinSubTrees(t.stack[i], current)
+		current = t.joinSubTrees(t.stack[i], current)
 	}
 
 	// Sanity check - check that either 'current' or 'current.next' is the
@@ -173,16 +214,16 @@ func (t *Tree) Push(data []byte) {
 	// data is being inserted at the proof index, it is added to the proof set.
 	if t.currentIndex == t.proofIndex {
 		t.proofBase = data
-		t.proofSet = append(t.proofSet, LeafSum(data))
+		t.proofSet = append(t.proofSet, t.leafHash(data))
 	}
 
 	// Hash the data to create a subtree of height 0. The sum of the new node
 	// is going to be the data for cached trees, and is going to be the result
-	// of calling LeafSum() on the data for standard trees. Doing a check here
+	// of calling leafHash() on the data for standard trees. Doing a check here
 	// prevents needing to duplicate the entire 'Push' function for the trees.
 	t.stack = append(t.stack, subTree{
 		height: 0,
-		sum:    LeafSum(data),
+		sum:    t.leafHash(data),
 	})
 
 	// Join subTrees if possible.
@@ -233,9 +274,29 @@ func (t *Tree) PushSubTree(height int, sum [32]byte) error {
 	return nil
 }
 
-// Root returns the Merkle root of the data that has been pushed.
+// PushSubTreeChecked is like PushSubTree, but additionally verifies that the
+// subtree covers expectedLeaves leaves, i.e. that 1<<height == expectedLeaves,
+// and that the subtree is aligned, i.e. that it begins at a multiple of
+// 1<<height leaves. This catches the most common misuses of PushSubTree, but
+// it still can't detect a subtree that is itself unbalanced.
+func (t *Tree) PushSubTreeChecked(height int, sum [32]byte, expectedLeaves uint64) error {
+	if height < 0 || height >= 64 {
+		return fmt.Errorf("invalid subtree height %v", height)
+	}
+	size := uint64(1) << uint64(height)
+	if size != expectedLeaves {
+		return fmt.Errorf("subtree of height %v contains %v leaves, not %v", height, size, expectedLeaves)
+	}
+	if t.currentIndex%size != 0 {
+		return fmt.Errorf("can't push a subtree of %v leaves at index %v, which is not a multiple of %v", size, t.currentIndex, size)
+	}
+	return t.PushSubTree(height, sum)
+}
+
+// Root returns the Merkle root of the data that has been pushed. If no data
+// has been pushed, Root returns the zero hash.
 func (t *Tree) Root() [32]byte {
-	// If the Tree is empty, return nil.
+	// If the Tree is empty, return the zero hash.
 	if len(t.stack) == 0 {
 		return [32]byte{}
 	}
@@ -245,11 +306,54 @@ func (t *Tree) Root() [32]byte {
 	// the join.
 	current := t.stack[len(t.stack)-1]
 	for i := len(t.stack) - 2; i >= 0; i-- {
-		current = joinSubTrees(t.stack[i], current)
+		if t.padding == PadDuplicate {
+			// Pair the smaller subtree with itself until it is as tall as
+			// its left sibling.
+			for current.height < t.stack[i].height {
+				current = t.joinSubTrees(current, current)
+			}
+		}
+		current = t.joinSubTrees(t.stack[i], current)
 	}
 	return current.sum
 }
 
+// SetPaddingMode sets the TreePaddingMode used to compute the root of the
+// Tree. Prove is not supported in PadDuplicate mode, since VerifyProof assumes
+// PadNone.
+func (t *Tree) SetPaddingMode(mode TreePaddingMode) {
+	t.padding = mode
+}
+
+// SubtreeRoots returns the roots of the complete subtrees that currently make
+// up the Tree, from the bottom of the stack (the leftmost and tallest
+// subtree) to the top. Together with SubtreeHeights, they are sufficient to
+// compute the Merkle root of the Tree, or to build range proofs with
+// BuildRangeProofFromStack, without retaining the data.
+func (t *Tree) SubtreeRoots() [][32]byte {
+	roots := make([][32]byte, len(t.stack))
+	for i, st := range t.stack {
+		roots[i] = st.sum
+	}
+	return roots
+}
+
+// SubtreeHeights returns the heights of the subtrees returned by SubtreeRoots.
+func (t *Tree) SubtreeHeights() []int {
+	heights := make([]int, len(t.stack))
+	for i, st := range t.stack {
+		heights[i] = st.height
+	}
+	return heights
+}
+
+// ProofBase returns the data of the leaf at the proof index, i.e. the base
+// that Prove would return, or nil if that leaf has not yet been pushed. Unlike
+// Prove, ProofBase can be called at any time.
+func (t *Tree) ProofBase() []byte {
+	return t.proofBase
+}
+
 // SetIndex will tell the Tree to create a storage proof for the leaf at the
 // input index. SetIndex must be called on an empty tree.
 func (t *Tree) SetIndex(i uint64) error {
@@ -261,6 +365,20 @@ func (t *Tree) SetIndex(i uint64) error {
 	return nil
 }
 
+// Reset returns the Tree to its initial, empty state, retaining its hash
+// functions and allocated memory so that it can be reused. Whether the Tree is
+// cached is also retained. Any proof returned by Prove before the call to
+// Reset should not be used after the Tree is modified again, since the
+// underlying memory is reused.
+func (t *Tree) Reset() {
+	t.stack = t.stack[:0]
+	t.currentIndex = 0
+	t.proofIndex = 0
+	t.proofBase = nil
+	t.proofSet = t.proofSet[:0]
+	t.proofTree = false
+}
+
 // joinAllSubTrees inserts the subTree at t.head into the Tree. As long as the
 // height of the next subTree is the same as the height of the current subTree,
 // the two will be combined into a single subTree of height n+1.
@@ -299,7 +417,7 @@ func (t *Tree) joinAllSubTrees() {
 		}
 
 		// Join the two subTrees into one subTree with a greater height.
-		t.stack = append(t.stack[:j], joinSubTrees(t.stack[j], t.stack[i]))
+		t.stack = append(t.stack[:j], t.joinSubTrees(t.stack[j], t.stack[i]))
 	}
 
 	// Sanity check - From head to tail of the stack, the height should be
@@ -0,0 +1,253 @@
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// A Tree512 is a Tree that uses BLAKE2b-512 rather than BLAKE2b-256, producing
+// 64-byte leaf sums, node sums, and Merkle roots. It is intended for
+// applications that require a larger security margin; otherwise, it behaves
+// identically to Tree.
+type Tree512 struct {
+	// See Tree for a description of these fields.
+	stack []subTree512
+
+	currentIndex uint64
+	proofIndex   uint64
+	proofBase    []byte
+	proofSet     [][64]byte
+	proofTree    bool
+
+	cachedTree bool
+}
+
+// A subTree512 contains the Merkle root of a complete (2^height leaves)
+// subTree of the Tree512. 'sum' is the Merkle root of the subTree.
+type subTree512 struct {
+	height int // a height over 300 is physically unachievable
+	sum    [64]byte
+}
+
+// LeafSum512 returns the BLAKE2b-512 hash created from data inserted to form a
+// leaf. Leaf sums are calculated using:
+//		Hash(0x00 || data)
+func LeafSum512(data []byte) [64]byte {
+	buf := make([]byte, 0, 129)
+	buf = append(buf, leafHashPrefix...)
+	buf = append(buf, data...)
+	return blake2b.Sum512(buf)
+}
+
+// nodeSum512 returns the BLAKE2b-512 hash created from two sibling nodes being
+// combined into a parent node. Node sums are calculated using:
+//		Hash(0x01 || left sibling sum || right sibling sum)
+func nodeSum512(a, b [64]byte) [64]byte {
+	buf := make([]byte, 0, 129)
+	buf = append(buf, nodeHashPrefix...)
+	buf = append(buf, a[:]...)
+	buf = append(buf, b[:]...)
+	return blake2b.Sum512(buf)
+}
+
+// joinSubTrees combines two equal sized subTrees into a larger subTree.
+func (t *Tree512) joinSubTrees(a, b subTree512) subTree512 {
+	if DEBUG {
+		if a.height < b.height {
+			panic("invalid subtree presented - height mismatch")
+		}
+	}
+
+	return subTree512{
+		height: a.height + 1,
+		sum:    nodeSum512(a.sum, b.sum),
+	}
+}
+
+// New512 creates a new Tree512. BLAKE2b-512 will be used for all hashing
+// operations within the Tree512.
+func New512() *Tree512 {
+	return &Tree512{
+		// preallocate a stack large enough for most trees
+		stack: make([]subTree512, 0, 32),
+	}
+}
+
+// Prove creates a proof that the leaf at the established index (established by
+// SetIndex) is an element of the Merkle tree. Prove will return a nil proof
+// set if used incorrectly. Prove does not modify the Tree512. Prove can only be
+// called if SetIndex has been called previously.
+func (t *Tree512) Prove() (merkleRoot [64]byte, base []byte, proofSet [][64]byte, proofIndex uint64, numLeaves uint64) {
+	if !t.proofTree {
+		panic("wrong usage: can't call prove on a tree if SetIndex wasn't called")
+	}
+
+	// Return nil if the Tree512 is empty, or if the proofIndex hasn't yet
+	// been reached.
+	if len(t.stack) == 0 || len(t.proofSet) == 0 {
+		return t.Root(), nil, nil, t.proofIndex, t.currentIndex
+	}
+	proofSet = t.proofSet
+
+	// See Tree.Prove for an explanation of how the remaining subtrees are
+	// collapsed into the proof set.
+	i := len(t.stack) - 1
+	current := t.stack[i]
+	for i--; i >= 0 && t.stack[i].height < len(proofSet)-1; i-- {
+		current = t.joinSubTrees(t.stack[i], current)
+	}
+
+	// Sanity check - check that either 'current' or 'current.next' is the
+	// subtree containing the proof index.
+	if DEBUG {
+		if current.height != len(t.proofSet)-1 && (i >= 0 && t.stack[i].height != len(t.proofSet)-1) {
+			panic("could not find the subtree containing the proof index")
+		}
+	}
+
+	if i >= 0 && t.stack[i].height == len(proofSet)-1 {
+		proofSet = append(proofSet, current.sum)
+		current = t.stack[i]
+		i--
+	}
+	for ; i >= 0; i-- {
+		current = t.stack[i]
+		proofSet = append(proofSet, current.sum)
+	}
+	return t.Root(), t.proofBase, proofSet, t.proofIndex, t.currentIndex
+}
+
+// Push will add data to the set, building out the Merkle tree and Root. See
+// Tree.Push.
+func (t *Tree512) Push(data []byte) {
+	if t.cachedTree {
+		panic("cannot call Push on a cached tree")
+	}
+	// The first element of a proof is the data at the proof index. If this
+	// data is being inserted at the proof index, it is added to the proof set.
+	if t.currentIndex == t.proofIndex {
+		t.proofBase = data
+		t.proofSet = append(t.proofSet, LeafSum512(data))
+	}
+
+	t.stack = append(t.stack, subTree512{
+		height: 0,
+		sum:    LeafSum512(data),
+	})
+
+	// Join subTrees if possible.
+	t.joinAllSubTrees()
+
+	// Update the index.
+	t.currentIndex++
+}
+
+// PushSubTree pushes a cached subtree into the merkle tree. See
+// Tree.PushSubTree for the restrictions on the subtree.
+func (t *Tree512) PushSubTree(height int, sum [64]byte) error {
+	newIndex := t.currentIndex + 1<<uint64(height)
+
+	// If pushing a subtree of height 0 at the proof index, add the hash to the
+	// proof set. Otherwise, the subtree containing the proof index should not
+	// be pushed.
+	if t.proofTree {
+		if t.currentIndex == t.proofIndex && height == 0 {
+			t.proofSet = append(t.proofSet, sum)
+		} else if t.currentIndex <= t.proofIndex && t.proofIndex < newIndex {
+			return errors.New("the cached tree shouldn't contain the element to prove")
+		}
+	}
+
+	// We can only add the cached tree if its depth is <= the depth of the
+	// current subtree.
+	if len(t.stack) != 0 && height > t.stack[len(t.stack)-1].height {
+		return fmt.Errorf("can't add a subtree that is larger than the smallest subtree %v > %v", height, t.stack[len(t.stack)-1].height)
+	}
+
+	// Insert the cached tree as the new head.
+	t.stack = append(t.stack, subTree512{
+		height: height,
+		sum:    sum,
+	})
+
+	// Join subTrees if possible.
+	t.joinAllSubTrees()
+
+	// Update the index.
+	t.currentIndex = newIndex
+
+	return nil
+}
+
+// Root returns the Merkle root of the data that has been pushed. If no data
+// has been pushed, Root returns the zero hash.
+func (t *Tree512) Root() [64]byte {
+	// If the Tree512 is empty, return the zero hash.
+	if len(t.stack) == 0 {
+		return [64]byte{}
+	}
+
+	// The root is formed by hashing together subTrees in order from least in
+	// height to greatest in height. The taller subtree is the first subtree in
+	// the join.
+	current := t.stack[len(t.stack)-1]
+	for i := len(t.stack) - 2; i >= 0; i-- {
+		current = t.joinSubTrees(t.stack[i], current)
+	}
+	return current.sum
+}
+
+// SetIndex will tell the Tree512 to create a storage proof for the leaf at the
+// input index. SetIndex must be called on an empty tree.
+func (t *Tree512) SetIndex(i uint64) error {
+	if len(t.stack) != 0 {
+		return errors.New("cannot call SetIndex on Tree if Tree has not been reset")
+	}
+	t.proofTree = true
+	t.proofIndex = i
+	return nil
+}
+
+// joinAllSubTrees inserts the subTree at t.head into the Tree512. See
+// Tree.joinAllSubTrees.
+func (t *Tree512) joinAllSubTrees() {
+	for len(t.stack) > 1 && t.stack[len(t.stack)-1].height == t.stack[len(t.stack)-2].height {
+		i := len(t.stack) - 1
+		j := len(t.stack) - 2
+
+		// Before combining subtrees, check whether one of the subtree hashes
+		// needs to be added to the proof set.
+		if t.stack[i].height == len(t.proofSet)-1 {
+			leaves := uint64(1 << uint(t.stack[i].height))
+			mid := (t.currentIndex / leaves) * leaves
+			if t.proofIndex < mid {
+				t.proofSet = append(t.proofSet, t.stack[i].sum)
+			} else {
+				t.proofSet = append(t.proofSet, t.stack[j].sum)
+			}
+
+			// Sanity check - the proofIndex should never be less than the
+			// midpoint minus the number of leaves in each subtree.
+			if DEBUG {
+				if t.proofIndex < mid-leaves {
+					panic("proof being added with weird values")
+				}
+			}
+		}
+
+		// Join the two subTrees into one subTree with a greater height.
+		t.stack = append(t.stack[:j], t.joinSubTrees(t.stack[j], t.stack[i]))
+	}
+
+	// Sanity check - From head to tail of the stack, the height should be
+	// strictly decreasing.
+	if DEBUG {
+		for i := range t.stack[1:] {
+			if t.stack[i].height <= t.stack[i+1].height {
+				panic("subtrees are out of order")
+			}
+		}
+	}
+}
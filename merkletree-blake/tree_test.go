@@ -1,8 +1,12 @@
 package merkletree
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"math/big"
+	"reflect"
 	"strconv"
 	"testing"
 
@@ -385,6 +389,18 @@ func TestBadInputs(t *testing.T) {
 	}
 }
 
+// TestEmptyTree pins down the root of an empty tree.
+func TestEmptyTree(t *testing.T) {
+	if New().Root() != ([32]byte{}) {
+		t.Error("root of empty Tree should be the zero hash")
+	}
+	if root, err := ReaderRoot(new(bytes.Reader), 64); err != nil {
+		t.Fatal(err)
+	} else if root != ([32]byte{}) {
+		t.Error("root of empty reader should be the zero hash")
+	}
+}
+
 // TestCompatibility runs BuildProof for a large set of trees, and checks that
 // verify affirms each proof, while rejecting for all other indexes (this
 // second half requires that all input data be unique). The test checks that
@@ -759,6 +775,389 @@ func TestPushSubTreeSimple(t *testing.T) {
 	}
 }
 
+// TestPushSubTreeChecked tests that PushSubTreeChecked accepts aligned
+// subtrees of the expected size and rejects misaligned or wrong-height ones.
+func TestPushSubTreeChecked(t *testing.T) {
+	tree := New()
+
+	// Aligned pushes should succeed.
+	if err := tree.PushSubTreeChecked(2, [32]byte{1}, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.PushSubTreeChecked(1, [32]byte{2}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.PushSubTreeChecked(0, [32]byte{3}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if tree.currentIndex != 7 {
+		t.Fatalf("expected index %v but was %v", 7, tree.currentIndex)
+	}
+
+	// A subtree of height 1 at index 7 is misaligned.
+	if err := tree.PushSubTreeChecked(1, [32]byte{}, 2); err == nil {
+		t.Fatal("pushing a misaligned subTree should fail")
+	}
+	// A subtree whose height doesn't match the expected number of leaves
+	// should be rejected.
+	if err := tree.PushSubTreeChecked(0, [32]byte{}, 2); err == nil {
+		t.Fatal("pushing a subTree of the wrong height should fail")
+	}
+	if err := tree.PushSubTreeChecked(-1, [32]byte{}, 0); err == nil {
+		t.Fatal("pushing a subTree with a negative height should fail")
+	}
+	// Failed pushes should not modify the tree.
+	if tree.currentIndex != 7 {
+		t.Fatalf("expected index %v but was %v", 7, tree.currentIndex)
+	}
+
+	// The resulting root should match a tree built with PushSubTree.
+	tree2 := New()
+	tree2.PushSubTree(2, [32]byte{1})
+	tree2.PushSubTree(1, [32]byte{2})
+	tree2.PushSubTree(0, [32]byte{3})
+	if tree.Root() != tree2.Root() {
+		t.Fatal("PushSubTreeChecked produced a different root than PushSubTree")
+	}
+
+	// Once smaller subtrees have been joined, a larger subtree can be pushed
+	// at the resulting aligned index.
+	tree3 := New()
+	if err := tree3.PushSubTreeChecked(1, [32]byte{}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree3.PushSubTreeChecked(0, [32]byte{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree3.PushSubTreeChecked(0, [32]byte{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree3.PushSubTreeChecked(2, [32]byte{}, 4); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNewWithHashers tests that a Tree created with NewWithHashers uses the
+// supplied hash functions, and that the default hash functions produce the
+// same roots and proofs as they always have.
+func TestNewWithHashers(t *testing.T) {
+	// The default hashers must be byte-identical to the original
+	// implementation. These values were generated before the hashers became
+	// pluggable.
+	goldenRoot := "9a32133fb577b45268f6dcb813645347b5955c4b19e56b7474197a31e75a6a5f"
+	goldenProof := []string{
+		"8f1f9fd0816a310a79d0e0c4bf605a544c260c561740bcdeb175ea46f5312890",
+		"da71b5a250e13516be21e61457038fe23ba276e5dc9f36bf96430f174f8a4605",
+		"47f61e4f4620e9946a8831b8c717a76f36982b82d88e005bc4635a1b21c73eff",
+		"b1416ae5d902b04f7d9344de9b7569147424128d23fc01683ba4d5a34aea12c9",
+	}
+	for _, tree := range []*Tree{New(), NewWithHashers(nil, nil), NewWithHashers(LeafSum, nodeSum)} {
+		if err := tree.SetIndex(2); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 7; i++ {
+			tree.Push([]byte{byte(i)})
+		}
+		root, _, proof, _, _ := tree.Prove()
+		if hex.EncodeToString(root[:]) != goldenRoot {
+			t.Error("default hashers produced the wrong root")
+		}
+		if len(proof) != len(goldenProof) {
+			t.Fatal("default hashers produced the wrong proof")
+		}
+		for i := range proof {
+			if hex.EncodeToString(proof[i][:]) != goldenProof[i] {
+				t.Error("default hashers produced the wrong proof")
+			}
+		}
+	}
+
+	// Use a Bitcoin-style tree that double-SHA256s leaves and concatenated
+	// children, with no domain-separating prefix.
+	sha256d := func(b []byte) [32]byte {
+		h := sha256.Sum256(b)
+		return sha256.Sum256(h[:])
+	}
+	nodeHash := func(a, b [32]byte) [32]byte {
+		return sha256d(append(a[:], b[:]...))
+	}
+	tree := NewWithHashers(sha256d, nodeHash)
+	if err := tree.SetIndex(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		tree.Push([]byte{byte(i)})
+	}
+	leaves := [][32]byte{sha256d([]byte{0}), sha256d([]byte{1}), sha256d([]byte{2})}
+	expRoot := nodeHash(nodeHash(leaves[0], leaves[1]), leaves[2])
+	root, _, proof, _, numLeaves := tree.Prove()
+	if root != expRoot {
+		t.Error("custom hashers produced the wrong root")
+	}
+	expProof := [][32]byte{leaves[1], leaves[0], leaves[2]}
+	if numLeaves != 3 || len(proof) != len(expProof) {
+		t.Fatal("custom hashers produced the wrong proof")
+	}
+	for i := range proof {
+		if proof[i] != expProof[i] {
+			t.Error("custom hashers produced the wrong proof")
+		}
+	}
+}
+
+// TestTreeReset checks that a Tree that has been reset produces the same
+// roots and proofs as a fresh Tree.
+func TestTreeReset(t *testing.T) {
+	reused := New()
+	for n := 1; n < 20; n++ {
+		for proofIndex := uint64(0); proofIndex < uint64(n); proofIndex += 3 {
+			fresh := New()
+			reused.Reset()
+			if err := fresh.SetIndex(proofIndex); err != nil {
+				t.Fatal(err)
+			}
+			if err := reused.SetIndex(proofIndex); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < n; i++ {
+				fresh.Push([]byte{byte(i)})
+				reused.Push([]byte{byte(i)})
+			}
+			expRoot, expBase, expProof, _, _ := fresh.Prove()
+			root, base, proof, index, numLeaves := reused.Prove()
+			if root != expRoot {
+				t.Fatalf("expected root %x, got %x", expRoot, root)
+			} else if !bytes.Equal(base, expBase) {
+				t.Fatalf("expected proof base %x, got %x", expBase, base)
+			} else if !reflect.DeepEqual(proof, expProof) {
+				t.Fatalf("expected proof %x, got %x", expProof, proof)
+			} else if index != proofIndex || numLeaves != uint64(n) {
+				t.Fatalf("expected index %v of %v leaves, got %v of %v", proofIndex, n, index, numLeaves)
+			}
+			if !VerifyProof(root, proof, index, numLeaves) {
+				t.Fatal("proof from reset tree did not verify")
+			}
+		}
+	}
+
+	// Once reset, the tree should no longer be a proof tree.
+	reused.Reset()
+	if reused.Root() != New().Root() {
+		t.Error("reset tree is not empty")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Prove to panic on a reset tree")
+			}
+		}()
+		reused.Prove()
+	}()
+
+	// A reset CachedTree should remain cached.
+	ct := NewCachedTree(1)
+	ct.PushSubTree(0, LeafSum([]byte{1}))
+	ct.Reset()
+	if err := ct.SetIndex(3); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Push to panic on a reset CachedTree")
+			}
+		}()
+		ct.Push([]byte{1})
+	}()
+}
+
+// bitcoinRoot computes the Merkle root of a set of transaction IDs the way
+// Bitcoin does: level by level, duplicating the last node of each level with
+// an odd number of nodes. It is used as a reference for PadDuplicate.
+func bitcoinRoot(level [][32]byte, nodeHash func(a, b [32]byte) [32]byte) [32]byte {
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([][32]byte, len(level)/2)
+		for i := range next {
+			next[i] = nodeHash(level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// TestProofBase tests that ProofBase returns the data at the proof index once
+// it has been pushed, and nil before then.
+func TestProofBase(t *testing.T) {
+	tree := New()
+	if err := tree.SetIndex(3); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		base := tree.ProofBase()
+		if i <= 3 && base != nil {
+			t.Fatalf("expected nil proof base after %v leaves, got %x", i, base)
+		} else if i > 3 && !bytes.Equal(base, []byte{3}) {
+			t.Fatalf("expected proof base %x after %v leaves, got %x", []byte{3}, i, base)
+		}
+		tree.Push([]byte{byte(i)})
+	}
+	if _, base, _, _, _ := tree.Prove(); !bytes.Equal(tree.ProofBase(), base) {
+		t.Fatalf("expected %x, got %x", base, tree.ProofBase())
+	}
+	tree.Reset()
+	if base := tree.ProofBase(); base != nil {
+		t.Fatalf("expected nil proof base after Reset, got %x", base)
+	}
+}
+
+// TestMockHashers tests that a Tree routes all hashing through the functions
+// supplied to NewWithHashers by using a trivial XOR "hash", under which the
+// root of a tree is the XOR of its leaves.
+func TestMockHashers(t *testing.T) {
+	var leafCalls, nodeCalls int
+	leafHash := func(data []byte) (sum [32]byte) {
+		leafCalls++
+		copy(sum[:], data)
+		return
+	}
+	nodeHash := func(a, b [32]byte) (sum [32]byte) {
+		nodeCalls++
+		for i := range sum {
+			sum[i] = a[i] ^ b[i]
+		}
+		return
+	}
+	for n := 1; n < 20; n++ {
+		leafCalls, nodeCalls = 0, 0
+		tree := NewWithHashers(leafHash, nodeHash)
+		if err := tree.SetIndex(uint64(n / 2)); err != nil {
+			t.Fatal(err)
+		}
+		var expRoot [32]byte
+		for i := 0; i < n; i++ {
+			leaf := []byte{byte(i + 1), byte(i * 7)}
+			tree.Push(leaf)
+			expRoot[0] ^= leaf[0]
+			expRoot[1] ^= leaf[1]
+		}
+		root, _, proof, _, _ := tree.Prove()
+		if root != expRoot {
+			t.Fatalf("%v leaves: expected root %x, got %x", n, expRoot, root)
+		}
+		// the proof consists of the leaf and the roots of its siblings, which
+		// together cover every leaf
+		var proofRoot [32]byte
+		for _, p := range proof {
+			proofRoot = nodeHash(proofRoot, p)
+		}
+		if proofRoot != root {
+			t.Fatalf("%v leaves: proof does not cover the tree", n)
+		}
+		if leafCalls < n || nodeCalls == 0 {
+			t.Fatalf("%v leaves: expected mock hashers to be used, got %v leaf and %v node calls", n, leafCalls, nodeCalls)
+		}
+	}
+}
+
+// TestPadDuplicate checks that a Tree using PadDuplicate computes
+// Bitcoin-style Merkle roots.
+func TestPadDuplicate(t *testing.T) {
+	// Bitcoin hashes nodes with double SHA-256 and uses transaction IDs
+	// directly as leaves.
+	txid := func(data []byte) (leaf [32]byte) {
+		copy(leaf[:], data)
+		return
+	}
+	sha256d := func(a, b [32]byte) [32]byte {
+		sum := sha256.Sum256(append(a[:], b[:]...))
+		return sha256.Sum256(sum[:])
+	}
+	// Bitcoin displays hashes in reverse byte order.
+	reversed := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return b
+	}
+
+	// block 100000
+	tree := NewWithHashers(txid, sha256d)
+	tree.SetPaddingMode(PadDuplicate)
+	for _, id := range []string{
+		"8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87",
+		"fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4",
+		"6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4",
+		"e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d",
+	} {
+		tree.Push(reversed(id))
+	}
+	if root := tree.Root(); !bytes.Equal(root[:], reversed("f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766")) {
+		t.Fatalf("wrong root for block 100000: %x", root)
+	}
+
+	// With three leaves, the third is paired with itself.
+	a, b, c := [32]byte{1}, [32]byte{2}, [32]byte{3}
+	tree = NewWithHashers(txid, sha256d)
+	tree.SetPaddingMode(PadDuplicate)
+	tree.Push(a[:])
+	tree.Push(b[:])
+	tree.Push(c[:])
+	if tree.Root() != sha256d(sha256d(a, b), sha256d(c, c)) {
+		t.Fatal("wrong root for three leaves")
+	}
+
+	// Compare against the reference implementation, for both the Bitcoin
+	// hashers and the default hashers.
+	for _, hashers := range []struct {
+		leafHash func([]byte) [32]byte
+		nodeHash func(a, b [32]byte) [32]byte
+	}{
+		{txid, sha256d},
+		{LeafSum, nodeSum},
+	} {
+		for n := 1; n <= 33; n++ {
+			padded := NewWithHashers(hashers.leafHash, hashers.nodeHash)
+			padded.SetPaddingMode(PadDuplicate)
+			unpadded := NewWithHashers(hashers.leafHash, hashers.nodeHash)
+			var leaves [][32]byte
+			for i := 0; i < n; i++ {
+				data := fastrand.Bytes(32)
+				padded.Push(data)
+				unpadded.Push(data)
+				leaves = append(leaves, hashers.leafHash(data))
+			}
+			if padded.Root() != bitcoinRoot(leaves, hashers.nodeHash) {
+				t.Fatalf("PadDuplicate root of %v leaves does not match reference", n)
+			}
+			// the modes only differ when the tree is unbalanced
+			if balanced := n&(n-1) == 0; balanced != (padded.Root() == unpadded.Root()) {
+				t.Fatalf("unexpected PadNone root of %v leaves", n)
+			}
+		}
+	}
+
+	// Prove is not supported with PadDuplicate
+	defer func() {
+		if recover() == nil {
+			t.Error("expected Prove to panic with PadDuplicate")
+		}
+	}()
+	tree = New()
+	tree.SetPaddingMode(PadDuplicate)
+	if err := tree.SetIndex(0); err != nil {
+		t.Fatal(err)
+	}
+	tree.Push([]byte{1})
+	tree.Prove()
+}
+
 // BenchmarkTree64_4MB creates a Merkle tree out of 4MB using a segment size of
 // 64 bytes.
 func BenchmarkTree64_4MB(b *testing.B) {
@@ -800,3 +1199,37 @@ func BenchmarkTree4k_4MB(b *testing.B) {
 		tree.Root()
 	}
 }
+
+// BenchmarkTreeReset compares building 1000 small proofs using a fresh Tree
+// for each proof against reusing a single Tree via Reset.
+func BenchmarkTreeReset(b *testing.B) {
+	data := make([]byte, 64)
+	build := func(tree *Tree) {
+		if err := tree.SetIndex(5); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 32; j++ {
+			tree.Push(data)
+		}
+		tree.Prove()
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 1000; j++ {
+				build(New())
+			}
+		}
+	})
+	b.Run("reset", func(b *testing.B) {
+		b.ReportAllocs()
+		tree := New()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 1000; j++ {
+				tree.Reset()
+				build(tree)
+			}
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package merkletree
+
+// VerifyProof512 is the BLAKE2b-512 counterpart of VerifyProof. It takes a
+// Merkle root, a proofSet, and a proofIndex and returns true if the first
+// element of the proof set is a leaf of data in the Merkle root.
+func VerifyProof512(merkleRoot [64]byte, proofSet [][64]byte, proofIndex uint64, numLeaves uint64) bool {
+	// Return false for nonsense input.
+	if merkleRoot == ([64]byte{}) {
+		return false
+	}
+	if proofIndex >= numLeaves {
+		return false
+	}
+
+	// See VerifyProof for an explanation of this algorithm.
+	height := 0
+	if len(proofSet) <= height {
+		return false
+	}
+	sum := proofSet[height]
+	height++
+
+	// While the current subtree (of height 'height') is complete, determine
+	// the position of the next sibling using the complete subtree algorithm.
+	stableEnd := proofIndex
+	for {
+		subTreeStartIndex := (proofIndex / (1 << uint(height))) * (1 << uint(height)) // round down to the nearest 1 << height
+		subTreeEndIndex := subTreeStartIndex + (1 << (uint(height))) - 1              // subtract 1 because the start index is inclusive
+		if subTreeEndIndex >= numLeaves {
+			break
+		}
+		stableEnd = subTreeEndIndex
+
+		if len(proofSet) <= height {
+			return false
+		}
+		if proofIndex-subTreeStartIndex < 1<<uint(height-1) {
+			sum = nodeSum512(sum, proofSet[height])
+		} else {
+			sum = nodeSum512(proofSet[height], sum)
+		}
+		height++
+	}
+
+	// Determine if the next hash belongs to an orphan that was elevated.
+	if stableEnd != numLeaves-1 {
+		if len(proofSet) <= height {
+			return false
+		}
+		sum = nodeSum512(sum, proofSet[height])
+		height++
+	}
+
+	// All remaining elements in the proof set will belong to a left sibling.
+	for height < len(proofSet) {
+		sum = nodeSum512(proofSet[height], sum)
+		height++
+	}
+
+	// Compare our calculated Merkle root to the desired Merkle root.
+	return sum == merkleRoot
+}
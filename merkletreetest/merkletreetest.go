@@ -0,0 +1,28 @@
+// Package merkletreetest provides utilities for testing code that uses the
+// merkletree package.
+package merkletreetest
+
+import (
+	"hash"
+	"math/rand"
+
+	"github.com/celestiaorg/merkletree"
+)
+
+// BuildRandomTree generates numLeaves leaves of leafSize random bytes each,
+// returning their leaf hashes along with the root of the resulting tree. The
+// leaves are generated by a PRNG initialized with seed, so the same seed always
+// produces the same tree.
+func BuildRandomTree(seed int64, numLeaves, leafSize int, h hash.Hash) (leafHashes [][]byte, root []byte) {
+	rng := rand.New(rand.NewSource(seed))
+	th := merkletree.NewDefaultHasher(h)
+	s := merkletree.NewStack(h)
+	leaf := make([]byte, leafSize)
+	leafHashes = make([][]byte, numLeaves)
+	for i := range leafHashes {
+		_, _ = rng.Read(leaf)
+		leafHashes[i] = th.HashLeaf(leaf)
+		s.AppendNode(leafHashes[i])
+	}
+	return leafHashes, s.Root()
+}
@@ -0,0 +1,46 @@
+package merkletreetest
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/celestiaorg/merkletree"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestBuildRandomTree tests that BuildRandomTree is deterministic and returns
+// the correct root for the leaf hashes it generates.
+func TestBuildRandomTree(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafHashes, root := BuildRandomTree(1, 100, 64, blake)
+	if len(leafHashes) != 100 {
+		t.Fatalf("expected %v leaf hashes, got %v", 100, len(leafHashes))
+	}
+
+	// the same seed should yield the same tree
+	leafHashes2, root2 := BuildRandomTree(1, 100, 64, blake)
+	if !bytes.Equal(root, root2) || !reflect.DeepEqual(leafHashes, leafHashes2) {
+		t.Fatal("same seed produced different trees")
+	}
+	// a different seed should not
+	if _, root3 := BuildRandomTree(2, 100, 64, blake); bytes.Equal(root, root3) {
+		t.Fatal("different seeds produced the same root")
+	}
+
+	// the root should match a Tree built from the leaf hashes
+	tree := merkletree.New(blake)
+	for _, leafHash := range leafHashes {
+		if err := tree.PushSubTree(0, leafHash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(tree.Root(), root) {
+		t.Fatal("BuildRandomTree returned the wrong root")
+	}
+
+	// an empty tree has no root
+	if leafHashes, root := BuildRandomTree(1, 0, 64, blake); len(leafHashes) != 0 || root != nil {
+		t.Fatal("expected empty tree")
+	}
+}
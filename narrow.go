@@ -0,0 +1,114 @@
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// A proofItem is a node that covers a contiguous, aligned set of leaves: either
+// a proof hash or a known leaf hash.
+type proofItem struct {
+	hash   []byte
+	height uint64
+	isLeaf bool
+}
+
+// itemSubtreeHasher implements SubtreeHasher using a sequence of proofItems.
+// The subtrees requested by NextSubtreeRoot must consist of whole items, and
+// Skip may only skip leaf items.
+type itemSubtreeHasher struct {
+	items []proofItem
+	s     *Stack
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (ish *itemSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if len(ish.items) == 0 {
+		return nil, io.EOF
+	}
+	ish.s.Reset()
+	for n := uint64(0); n < uint64(subtreeSize) && len(ish.items) > 0; {
+		it := ish.items[0]
+		if n+1<<it.height > uint64(subtreeSize) {
+			return nil, errors.New("subtree splits a proof hash")
+		} else if err := ish.s.checkAppend(it.height); err != nil {
+			return nil, err
+		}
+		ish.s.appendNodeAtHeight(it.hash, it.height)
+		ish.items = ish.items[1:]
+		n += 1 << it.height
+	}
+	return ish.s.Root(), nil
+}
+
+// Skip implements SubtreeHasher.
+func (ish *itemSubtreeHasher) Skip(n int) error {
+	if n > len(ish.items) {
+		return io.ErrUnexpectedEOF
+	}
+	for _, it := range ish.items[:n] {
+		if !it.isLeaf {
+			return errors.New("skipped leaves are not known")
+		}
+	}
+	ish.items = ish.items[n:]
+	return nil
+}
+
+// NarrowRangeProof derives the proof for newRanges from a proof for
+// origRanges in a tree of numLeaves leaves, without reading any leaf data.
+// origLeafHashes must contain the hashes of the leaves within origRanges,
+// which serve as the proof hashes for any of those leaves that fall outside
+// newRanges. Every range in newRanges must lie within a range in origRanges.
+// The result is identical to the proof that BuildMultiRangeProof would
+// produce for newRanges.
+func NarrowRangeProof(origRanges []LeafRange, proof [][]byte, origLeafHashes [][]byte, newRanges []LeafRange, numLeaves uint64, h hash.Hash) ([][]byte, error) {
+	if err := ValidateRanges(origRanges, numLeaves); err != nil {
+		return nil, err
+	} else if err := ValidateRanges(newRanges, numLeaves); err != nil {
+		return nil, err
+	}
+	for i, j := 0, 0; i < len(newRanges); i++ {
+		for j < len(origRanges) && origRanges[j].End <= newRanges[i].Start {
+			j++
+		}
+		if j == len(origRanges) || newRanges[i].Start < origRanges[j].Start || newRanges[i].End > origRanges[j].End {
+			return nil, fmt.Errorf("range %v is not within the original ranges", newRanges[i])
+		}
+	}
+	var numKnown uint64
+	for _, r := range origRanges {
+		numKnown += r.End - r.Start
+	}
+	if n := MultiRangeProofSize(origRanges, numLeaves); len(proof) != n {
+		return nil, fmt.Errorf("proof contains %v hashes, expected %v", len(proof), n)
+	} else if uint64(len(origLeafHashes)) != numKnown {
+		return nil, fmt.Errorf("%v leaf hashes supplied, expected %v", len(origLeafHashes), numKnown)
+	}
+
+	// lay out the proof hashes and leaf hashes in leaf order
+	var items []proofItem
+	var leafIndex uint64
+	consumeUntil := func(end uint64) {
+		for leafIndex != end && leafIndex < numLeaves {
+			subtreeSize := nextSubtreeSize(leafIndex, end)
+			items = append(items, proofItem{hash: proof[0], height: uint64(bits.TrailingZeros64(uint64(subtreeSize)))})
+			proof = proof[1:]
+			leafIndex += uint64(subtreeSize)
+		}
+	}
+	for _, r := range origRanges {
+		consumeUntil(r.Start)
+		for ; leafIndex < r.End; leafIndex++ {
+			items = append(items, proofItem{hash: origLeafHashes[0], isLeaf: true})
+			origLeafHashes = origLeafHashes[1:]
+		}
+	}
+	consumeUntil(math.MaxUint64)
+
+	return BuildMultiRangeProof(newRanges, &itemSubtreeHasher{items: items, s: NewStack(h)})
+}
@@ -0,0 +1,103 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestNarrowRangeProof tests that NarrowRangeProof produces the same proofs as
+// BuildMultiRangeProof for ranges within the original ranges.
+func TestNarrowRangeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+	buildProof := func(ranges []LeafRange) [][]byte {
+		proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	hashesWithin := func(ranges []LeafRange) [][]byte {
+		var hashes [][]byte
+		for _, r := range ranges {
+			hashes = append(hashes, leafHashes[r.Start:r.End]...)
+		}
+		return hashes
+	}
+
+	tests := []struct {
+		orig, narrow []LeafRange
+	}{
+		{[]LeafRange{{10, 50}}, []LeafRange{{20, 30}}},
+		{[]LeafRange{{10, 50}}, []LeafRange{{10, 50}}},
+		{[]LeafRange{{10, 50}}, []LeafRange{{10, 11}, {49, 50}}},
+		{[]LeafRange{{0, numLeaves}}, []LeafRange{{63, 65}}},
+		{[]LeafRange{{0, numLeaves}}, []LeafRange{{numLeaves - 1, numLeaves}}},
+		{[]LeafRange{{3, 9}, {40, 90}}, []LeafRange{{5, 6}, {64, 80}}},
+		{[]LeafRange{{3, 9}, {40, 90}}, []LeafRange{{41, 42}}},
+		{[]LeafRange{{90, numLeaves}}, []LeafRange{{95, 97}}},
+	}
+	for _, test := range tests {
+		proof := buildProof(test.orig)
+		narrowed, err := NarrowRangeProof(test.orig, proof, hashesWithin(test.orig), test.narrow, numLeaves, blake)
+		if err != nil {
+			t.Fatalf("%v -> %v: %v", test.orig, test.narrow, err)
+		} else if exp := buildProof(test.narrow); !ProofsEqual(narrowed, exp) {
+			t.Fatalf("%v -> %v: %v", test.orig, test.narrow, ProofEqualityReport(narrowed, exp))
+		}
+		if ok, err := VerifyMultiRangeProof(NewCachedLeafHasher(hashesWithin(test.narrow)), blake, test.narrow, narrowed, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("%v -> %v: failed to verify narrowed proof", test.orig, test.narrow)
+		}
+	}
+
+	// narrow random ranges to random subranges
+	for i := 0; i < 100; i++ {
+		var orig, narrow []LeafRange
+		for start := uint64(fastrand.Intn(10)); start < numLeaves; start += uint64(1 + fastrand.Intn(20)) {
+			end := start + uint64(1+fastrand.Intn(30))
+			if end > numLeaves {
+				end = numLeaves
+			}
+			orig = append(orig, LeafRange{start, end})
+			if fastrand.Intn(2) == 0 {
+				s := start + uint64(fastrand.Intn(int(end-start)))
+				narrow = append(narrow, LeafRange{s, s + 1 + uint64(fastrand.Intn(int(end-s)))})
+			}
+			start = end
+		}
+		narrowed, err := NarrowRangeProof(orig, buildProof(orig), hashesWithin(orig), narrow, numLeaves, blake)
+		if err != nil {
+			t.Fatalf("%v -> %v: %v", orig, narrow, err)
+		} else if exp := buildProof(narrow); !ProofsEqual(narrowed, exp) {
+			t.Fatalf("%v -> %v: %v", orig, narrow, ProofEqualityReport(narrowed, exp))
+		}
+	}
+
+	// ranges outside the original ranges, or malformed inputs, are rejected
+	orig := []LeafRange{{10, 50}}
+	proof := buildProof(orig)
+	known := hashesWithin(orig)
+	for _, narrow := range [][]LeafRange{{{5, 20}}, {{45, 55}}, {{60, 61}}} {
+		if _, err := NarrowRangeProof(orig, proof, known, narrow, numLeaves, blake); err == nil {
+			t.Fatalf("expected error narrowing %v to %v", orig, narrow)
+		}
+	}
+	if _, err := NarrowRangeProof(orig, proof[1:], known, []LeafRange{{20, 30}}, numLeaves, blake); err == nil {
+		t.Fatal("expected error for a short proof")
+	} else if _, err := NarrowRangeProof(orig, proof, known[1:], []LeafRange{{20, 30}}, numLeaves, blake); err == nil {
+		t.Fatal("expected error for missing leaf hashes")
+	}
+}
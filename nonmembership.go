@@ -0,0 +1,43 @@
+package merkletree
+
+import (
+	"errors"
+	"hash"
+)
+
+// BuildNonMembershipProof constructs a proof for the adjacent leaves at
+// leftIndex and leftIndex+1 using the provided SubtreeHasher. If the leaves of
+// the tree are sorted keys, such a proof demonstrates that no key between the
+// two leaves is present in the tree; see VerifyNonMembership. h must be the
+// hash function used by sh; BuildNonMembershipProof returns
+// ErrHashSizeMismatch if sh produces hashes of a different size.
+func BuildNonMembershipProof(sh SubtreeHasher, leftIndex int, h hash.Hash) ([][]byte, error) {
+	if leftIndex < 0 || leftIndex > maxInt-2 {
+		return nil, errors.New("BuildNonMembershipProof: leaf index out of range")
+	}
+	proof, err := BuildRangeProof(leftIndex, leftIndex+2, sh)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range proof {
+		if len(p) != h.Size() {
+			return nil, ErrHashSizeMismatch
+		}
+	}
+	return proof, nil
+}
+
+// VerifyNonMembership verifies a proof produced by BuildNonMembershipProof,
+// demonstrating that key is not present in a tree whose leaves are sorted
+// according to less. left and right are the leaves at leftIndex and
+// leftIndex+1, which must bracket key, i.e. less(left, key) and less(key,
+// right) must both hold. Keys that sort before the first leaf or after the
+// last leaf cannot be proven absent in this way.
+func VerifyNonMembership(key, left, right []byte, less func(a, b []byte) bool, h hash.Hash, leftIndex int, proof [][]byte, root []byte) (bool, error) {
+	if leftIndex < 0 || leftIndex > maxInt-2 {
+		return false, errors.New("VerifyNonMembership: leaf index out of range")
+	} else if !less(left, key) || !less(key, right) {
+		return false, nil
+	}
+	return VerifyRangeProof(NewSliceLeafHasher([][]byte{left, right}, h), h, leftIndex, leftIndex+2, proof, root)
+}
@@ -0,0 +1,86 @@
+package merkletree
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestNonMembership tests that BuildNonMembershipProof and
+// VerifyNonMembership can prove the absence of keys from a tree of sorted
+// integers.
+func TestNonMembership(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	key := func(n uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		return b
+	}
+	less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+
+	// leaves are the even numbers 0, 2, ..., 198
+	const numLeaves = 100
+	th := NewDefaultHasher(blake)
+	leaves := make([][]byte, numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leaves {
+		leaves[i] = key(uint64(2 * i))
+		leafHashes[i] = th.HashLeaf(leaves[i])
+	}
+	root := recNodeRoot(leafHashes, blake)
+
+	for leftIndex := 0; leftIndex < numLeaves-1; leftIndex++ {
+		proof, err := BuildNonMembershipProof(NewCachedSubtreeHasher(leafHashes, blake), leftIndex, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		left, right := leaves[leftIndex], leaves[leftIndex+1]
+
+		// the odd number between the two leaves is absent
+		absent := key(uint64(2*leftIndex + 1))
+		if ok, err := VerifyNonMembership(absent, left, right, less, blake, leftIndex, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to prove absence of %v", 2*leftIndex+1)
+		}
+
+		// a present key is not bracketed by its neighbors
+		if ok, _ := VerifyNonMembership(left, left, right, less, blake, leftIndex, proof, root); ok {
+			t.Fatalf("proved absence of present key %v", 2*leftIndex)
+		}
+		if leftIndex == 0 {
+			continue
+		}
+		// leaves that are not in the tree should be rejected
+		if ok, _ := VerifyNonMembership(absent, key(uint64(2*leftIndex-1)), right, less, blake, leftIndex, proof, root); ok {
+			t.Fatal("accepted a left neighbor that is not in the tree")
+		}
+		// as should leaves at a different position
+		if ok, _ := VerifyNonMembership(absent, left, right, less, blake, leftIndex-1, proof, root); ok {
+			t.Fatal("accepted neighbors at the wrong index")
+		}
+	}
+
+	// there is no right neighbor for the last leaf
+	if _, err := BuildNonMembershipProof(NewCachedSubtreeHasher(leafHashes, blake), numLeaves-1, blake); err == nil {
+		t.Error("expected error when proving past the end of the tree")
+	}
+
+	// indices whose right neighbor would overflow should be rejected
+	for _, leftIndex := range []int{-1, maxInt - 1, maxInt} {
+		if _, err := BuildNonMembershipProof(NewCachedSubtreeHasher(leafHashes, blake), leftIndex, blake); err == nil {
+			t.Errorf("expected error for leaf index %v", leftIndex)
+		}
+		if ok, err := VerifyNonMembership(key(1), leaves[0], leaves[1], less, blake, leftIndex, nil, root); err == nil || ok {
+			t.Errorf("expected error for leaf index %v", leftIndex)
+		}
+	}
+
+	// a hash function that does not match sh should be detected
+	if _, err := BuildNonMembershipProof(NewCachedSubtreeHasher(leafHashes, blake), 0, sha512.New()); err != ErrHashSizeMismatch {
+		t.Errorf("expected %v, got %v", ErrHashSizeMismatch, err)
+	}
+}
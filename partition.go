@@ -0,0 +1,160 @@
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"math/bits"
+)
+
+// A ProofPartition is the portion of a multi-range proof that lies beneath a
+// single subtree root. Partitions can be verified independently, e.g. on
+// separate goroutines, and their roots combined with CombinePartitionRoots.
+type ProofPartition struct {
+	// Subtree is the set of leaves beneath the partition's root.
+	Subtree LeafRange
+	// Ranges are the proof ranges within the subtree, relative to
+	// Subtree.Start. If Ranges is empty, the subtree contains no proof ranges
+	// and Proof contains a single hash: the root of the subtree.
+	Ranges []LeafRange
+	// Proof contains the proof hashes within the subtree.
+	Proof [][]byte
+}
+
+// PartitionProof splits a proof produced by BuildMultiRangeProof for a tree of
+// numLeaves leaves into partitions. Each partition that contains proof ranges
+// covers an aligned subtree of 1<<partitionHeight leaves (or fewer, at the end
+// of the tree). The remaining partitions consist of a single proof hash
+// covering 1<<partitionHeight leaves or more. The partitions are returned in
+// order and together cover the entire tree.
+func PartitionProof(ranges []LeafRange, proof [][]byte, numLeaves uint64, partitionHeight int) ([]ProofPartition, error) {
+	if len(ranges) == 0 {
+		return nil, errors.New("no proof ranges")
+	} else if !validRangeSet(ranges) {
+		return nil, errors.New("illegal set of proof ranges")
+	} else if ranges[len(ranges)-1].End > numLeaves {
+		return nil, fmt.Errorf("proof range %v extends beyond tree of %v leaves", ranges[len(ranges)-1], numLeaves)
+	} else if partitionHeight < 0 || partitionHeight >= 64 {
+		return nil, fmt.Errorf("invalid partition height %v", partitionHeight)
+	}
+	partitionSize := uint64(1) << uint(partitionHeight)
+	min := func(a, b uint64) uint64 {
+		if a < b {
+			return a
+		}
+		return b
+	}
+
+	var partitions []ProofPartition
+	// partitionFor returns the partition for the aligned subtree containing
+	// leafIndex, creating it if necessary.
+	partitionFor := func(leafIndex uint64) *ProofPartition {
+		start := leafIndex &^ (partitionSize - 1)
+		if len(partitions) == 0 || partitions[len(partitions)-1].Subtree.Start != start {
+			partitions = append(partitions, ProofPartition{
+				Subtree: LeafRange{start, min(start+partitionSize, numLeaves)},
+			})
+		}
+		return &partitions[len(partitions)-1]
+	}
+
+	var leafIndex uint64
+	consumeUntil := func(end uint64) error {
+		for leafIndex != end && leafIndex < numLeaves {
+			if len(proof) == 0 {
+				return errors.New("proof is too short")
+			}
+			subtreeSize := uint64(nextSubtreeSize(leafIndex, end))
+			if subtreeSize >= partitionSize {
+				partitions = append(partitions, ProofPartition{
+					Subtree: LeafRange{leafIndex, min(leafIndex+subtreeSize, numLeaves)},
+					Proof:   proof[:1:1],
+				})
+			} else {
+				p := partitionFor(leafIndex)
+				p.Proof = append(p.Proof, proof[0])
+			}
+			proof = proof[1:]
+			leafIndex += subtreeSize
+		}
+		return nil
+	}
+
+	for _, r := range ranges {
+		if err := consumeUntil(r.Start); err != nil {
+			return nil, err
+		}
+		// split the range at partition boundaries
+		for leafIndex != r.End {
+			p := partitionFor(leafIndex)
+			end := min(r.End, p.Subtree.End)
+			p.Ranges = append(p.Ranges, LeafRange{leafIndex - p.Subtree.Start, end - p.Subtree.Start})
+			leafIndex = end
+		}
+	}
+	if err := consumeUntil(math.MaxUint64); err != nil {
+		return nil, err
+	} else if len(proof) != 0 {
+		return nil, errors.New("proof is too long")
+	}
+	return partitions, nil
+}
+
+// PartitionRoot reconstructs the root of the subtree covered by p using the
+// leaf hashes produced by lh, which must contain the concatenation of the leaf
+// hashes within p's ranges.
+func PartitionRoot(p ProofPartition, lh LeafHasher, h hash.Hash) ([]byte, error) {
+	if len(p.Ranges) == 0 {
+		if len(p.Proof) != 1 {
+			return nil, errors.New("partition without ranges must contain exactly one proof hash")
+		}
+		return p.Proof[0], nil
+	}
+	if !validRangeSet(p.Ranges) {
+		return nil, errors.New("illegal set of proof ranges")
+	}
+	return reconstructRangeRoot(lh, h, p.Ranges, p.Proof)
+}
+
+// CombinePartitionRoots combines the roots of a set of partitions produced by
+// PartitionProof, as computed by PartitionRoot, into the root of the tree.
+func CombinePartitionRoots(partitions []ProofPartition, roots [][]byte, h hash.Hash) ([]byte, error) {
+	if len(partitions) == 0 {
+		return nil, errors.New("no partitions")
+	} else if len(roots) != len(partitions) {
+		return nil, fmt.Errorf("%v roots supplied for %v partitions", len(roots), len(partitions))
+	}
+	nh := NewDefaultHasher(h)
+
+	// The root of leaves [start,end) is formed by splitting them at the
+	// largest power of two smaller than end-start. Since every partition is a
+	// subtree of the tree, such a split always falls between two partitions.
+	var combine func(partitions []ProofPartition, roots [][]byte, start, end uint64) ([]byte, error)
+	combine = func(partitions []ProofPartition, roots [][]byte, start, end uint64) ([]byte, error) {
+		if len(partitions) == 1 {
+			if partitions[0].Subtree != (LeafRange{start, end}) {
+				return nil, fmt.Errorf("partition %v does not cover leaves [%v,%v)", partitions[0].Subtree, start, end)
+			}
+			return roots[0], nil
+		} else if end-start < 2 {
+			return nil, fmt.Errorf("too many partitions cover leaves [%v,%v)", start, end)
+		}
+		mid := start + uint64(1)<<uint(bits.Len64(end-start-1)-1)
+		for i := 1; i < len(partitions); i++ {
+			if partitions[i].Subtree.Start == mid {
+				left, err := combine(partitions[:i], roots[:i], start, mid)
+				if err != nil {
+					return nil, err
+				}
+				right, err := combine(partitions[i:], roots[i:], mid, end)
+				if err != nil {
+					return nil, err
+				}
+				return nh.HashNode(left, right), nil
+			}
+		}
+		return nil, fmt.Errorf("no partition begins at leaf %v", mid)
+	}
+	return combine(partitions, roots, 0, partitions[len(partitions)-1].Subtree.End)
+}
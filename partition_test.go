@@ -0,0 +1,119 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// partitionLeafHasher returns a LeafHasher for the leaves within the ranges of
+// p, given the leaf hashes of the whole tree.
+func partitionLeafHasher(p ProofPartition, leafHashes [][]byte) LeafHasher {
+	var hashes [][]byte
+	for _, r := range p.Ranges {
+		hashes = append(hashes, leafHashes[p.Subtree.Start+r.Start:p.Subtree.Start+r.End]...)
+	}
+	return NewCachedLeafHasher(hashes)
+}
+
+// TestPartitionProof tests that the roots of the partitions produced by
+// PartitionProof can be computed independently and combined into the root of
+// the tree.
+func TestPartitionProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+
+	// the known fixture from TestBuildVerifyMultiRangeProof
+	const dataSize = 1 << 22
+	const leafSize = 64
+	const numLeaves = dataSize / leafSize
+	leafData := make([]byte, dataSize)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+	ranges := []LeafRange{{0, 1}, {numLeaves - 1, numLeaves}}
+	proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, height := range []int{0, 4, 10, 16} {
+		partitions, err := PartitionProof(ranges, proof, numLeaves, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// compute the partition roots in parallel
+		roots := make([][]byte, len(partitions))
+		errs := make(chan error, len(partitions))
+		for i := range partitions {
+			go func(i int) {
+				var err error
+				roots[i], err = PartitionRoot(partitions[i], partitionLeafHasher(partitions[i], leafHashes), blake)
+				errs <- err
+			}(i)
+		}
+		for range partitions {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		root, err := CombinePartitionRoots(partitions, roots, blake)
+		if err != nil {
+			t.Fatal(err)
+		} else if hex.EncodeToString(root) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
+			t.Errorf("height %v: partition roots combined to an incorrect root", height)
+		}
+	}
+
+	// random data, including trees whose size is not a power of two
+	for _, n := range []uint64{1, 7, 64, 100} {
+		leafData := fastrand.Bytes(int(n) * leafSize)
+		root := bytesRoot(leafData, blake, leafSize)
+		leafHashes := make([][]byte, n)
+		for i := range leafHashes {
+			leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+		}
+		for _, ranges := range [][]LeafRange{
+			{{0, 1}},
+			{{n - 1, n}},
+			{{0, n}},
+			{{n / 3, n/2 + 1}, {n - 1, n}},
+		} {
+			if !validRangeSet(ranges) {
+				continue
+			}
+			proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for height := 0; height < 8; height++ {
+				partitions, err := PartitionProof(ranges, proof, n, height)
+				if err != nil {
+					t.Fatal(err)
+				}
+				roots := make([][]byte, len(partitions))
+				for i, p := range partitions {
+					if roots[i], err = PartitionRoot(p, partitionLeafHasher(p, leafHashes), blake); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if combined, err := CombinePartitionRoots(partitions, roots, blake); err != nil {
+					t.Fatal(err)
+				} else if !bytes.Equal(combined, root) {
+					t.Errorf("%v leaves, ranges %v, height %v: partition roots combined to an incorrect root", n, ranges, height)
+				}
+			}
+		}
+	}
+
+	// malformed proofs should be rejected
+	if _, err := PartitionProof(ranges, proof[1:], numLeaves, 4); err == nil {
+		t.Error("PartitionProof accepted a proof that is too short")
+	}
+	if _, err := PartitionProof(ranges, append(proof[:len(proof):len(proof)], proof[0]), numLeaves, 4); err == nil {
+		t.Error("PartitionProof accepted a proof that is too long")
+	}
+}
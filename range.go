@@ -2,11 +2,14 @@ package merkletree
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/bits"
+	"sort"
 )
 
 // A LeafRange represents the contiguous set of leaves [Start,End).
@@ -26,17 +29,84 @@ func nextSubtreeSize(start, end uint64) int {
 	return 1 << uint(ideal)
 }
 
-// validRangeSet checks whether a set of ranges is sorted and non-overlapping.
-func validRangeSet(ranges []LeafRange) bool {
+// ErrSubtreeTooLarge is returned when a set of proof ranges would require a
+// SubtreeHasher to hash or skip a subtree whose size does not fit in an int.
+// This only happens for ranges that extend far beyond any real tree, e.g.
+// ranges near 2^64 leaves.
+var ErrSubtreeTooLarge = errors.New("proof ranges require a subtree that is too large to hash")
+
+// checkedSubtreeSize is like nextSubtreeSize, but returns ErrSubtreeTooLarge
+// rather than a size that overflows an int.
+func checkedSubtreeSize(start, end uint64) (int, error) {
+	size := nextSubtreeSize(start, end)
+	if size <= 0 {
+		return 0, ErrSubtreeTooLarge
+	}
+	return size, nil
+}
+
+// maxInt is the largest value of an int.
+const maxInt = int(^uint(0) >> 1)
+
+// intRange converts the leaf range [start, end), specified as ints, to a
+// LeafRange. It reports false if the range is empty or starts at a negative
+// index, so that a negative int is never converted to a huge uint64.
+func intRange(start, end int) (LeafRange, bool) {
+	if start < 0 || end <= start {
+		return LeafRange{}, false
+	}
+	return LeafRange{uint64(start), uint64(end)}, true
+}
+
+// Errors returned by ValidateRanges.
+var (
+	ErrRangeUnsorted    = errors.New("proof ranges are not sorted")
+	ErrRangeOverlap     = errors.New("proof ranges overlap")
+	ErrRangeEmpty       = errors.New("proof range is empty")
+	ErrRangeOutOfBounds = errors.New("proof range extends beyond the tree")
+)
+
+// ValidateRanges checks whether ranges is a legal set of proof ranges for a
+// tree of numLeaves leaves, i.e. whether the ranges are non-empty, sorted,
+// non-overlapping, and within the tree. The returned error wraps one of
+// ErrRangeUnsorted, ErrRangeOverlap, ErrRangeEmpty, or ErrRangeOutOfBounds.
+func ValidateRanges(ranges []LeafRange, numLeaves uint64) error {
 	for i, r := range ranges {
-		if r.Start < 0 || r.Start >= r.End {
-			return false
-		}
-		if i > 0 && ranges[i-1].End > r.Start {
-			return false
+		if r.Start >= r.End {
+			return fmt.Errorf("range %v %v: %w", i, r, ErrRangeEmpty)
+		} else if r.End > numLeaves {
+			return fmt.Errorf("range %v %v in tree of %v leaves: %w", i, r, numLeaves, ErrRangeOutOfBounds)
+		} else if i > 0 && r.Start < ranges[i-1].Start {
+			return fmt.Errorf("range %v %v precedes %v: %w", i, r, ranges[i-1], ErrRangeUnsorted)
+		} else if i > 0 && r.Start < ranges[i-1].End {
+			return fmt.Errorf("range %v %v overlaps %v: %w", i, r, ranges[i-1], ErrRangeOverlap)
 		}
 	}
-	return true
+	return nil
+}
+
+// validRangeSet checks whether a set of ranges is sorted and non-overlapping.
+func validRangeSet(ranges []LeafRange) bool {
+	return ValidateRanges(ranges, math.MaxUint64) == nil
+}
+
+// StrictPanics controls how BuildMultiRangeProof, BuildRangeProof, and
+// CompressLeafHashes handle an illegal set of proof ranges. If StrictPanics is
+// true (the default), they panic, since such ranges indicate a bug in the
+// caller. Otherwise, they return ErrInvalidRangeSet.
+var StrictPanics = true
+
+// ErrInvalidRangeSet is returned when StrictPanics is false and a set of
+// proof ranges is unsorted, overlapping, or contains an empty range.
+var ErrInvalidRangeSet = errors.New("illegal set of proof ranges")
+
+// invalidRangeSet panics with msg if StrictPanics is set, and otherwise
+// returns ErrInvalidRangeSet.
+func invalidRangeSet(msg string) error {
+	if StrictPanics {
+		panic(msg)
+	}
+	return ErrInvalidRangeSet
 }
 
 // A SubtreeHasher calculates subtree roots in sequential order, for use with
@@ -52,23 +122,96 @@ type SubtreeHasher interface {
 	Skip(n int) error
 }
 
+// A Closer is a SubtreeHasher that holds resources, such as an open file or
+// network connection, that can be released once it is no longer needed. If
+// the SubtreeHasher passed to a function that builds a proof or compresses
+// leaf hashes, such as BuildMultiRangeProof, BuildRangeProof,
+// BuildMultiRangeProofAnnotated, BuildDiffProof, or CompressLeafHashes,
+// implements Closer and CloseOnFinish returns true, it is closed before the
+// function returns, even if the function fails. SubtreeHashers that wrap
+// other SubtreeHashers, such as FallbackSubtreeHasher, do not implement
+// Closer; the wrapped SubtreeHashers must be closed by the caller.
+type Closer interface {
+	io.Closer
+	// CloseOnFinish reports whether the SubtreeHasher should be closed once
+	// a proof has been built.
+	CloseOnFinish() bool
+}
+
+// closeOnFinish closes h if it implements Closer and CloseOnFinish returns
+// true. It returns err, or the error returned by Close if err is nil.
+func closeOnFinish(h SubtreeHasher, err error) error {
+	if c, ok := h.(Closer); ok && c.CloseOnFinish() {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			return cerr
+		}
+	}
+	return err
+}
+
 // ReaderSubtreeHasher implements SubtreeHasher by reading leaf data from an
 // underlying stream.
 type ReaderSubtreeHasher struct {
-	r    io.Reader
-	h    hash.Hash
-	leaf []byte
+	r        io.Reader
+	h        hash.Hash
+	leafSize int
+	leaf     []byte
+	// chunk is non-nil if leaves are hashed incrementally, one chunk at a
+	// time, in which case leaf is nil.
+	chunk []byte
+	// stack is reused across calls to NextSubtreeRoot to avoid allocating a
+	// new Tree for every subtree.
+	stack *Stack
+	// If expectLeaves is set, the stream must contain at least expected
+	// leaves; leafIndex is the number of leaves consumed so far.
+	expectLeaves bool
+	expected     uint64
+	leafIndex    uint64
+	// closeOnFinish is returned by CloseOnFinish.
+	closeOnFinish bool
+	// If newBuilder is set, it is used in place of stack.
+	newBuilder func() RootBuilder
 }
 
+// ErrShortStream is returned by a ReaderSubtreeHasher created with
+// NewReaderSubtreeHasherExpecting if the stream ends before the expected
+// number of leaves have been read.
+var ErrShortStream = errors.New("stream ended before the expected number of leaves")
+
 // NextSubtreeRoot implements SubtreeHasher.
 func (rsh *ReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
-	tree := New(rsh.h)
+	var tree RootBuilder = rsh.stack
+	if rsh.newBuilder != nil {
+		tree = rsh.newBuilder()
+	} else {
+		rsh.stack.Reset()
+	}
 	for i := 0; i < subtreeSize; i++ {
-		n, err := io.ReadFull(rsh.r, rsh.leaf)
+		var n int
+		var err error
+		if rsh.chunk != nil {
+			var leafHash []byte
+			leafHash, n, err = rsh.hashLeafStreaming()
+			if n > 0 {
+				tree.AppendNode(leafHash)
+			}
+		} else {
+			n, err = io.ReadFull(rsh.r, rsh.leaf)
+			if n > 0 {
+				tree.AppendNode(rsh.stack.treeHasher.HashLeaf(rsh.leaf[:n]))
+			}
+		}
 		if n > 0 {
-			tree.Push(rsh.leaf[:n])
+			rsh.leafIndex++
+		} else if err == nil {
+			// a zero-length read without an error would otherwise produce
+			// an endless sequence of empty leaves
+			return nil, io.ErrNoProgress
 		}
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if rsh.expectLeaves && rsh.leafIndex < rsh.expected {
+				return nil, ErrShortStream
+			}
 			break // reading a partial leaf is normal at the end of the stream
 		} else if err != nil {
 			return nil, err
@@ -83,25 +226,146 @@ func (rsh *ReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error)
 	return root, nil
 }
 
+// SetRootBuilder causes rsh to compute each subtree root using a RootBuilder
+// returned by newBuilder, which must return a new, empty RootBuilder each time
+// it is called. Leaves are still hashed by rsh. By default, a single Stack is
+// reused for every subtree.
+func (rsh *ReaderSubtreeHasher) SetRootBuilder(newBuilder func() RootBuilder) {
+	rsh.newBuilder = newBuilder
+}
+
+// hashLeafStreaming reads the next leaf from the underlying stream one chunk at
+// a time, feeding each chunk into the hash as it arrives. It returns the leaf
+// hash, the number of bytes read, and an error with the same semantics as
+// io.ReadFull.
+func (rsh *ReaderSubtreeHasher) hashLeafStreaming() ([]byte, int, error) {
+	rsh.h.Reset()
+	_, _ = rsh.h.Write(leafHashPrefix)
+	var n int
+	for n < rsh.leafSize {
+		chunk := rsh.chunk
+		if rem := rsh.leafSize - n; rem < len(chunk) {
+			chunk = chunk[:rem]
+		}
+		read, err := io.ReadFull(rsh.r, chunk)
+		_, _ = rsh.h.Write(chunk[:read])
+		n += read
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return rsh.h.Sum(nil), n, err
+		}
+	}
+	return rsh.h.Sum(nil), n, nil
+}
+
 // Skip implements SubtreeHasher.
 func (rsh *ReaderSubtreeHasher) Skip(n int) (err error) {
-	skipSize := int64(len(rsh.leaf) * n)
+	// if the size overflows, skip as much as possible; no stream is that long
+	skipSize := int64(math.MaxInt64)
+	if int64(n) <= math.MaxInt64/int64(rsh.leafSize) {
+		skipSize = int64(rsh.leafSize) * int64(n)
+	}
 	skipped, err := io.CopyN(ioutil.Discard, rsh.r, skipSize)
+	want := rsh.leafIndex + uint64(n)
+	rsh.leafIndex += uint64((skipped + int64(rsh.leafSize) - 1) / int64(rsh.leafSize))
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		if skipped == skipSize {
 			return nil
 		}
+		if rsh.expectLeaves && rsh.leafIndex < rsh.expected && rsh.leafIndex < want {
+			return ErrShortStream
+		} else if rsh.leafIndex == want {
+			// the final leaf was short, which is normal at the end of the
+			// stream; NextSubtreeRoot treats it the same way
+			return nil
+		}
 		return io.ErrUnexpectedEOF
 	}
 	return err
 }
 
+// Close implements io.Closer. If the underlying stream implements io.Closer,
+// Close closes it; otherwise, Close does nothing.
+func (rsh *ReaderSubtreeHasher) Close() error {
+	if c, ok := rsh.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CloseOnFinish implements Closer.
+func (rsh *ReaderSubtreeHasher) CloseOnFinish() bool {
+	return rsh.closeOnFinish
+}
+
+// SetCloseOnFinish controls whether the functions that build proofs from the
+// ReaderSubtreeHasher, such as BuildMultiRangeProof and BuildRangeProof, close
+// it, and thus its underlying stream, once they have finished with it; see
+// Closer. By default, they do not.
+func (rsh *ReaderSubtreeHasher) SetCloseOnFinish(enabled bool) {
+	rsh.closeOnFinish = enabled
+}
+
 // NewReaderSubtreeHasher returns a new ReaderSubtreeHasher that reads leaf data from r.
 func NewReaderSubtreeHasher(r io.Reader, leafSize int, h hash.Hash) *ReaderSubtreeHasher {
+	if leafSize <= 0 {
+		panic("NewReaderSubtreeHasher: leafSize must be positive")
+	}
 	return &ReaderSubtreeHasher{
-		r:    r,
-		h:    h,
-		leaf: make([]byte, leafSize),
+		r:        r,
+		h:        h,
+		leafSize: leafSize,
+		leaf:     make([]byte, leafSize),
+		stack:    NewStack(h),
+	}
+}
+
+// NewReaderSubtreeHasherExpecting returns a new ReaderSubtreeHasher that reads
+// leaf data from r, which must contain at least expectedLeaves leaves. If the
+// stream ends early, e.g. because an upload was truncated, ErrShortStream is
+// returned rather than silently hashing a smaller tree. Since the number of
+// leaves is known, the final leaf may also be skipped even if it is short.
+func NewReaderSubtreeHasherExpecting(r io.Reader, leafSize int, expectedLeaves uint64, h hash.Hash) *ReaderSubtreeHasher {
+	rsh := NewReaderSubtreeHasher(r, leafSize, h)
+	rsh.expectLeaves = true
+	rsh.expected = expectedLeaves
+	return rsh
+}
+
+// NewSaltedReaderSubtreeHasher returns a new ReaderSubtreeHasher that reads
+// leaf data from r, writing salt into the hash before each leaf. This
+// separates trees over identical data that belong to different contexts,
+// e.g. different files, preventing a proof for one from being replayed
+// against the other. Proofs must be verified using a LeafHasher with the same
+// salt, such as one returned by NewSaltedReaderLeafHasher.
+func NewSaltedReaderSubtreeHasher(r io.Reader, salt []byte, leafSize int, h hash.Hash) *ReaderSubtreeHasher {
+	rsh := NewReaderSubtreeHasher(r, leafSize, h)
+	rsh.stack.treeHasher = NewSaltedHasher(h, salt)
+	return rsh
+}
+
+// NewStreamingReaderSubtreeHasher returns a new ReaderSubtreeHasher that reads
+// leaf data from r, hashing each leaf incrementally in chunks of chunkSize
+// bytes rather than reading the whole leaf into memory first. This reduces
+// peak memory usage when leaves are very large. The resulting roots are
+// identical to those of NewReaderSubtreeHasher.
+func NewStreamingReaderSubtreeHasher(r io.Reader, leafSize int, chunkSize int, h hash.Hash) *ReaderSubtreeHasher {
+	if leafSize <= 0 {
+		panic("NewStreamingReaderSubtreeHasher: leafSize must be positive")
+	} else if chunkSize <= 0 {
+		panic("NewStreamingReaderSubtreeHasher: chunkSize must be positive")
+	}
+	if chunkSize > leafSize {
+		chunkSize = leafSize
+	}
+	return &ReaderSubtreeHasher{
+		r:        r,
+		h:        h,
+		leafSize: leafSize,
+		chunk:    make([]byte, chunkSize),
+		stack:    NewStack(h),
 	}
 }
 
@@ -110,6 +374,11 @@ func NewReaderSubtreeHasher(r io.Reader, leafSize int, h hash.Hash) *ReaderSubtr
 type CachedSubtreeHasher struct {
 	leafHashes [][]byte
 	h          hash.Hash
+	// stack is reused across calls to NextSubtreeRoot to avoid allocating a
+	// new Tree for every subtree.
+	stack *Stack
+	// If newBuilder is set, it is used in place of stack.
+	newBuilder func() RootBuilder
 }
 
 // NextSubtreeRoot implements SubtreeHasher.
@@ -117,11 +386,14 @@ func (csh *CachedSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error)
 	if len(csh.leafHashes) == 0 {
 		return nil, io.EOF
 	}
-	tree := New(csh.h)
+	var tree RootBuilder = csh.stack
+	if csh.newBuilder != nil {
+		tree = csh.newBuilder()
+	} else {
+		csh.stack.Reset()
+	}
 	for i := 0; i < subtreeSize && len(csh.leafHashes) > 0; i++ {
-		if err := tree.PushSubTree(0, csh.leafHashes[0]); err != nil {
-			return nil, err
-		}
+		tree.AppendNode(csh.leafHashes[0])
 		csh.leafHashes = csh.leafHashes[1:]
 	}
 	return tree.Root(), nil
@@ -129,19 +401,27 @@ func (csh *CachedSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error)
 
 // Skip implements SubtreeHasher.
 func (csh *CachedSubtreeHasher) Skip(n int) error {
-	if n > len(csh.leafHashes) {
+	if n < 0 || n > len(csh.leafHashes) {
 		return io.ErrUnexpectedEOF
 	}
 	csh.leafHashes = csh.leafHashes[n:]
 	return nil
 }
 
+// SetRootBuilder causes csh to compute each subtree root using a RootBuilder
+// returned by newBuilder, which must return a new, empty RootBuilder each time
+// it is called. By default, a single Stack is reused for every subtree.
+func (csh *CachedSubtreeHasher) SetRootBuilder(newBuilder func() RootBuilder) {
+	csh.newBuilder = newBuilder
+}
+
 // NewCachedSubtreeHasher creates a CachedSubtreeHasher using the specified
 // leaf hashes and hash function.
 func NewCachedSubtreeHasher(leafHashes [][]byte, h hash.Hash) *CachedSubtreeHasher {
 	return &CachedSubtreeHasher{
 		leafHashes: leafHashes,
 		h:          h,
+		stack:      NewStack(h),
 	}
 }
 
@@ -160,6 +440,9 @@ type MixedSubtreeHasher struct {
 // as soon as NextSubtreeRoot or Skip are called with a size greater than or
 // equal to leavesPerNode.
 func NewMixedSubtreeHasher(nodeHashes [][]byte, leafReader io.Reader, leavesPerNode int, leafSize int, h hash.Hash) *MixedSubtreeHasher {
+	if leafSize <= 0 {
+		panic("NewMixedSubtreeHasher: leafSize must be positive")
+	}
 	return &MixedSubtreeHasher{
 		csh:           NewCachedSubtreeHasher(nodeHashes, h),
 		rsh:           NewReaderSubtreeHasher(leafReader, leafSize, h),
@@ -184,14 +467,41 @@ func (msh *MixedSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error)
 	return msh.rsh.NextSubtreeRoot(subtreeSize)
 }
 
+// SubtreeRoots reads leaf data from r and returns the Merkle root of each
+// consecutive group of leavesPerNode leaves. The final group, and the final
+// leaf within it, may be short. The roots are suitable for use as the
+// nodeHashes of a MixedSubtreeHasher.
+func SubtreeRoots(r io.Reader, leafSize, leavesPerNode int, h hash.Hash) ([][]byte, error) {
+	if leavesPerNode <= 0 {
+		return nil, errors.New("SubtreeRoots: leavesPerNode must be positive")
+	}
+	rsh := NewReaderSubtreeHasher(r, leafSize, h)
+	var roots [][]byte
+	for {
+		root, err := rsh.NextSubtreeRoot(leavesPerNode)
+		if err == io.EOF {
+			return roots, nil
+		} else if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+}
+
 // BuildMultiRangeProof constructs a proof for the specified leaf ranges, using
-// the provided SubtreeHasher. The ranges must be sorted and non-overlapping.
+// the provided SubtreeHasher. The ranges must be sorted and non-overlapping;
+// see StrictPanics for how an illegal set of ranges is handled.
 func BuildMultiRangeProof(ranges []LeafRange, h SubtreeHasher) (proof [][]byte, err error) {
+	defer func() {
+		if err = closeOnFinish(h, err); err != nil {
+			proof = nil
+		}
+	}()
 	if len(ranges) == 0 {
 		return nil, nil
 	}
 	if !validRangeSet(ranges) {
-		panic("BuildMultiRangeProof: illegal set of proof ranges")
+		return nil, invalidRangeSet("BuildMultiRangeProof: illegal set of proof ranges")
 	}
 
 	// NOTE: this implementation is a bit magical. Essentially, the binary
@@ -258,7 +568,10 @@ func BuildMultiRangeProof(ranges []LeafRange, h SubtreeHasher) (proof [][]byte,
 	var leafIndex uint64
 	consumeUntil := func(end uint64) error {
 		for leafIndex != end {
-			subtreeSize := nextSubtreeSize(leafIndex, end)
+			subtreeSize, err := checkedSubtreeSize(leafIndex, end)
+			if err != nil {
+				return err
+			}
 			root, err := h.NextSubtreeRoot(subtreeSize)
 			if err != nil {
 				return err
@@ -276,7 +589,10 @@ func BuildMultiRangeProof(ranges []LeafRange, h SubtreeHasher) (proof [][]byte,
 		}
 		// skip leaves within proof range, one subtree at a time
 		for leafIndex != r.End {
-			subtreeSize := nextSubtreeSize(leafIndex, r.End)
+			subtreeSize, err := checkedSubtreeSize(leafIndex, r.End)
+			if err != nil {
+				return nil, err
+			}
 			if err := h.Skip(subtreeSize); err != nil {
 				return nil, err
 			}
@@ -292,13 +608,148 @@ func BuildMultiRangeProof(ranges []LeafRange, h SubtreeHasher) (proof [][]byte,
 	return proof, err
 }
 
+// CoalesceRanges returns a sorted copy of ranges in which overlapping and
+// adjacent ranges have been merged. The input slice is not modified. Ranges
+// are not otherwise validated; a degenerate range (Start >= End) may survive
+// coalescing.
+func CoalesceRanges(ranges []LeafRange) []LeafRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sorted := append([]LeafRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+		return sorted[i].End < sorted[j].End
+	})
+	coalesced := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &coalesced[len(coalesced)-1]
+		if last.Start < last.End && r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		coalesced = append(coalesced, r)
+	}
+	return coalesced
+}
+
+// ComplementRanges returns the sorted set of ranges covering every leaf in
+// [0, numLeaves) that is not covered by ranges, i.e. the gaps between the
+// ranges, along with any gaps before the first range and after the last. The
+// ranges may be supplied in any order; empty ranges are ignored, and ranges
+// extending beyond numLeaves are truncated. If ranges is empty, the result is
+// the single range [0, numLeaves).
+func ComplementRanges(ranges []LeafRange, numLeaves uint64) []LeafRange {
+	var complement []LeafRange
+	var leafIndex uint64
+	for _, r := range CoalesceRanges(ranges) {
+		if r.Start >= r.End {
+			continue
+		} else if r.Start >= numLeaves {
+			break
+		}
+		if leafIndex < r.Start {
+			complement = append(complement, LeafRange{leafIndex, r.Start})
+		}
+		if r.End > leafIndex {
+			leafIndex = r.End
+		}
+	}
+	if leafIndex < numLeaves {
+		complement = append(complement, LeafRange{leafIndex, numLeaves})
+	}
+	return complement
+}
+
+// BuildMultiRangeProofSorted is like BuildMultiRangeProof, but accepts ranges
+// in any order. The ranges are sorted and coalesced (see CoalesceRanges)
+// before the proof is constructed; the caller's slice is not modified. The
+// proof must be verified against the coalesced ranges.
+func BuildMultiRangeProofSorted(ranges []LeafRange, h SubtreeHasher) (proof [][]byte, err error) {
+	ranges = CoalesceRanges(ranges)
+	for _, r := range ranges {
+		if r.Start >= r.End {
+			return nil, closeOnFinish(h, fmt.Errorf("BuildMultiRangeProofSorted: illegal proof range [%v,%v)", r.Start, r.End))
+		}
+	}
+	return BuildMultiRangeProof(ranges, h)
+}
+
+// IndexRanges converts a set of leaf indices into the equivalent sorted,
+// coalesced set of LeafRanges. The indices may be unsorted and may contain
+// duplicates, but must not be negative.
+func IndexRanges(indices []int) ([]LeafRange, error) {
+	ranges := make([]LeafRange, len(indices))
+	for i, index := range indices {
+		if index < 0 {
+			return nil, fmt.Errorf("IndexRanges: illegal leaf index %v", index)
+		}
+		ranges[i] = LeafRange{uint64(index), uint64(index) + 1}
+	}
+	return CoalesceRanges(ranges), nil
+}
+
+// RequiredLeafIndices returns the indices of the leaves within ranges, in
+// order. These are exactly the leaves whose hashes a LeafHasher must produce
+// in order to verify a proof for ranges.
+func RequiredLeafIndices(ranges []LeafRange) []uint64 {
+	var n uint64
+	for _, r := range ranges {
+		if r.End > r.Start {
+			n += r.End - r.Start
+		}
+	}
+	indices := make([]uint64, 0, n)
+	for _, r := range ranges {
+		for i := r.Start; i < r.End; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// BuildIndexProof constructs a proof for the specified leaf indices, using the
+// provided SubtreeHasher. The indices may be unsorted and may contain
+// duplicates. The ranges that the proof was built for are also returned.
+func BuildIndexProof(indices []int, sh SubtreeHasher) ([][]byte, []LeafRange, error) {
+	ranges, err := IndexRanges(indices)
+	if err != nil {
+		return nil, nil, closeOnFinish(sh, err)
+	}
+	proof, err := BuildMultiRangeProof(ranges, sh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, ranges, nil
+}
+
 // BuildRangeProof constructs a proof for the leaf range [proofStart,
 // proofEnd) using the provided SubtreeHasher.
 func BuildRangeProof(proofStart, proofEnd int, h SubtreeHasher) (proof [][]byte, err error) {
-	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
-		panic("BuildRangeProof: illegal proof range")
+	r, ok := intRange(proofStart, proofEnd)
+	if !ok {
+		return nil, closeOnFinish(h, invalidRangeSet("BuildRangeProof: illegal proof range"))
+	}
+	return BuildMultiRangeProof([]LeafRange{r}, h)
+}
+
+// ProveLeaf constructs a proof for the leaf at index in the tree formed by
+// leafHashes, returning the leaf's hash along with the proof. It is
+// equivalent to calling BuildRangeProof(index, index+1, sh) with a
+// CachedSubtreeHasher over leafHashes.
+func ProveLeaf(leafHashes [][]byte, index int, h hash.Hash) (leafHash []byte, proof [][]byte, err error) {
+	if index < 0 || index >= len(leafHashes) {
+		return nil, nil, fmt.Errorf("ProveLeaf: index %v out of range for tree of %v leaves", index, len(leafHashes))
+	}
+	proof, err = BuildRangeProof(index, index+1, NewCachedSubtreeHasher(leafHashes, h))
+	if err != nil {
+		return nil, nil, err
 	}
-	return BuildMultiRangeProof([]LeafRange{{uint64(proofStart), uint64(proofEnd)}}, h)
+	return leafHashes[index], proof, nil
 }
 
 // A LeafHasher returns the leaves of a Merkle tree in sequential order. When
@@ -313,22 +764,74 @@ type ReaderLeafHasher struct {
 	r    io.Reader
 	lh   LeafHasherz
 	leaf []byte
+	err  error
+	// If strict is set, a short leaf must be the final leaf. short is set
+	// once a short leaf has been read.
+	strict bool
+	short  bool
 }
 
-// NextLeafHash implements LeafHasher.
+// ErrWrongLeafSize is returned by a ReaderLeafHasher created with
+// NewStrictReaderLeafHasher if the stream yields more data after a leaf
+// shorter than leafSize, i.e. if a short leaf is not the final leaf.
+var ErrWrongLeafSize = errors.New("leaf has the wrong size")
+
+// NextLeafHash implements LeafHasher. If the underlying stream returns an
+// error other than io.EOF after a partial leaf has been read, the partial leaf
+// is hashed and returned, and the error is returned by the next call to
+// NextLeafHash.
 func (rlh *ReaderLeafHasher) NextLeafHash() ([]byte, error) {
+	if rlh.err != nil {
+		return nil, rlh.err
+	} else if rlh.strict {
+		return rlh.nextLeafHashStrict()
+	}
 	n, err := io.ReadFull(rlh.r, rlh.leaf)
 	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		return nil, err
+		if n == 0 {
+			return nil, err
+		}
+		// remember the error, so that it can be reported after the
+		// partial leaf
+		rlh.err = err
 	} else if n == 0 {
 		return nil, io.EOF
 	}
 	return rlh.lh.HashLeaf(rlh.leaf[:n]), nil
 }
 
+// nextLeafHashStrict implements NextLeafHash for a strict ReaderLeafHasher.
+func (rlh *ReaderLeafHasher) nextLeafHashStrict() ([]byte, error) {
+	n, err := io.ReadFull(rlh.r, rlh.leaf)
+	if rlh.short {
+		if n > 0 {
+			// the stream continued after a short leaf, so that leaf was
+			// not the final leaf
+			rlh.err = ErrWrongLeafSize
+			return nil, rlh.err
+		} else if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+	if err == io.ErrUnexpectedEOF {
+		// a short leaf must be the final leaf; this is checked by the next
+		// call
+		rlh.short = true
+	} else if err != nil {
+		if err != io.EOF {
+			rlh.err = err
+		}
+		return nil, err
+	}
+	return rlh.lh.HashLeaf(rlh.leaf[:n]), nil
+}
+
 // NewReaderLeafHasher creates a ReaderLeafHasher with the specified stream,
 // hash, and leaf size.
 func NewReaderLeafHasher(r io.Reader, h hash.Hash, leafSize int) *ReaderLeafHasher {
+	if leafSize <= 0 {
+		panic("NewReaderLeafHasher: leafSize must be positive")
+	}
 	return &ReaderLeafHasher{
 		r:    r,
 		lh:   NewDefaultHasher(h),
@@ -336,6 +839,32 @@ func NewReaderLeafHasher(r io.Reader, h hash.Hash, leafSize int) *ReaderLeafHash
 	}
 }
 
+// NewSaltedReaderLeafHasher returns a new ReaderLeafHasher that reads leaf
+// data from r, writing salt into the hash before each leaf. See
+// NewSaltedReaderSubtreeHasher.
+func NewSaltedReaderLeafHasher(r io.Reader, salt []byte, h hash.Hash, leafSize int) *ReaderLeafHasher {
+	rlh := NewReaderLeafHasher(r, h, leafSize)
+	rlh.lh = NewSaltedHasher(h, salt)
+	return rlh
+}
+
+// NewStrictReaderLeafHasher returns a new ReaderLeafHasher that, like
+// NewReaderLeafHasher, reads leafSize bytes of r per leaf, but only permits the
+// final leaf to be short. A short leaf is hashed as usual, after which
+// NextLeafHash returns io.EOF if the stream has ended, or ErrWrongLeafSize if
+// it yields more data, e.g. because a message-oriented reader delivered a short
+// leaf followed by further leaves. Since r is a plain byte stream, a leaf that
+// is too long cannot be detected; its excess bytes are read as the start of
+// the next leaf.
+func NewStrictReaderLeafHasher(r io.Reader, h hash.Hash, leafSize int) *ReaderLeafHasher {
+	if leafSize <= 0 {
+		panic("NewStrictReaderLeafHasher: leafSize must be positive")
+	}
+	rlh := NewReaderLeafHasher(r, h, leafSize)
+	rlh.strict = true
+	return rlh
+}
+
 // CachedLeafHasher implements the LeafHasher interface by returning
 // precomputed leaf hashes.
 type CachedLeafHasher struct {
@@ -360,9 +889,201 @@ func NewCachedLeafHasher(leafHashes [][]byte) *CachedLeafHasher {
 	}
 }
 
+// A RangeData pairs a LeafRange with the leaf data within that range.
+type RangeData struct {
+	Range LeafRange
+	Data  []byte
+}
+
+// NewMultiRangeLeafHasher creates a LeafHasher that hashes the leaf data of
+// each RangeData in turn, for use with VerifyMultiRangeProof. The leaves are
+// presented in ascending order of Range.Start, regardless of the order of
+// rds. Each Data must contain the (Range.End - Range.Start) leaves of its
+// range; only the final leaf of the tree may be shorter than leafSize. If any
+// Data has the wrong length, NextLeafHash returns an error.
+func NewMultiRangeLeafHasher(rds []RangeData, h hash.Hash, leafSize int) LeafHasher {
+	sorted := append([]RangeData(nil), rds...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Range.Start < sorted[j].Range.Start
+	})
+	rs := make([]io.Reader, len(sorted))
+	for i, rd := range sorted {
+		rs[i] = bytes.NewReader(rd.Data)
+	}
+	rlh := NewReaderLeafHasher(io.MultiReader(rs...), h, leafSize)
+	rlh.err = checkRangeData(sorted, leafSize)
+	return rlh
+}
+
+// checkRangeData returns an error if the Data of any of the sorted rds does
+// not contain exactly the leaves of its range. Otherwise, a short Data would
+// cause the leaves of the following range to be misaligned.
+func checkRangeData(rds []RangeData, leafSize int) error {
+	for i, rd := range rds {
+		if rd.Range.End < rd.Range.Start {
+			return fmt.Errorf("range %v is invalid", rd.Range)
+		}
+		n := rd.Range.End - rd.Range.Start
+		max := n * uint64(leafSize)
+		if max/uint64(leafSize) != n {
+			return fmt.Errorf("range %v is too large", rd.Range)
+		}
+		min := max
+		if i == len(rds)-1 && n > 0 {
+			// the final leaf may be short, but not empty
+			min = max - uint64(leafSize) + 1
+		}
+		if size := uint64(len(rd.Data)); size < min || size > max {
+			return fmt.Errorf("range %v has %v bytes of leaf data, expected %v", rd.Range, size, max)
+		}
+	}
+	return nil
+}
+
+// TreeHeight returns the height of a tree of numLeaves leaves, i.e. the
+// number of levels between its root and its deepest leaf. Since the tree is
+// unbalanced when numLeaves is not a power of two, this is
+// ceil(log2(numLeaves)). Trees of zero or one leaves have a height of 0.
+func TreeHeight(numLeaves uint64) int {
+	if numLeaves <= 1 {
+		return 0
+	}
+	return bits.Len64(numLeaves - 1)
+}
+
+// MaxProofLength returns the largest number of hashes in a proof for a single
+// leaf of a tree of numLeaves leaves. Each level between the leaf and the root
+// contributes at most one hash, so this is equal to TreeHeight(numLeaves).
+func MaxProofLength(numLeaves uint64) int {
+	return TreeHeight(numLeaves)
+}
+
+// MultiRangeProofSize returns the number of hashes in the proof produced by
+// BuildMultiRangeProof for the specified ranges in a tree of numLeaves leaves.
+func MultiRangeProofSize(ranges []LeafRange, numLeaves uint64) int {
+	if len(ranges) == 0 {
+		return 0
+	}
+	if !validRangeSet(ranges) {
+		panic("MultiRangeProofSize: illegal set of proof ranges")
+	} else if ranges[len(ranges)-1].End > numLeaves {
+		panic("MultiRangeProofSize: proof ranges extend beyond the tree")
+	}
+
+	// walk the tree as BuildMultiRangeProof would, counting the subtrees that
+	// are added to the proof
+	var size int
+	var leafIndex uint64
+	consumeUntil := func(end uint64) {
+		for leafIndex != end && leafIndex < numLeaves {
+			leafIndex += uint64(nextSubtreeSize(leafIndex, end))
+			size++
+		}
+	}
+	for _, r := range ranges {
+		consumeUntil(r.Start)
+		leafIndex = r.End
+	}
+	consumeUntil(math.MaxUint64)
+	return size
+}
+
+// ProofCoverage returns the leaves covered by each hash in the proof produced
+// by BuildMultiRangeProof for the specified ranges in a tree of numLeaves
+// leaves, in proof order. The final subtree is truncated to numLeaves, so the
+// returned ranges, together with the proof ranges, partition the tree.
+func ProofCoverage(ranges []LeafRange, numLeaves uint64) []LeafRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	if !validRangeSet(ranges) {
+		panic("ProofCoverage: illegal set of proof ranges")
+	} else if ranges[len(ranges)-1].End > numLeaves {
+		panic("ProofCoverage: proof ranges extend beyond the tree")
+	}
+
+	var coverage []LeafRange
+	var leafIndex uint64
+	consumeUntil := func(end uint64) {
+		for leafIndex != end && leafIndex < numLeaves {
+			subtreeEnd := leafIndex + uint64(nextSubtreeSize(leafIndex, end))
+			if subtreeEnd > numLeaves || subtreeEnd < leafIndex {
+				subtreeEnd = numLeaves
+			}
+			coverage = append(coverage, LeafRange{leafIndex, subtreeEnd})
+			leafIndex = subtreeEnd
+		}
+	}
+	for _, r := range ranges {
+		consumeUntil(r.Start)
+		leafIndex = r.End
+	}
+	consumeUntil(math.MaxUint64)
+	return coverage
+}
+
+// A NodePosition identifies a node of a tree by its height and its index among
+// the nodes at that height. The node at height h and index i is the root of
+// the leaves [i<<h, (i+1)<<h), truncated to the end of the tree.
+type NodePosition struct {
+	Height int
+	Index  uint64
+}
+
+// ProofHashPositions returns the position of each hash in the proof produced
+// by BuildMultiRangeProof for the specified ranges in a tree of numLeaves
+// leaves, in proof order. A hash near the end of the tree may cover fewer
+// than 2^Height leaves; its position is the lowest node covering the same
+// leaves, so a given hash always has the same position regardless of the
+// ranges it was proven with. This makes positions suitable as cache keys.
+func ProofHashPositions(ranges []LeafRange, numLeaves uint64) []NodePosition {
+	if len(ranges) == 0 {
+		return nil
+	}
+	if !validRangeSet(ranges) {
+		panic("ProofHashPositions: illegal set of proof ranges")
+	} else if ranges[len(ranges)-1].End > numLeaves {
+		panic("ProofHashPositions: proof ranges extend beyond the tree")
+	}
+	coverage := ProofCoverage(ranges, numLeaves)
+	positions := make([]NodePosition, len(coverage))
+	for i, r := range coverage {
+		height := bits.Len64(r.End - r.Start - 1)
+		positions[i] = NodePosition{height, r.Start >> uint(height)}
+	}
+	return positions
+}
+
+// IsCanonicalProof reports whether proof has exactly the number of hashes that
+// BuildMultiRangeProof produces for the specified ranges in a tree of
+// numLeaves leaves. Checking this before verification rejects proofs that have
+// been padded with extra hashes. It returns false if the ranges are invalid or
+// extend beyond the tree.
+func IsCanonicalProof(ranges []LeafRange, proof [][]byte, numLeaves uint64) bool {
+	if len(ranges) == 0 {
+		return len(proof) == 0
+	} else if !validRangeSet(ranges) || ranges[len(ranges)-1].End > numLeaves {
+		return false
+	}
+	return len(proof) == MultiRangeProofSize(ranges, numLeaves)
+}
+
+// ErrUnexpectedLeafCount is returned when verifying a proof if the LeafHasher
+// runs out of leaves before every leaf in the proof ranges has been hashed.
+// This indicates that not enough leaf data was supplied, as opposed to an
+// invalid proof.
+var ErrUnexpectedLeafCount = errors.New("LeafHasher returned fewer leaves than the proof ranges contain")
+
 // VerifyMultiRangeProof verifies a proof produced by BuildMultiRangeProof
 // using leaf hashes produced by lh, which must contain the concatenation of
-// the leaf hashes within the proof ranges.
+// the leaf hashes within the proof ranges. If lh runs out of leaves early,
+// ErrUnexpectedLeafCount is returned.
+//
+// The final leaf of the tree may be shorter than the others, e.g. when the
+// leaves are read from a file whose size is not a multiple of the leaf size.
+// Since ReaderLeafHasher hashes a short final leaf as-is, such a leaf may be
+// included in the last range like any other; the ranges are always expressed
+// in terms of leaves, not bytes.
 func VerifyMultiRangeProof(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte) (bool, error) {
 	if len(ranges) == 0 {
 		return true, nil
@@ -371,19 +1092,197 @@ func VerifyMultiRangeProof(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof
 		panic("BuildMultiRangeProof: illegal set of proof ranges")
 	}
 
-	// manually build a tree using the proof hashes
-	tree := New(h)
+	reconstructed, err := reconstructRangeRoot(lh, h, ranges, proof)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(reconstructed, root), nil
+}
+
+// ErrProofTooLarge is returned by VerifyMultiRangeProofLimited when a proof
+// contains more hashes than the caller is willing to process.
+var ErrProofTooLarge = errors.New("proof contains too many hashes")
+
+// VerifyMultiRangeProofLimited is like VerifyMultiRangeProof, but returns
+// ErrProofTooLarge without reading any leaves if the proof contains more than
+// maxProofLen hashes. This is useful when the proof comes from an untrusted
+// source. For single-leaf proofs, MaxProofLength(numLeaves) is a suitable
+// limit; for multi-range proofs, MultiRangeProofSize gives the exact size.
+func VerifyMultiRangeProofLimited(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte, maxProofLen int) (bool, error) {
+	if len(proof) > maxProofLen {
+		return false, ErrProofTooLarge
+	}
+	return VerifyMultiRangeProof(lh, h, ranges, proof, root)
+}
+
+// VerifyMultiRangeProofFunc is like VerifyMultiRangeProof, but obtains the
+// hash function by calling newHash. Since a hash.Hash cannot be shared between
+// goroutines, this allows multiple proofs to be verified concurrently. newHash
+// is called once per verification and must return a fresh hash.Hash each time.
+func VerifyMultiRangeProofFunc(lh LeafHasher, newHash func() hash.Hash, ranges []LeafRange, proof [][]byte, root []byte) (bool, error) {
+	return VerifyMultiRangeProof(lh, newHash(), ranges, proof, root)
+}
+
+// collectingLeafHasher implements LeafHasher by recording each leaf hash
+// returned by an underlying LeafHasher.
+type collectingLeafHasher struct {
+	lh         LeafHasher
+	leafHashes [][]byte
+}
+
+// NextLeafHash implements LeafHasher.
+func (clh *collectingLeafHasher) NextLeafHash() ([]byte, error) {
+	leafHash, err := clh.lh.NextLeafHash()
+	if err == nil {
+		clh.leafHashes = append(clh.leafHashes, leafHash)
+	}
+	return leafHash, err
+}
+
+// VerifyAndCollect is like VerifyMultiRangeProof, but also returns the leaf
+// hashes produced by lh, in range order. This allows the verified leaf hashes
+// to be used without a second pass over the leaf data. leafHashes is nil if
+// err is non-nil, and should be discarded if ok is false.
+func VerifyAndCollect(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte) (leafHashes [][]byte, ok bool, err error) {
+	clh := &collectingLeafHasher{lh: lh}
+	ok, err = VerifyMultiRangeProof(clh, h, ranges, proof, root)
+	if err != nil {
+		return nil, false, err
+	}
+	return clh.leafHashes, ok, nil
+}
+
+// VerifyLeafSet verifies a proof for a set of leaves in a tree of numLeaves
+// leaves, where leafHashes maps the index of each leaf to its hash. The proof
+// must have been produced by BuildMultiRangeProof for the ranges formed by
+// coalescing the leaf indices, i.e. CoalesceRanges applied to a single-leaf
+// range for each index. If leafHashes is empty, VerifyLeafSet returns true.
+func VerifyLeafSet(leafHashes map[uint64][]byte, proof [][]byte, numLeaves uint64, root []byte, h hash.Hash) (bool, error) {
+	indices := make([]uint64, 0, len(leafHashes))
+	for i := range leafHashes {
+		if i >= numLeaves {
+			return false, fmt.Errorf("leaf index %v is beyond tree of %v leaves", i, numLeaves)
+		}
+		indices = append(indices, i)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	ranges := make([]LeafRange, len(indices))
+	hashes := make([][]byte, len(indices))
+	for i, index := range indices {
+		ranges[i] = LeafRange{index, index + 1}
+		hashes[i] = leafHashes[index]
+	}
+	ranges = CoalesceRanges(ranges)
+	if len(ranges) > 0 && MultiRangeProofSize(ranges, numLeaves) != len(proof) {
+		return false, nil
+	}
+	return VerifyMultiRangeProof(NewCachedLeafHasher(hashes), h, ranges, proof, root)
+}
+
+// MatchRoot verifies a proof produced by BuildMultiRangeProof against each of
+// the candidate roots, returning the index of the first root that the proof
+// is valid for, or -1 if there is none. The root is reconstructed only once,
+// so lh is consumed only once, regardless of the number of candidates. If
+// ranges is empty, every root matches trivially.
+func MatchRoot(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof [][]byte, roots [][]byte) (int, error) {
+	if len(ranges) == 0 {
+		if len(roots) == 0 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	if !validRangeSet(ranges) {
+		panic("MatchRoot: illegal set of proof ranges")
+	}
+
+	reconstructed, err := reconstructRangeRoot(lh, h, ranges, proof)
+	if err != nil {
+		return -1, err
+	}
+	for i, root := range roots {
+		if bytes.Equal(reconstructed, root) {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// knownLeafHasher implements LeafHasher by returning known leaf hashes where
+// available, and otherwise deferring to an underlying LeafHasher.
+type knownLeafHasher struct {
+	lh        LeafHasher
+	known     map[uint64][]byte
+	ranges    []LeafRange
+	leafIndex uint64
+}
+
+// NextLeafHash implements LeafHasher.
+func (klh *knownLeafHasher) NextLeafHash() ([]byte, error) {
+	for len(klh.ranges) > 0 && klh.leafIndex >= klh.ranges[0].End {
+		klh.ranges = klh.ranges[1:]
+		if len(klh.ranges) > 0 {
+			klh.leafIndex = klh.ranges[0].Start
+		}
+	}
+	if len(klh.ranges) == 0 {
+		return nil, io.EOF
+	}
+	i := klh.leafIndex
+	klh.leafIndex++
+	if leafHash, ok := klh.known[i]; ok {
+		return leafHash, nil
+	}
+	return klh.lh.NextLeafHash()
+}
+
+// VerifyMultiRangeProofWithKnown is like VerifyMultiRangeProof, but uses the
+// leaf hashes in known, keyed by leaf index, in place of the corresponding
+// leaf hashes from lh. lh must therefore produce only the leaf hashes within
+// the proof ranges that are not present in known, in increasing order of leaf
+// index. Entries in known that lie outside the proof ranges are ignored.
+func VerifyMultiRangeProofWithKnown(lh LeafHasher, known map[uint64][]byte, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte) (bool, error) {
+	if len(ranges) == 0 {
+		return true, nil
+	}
+	if !validRangeSet(ranges) {
+		panic("VerifyMultiRangeProofWithKnown: illegal set of proof ranges")
+	}
+	klh := &knownLeafHasher{
+		lh:        lh,
+		known:     known,
+		ranges:    ranges,
+		leafIndex: ranges[0].Start,
+	}
+	reconstructed, err := reconstructRangeRoot(klh, h, ranges, proof)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(reconstructed, root), nil
+}
+
+// reconstructRangeRoot reconstructs the Merkle root of a tree from a proof
+// produced by BuildMultiRangeProof and the leaf hashes produced by lh. The
+// ranges must be valid and non-empty.
+func reconstructRangeRoot(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof [][]byte) ([]byte, error) {
+	if len(proof) == 0 {
+		return foldLeafHashes(lh, h, ranges)
+	}
+
+	// manually build a tree using the proof hashes; since no proof is
+	// needed, a Stack suffices
+	tree := NewStack(h)
 	var leafIndex uint64
 	consumeUntil := func(end uint64) error {
 		for leafIndex != end && len(proof) > 0 {
 			subtreeSize := nextSubtreeSize(leafIndex, end)
-			i := bits.TrailingZeros64(uint64(subtreeSize)) // log2
-			if err := tree.PushSubTree(i, proof[0]); err != nil {
+			i := uint64(bits.TrailingZeros64(uint64(subtreeSize))) // log2
+			if err := tree.checkAppend(i); err != nil {
 				// This *probably* should never happen, but just to guard
 				// against adversarial inputs, return an error instead of
 				// panicking.
 				return err
 			}
+			tree.appendNodeAtHeight(proof[0], i)
 			proof = proof[1:]
 			leafIndex += uint64(subtreeSize)
 		}
@@ -393,26 +1292,139 @@ func VerifyMultiRangeProof(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof
 	for _, r := range ranges {
 		// add proof hashes from leaves [leafIndex, r.Start)
 		if err := consumeUntil(r.Start); err != nil {
-			return false, err
+			return nil, err
 		}
 		// add leaf hashes within the proof range
 		for i := r.Start; i < r.End; i++ {
 			leafHash, err := lh.NextLeafHash()
-			if err != nil {
-				return false, err
-			}
-			if err := tree.PushSubTree(0, leafHash); err != nil {
-				panic(err)
+			if err == io.EOF {
+				return nil, ErrUnexpectedLeafCount
+			} else if err != nil {
+				return nil, err
 			}
+			tree.AppendNode(leafHash)
 		}
 		leafIndex += r.End - r.Start
 	}
 
 	// add remaining proof hashes after the last range ends
 	if err := consumeUntil(math.MaxUint64); err != nil {
-		return false, err
+		return nil, err
 	}
 
+	return tree.Root(), nil
+}
+
+// foldLeafHashes is a fast path for reconstructRangeRoot when the proof is
+// empty, which is the case when the ranges cover the entire tree. The root is
+// then simply the root of the leaf hashes within the ranges.
+func foldLeafHashes(lh LeafHasher, h hash.Hash, ranges []LeafRange) ([]byte, error) {
+	s := NewStack(h)
+	for _, r := range ranges {
+		for i := r.Start; i < r.End; i++ {
+			leafHash, err := lh.NextLeafHash()
+			if err == io.EOF {
+				return nil, ErrUnexpectedLeafCount
+			} else if err != nil {
+				return nil, err
+			}
+			s.AppendNode(leafHash)
+		}
+	}
+	return s.Root(), nil
+}
+
+// RootFromLeaves reconstructs the Merkle root of a tree of numLeaves leaves
+// from a proof produced by BuildMultiRangeProof and the leaf hashes within the
+// proof ranges, supplied as a map from leaf index to leaf hash. The map must
+// contain exactly the leaves within the ranges.
+func RootFromLeaves(leaves map[uint64][]byte, proof [][]byte, ranges []LeafRange, numLeaves uint64, h hash.Hash) ([]byte, error) {
+	if len(ranges) == 0 {
+		return nil, errors.New("RootFromLeaves: no proof ranges")
+	} else if !validRangeSet(ranges) {
+		return nil, errors.New("RootFromLeaves: illegal set of proof ranges")
+	} else if ranges[len(ranges)-1].End > numLeaves {
+		return nil, fmt.Errorf("RootFromLeaves: proof range %v extends beyond tree of %v leaves", ranges[len(ranges)-1], numLeaves)
+	}
+	leafHashes := make([][]byte, 0, len(leaves))
+	for _, r := range ranges {
+		for i := r.Start; i < r.End; i++ {
+			leafHash, ok := leaves[i]
+			if !ok {
+				return nil, fmt.Errorf("RootFromLeaves: missing leaf hash for index %v", i)
+			}
+			leafHashes = append(leafHashes, leafHash)
+		}
+	}
+	if len(leafHashes) != len(leaves) {
+		return nil, fmt.Errorf("RootFromLeaves: %v leaf hashes supplied, but ranges only contain %v leaves", len(leaves), len(leafHashes))
+	}
+	return reconstructRangeRoot(NewCachedLeafHasher(leafHashes), h, ranges, proof)
+}
+
+// VerifyInterleavedProof verifies a multi-range proof in which the leaf hashes
+// within the ranges and the proof hashes are interleaved in traversal order,
+// i.e. in the order of the leaves they cover. Each call to stream returns the
+// next hash along with whether it is a leaf hash; stream must return io.EOF
+// after the final hash. A hash whose tag does not match its position in the
+// traversal results in an error.
+func VerifyInterleavedProof(stream func() (isLeaf bool, hash []byte, err error), h hash.Hash, ranges []LeafRange, root []byte) (bool, error) {
+	if len(ranges) == 0 {
+		return true, nil
+	}
+	if !validRangeSet(ranges) {
+		panic("VerifyInterleavedProof: illegal set of proof ranges")
+	}
+
+	tree := NewStack(h)
+	var leafIndex uint64
+	// next appends the next hash of the stream, which must have the specified
+	// tag, as the root of a subtree of 2^height leaves.
+	next := func(wantLeaf bool, height uint64) error {
+		isLeaf, hash, err := stream()
+		if err != nil {
+			return err
+		} else if isLeaf != wantLeaf {
+			if isLeaf {
+				return fmt.Errorf("expected proof hash at leaf %v, got leaf hash", leafIndex)
+			}
+			return fmt.Errorf("expected leaf hash at leaf %v, got proof hash", leafIndex)
+		} else if err := tree.checkAppend(height); err != nil {
+			return err
+		}
+		tree.appendNodeAtHeight(hash, height)
+		leafIndex += 1 << height
+		return nil
+	}
+	consumeUntil := func(end uint64) error {
+		for leafIndex != end {
+			height := uint64(bits.TrailingZeros64(uint64(nextSubtreeSize(leafIndex, end))))
+			if err := next(false, height); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, r := range ranges {
+		if err := consumeUntil(r.Start); err == io.EOF {
+			return false, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return false, err
+		}
+		for leafIndex < r.End {
+			if err := next(true, 0); err == io.EOF {
+				return false, ErrUnexpectedLeafCount
+			} else if err != nil {
+				return false, err
+			}
+		}
+	}
+	// the proof hashes after the last range continue until the end of the
+	// stream
+	if err := consumeUntil(math.MaxUint64); err != nil && err != io.EOF {
+		return false, err
+	}
 	return bytes.Equal(tree.Root(), root), nil
 }
 
@@ -420,10 +1432,96 @@ func VerifyMultiRangeProof(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof
 // hashes produced by lh, which must contain only the leaf hashes within the
 // proof range.
 func VerifyRangeProof(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
-	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+	r, ok := intRange(proofStart, proofEnd)
+	if !ok {
 		panic("VerifyRangeProof: illegal proof range")
 	}
-	return VerifyMultiRangeProof(lh, h, []LeafRange{{uint64(proofStart), uint64(proofEnd)}}, proof, root)
+	return VerifyMultiRangeProof(lh, h, []LeafRange{r}, proof, root)
+}
+
+// VerifyRangeProofFunc is like VerifyRangeProof, but obtains the hash function
+// by calling newHash. See VerifyMultiRangeProofFunc.
+func VerifyRangeProofFunc(lh LeafHasher, newHash func() hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	return VerifyRangeProof(lh, newHash(), proofStart, proofEnd, proof, root)
+}
+
+// funcLeafHasher implements LeafHasher using a function that returns the next
+// leaf hash, or nil if no leaves remain.
+type funcLeafHasher func() []byte
+
+// NextLeafHash implements LeafHasher.
+func (flh funcLeafHasher) NextLeafHash() ([]byte, error) {
+	if h := flh(); h != nil {
+		return h, nil
+	}
+	return nil, io.EOF
+}
+
+// VerifyCachedRangeProof verifies a proof for the cached subtrees [start, end)
+// of a tree whose leaves are grouped into subtrees of 2^cacheHeight leaves,
+// e.g. sectors. subtreeRootHasher is called once per subtree in the range and
+// must return its root, or nil if no roots remain. The final subtree of the
+// tree may contain fewer leaves than the others.
+//
+// Since the subtrees are aligned, the proof for subtrees [start, end) is
+// identical to the proof for leaves [start<<cacheHeight, end<<cacheHeight), so
+// it may be produced by BuildRangeProof with any SubtreeHasher, including a
+// MixedSubtreeHasher using the cached subtree roots.
+func VerifyCachedRangeProof(subtreeRootHasher func() []byte, cacheHeight int, h hash.Hash, start, end int, proof [][]byte, root []byte) (bool, error) {
+	if _, ok := intRange(start, end); !ok {
+		panic("VerifyCachedRangeProof: illegal proof range")
+	} else if cacheHeight < 0 || cacheHeight >= 64 || uint64(end) > math.MaxUint64>>uint(cacheHeight) {
+		return false, fmt.Errorf("cache height %v is invalid for a range ending at subtree %v", cacheHeight, end)
+	}
+	return VerifyRangeProof(funcLeafHasher(subtreeRootHasher), h, start, end, proof, root)
+}
+
+// VerifyRangeProofHashes is like VerifyRangeProof, but takes the leaf hashes
+// within the proof range directly. It returns ErrInvalidRangeSet if the range
+// is empty or negative, and an error if the number of leaf hashes does not
+// match the size of the range.
+func VerifyRangeProofHashes(leafHashes [][]byte, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	if _, ok := intRange(proofStart, proofEnd); !ok {
+		return false, ErrInvalidRangeSet
+	} else if len(leafHashes) != proofEnd-proofStart {
+		return false, fmt.Errorf("%v leaf hashes supplied for range [%v,%v)", len(leafHashes), proofStart, proofEnd)
+	}
+	return VerifyRangeProof(NewCachedLeafHasher(leafHashes), h, proofStart, proofEnd, proof, root)
+}
+
+// ErrSelfCheckFailed is returned by BuildVerifiedRangeProof when the proof it
+// constructed does not verify against the expected root.
+var ErrSelfCheckFailed = errors.New("constructed proof failed to verify against the expected root")
+
+// BuildVerifiedRangeProof constructs a proof for the leaf range [proofStart,
+// proofEnd) using sh, then verifies it against root using the leaf hashes
+// produced by lh before returning it. If the proof does not verify,
+// ErrSelfCheckFailed is returned. This is considerably slower than
+// BuildRangeProof, but guards against returning a silently incorrect proof,
+// e.g. due to a faulty SubtreeHasher.
+func BuildVerifiedRangeProof(proofStart, proofEnd int, sh SubtreeHasher, lh LeafHasher, h hash.Hash, root []byte) ([][]byte, error) {
+	proof, err := BuildRangeProof(proofStart, proofEnd, sh)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrSelfCheckFailed
+	}
+	return proof, nil
+}
+
+// VerifyIndexProof verifies a proof produced by BuildIndexProof using leaf
+// hashes produced by lh, which must contain the leaf hashes of the (sorted,
+// deduplicated) indices in ascending order.
+func VerifyIndexProof(lh LeafHasher, h hash.Hash, indices []int, proof [][]byte, root []byte) (bool, error) {
+	ranges, err := IndexRanges(indices)
+	if err != nil {
+		return false, err
+	}
+	return VerifyMultiRangeProof(lh, h, ranges, proof, root)
 }
 
 // proofMapping returns an index-to-index mapping that maps a hash's index in
@@ -476,6 +1574,14 @@ func proofMapping(proofSize, proofIndex int) (mapping []int) {
 	// know what the limit is? Easy: we know that there's a 1 bit in the
 	// proofIndex for each left-side hash, so we just subtract the number of 1
 	// bits from the total number of proof hashes.
+	//
+	// This also gives us a cheap sanity check for untrusted inputs: a proof
+	// must contain at least as many hashes as there are 1 bits in the
+	// proofIndex. If it doesn't, no valid mapping exists, and we return an
+	// empty mapping rather than attempting to construct one.
+	if proofIndex < 0 || bits.OnesCount(uint(proofIndex)) > proofSize {
+		return nil
+	}
 	numRights := proofSize - bits.OnesCount(uint(proofIndex))
 	var left, right []int
 	for i := 0; len(left)+len(right) < proofSize; i++ {
@@ -497,10 +1603,15 @@ func proofMapping(proofSize, proofIndex int) (mapping []int) {
 }
 
 // ConvertSingleProofToRangeProof converts a proof produced by (*Tree).Prove
-// to a single-leaf range proof. proofIndex must be >= 0.
+// to a single-leaf range proof. proofIndex must be >= 0. If no proof of this
+// length could exist for proofIndex, ConvertSingleProofToRangeProof returns
+// nil.
 func ConvertSingleProofToRangeProof(proof [][]byte, proofIndex int) [][]byte {
-	newproof := make([][]byte, len(proof))
 	mapping := proofMapping(len(proof), proofIndex)
+	if len(mapping) != len(proof) {
+		return nil
+	}
+	newproof := make([][]byte, len(proof))
 	for i, j := range mapping {
 		newproof[i] = proof[j]
 	}
@@ -508,12 +1619,97 @@ func ConvertSingleProofToRangeProof(proof [][]byte, proofIndex int) [][]byte {
 }
 
 // ConvertRangeProofToSingleProof converts a single-leaf range proof to the
-// equivalent proof produced by (*Tree).Prove. proofIndex must be >= 0.
+// equivalent proof produced by (*Tree).Prove. proofIndex must be >= 0. If no
+// proof of this length could exist for proofIndex,
+// ConvertRangeProofToSingleProof returns nil.
 func ConvertRangeProofToSingleProof(proof [][]byte, proofIndex int) [][]byte {
-	oldproof := make([][]byte, len(proof))
 	mapping := proofMapping(len(proof), proofIndex)
+	if len(mapping) != len(proof) {
+		return nil
+	}
+	oldproof := make([][]byte, len(proof))
 	for i, j := range mapping {
 		oldproof[j] = proof[i]
 	}
 	return oldproof
 }
+
+// A ProofFormatVersion identifies the order of the hashes in a stored proof.
+// Its values are stable, so they may be persisted alongside proofs.
+type ProofFormatVersion int
+
+// Proof format versions.
+const (
+	// ProofFormatBottomUp is the format of the single-leaf proofs produced by
+	// (*Tree).Prove, excluding the leaf data in proofSet[0]: the hashes are
+	// ordered from the leaf to the root.
+	ProofFormatBottomUp ProofFormatVersion = 1
+	// ProofFormatLeftToRight is the format of the proofs produced by
+	// BuildMultiRangeProof: the hashes are ordered by the leaves they cover.
+	ProofFormatLeftToRight ProofFormatVersion = 2
+	// ProofFormatCurrent is the format produced by the current version of
+	// this package.
+	ProofFormatCurrent = ProofFormatLeftToRight
+)
+
+// VerifyMultiRangeProofVersioned is like VerifyMultiRangeProof, but accepts
+// proofs in any supported format, identified by version. This allows proofs
+// stored by older versions of this package to be verified alongside current
+// ones. Proofs in ProofFormatBottomUp must be for a single leaf; they are
+// converted with ConvertSingleProofToRangeProof before verification.
+func VerifyMultiRangeProofVersioned(lh LeafHasher, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte, version ProofFormatVersion) (bool, error) {
+	switch version {
+	case ProofFormatLeftToRight:
+		return VerifyMultiRangeProof(lh, h, ranges, proof, root)
+	case ProofFormatBottomUp:
+		if len(ranges) != 1 || ranges[0].End-ranges[0].Start != 1 {
+			return false, errors.New("bottom-up proofs must be for a single leaf")
+		}
+		proofIndex := int(ranges[0].Start)
+		if proofIndex < 0 || uint64(proofIndex) != ranges[0].Start {
+			return false, fmt.Errorf("leaf index %v is too large", ranges[0].Start)
+		}
+		rangeProof := ConvertSingleProofToRangeProof(proof, proofIndex)
+		if rangeProof == nil {
+			return false, nil // no proof of this length could be valid
+		}
+		return VerifyMultiRangeProof(lh, h, ranges, rangeProof, root)
+	default:
+		return false, fmt.Errorf("unknown proof format version %v", version)
+	}
+}
+
+// ProofSiblingSides reports, for each hash in a single-leaf range proof of
+// proofSize hashes for proofIndex, whether the hash is the root of a subtree
+// to the left (true) or right (false) of the path from the leaf to the root.
+// The sides are returned in the same order as the hashes of the proof. If no
+// proof of this length could exist for proofIndex, ProofSiblingSides returns
+// nil.
+func ProofSiblingSides(proofSize, proofIndex int) []bool {
+	if proofIndex < 0 || bits.OnesCount(uint(proofIndex)) > proofSize {
+		return nil
+	}
+	// As explained in proofMapping, there is one left-side hash for each 1
+	// bit in the proofIndex, and a range proof places all of the left-side
+	// hashes before the right-side hashes.
+	sides := make([]bool, proofSize)
+	for i := 0; i < bits.OnesCount(uint(proofIndex)); i++ {
+		sides[i] = true
+	}
+	return sides
+}
+
+// ProofSideCounts returns the number of hashes in a single-leaf range proof of
+// proofSize hashes for proofIndex that are roots of subtrees to the left and
+// to the right of the path from the leaf to the root. The left-side hashes
+// occupy the first leftCount entries of the proof, and the right-side hashes
+// the remainder. If no proof of this length could exist for proofIndex,
+// ProofSideCounts returns -1, -1.
+func ProofSideCounts(proofSize, proofIndex int) (leftCount, rightCount int) {
+	if proofIndex < 0 || bits.OnesCount(uint(proofIndex)) > proofSize {
+		return -1, -1
+	}
+	// see proofMapping
+	leftCount = bits.OnesCount(uint(proofIndex))
+	return leftCount, proofSize - leftCount
+}
@@ -0,0 +1,242 @@
+package merkletree
+
+import (
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// A SubtreeHasher32 is a SubtreeHasher specialized for hash functions with a
+// 32-byte output. Returning fixed-size arrays rather than slices avoids an
+// allocation per subtree root and makes it impossible to mix hash sizes.
+type SubtreeHasher32 interface {
+	// NextSubtreeRoot hashes the next subtreeSize leaves, returning their
+	// Merkle root. If there are fewer than subtreeSize leaves remaining, the
+	// root of the remaining leaves is returned. If no leaves remain,
+	// NextSubtreeRoot returns io.EOF.
+	NextSubtreeRoot(subtreeSize int) ([32]byte, error)
+	// Skip skips the next n leaves.
+	Skip(n int) error
+}
+
+// stack32 is a Stack specialized for 32-byte hashes. All hashing is performed
+// in place, so appending leaves never allocates.
+type stack32 struct {
+	h     hash.Hash
+	stack [64][32]byte
+	used  uint64
+	// node holds the node currently being appended; sum is scratch space for
+	// h.Sum.
+	node [32]byte
+	sum  []byte
+}
+
+// sumInto writes the current sum of s.h to dst.
+func (s *stack32) sumInto(dst *[32]byte) {
+	s.sum = s.h.Sum(s.sum[:0])
+	copy(dst[:], s.sum)
+}
+
+// hashNodeInto writes the hash of the node with the given children to dst,
+// which may alias right.
+func (s *stack32) hashNodeInto(dst, left, right *[32]byte) {
+	s.h.Reset()
+	_, _ = s.h.Write(nodeHashPrefix)
+	_, _ = s.h.Write(left[:])
+	_, _ = s.h.Write(right[:])
+	s.sumInto(dst)
+}
+
+// appendLeaf hashes data to form a leaf and appends it to the stack.
+func (s *stack32) appendLeaf(data []byte) {
+	s.h.Reset()
+	_, _ = s.h.Write(leafHashPrefix)
+	_, _ = s.h.Write(data)
+	s.sumInto(&s.node)
+	i := 0
+	for ; s.used&(1<<uint(i)) != 0; i++ {
+		s.hashNodeInto(&s.node, &s.stack[i], &s.node)
+	}
+	s.stack[i] = s.node
+	s.used++
+}
+
+// root returns the Merkle root of the leaves that have been appended, or
+// false if the stack is empty.
+func (s *stack32) root() ([32]byte, bool) {
+	if s.used == 0 {
+		return [32]byte{}, false
+	}
+	i := 0
+	for s.used&(1<<uint(i)) == 0 {
+		i++
+	}
+	s.node = s.stack[i]
+	for i++; i < 64; i++ {
+		if s.used&(1<<uint(i)) != 0 {
+			s.hashNodeInto(&s.node, &s.stack[i], &s.node)
+		}
+	}
+	return s.node, true
+}
+
+// ReaderSubtreeHasher32 implements SubtreeHasher32 by reading leaf data from
+// an underlying stream. It is equivalent to ReaderSubtreeHasher, but does not
+// allocate.
+type ReaderSubtreeHasher32 struct {
+	r     io.Reader
+	leaf  []byte
+	stack stack32
+}
+
+// NextSubtreeRoot implements SubtreeHasher32.
+func (rsh *ReaderSubtreeHasher32) NextSubtreeRoot(subtreeSize int) ([32]byte, error) {
+	rsh.stack.used = 0
+	for i := 0; i < subtreeSize; i++ {
+		n, err := io.ReadFull(rsh.r, rsh.leaf)
+		if n > 0 {
+			rsh.stack.appendLeaf(rsh.leaf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // reading a partial leaf is normal at the end of the stream
+		} else if err != nil {
+			return [32]byte{}, err
+		}
+	}
+	root, ok := rsh.stack.root()
+	if !ok {
+		// we didn't read anything; return EOF to signal that there are no
+		// more subtrees to hash.
+		return [32]byte{}, io.EOF
+	}
+	return root, nil
+}
+
+// Skip implements SubtreeHasher32.
+func (rsh *ReaderSubtreeHasher32) Skip(n int) error {
+	skipSize := int64(math.MaxInt64) // see ReaderSubtreeHasher.Skip
+	if int64(n) <= math.MaxInt64/int64(len(rsh.leaf)) {
+		skipSize = int64(len(rsh.leaf)) * int64(n)
+	}
+	skipped, err := io.CopyN(ioutil.Discard, rsh.r, skipSize)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if skipped == skipSize {
+			return nil
+		}
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// NewReaderSubtreeHasher32 returns a new ReaderSubtreeHasher32 that reads leaf
+// data from r. h must produce 32-byte hashes.
+func NewReaderSubtreeHasher32(r io.Reader, leafSize int, h hash.Hash) *ReaderSubtreeHasher32 {
+	if leafSize <= 0 {
+		panic("NewReaderSubtreeHasher32: leafSize must be positive")
+	} else if h.Size() != 32 {
+		panic("NewReaderSubtreeHasher32: hash function must produce 32-byte hashes")
+	}
+	return &ReaderSubtreeHasher32{
+		r:    r,
+		leaf: make([]byte, leafSize),
+		stack: stack32{
+			h:   h,
+			sum: make([]byte, 0, 32),
+		},
+	}
+}
+
+// BuildMultiRangeProof32 is like BuildMultiRangeProof, but produces a proof
+// of 32-byte hashes using a SubtreeHasher32. The proof can be converted for
+// use with VerifyMultiRangeProof using ProofFrom32.
+func BuildMultiRangeProof32(ranges []LeafRange, h SubtreeHasher32) (proof [][32]byte, err error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	if !validRangeSet(ranges) {
+		panic("BuildMultiRangeProof32: illegal set of proof ranges")
+	}
+
+	// see BuildMultiRangeProof for an explanation of this algorithm
+	var leafIndex uint64
+	consumeUntil := func(end uint64) error {
+		for leafIndex != end {
+			subtreeSize, err := checkedSubtreeSize(leafIndex, end)
+			if err != nil {
+				return err
+			}
+			root, err := h.NextSubtreeRoot(subtreeSize)
+			if err != nil {
+				return err
+			}
+			proof = append(proof, root)
+			leafIndex += uint64(subtreeSize)
+		}
+		return nil
+	}
+
+	for _, r := range ranges {
+		if err := consumeUntil(r.Start); err != nil {
+			return nil, err
+		}
+		for leafIndex != r.End {
+			subtreeSize, err := checkedSubtreeSize(leafIndex, r.End)
+			if err != nil {
+				return nil, err
+			}
+			if err := h.Skip(subtreeSize); err != nil {
+				return nil, err
+			}
+			leafIndex += uint64(subtreeSize)
+		}
+	}
+
+	err = consumeUntil(math.MaxUint64)
+	if err == io.EOF {
+		err = nil // EOF is expected
+	}
+	return proof, err
+}
+
+// BuildRangeProof32 constructs a proof for the leaf range [proofStart,
+// proofEnd) using the provided SubtreeHasher32.
+func BuildRangeProof32(proofStart, proofEnd int, h SubtreeHasher32) (proof [][32]byte, err error) {
+	r, ok := intRange(proofStart, proofEnd)
+	if !ok {
+		panic("BuildRangeProof32: illegal proof range")
+	}
+	return BuildMultiRangeProof32([]LeafRange{r}, h)
+}
+
+// ProofTo32 converts a proof of []byte hashes to a proof of 32-byte hashes. It
+// returns an error if any hash is not exactly 32 bytes.
+func ProofTo32(proof [][]byte) ([][32]byte, error) {
+	if proof == nil {
+		return nil, nil
+	}
+	proof32 := make([][32]byte, len(proof))
+	for i := range proof {
+		if len(proof[i]) != 32 {
+			return nil, errors.New("proof contains a hash that is not 32 bytes")
+		}
+		copy(proof32[i][:], proof[i])
+	}
+	return proof32, nil
+}
+
+// ProofFrom32 converts a proof of 32-byte hashes to a proof of []byte hashes.
+// The returned hashes share a single backing array.
+func ProofFrom32(proof [][32]byte) [][]byte {
+	if proof == nil {
+		return nil
+	}
+	buf := make([]byte, 32*len(proof))
+	hashes := make([][]byte, len(proof))
+	for i := range proof {
+		hashes[i] = buf[i*32:][:32:32]
+		copy(hashes[i], proof[i][:])
+	}
+	return hashes
+}
@@ -0,0 +1,112 @@
+package merkletree
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestBuildRangeProof32 tests that BuildMultiRangeProof32 produces the same
+// proofs as BuildMultiRangeProof.
+func TestBuildRangeProof32(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{numLeaves - 1, numLeaves}},
+		{{0, numLeaves}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {50, 70}, {98, 99}},
+	} {
+		expected, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof32, err := BuildMultiRangeProof32(ranges, NewReaderSubtreeHasher32(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof := ProofFrom32(proof32)
+		if !ProofsEqual(proof, expected) {
+			t.Fatalf("proofs for ranges %v differ: %v", ranges, ProofEqualityReport(proof, expected))
+		}
+		if roundtrip, err := ProofTo32(proof); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(roundtrip, proof32) {
+			t.Fatal("ProofTo32 did not invert ProofFrom32")
+		}
+
+		var hashes [][]byte
+		th := NewDefaultHasher(blake)
+		for _, r := range ranges {
+			for i := r.Start; i < r.End; i++ {
+				hashes = append(hashes, th.HashLeaf(leafData[i*leafSize:][:leafSize]))
+			}
+		}
+		if ok, err := VerifyMultiRangeProof(NewCachedLeafHasher(hashes), blake, ranges, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof for ranges %v", ranges)
+		}
+	}
+
+	// hashes of the wrong size should be rejected
+	if _, err := ProofTo32([][]byte{make([]byte, 32), make([]byte, 31)}); err == nil {
+		t.Error("ProofTo32 accepted a 31-byte hash")
+	}
+}
+
+// BenchmarkBuildRangeProof32 benchmarks the performance of BuildRangeProof32
+// for various proof ranges. It is the [32]byte counterpart of
+// BenchmarkBuildRangeProof.
+func BenchmarkBuildRangeProof32(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(1 << 22)
+	const leafSize = 64
+	numLeaves := len(leafData) / 64
+
+	benchRange := func(start, end int) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = BuildRangeProof32(start, end, NewReaderSubtreeHasher32(bytes.NewReader(leafData), leafSize, blake))
+			}
+		}
+	}
+
+	b.Run("single", benchRange(0, 1))
+	b.Run("half", benchRange(0, numLeaves/2))
+	b.Run("mid", benchRange(numLeaves/2, 1+numLeaves/2))
+	b.Run("full", benchRange(0, numLeaves-1))
+}
+
+// BenchmarkBuildMultiRangeProof32 compares the performance and allocations of
+// BuildMultiRangeProof32 against BuildMultiRangeProof for a proof of several
+// ranges.
+func BenchmarkBuildMultiRangeProof32(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(1 << 22)
+	const leafSize = 64
+	numLeaves := uint64(len(leafData) / leafSize)
+	ranges := []LeafRange{{1, 2}, {numLeaves / 4, numLeaves/4 + 100}, {numLeaves / 2, numLeaves/2 + 1}, {numLeaves - 7, numLeaves - 3}}
+
+	b.Run("generic", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		}
+	})
+	b.Run("32", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = BuildMultiRangeProof32(ranges, NewReaderSubtreeHasher32(bytes.NewReader(leafData), leafSize, blake))
+		}
+	})
+}
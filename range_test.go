@@ -2,12 +2,19 @@ package merkletree
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"math"
+	"math/bits"
 	"reflect"
+	"sync"
 	"testing"
+	"testing/iotest"
 
 	"gitlab.com/NebulousLabs/fastrand"
 	"golang.org/x/crypto/blake2b"
@@ -142,6 +149,34 @@ func (msh *mockSubtreeHasher) Skip(n int) error {
 	return nil
 }
 
+// TestValidateRanges tests that ValidateRanges reports the reason a set of
+// ranges is rejected.
+func TestValidateRanges(t *testing.T) {
+	for _, test := range []struct {
+		ranges []LeafRange
+		err    error
+	}{
+		{nil, nil},
+		{[]LeafRange{{0, 10}}, nil},
+		{[]LeafRange{{0, 1}, {1, 2}, {5, 10}}, nil},
+		{[]LeafRange{{3, 4}, {0, 1}}, ErrRangeUnsorted},
+		{[]LeafRange{{0, 5}, {3, 4}}, ErrRangeOverlap},
+		{[]LeafRange{{2, 4}, {2, 5}}, ErrRangeOverlap},
+		{[]LeafRange{{3, 3}}, ErrRangeEmpty},
+		{[]LeafRange{{0, 1}, {5, 4}}, ErrRangeEmpty},
+		{[]LeafRange{{9, 11}}, ErrRangeOutOfBounds},
+		{[]LeafRange{{0, 1}, {10, 11}}, ErrRangeOutOfBounds},
+	} {
+		err := ValidateRanges(test.ranges, 10)
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("%v: expected %v, got %v", test.ranges, test.err, err)
+		}
+		if valid := validRangeSet(test.ranges); valid != (test.err == nil || test.err == ErrRangeOutOfBounds) {
+			t.Errorf("%v: validRangeSet returned %v", test.ranges, valid)
+		}
+	}
+}
+
 // TestBuildMultiRangeProof uses a mock SubtreeHasher to test whether
 // BuildMultiRange proof is examining the correct ranges of the tree.
 func TestBuildMultiRangeProof(t *testing.T) {
@@ -253,6 +288,22 @@ func TestBuildMultiRangeProof(t *testing.T) {
 		if !reflect.DeepEqual(m.calls, test.calls) {
 			t.Errorf("BuildMultiRangeProof made incorrect calls to SubtreeHasher:\nExpected:\n\t%v\nGot:\n\t%v", test.calls, m.calls)
 		}
+
+		// ProofCoverage should report the kept subtrees that lie within the
+		// tree, truncated to its final leaf
+		var expCoverage []LeafRange
+		for _, call := range test.calls {
+			var r LeafRange
+			if n, _ := fmt.Sscanf(call, "Keep [%d,%d)", &r.Start, &r.End); n == 2 && r.Start < uint64(test.leaves) {
+				if r.End > uint64(test.leaves) {
+					r.End = uint64(test.leaves)
+				}
+				expCoverage = append(expCoverage, r)
+			}
+		}
+		if coverage := ProofCoverage(test.ranges, uint64(test.leaves)); !reflect.DeepEqual(coverage, expCoverage) {
+			t.Errorf("ProofCoverage(%v, %v): expected %v, got %v", test.ranges, test.leaves, expCoverage, coverage)
+		}
 	}
 }
 
@@ -334,6 +385,31 @@ func TestBuildDiffProof(t *testing.T) {
 	}
 }
 
+// TestBuildDiffProofWithProgress tests that BuildDiffProofWithProgress reports
+// strictly increasing leaf indices, ending at numLeaves.
+func TestBuildDiffProofWithProgress(t *testing.T) {
+	const numLeaves = 15
+	ranges := []LeafRange{{3, 5}, {7, 8}}
+	var indices []uint64
+	m := &mockSubtreeHasher{leaves: numLeaves}
+	if _, err := BuildDiffProofWithProgress(ranges, m, numLeaves, func(leafIndex uint64) {
+		indices = append(indices, leafIndex)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// one call per subtree, whether kept or skipped
+	expected := []uint64{2, 3, 4, 5, 6, 7, 8, 12, 14, 15}
+	if !reflect.DeepEqual(indices, expected) {
+		t.Errorf("expected progress %v, got %v", expected, indices)
+	}
+
+	// a nil callback should be tolerated
+	m = &mockSubtreeHasher{leaves: numLeaves}
+	if _, err := BuildDiffProofWithProgress(ranges, m, numLeaves, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TestBuildVerifyMultiRangeProof tests the BuildMultiRangeProof and
 // VerifyMultiRangeProof functions.
 func TestBuildVerifyMultiRangeProof(t *testing.T) {
@@ -518,267 +594,1770 @@ func TestBuildVerifyMultiRangeProof(t *testing.T) {
 	}
 }
 
-// TestBuildVerifyRangeProof tests the BuildRangeProof and VerifyRangeProof
-// functions.
-func TestBuildVerifyRangeProof(t *testing.T) {
-	// setup proof parameters
+// TestBuildMultiRangeProofSorted tests that BuildMultiRangeProofSorted accepts
+// shuffled and overlapping ranges, producing the same proof as
+// BuildMultiRangeProof does for the equivalent sorted, disjoint ranges.
+func TestBuildMultiRangeProofSorted(t *testing.T) {
 	blake, _ := blake2b.New256(nil)
-	th := NewDefaultHasher(blake)
-	leafData := make([]byte, 1<<22)
 	const leafSize = 64
-	numLeaves := len(leafData) / 64
-	leafHashes := make([][]byte, numLeaves)
-	for i := range leafHashes {
-		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
-	}
+	const numLeaves = 37
+	leafData := fastrand.Bytes(leafSize * numLeaves)
 	root := bytesRoot(leafData, blake, leafSize)
 
-	// convenience functions
-	leafHash := func(leaf []byte) []byte {
-		return th.HashLeaf(leaf)
-	}
-	nodeHash := func(left, right []byte) []byte {
-		return th.HashNode(left, right)
+	tests := []struct {
+		ranges    []LeafRange
+		coalesced []LeafRange
+	}{
+		{
+			ranges:    []LeafRange{{20, 21}, {3, 5}, {9, 10}},
+			coalesced: []LeafRange{{3, 5}, {9, 10}, {20, 21}},
+		},
+		{
+			ranges:    []LeafRange{{4, 8}, {2, 6}, {30, 37}},
+			coalesced: []LeafRange{{2, 8}, {30, 37}},
+		},
+		{
+			ranges:    []LeafRange{{10, 12}, {12, 14}, {0, 1}, {11, 13}},
+			coalesced: []LeafRange{{0, 1}, {10, 14}},
+		},
+		{
+			ranges:    []LeafRange{{5, 6}, {0, 37}, {17, 19}},
+			coalesced: []LeafRange{{0, 37}},
+		},
 	}
-	buildProof := func(start, end int) [][]byte {
-		// flip a coin to decide whether to use leaf data or leaf hashes
-		var sh SubtreeHasher
-		if fastrand.Intn(2) == 0 {
-			sh = NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
-		} else {
-			sh = NewCachedSubtreeHasher(leafHashes, blake)
+	for _, test := range tests {
+		orig := append([]LeafRange(nil), test.ranges...)
+		if coalesced := CoalesceRanges(test.ranges); !reflect.DeepEqual(coalesced, test.coalesced) {
+			t.Errorf("CoalesceRanges(%v): expected %v, got %v", test.ranges, test.coalesced, coalesced)
 		}
-		proof, err := BuildRangeProof(start, end, sh)
+		proof, err := BuildMultiRangeProofSorted(test.ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
 		if err != nil {
 			t.Fatal(err)
 		}
-		return proof
+		if !reflect.DeepEqual(test.ranges, orig) {
+			t.Errorf("BuildMultiRangeProofSorted modified its input: expected %v, got %v", orig, test.ranges)
+		}
+		expProof, err := BuildMultiRangeProof(test.coalesced, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(proof, expProof) {
+			t.Errorf("BuildMultiRangeProofSorted(%v) produced a different proof than BuildMultiRangeProof(%v)", test.ranges, test.coalesced)
+		}
+		var rs []io.Reader
+		for _, r := range test.coalesced {
+			rs = append(rs, bytes.NewReader(leafData[r.Start*leafSize:r.End*leafSize]))
+		}
+		lh := NewReaderLeafHasher(io.MultiReader(rs...), blake, leafSize)
+		if ok, err := VerifyMultiRangeProof(lh, blake, test.coalesced, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof for ranges %v", test.ranges)
+		}
 	}
-	verifyProof := func(start, end int, proof [][]byte) bool {
-		// flip a coin to decide whether to use leaf data or leaf hashes
-		var lh LeafHasher
-		if fastrand.Intn(2) == 0 {
-			lh = NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
-		} else {
-			lh = NewCachedLeafHasher(leafHashes[start:end])
+
+	// randomly shuffled single-leaf ranges should always produce the same
+	// proof as the sorted ranges
+	var sorted []LeafRange
+	for i := uint64(1); i < numLeaves; i += 3 {
+		sorted = append(sorted, LeafRange{i, i + 1})
+	}
+	expProof, err := BuildMultiRangeProof(sorted, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		shuffled := make([]LeafRange, len(sorted))
+		for j, k := range fastrand.Perm(len(sorted)) {
+			shuffled[j] = sorted[k]
 		}
-		ok, err := VerifyRangeProof(lh, blake, start, end, proof, root)
+		proof, err := BuildMultiRangeProofSorted(shuffled, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
 		if err != nil {
 			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, expProof) {
+			t.Fatalf("BuildMultiRangeProofSorted produced an incorrect proof for shuffled ranges %v", shuffled)
 		}
-		return ok
 	}
 
-	// test some known proofs
-	proof := buildProof(0, numLeaves)
-	if len(proof) != 0 {
-		t.Error("BuildRangeProof constructed an incorrect proof for the entire sector")
+	// degenerate ranges should be rejected rather than panicking
+	bad := [][]LeafRange{
+		{{3, 3}},
+		{{8, 9}, {5, 2}},
+	}
+	for _, ranges := range bad {
+		if _, err := BuildMultiRangeProofSorted(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)); err == nil {
+			t.Errorf("expected error for degenerate ranges %v", ranges)
+		}
 	}
+}
 
-	proof = buildProof(0, 1)
-	checkRoot := leafHash(leafData[:leafSize])
-	for i := range proof {
-		checkRoot = nodeHash(checkRoot, proof[i])
+// TestComplementRanges tests the ComplementRanges function.
+func TestComplementRanges(t *testing.T) {
+	tests := []struct {
+		ranges     []LeafRange
+		numLeaves  uint64
+		complement []LeafRange
+	}{
+		{nil, 10, []LeafRange{{0, 10}}},
+		{nil, 0, nil},
+		{[]LeafRange{{0, 10}}, 10, nil},
+		{[]LeafRange{{0, 3}}, 10, []LeafRange{{3, 10}}},
+		{[]LeafRange{{7, 10}}, 10, []LeafRange{{0, 7}}},
+		{[]LeafRange{{3, 5}}, 10, []LeafRange{{0, 3}, {5, 10}}},
+		{[]LeafRange{{0, 2}, {4, 6}, {8, 10}}, 10, []LeafRange{{2, 4}, {6, 8}}},
+		// adjacent ranges leave no gap between them
+		{[]LeafRange{{2, 4}, {4, 6}}, 10, []LeafRange{{0, 2}, {6, 10}}},
+		// order doesn't matter
+		{[]LeafRange{{8, 9}, {1, 2}}, 10, []LeafRange{{0, 1}, {2, 8}, {9, 10}}},
+		// empty ranges are ignored
+		{[]LeafRange{{3, 3}}, 10, []LeafRange{{0, 10}}},
+		// ranges beyond numLeaves are truncated
+		{[]LeafRange{{5, 20}}, 10, []LeafRange{{0, 5}}},
+		{[]LeafRange{{12, 20}}, 10, []LeafRange{{0, 10}}},
 	}
-	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
-		t.Error("BuildRangeProof constructed an incorrect proof for the first leaf")
-	} else if !verifyProof(0, 1, proof) {
-		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	for _, test := range tests {
+		complement := ComplementRanges(test.ranges, test.numLeaves)
+		if !reflect.DeepEqual(complement, test.complement) {
+			t.Errorf("ComplementRanges(%v, %v): expected %v, got %v", test.ranges, test.numLeaves, test.complement, complement)
+		}
 	}
 
-	proof = buildProof(numLeaves-1, numLeaves)
-	checkRoot = leafHash(leafData[len(leafData)-leafSize:])
-	for i := range proof {
-		checkRoot = nodeHash(proof[len(proof)-i-1], checkRoot)
+	// a proof for the complement should verify
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 32
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	complement := ComplementRanges([]LeafRange{{0, 1}, {5, 9}, {20, 21}}, numLeaves)
+	proof, err := BuildMultiRangeProof(complement, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
-		t.Error("BuildRangeProof constructed an incorrect proof for the last leaf")
-	} else if !verifyProof(numLeaves-1, numLeaves, proof) {
-		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	var rs []io.Reader
+	for _, r := range complement {
+		rs = append(rs, bytes.NewReader(leafData[r.Start*leafSize:r.End*leafSize]))
 	}
+	lh := NewReaderLeafHasher(io.MultiReader(rs...), blake, leafSize)
+	if ok, err := VerifyMultiRangeProof(lh, blake, complement, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("failed to verify proof for complement ranges")
+	}
+}
 
-	proof = buildProof(10, 11)
-	checkRoot = leafHash(leafData[10*leafSize:][:leafSize])
-	checkRoot = nodeHash(checkRoot, proof[2])
-	checkRoot = nodeHash(proof[1], checkRoot)
-	checkRoot = nodeHash(checkRoot, proof[3])
-	checkRoot = nodeHash(proof[0], checkRoot)
-	for i := 4; i < len(proof); i++ {
-		checkRoot = nodeHash(checkRoot, proof[i])
+// TestRequiredLeafIndices tests the RequiredLeafIndices function.
+func TestRequiredLeafIndices(t *testing.T) {
+	tests := []struct {
+		ranges  []LeafRange
+		indices []uint64
+	}{
+		{nil, []uint64{}},
+		{[]LeafRange{{0, 1}}, []uint64{0}},
+		{[]LeafRange{{3, 5}, {9, 10}}, []uint64{3, 4, 9}},
+		{[]LeafRange{{0, 2}, {2, 4}}, []uint64{0, 1, 2, 3}},
 	}
-	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
-		t.Error("BuildRangeProof constructed an incorrect proof for a middle leaf")
-	} else if !verifyProof(10, 11, proof) {
-		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	for _, test := range tests {
+		if indices := RequiredLeafIndices(test.ranges); !reflect.DeepEqual(indices, test.indices) {
+			t.Errorf("RequiredLeafIndices(%v): expected %v, got %v", test.ranges, test.indices, indices)
+		}
 	}
 
-	// this is the largest possible proof
-	midl, midr := numLeaves/2-1, numLeaves/2+1
-	proof = buildProof(midl, midr)
-	left := leafHash(leafData[midl*leafSize:][:leafSize])
-	for i := 0; i < len(proof)/2; i++ {
-		left = nodeHash(proof[len(proof)/2-i-1], left)
+	// the indices should select exactly the leaf hashes needed to verify a
+	// proof for the multi-range fixture
+	const leafSize = 64
+	const numLeaves = 1 << 16
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	leafData := make([]byte, leafSize*numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
 	}
-	right := leafHash(leafData[(midr-1)*leafSize:][:leafSize])
-	for i := len(proof) / 2; i < len(proof); i++ {
-		right = nodeHash(right, proof[i])
+	ranges := []LeafRange{{0, 1}, {numLeaves - 1, numLeaves}}
+	indices := RequiredLeafIndices(ranges)
+	if !reflect.DeepEqual(indices, []uint64{0, numLeaves - 1}) {
+		t.Fatalf("RequiredLeafIndices(%v) returned %v", ranges, indices)
 	}
-	checkRoot = nodeHash(left, right)
-	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
-		t.Error("BuildRangeProof constructed an incorrect proof for worst-case inputs")
-	} else if !verifyProof(midl, midr, proof) {
-		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
 	}
+	var hashes [][]byte
+	for _, i := range indices {
+		hashes = append(hashes, leafHashes[i])
+	}
+	if ok, err := VerifyMultiRangeProof(NewCachedLeafHasher(hashes), blake, ranges, proof, recNodeRoot(leafHashes, blake)); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("failed to verify proof using the required leaf hashes")
+	}
+}
 
-	// for more intensive testing, use smaller trees
-	buildSmallProof := func(start, end, nLeaves int) [][]byte {
-		// flip a coin to decide whether to use leaf data or leaf hashes
-		var sh SubtreeHasher
-		if fastrand.Intn(2) == 0 {
-			sh = NewReaderSubtreeHasher(bytes.NewReader(leafData[:leafSize*nLeaves]), leafSize, blake)
-		} else {
-			sh = NewCachedSubtreeHasher(leafHashes[:nLeaves], blake)
-		}
-		proof, err := BuildRangeProof(start, end, sh)
-		if err != nil {
-			t.Fatal(err)
-		}
-		return proof
-
+// TestTreeHeight tests TreeHeight and MaxProofLength around powers of two.
+func TestTreeHeight(t *testing.T) {
+	tests := []struct {
+		numLeaves uint64
+		height    int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{5, 3},
+		{7, 3},
+		{8, 3},
+		{9, 4},
+		{1023, 10},
+		{1024, 10},
+		{1025, 11},
+		{1 << 63, 63},
+		{1<<63 + 1, 64},
+		{math.MaxUint64, 64},
 	}
-	verifySmallProof := func(start, end int, proof [][]byte, nLeaves int) bool {
-		// flip a coin to decide whether to use leaf data or leaf hashes
-		var lh LeafHasher
-		if fastrand.Intn(2) == 0 {
-			lh = NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
-		} else {
-			lh = NewCachedLeafHasher(leafHashes[start:end])
-		}
-		smallRoot := bytesRoot(leafData[:leafSize*nLeaves], blake, leafSize)
-		ok, err := VerifyRangeProof(lh, blake, start, end, proof, smallRoot)
-		if err != nil {
-			t.Fatal(err)
+	for _, test := range tests {
+		if h := TreeHeight(test.numLeaves); h != test.height {
+			t.Errorf("TreeHeight(%v): expected %v, got %v", test.numLeaves, test.height, h)
 		}
-		return ok
 	}
 
-	// test some random proofs against VerifyRangeProof
-	for nLeaves := 1; nLeaves <= 65; nLeaves++ {
-		for n := 0; n < 5; n++ {
-			start := fastrand.Intn(nLeaves)
-			end := start + fastrand.Intn(nLeaves-start) + 1
-			proof := buildSmallProof(start, end, nLeaves)
-			if !verifySmallProof(start, end, proof, nLeaves) {
-				t.Errorf("BuildRangeProof constructed an incorrect proof for nLeaves=%v, range %v-%v", nLeaves, start, end)
+	// MaxProofLength should match the longest single-leaf proof
+	for numLeaves := uint64(1); numLeaves < 70; numLeaves++ {
+		var max int
+		for i := uint64(0); i < numLeaves; i++ {
+			if n := MultiRangeProofSize([]LeafRange{{i, i + 1}}, numLeaves); n > max {
+				max = n
 			}
+		}
+		if n := MaxProofLength(numLeaves); n != max {
+			t.Errorf("MaxProofLength(%v): expected %v, got %v", numLeaves, max, n)
+		}
+	}
+}
 
-			// corrupt the proof; it should fail to verify
-			if len(proof) == 0 {
+// TestIsCanonicalProof tests the MultiRangeProofSize and IsCanonicalProof
+// functions.
+func TestIsCanonicalProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	for numLeaves := uint64(1); numLeaves <= 40; numLeaves++ {
+		leafHashes := make([][]byte, numLeaves)
+		for i := range leafHashes {
+			leafHashes[i] = th.HashLeaf([]byte{byte(i)})
+		}
+		for _, ranges := range [][]LeafRange{
+			{{0, 1}},
+			{{numLeaves - 1, numLeaves}},
+			{{0, numLeaves}},
+			{{numLeaves / 3, numLeaves/2 + 1}},
+			{{0, 1}, {numLeaves - 1, numLeaves}},
+		} {
+			if !validRangeSet(ranges) {
 				continue
 			}
-			switch fastrand.Intn(3) {
-			case 0:
-				// modify an element of the proof
-				proof[fastrand.Intn(len(proof))][fastrand.Intn(blake.Size())]++
-			case 1:
-				// add an element to the proof
-				proof = append(proof, make([]byte, blake.Size()))
-				i := fastrand.Intn(len(proof))
-				proof[i], proof[len(proof)-1] = proof[len(proof)-1], proof[i]
-			case 2:
-				// delete a random element of the proof
-				i := fastrand.Intn(len(proof))
-				proof = append(proof[:i], proof[i+1:]...)
+			proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
 			}
-			if verifyProof(start, end, proof) {
-				t.Errorf("VerifyRangeProof verified an incorrect proof for nLeaves=%v, range %v-%v", nLeaves, start, end)
+			if size := MultiRangeProofSize(ranges, numLeaves); size != len(proof) {
+				t.Fatalf("MultiRangeProofSize(%v, %v): expected %v, got %v", ranges, numLeaves, len(proof), size)
+			}
+			if !IsCanonicalProof(ranges, proof, numLeaves) {
+				t.Errorf("IsCanonicalProof(%v, %v) rejected a valid proof", ranges, numLeaves)
 			}
-		}
-	}
 
-	// build and verify every possible proof for a small tree
-	for start := 0; start < 12; start++ {
-		for end := start + 1; end <= 12; end++ {
-			proof := buildSmallProof(start, end, 12)
-			if !verifySmallProof(start, end, proof, 12) {
-				t.Errorf("BuildRangeProof constructed an incorrect proof for range %v-%v", start, end)
+			// padded proofs should be rejected
+			padded := append(append([][]byte(nil), proof...), leafHashes[0])
+			if IsCanonicalProof(ranges, padded, numLeaves) {
+				t.Errorf("IsCanonicalProof(%v, %v) accepted a padded proof", ranges, numLeaves)
+			}
+			padded = append([][]byte{leafHashes[0]}, proof...)
+			if IsCanonicalProof(ranges, padded, numLeaves) {
+				t.Errorf("IsCanonicalProof(%v, %v) accepted a prepended proof", ranges, numLeaves)
+			}
+			if len(proof) > 0 && IsCanonicalProof(ranges, proof[1:], numLeaves) {
+				t.Errorf("IsCanonicalProof(%v, %v) accepted a truncated proof", ranges, numLeaves)
 			}
 		}
 	}
 
-	// manually verify every hash in a proof
-	//
-	// NOTE: this is the same proof described in the BuildRangeProof comment:
-	//
-	//               ┌────────┴────────*
-	//         ┌─────┴─────┐           │
-	//      *──┴──┐     ┌──┴──*     ┌──┴──┐
-	//    ┌─┴─┐ *─┴─┐ ┌─┴─* ┌─┴─┐ ┌─┴─┐ ┌─┴─┐
-	//    0   1 2   3 4   5 6   7 8   9 10  11
-	//              ^^^
-	//
-	proof = buildSmallProof(3, 5, 12)
-	subtreeRoot := func(i, j int) []byte {
-		return bytesRoot(leafData[i*leafSize:j*leafSize], blake, leafSize)
+	// invalid ranges should be rejected
+	if IsCanonicalProof([]LeafRange{{0, 5}}, nil, 4) {
+		t.Error("IsCanonicalProof accepted ranges extending beyond the tree")
 	}
-	manualProof := [][]byte{
-		subtreeRoot(0, 2),
-		subtreeRoot(2, 3),
-		subtreeRoot(5, 6),
-		subtreeRoot(6, 8),
-		subtreeRoot(8, 12),
+	if IsCanonicalProof([]LeafRange{{2, 3}, {0, 1}}, [][]byte{{1}, {2}}, 4) {
+		t.Error("IsCanonicalProof accepted unsorted ranges")
+	}
+	if !IsCanonicalProof(nil, nil, 4) || IsCanonicalProof(nil, [][]byte{{1}}, 4) {
+		t.Error("IsCanonicalProof mishandled empty ranges")
+	}
+}
+
+// TestSubtreeRoots tests that the roots produced by SubtreeRoots can be used
+// with a MixedSubtreeHasher to produce valid proofs.
+func TestSubtreeRoots(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const leavesPerNode = 4
+	// 10 full nodes, plus a short node whose final leaf is also short
+	leafData := fastrand.Bytes(leafSize*leavesPerNode*10 + 2*leafSize + 7)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	nodeHashes, err := SubtreeRoots(bytes.NewReader(leafData), leafSize, leavesPerNode, blake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodeHashes) != 11 {
+		t.Fatalf("expected %v node hashes, got %v", 11, len(nodeHashes))
+	}
+	const nodeSize = leafSize * leavesPerNode
+	for i := range nodeHashes {
+		end := (i + 1) * nodeSize
+		if end > len(leafData) {
+			end = len(leafData)
+		}
+		if exp := bytesRoot(leafData[i*nodeSize:end], blake, leafSize); !bytes.Equal(nodeHashes[i], exp) {
+			t.Fatalf("node hash %v: expected %x, got %x", i, exp, nodeHashes[i])
+		}
+	}
+
+	// prove each full node using only the node hashes
+	for i := 0; i < 10; i++ {
+		ranges := []LeafRange{{uint64(i * leavesPerNode), uint64((i + 1) * leavesPerNode)}}
+		proof, err := BuildMultiRangeProof(ranges, NewMixedSubtreeHasher(nodeHashes, nil, leavesPerNode, leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lh := NewReaderLeafHasher(bytes.NewReader(leafData[i*nodeSize:][:nodeSize]), blake, leafSize)
+		if ok, err := VerifyMultiRangeProof(lh, blake, ranges, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof for node %v", i)
+		}
+	}
+
+	if _, err := SubtreeRoots(bytes.NewReader(leafData), leafSize, 0, blake); err == nil {
+		t.Error("SubtreeRoots accepted leavesPerNode of 0")
+	}
+	if roots, err := SubtreeRoots(bytes.NewReader(nil), leafSize, leavesPerNode, blake); err != nil || len(roots) != 0 {
+		t.Errorf("expected no roots for empty reader, got %v (%v)", roots, err)
+	}
+}
+
+// TestProveLeaf tests that ProveLeaf produces the same proof as
+// BuildRangeProof.
+func TestProveLeaf(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const numLeaves = 37
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf([]byte{byte(i)})
+	}
+	root := recNodeRoot(leafHashes, blake)
+
+	for i := 0; i < numLeaves; i++ {
+		leafHash, proof, err := ProveLeaf(leafHashes, i, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expProof, err := BuildRangeProof(i, i+1, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(leafHash, leafHashes[i]) {
+			t.Fatalf("leaf %v: expected leaf hash %x, got %x", i, leafHashes[i], leafHash)
+		} else if !ProofsEqual(proof, expProof) {
+			t.Fatalf("leaf %v: %v", i, ProofEqualityReport(proof, expProof))
+		}
+		if ok, err := VerifyRangeProof(NewCachedLeafHasher([][]byte{leafHash}), blake, i, i+1, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("leaf %v: proof did not verify", i)
+		}
+	}
+
+	for _, i := range []int{-1, numLeaves, numLeaves + 10} {
+		if _, _, err := ProveLeaf(leafHashes, i, blake); err == nil {
+			t.Errorf("ProveLeaf accepted out-of-range index %v", i)
+		}
+	}
+	if _, _, err := ProveLeaf(nil, 0, blake); err == nil {
+		t.Error("ProveLeaf accepted an empty tree")
+	}
+}
+
+// TestBuildVerifyIndexProof tests the BuildIndexProof and VerifyIndexProof
+// functions.
+func TestBuildVerifyIndexProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const leafSize = 64
+	const numLeaves = 50
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
+
+	tests := []struct {
+		indices []int
+		ranges  []LeafRange
+	}{
+		{
+			indices: []int{3, 9, 40, 41},
+			ranges:  []LeafRange{{3, 4}, {9, 10}, {40, 42}},
+		},
+		{
+			indices: []int{41, 9, 3, 40},
+			ranges:  []LeafRange{{3, 4}, {9, 10}, {40, 42}},
+		},
+		{
+			indices: []int{9, 9, 3, 41, 40, 3, 41},
+			ranges:  []LeafRange{{3, 4}, {9, 10}, {40, 42}},
+		},
+		{
+			indices: []int{0, 2, 1, 49},
+			ranges:  []LeafRange{{0, 3}, {49, 50}},
+		},
+	}
+	for _, test := range tests {
+		proof, ranges, err := BuildIndexProof(test.indices, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("BuildIndexProof(%v): expected ranges %v, got %v", test.indices, test.ranges, ranges)
+		}
+		expProof, err := BuildMultiRangeProof(test.ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, expProof) {
+			t.Errorf("BuildIndexProof(%v) produced an incorrect proof", test.indices)
+		}
+
+		var hashes [][]byte
+		for _, r := range ranges {
+			hashes = append(hashes, leafHashes[r.Start:r.End]...)
+		}
+		if ok, err := VerifyIndexProof(NewCachedLeafHasher(hashes), blake, test.indices, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("VerifyIndexProof(%v) failed to verify a valid proof", test.indices)
+		}
+	}
+
+	// negative indices should be rejected
+	if _, _, err := BuildIndexProof([]int{1, -1}, NewCachedSubtreeHasher(leafHashes, blake)); err == nil {
+		t.Error("expected error for negative index")
+	}
+	if _, err := VerifyIndexProof(NewCachedLeafHasher(leafHashes), blake, []int{-1}, nil, root); err == nil {
+		t.Error("expected error for negative index")
+	}
+}
+
+// TestMultiRangeLeafHasher tests that NewMultiRangeLeafHasher can be used to
+// verify multi-range proofs.
+func TestMultiRangeLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 30
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	rangeData := func(r LeafRange) RangeData {
+		return RangeData{Range: r, Data: leafData[r.Start*leafSize : r.End*leafSize]}
+	}
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{29, 30}},
+		{{3, 5}, {9, 10}},
+		{{0, 1}, {2, 3}, {4, 5}, {6, 7}},
+		{{1, 13}, {15, 30}},
+	} {
+		proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rds []RangeData
+		for _, r := range ranges {
+			rds = append(rds, rangeData(r))
+		}
+		ok, err := VerifyMultiRangeProof(NewMultiRangeLeafHasher(rds, blake, leafSize), blake, ranges, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof for ranges %v", ranges)
+		}
+
+		// the order of the RangeData should not matter
+		for i, j := range fastrand.Perm(len(rds)) {
+			rds[i] = rangeData(ranges[j])
+		}
+		ok, err = VerifyMultiRangeProof(NewMultiRangeLeafHasher(rds, blake, leafSize), blake, ranges, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof for shuffled ranges %v", ranges)
+		}
+	}
+
+	// a range with too little or too much data should be rejected, rather
+	// than borrowing leaves from the next range
+	ranges := []LeafRange{{3, 5}, {9, 10}}
+	proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rds := range [][]RangeData{
+		{{Range: ranges[0], Data: leafData[3*leafSize : 5*leafSize-1]}, rangeData(ranges[1])},
+		{{Range: ranges[0], Data: leafData[3*leafSize : 5*leafSize+1]}, rangeData(ranges[1])},
+		{rangeData(ranges[0]), {Range: ranges[1], Data: leafData[9*leafSize : 10*leafSize+1]}},
+		{rangeData(ranges[0]), {Range: ranges[1], Data: nil}},
+	} {
+		if _, err := VerifyMultiRangeProof(NewMultiRangeLeafHasher(rds, blake, leafSize), blake, ranges, proof, root); err == nil {
+			t.Error("expected error for mismatched leaf data")
+		}
+	}
+}
+
+// TestRootFromLeaves tests the RootFromLeaves function.
+func TestRootFromLeaves(t *testing.T) {
+	const dataSize = 1 << 22
+	const leafSize = 64
+	const numLeaves = dataSize / leafSize
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	leafData := make([]byte, dataSize)
+	leafHash := th.HashLeaf(leafData[:leafSize])
+
+	ranges := []LeafRange{
+		{0, 1},
+		{numLeaves - 1, numLeaves},
+	}
+	proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := map[uint64][]byte{
+		0:             leafHash,
+		numLeaves - 1: leafHash,
+	}
+	root, err := RootFromLeaves(leaves, proof, ranges, numLeaves, blake)
+	if err != nil {
+		t.Fatal(err)
+	} else if hex.EncodeToString(root) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
+		t.Error("RootFromLeaves reconstructed an incorrect root:", hex.EncodeToString(root))
+	}
+
+	// missing, extra, and out-of-bounds leaves should be rejected
+	if _, err := RootFromLeaves(map[uint64][]byte{0: leafHash}, proof, ranges, numLeaves, blake); err == nil {
+		t.Error("RootFromLeaves accepted a missing leaf")
+	}
+	leaves[1] = leafHash
+	if _, err := RootFromLeaves(leaves, proof, ranges, numLeaves, blake); err == nil {
+		t.Error("RootFromLeaves accepted an extra leaf")
+	}
+	delete(leaves, 1)
+	if _, err := RootFromLeaves(leaves, proof, ranges, numLeaves-1, blake); err == nil {
+		t.Error("RootFromLeaves accepted a range beyond the end of the tree")
+	}
+	if _, err := RootFromLeaves(leaves, proof, nil, numLeaves, blake); err == nil {
+		t.Error("RootFromLeaves accepted an empty set of ranges")
+	}
+}
+
+// TestBuildVerifyRangeProof tests the BuildRangeProof and VerifyRangeProof
+// functions.
+func TestBuildVerifyRangeProof(t *testing.T) {
+	// setup proof parameters
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	leafData := make([]byte, 1<<22)
+	const leafSize = 64
+	numLeaves := len(leafData) / 64
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
+
+	// convenience functions
+	leafHash := func(leaf []byte) []byte {
+		return th.HashLeaf(leaf)
+	}
+	nodeHash := func(left, right []byte) []byte {
+		return th.HashNode(left, right)
+	}
+	buildProof := func(start, end int) [][]byte {
+		// flip a coin to decide whether to use leaf data or leaf hashes
+		var sh SubtreeHasher
+		if fastrand.Intn(2) == 0 {
+			sh = NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+		} else {
+			sh = NewCachedSubtreeHasher(leafHashes, blake)
+		}
+		proof, err := BuildRangeProof(start, end, sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	verifyProof := func(start, end int, proof [][]byte) bool {
+		// flip a coin to decide whether to use leaf data or leaf hashes
+		var lh LeafHasher
+		if fastrand.Intn(2) == 0 {
+			lh = NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+		} else {
+			lh = NewCachedLeafHasher(leafHashes[start:end])
+		}
+		ok, err := VerifyRangeProof(lh, blake, start, end, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// test some known proofs
+	proof := buildProof(0, numLeaves)
+	if len(proof) != 0 {
+		t.Error("BuildRangeProof constructed an incorrect proof for the entire sector")
+	}
+
+	proof = buildProof(0, 1)
+	checkRoot := leafHash(leafData[:leafSize])
+	for i := range proof {
+		checkRoot = nodeHash(checkRoot, proof[i])
+	}
+	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
+		t.Error("BuildRangeProof constructed an incorrect proof for the first leaf")
+	} else if !verifyProof(0, 1, proof) {
+		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	}
+
+	proof = buildProof(numLeaves-1, numLeaves)
+	checkRoot = leafHash(leafData[len(leafData)-leafSize:])
+	for i := range proof {
+		checkRoot = nodeHash(proof[len(proof)-i-1], checkRoot)
+	}
+	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
+		t.Error("BuildRangeProof constructed an incorrect proof for the last leaf")
+	} else if !verifyProof(numLeaves-1, numLeaves, proof) {
+		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	}
+
+	proof = buildProof(10, 11)
+	checkRoot = leafHash(leafData[10*leafSize:][:leafSize])
+	checkRoot = nodeHash(checkRoot, proof[2])
+	checkRoot = nodeHash(proof[1], checkRoot)
+	checkRoot = nodeHash(checkRoot, proof[3])
+	checkRoot = nodeHash(proof[0], checkRoot)
+	for i := 4; i < len(proof); i++ {
+		checkRoot = nodeHash(checkRoot, proof[i])
+	}
+	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
+		t.Error("BuildRangeProof constructed an incorrect proof for a middle leaf")
+	} else if !verifyProof(10, 11, proof) {
+		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	}
+
+	// this is the largest possible proof
+	midl, midr := numLeaves/2-1, numLeaves/2+1
+	proof = buildProof(midl, midr)
+	left := leafHash(leafData[midl*leafSize:][:leafSize])
+	for i := 0; i < len(proof)/2; i++ {
+		left = nodeHash(proof[len(proof)/2-i-1], left)
+	}
+	right := leafHash(leafData[(midr-1)*leafSize:][:leafSize])
+	for i := len(proof) / 2; i < len(proof); i++ {
+		right = nodeHash(right, proof[i])
+	}
+	checkRoot = nodeHash(left, right)
+	if hex.EncodeToString(checkRoot) != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
+		t.Error("BuildRangeProof constructed an incorrect proof for worst-case inputs")
+	} else if !verifyProof(midl, midr, proof) {
+		t.Error("VerifyRangeProof failed to verify a known correct proof")
+	}
+
+	// for more intensive testing, use smaller trees
+	buildSmallProof := func(start, end, nLeaves int) [][]byte {
+		// flip a coin to decide whether to use leaf data or leaf hashes
+		var sh SubtreeHasher
+		if fastrand.Intn(2) == 0 {
+			sh = NewReaderSubtreeHasher(bytes.NewReader(leafData[:leafSize*nLeaves]), leafSize, blake)
+		} else {
+			sh = NewCachedSubtreeHasher(leafHashes[:nLeaves], blake)
+		}
+		proof, err := BuildRangeProof(start, end, sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+
+	}
+	verifySmallProof := func(start, end int, proof [][]byte, nLeaves int) bool {
+		// flip a coin to decide whether to use leaf data or leaf hashes
+		var lh LeafHasher
+		if fastrand.Intn(2) == 0 {
+			lh = NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+		} else {
+			lh = NewCachedLeafHasher(leafHashes[start:end])
+		}
+		smallRoot := bytesRoot(leafData[:leafSize*nLeaves], blake, leafSize)
+		ok, err := VerifyRangeProof(lh, blake, start, end, proof, smallRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// test some random proofs against VerifyRangeProof
+	for nLeaves := 1; nLeaves <= 65; nLeaves++ {
+		for n := 0; n < 5; n++ {
+			start := fastrand.Intn(nLeaves)
+			end := start + fastrand.Intn(nLeaves-start) + 1
+			proof := buildSmallProof(start, end, nLeaves)
+			if !verifySmallProof(start, end, proof, nLeaves) {
+				t.Errorf("BuildRangeProof constructed an incorrect proof for nLeaves=%v, range %v-%v", nLeaves, start, end)
+			}
+
+			// corrupt the proof; it should fail to verify
+			if len(proof) == 0 {
+				continue
+			}
+			switch fastrand.Intn(3) {
+			case 0:
+				// modify an element of the proof
+				proof[fastrand.Intn(len(proof))][fastrand.Intn(blake.Size())]++
+			case 1:
+				// add an element to the proof
+				proof = append(proof, make([]byte, blake.Size()))
+				i := fastrand.Intn(len(proof))
+				proof[i], proof[len(proof)-1] = proof[len(proof)-1], proof[i]
+			case 2:
+				// delete a random element of the proof
+				i := fastrand.Intn(len(proof))
+				proof = append(proof[:i], proof[i+1:]...)
+			}
+			if verifyProof(start, end, proof) {
+				t.Errorf("VerifyRangeProof verified an incorrect proof for nLeaves=%v, range %v-%v", nLeaves, start, end)
+			}
+		}
+	}
+
+	// build and verify every possible proof for a small tree
+	for start := 0; start < 12; start++ {
+		for end := start + 1; end <= 12; end++ {
+			proof := buildSmallProof(start, end, 12)
+			if !verifySmallProof(start, end, proof, 12) {
+				t.Errorf("BuildRangeProof constructed an incorrect proof for range %v-%v", start, end)
+			}
+		}
+	}
+
+	// manually verify every hash in a proof
+	//
+	// NOTE: this is the same proof described in the BuildRangeProof comment:
+	//
+	//               ┌────────┴────────*
+	//         ┌─────┴─────┐           │
+	//      *──┴──┐     ┌──┴──*     ┌──┴──┐
+	//    ┌─┴─┐ *─┴─┐ ┌─┴─* ┌─┴─┐ ┌─┴─┐ ┌─┴─┐
+	//    0   1 2   3 4   5 6   7 8   9 10  11
+	//              ^^^
+	//
+	proof = buildSmallProof(3, 5, 12)
+	subtreeRoot := func(i, j int) []byte {
+		return bytesRoot(leafData[i*leafSize:j*leafSize], blake, leafSize)
+	}
+	manualProof := [][]byte{
+		subtreeRoot(0, 2),
+		subtreeRoot(2, 3),
+		subtreeRoot(5, 6),
+		subtreeRoot(6, 8),
+		subtreeRoot(8, 12),
 	}
 	if !reflect.DeepEqual(proof, manualProof) {
 		t.Error("BuildRangeProof constructed a proof that differs from manual proof")
 	}
 
-	// test a proof with precomputed inputs
-	precalcRoots := [][]byte{
-		bytesRoot(leafData[:len(leafData)/2], blake, leafSize),
-		bytesRoot(leafData[len(leafData)/2:], blake, leafSize),
+	// test a proof with precomputed inputs
+	precalcRoots := [][]byte{
+		bytesRoot(leafData[:len(leafData)/2], blake, leafSize),
+		bytesRoot(leafData[len(leafData)/2:], blake, leafSize),
+	}
+	precalc := newPrecalcSubtreeHasher(precalcRoots, numLeaves/2, blake, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	proof, err := BuildRangeProof(numLeaves-1, numLeaves, precalc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recalcProof, err := BuildRangeProof(numLeaves-1, numLeaves, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, recalcProof) {
+		t.Fatal("precalc failed")
+	}
+}
+
+// corruptSubtreeHasher wraps a SubtreeHasher and corrupts the nth subtree root
+// that it produces.
+type corruptSubtreeHasher struct {
+	sh SubtreeHasher
+	n  int
+}
+
+func (c *corruptSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	root, err := c.sh.NextSubtreeRoot(subtreeSize)
+	if c.n == 0 && err == nil {
+		root = append([]byte(nil), root...)
+		root[0] ^= 1
+	}
+	c.n--
+	return root, err
+}
+
+func (c *corruptSubtreeHasher) Skip(n int) error {
+	return c.sh.Skip(n)
+}
+
+// TestBuildVerifiedRangeProof tests that BuildVerifiedRangeProof returns
+// correct proofs and detects incorrect ones.
+func TestBuildVerifiedRangeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	lh := func(start, end int) LeafHasher {
+		return NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+	}
+	for _, r := range []LeafRange{{0, 1}, {10, 20}, {50, 99}, {0, numLeaves}} {
+		start, end := int(r.Start), int(r.End)
+		sh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+		proof, err := BuildVerifiedRangeProof(start, end, sh, lh(start, end), blake, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if !ProofsEqual(proof, expected) {
+			t.Error("BuildVerifiedRangeProof returned a different proof than BuildRangeProof")
+		}
+		if len(proof) == 0 {
+			continue
+		}
+
+		// corrupt one of the subtree roots
+		sh = NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+		csh := &corruptSubtreeHasher{sh: sh, n: fastrand.Intn(len(proof))}
+		if _, err := BuildVerifiedRangeProof(start, end, csh, lh(start, end), blake, root); err != ErrSelfCheckFailed {
+			t.Errorf("expected %v, got %v", ErrSelfCheckFailed, err)
+		}
+	}
+}
+
+// TestBuildProofRangeEOF tests that BuildRangeProof behaves correctly in the
+// presence of EOF errors.
+func TestBuildProofRangeEOF(t *testing.T) {
+	// setup proof parameters
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	leafData := make([]byte, 1<<22)
+	const leafSize = 64
+	numLeaves := len(leafData) / 64
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+
+	// build a proof for the middle of the tree, but only supply half of the
+	// leafData. This should trigger an io.ErrUnexpectedEOF when
+	// BuildRangeProof tries to skip over the proof range.
+	midl, midr := numLeaves/2-1, numLeaves/2+1
+
+	// test with both ReaderSubtreeHasher and CachedSubtreeHasher
+	shs := []SubtreeHasher{
+		NewReaderSubtreeHasher(bytes.NewReader(leafData[:len(leafData)/2]), leafSize, blake),
+		NewCachedSubtreeHasher(leafHashes[:len(leafHashes)/2], blake),
+	}
+	for _, sh := range shs {
+		if _, err := BuildRangeProof(midl, midr, sh); err != io.ErrUnexpectedEOF {
+			t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+		}
+	}
+}
+
+// An errReader returns its data, followed by err.
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	if len(er.data) == 0 {
+		return 0, er.err
+	}
+	n := copy(p, er.data)
+	er.data = er.data[n:]
+	if len(er.data) == 0 {
+		return n, er.err
+	}
+	return n, nil
+}
+
+// TestReaderSubtreeHasherExpecting tests that a ReaderSubtreeHasher created
+// with NewReaderSubtreeHasherExpecting rejects truncated streams.
+func TestReaderSubtreeHasherExpecting(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+
+	// a complete stream should produce the usual proofs
+	for _, r := range []LeafRange{{0, 1}, {40, 60}, {99, 100}} {
+		expected, err := BuildMultiRangeProof([]LeafRange{r}, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := BuildMultiRangeProof([]LeafRange{r}, NewReaderSubtreeHasherExpecting(bytes.NewReader(leafData), leafSize, numLeaves, blake))
+		if err != nil {
+			t.Fatal(err)
+		} else if !ProofsEqual(proof, expected) {
+			t.Fatalf("proofs for range %v differ: %v", r, ProofEqualityReport(proof, expected))
+		}
+	}
+
+	// a truncated stream should be rejected, whether the missing leaves are
+	// hashed or skipped
+	truncated := leafData[:60*leafSize+10]
+	for _, r := range []LeafRange{{0, 1}, {40, 60}, {50, 90}, {61, 62}} {
+		sh := NewReaderSubtreeHasherExpecting(bytes.NewReader(truncated), leafSize, numLeaves, blake)
+		if _, err := BuildMultiRangeProof([]LeafRange{r}, sh); err != ErrShortStream {
+			t.Errorf("range %v: expected %v, got %v", r, ErrShortStream, err)
+		}
+	}
+
+	// a short final leaf is permitted, and may be skipped
+	short := leafData[:len(leafData)-5]
+	th := NewDefaultHasher(blake)
+	var leafHashes [][]byte
+	for buf := bytes.NewBuffer(short); buf.Len() > 0; {
+		leafHashes = append(leafHashes, th.HashLeaf(buf.Next(leafSize)))
+	}
+	for _, r := range []LeafRange{{0, 1}, {98, 100}} {
+		expected, err := BuildMultiRangeProof([]LeafRange{r}, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := BuildMultiRangeProof([]LeafRange{r}, NewReaderSubtreeHasherExpecting(bytes.NewReader(short), leafSize, numLeaves, blake))
+		if err != nil {
+			t.Fatal(err)
+		} else if !ProofsEqual(proof, expected) {
+			t.Fatalf("proofs for range %v differ: %v", r, ProofEqualityReport(proof, expected))
+		}
+	}
+}
+
+// TestStreamingReaderSubtreeHasher tests that a ReaderSubtreeHasher that hashes
+// leaves in chunks produces the same roots and proofs as one that reads each
+// leaf in full.
+func TestStreamingReaderSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for _, leafSize := range []int{1, 64, 1000, 1 << 16} {
+		for _, chunkSize := range []int{1, 7, 64, leafSize, 2 * leafSize} {
+			if leafSize/chunkSize > 1<<12 {
+				continue // too slow
+			}
+			// include a partial leaf at the end
+			leafData := fastrand.Bytes(leafSize*5 + leafSize/2 + 1)
+			sh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+			ssh := NewStreamingReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, chunkSize, blake)
+			for {
+				root, err := sh.NextSubtreeRoot(2)
+				sroot, serr := ssh.NextSubtreeRoot(2)
+				if err != serr {
+					t.Fatalf("leafSize %v, chunkSize %v: errors differ: %v != %v", leafSize, chunkSize, err, serr)
+				} else if !bytes.Equal(root, sroot) {
+					t.Fatalf("leafSize %v, chunkSize %v: roots differ", leafSize, chunkSize)
+				} else if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// proofs should also be identical
+			proof, err := BuildRangeProof(2, 3, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sproof, err := BuildRangeProof(2, 3, NewStreamingReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, chunkSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(proof, sproof) {
+				t.Fatalf("leafSize %v, chunkSize %v: proofs differ", leafSize, chunkSize)
+			}
+		}
+	}
+}
+
+// TestVerifyMultiRangeProofFunc tests that VerifyMultiRangeProofFunc can be
+// used to verify many proofs concurrently. Run with -race to detect sharing of
+// hash state.
+func TestVerifyMultiRangeProofFunc(t *testing.T) {
+	newHash := func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, newHash(), leafSize)
+
+	rangeSets := [][]LeafRange{
+		{{0, 1}},
+		{{numLeaves - 1, numLeaves}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {50, 70}, {98, 99}},
+	}
+	proofs := make([][][]byte, len(rangeSets))
+	for i, ranges := range rangeSets {
+		proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, newHash()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proofs[i] = proof
+	}
+	leafHasher := func(ranges []LeafRange) LeafHasher {
+		var rds []RangeData
+		for _, r := range ranges {
+			rds = append(rds, RangeData{Range: r, Data: leafData[r.Start*leafSize : r.End*leafSize]})
+		}
+		return NewMultiRangeLeafHasher(rds, newHash(), leafSize)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				i := (g + j) % len(rangeSets)
+				ok, err := VerifyMultiRangeProofFunc(leafHasher(rangeSets[i]), newHash, rangeSets[i], proofs[i], root)
+				if err != nil {
+					t.Error(err)
+					return
+				} else if !ok {
+					t.Errorf("failed to verify proof for ranges %v", rangeSets[i])
+					return
+				}
+			}
+			ok, err := VerifyRangeProofFunc(leafHasher(rangeSets[0]), newHash, 0, 1, proofs[0], root)
+			if err != nil {
+				t.Error(err)
+			} else if !ok {
+				t.Error("failed to verify single range proof")
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// TestVerifyMultiRangeProofLimited tests that VerifyMultiRangeProofLimited
+// rejects oversized proofs before reading any leaves.
+func TestVerifyMultiRangeProofLimited(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	leafHash := NewDefaultHasher(blake).HashLeaf(leafData[37*leafSize:][:leafSize])
+
+	proof, err := BuildRangeProof(37, 38, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxLen := MaxProofLength(numLeaves)
+	ranges := []LeafRange{{37, 38}}
+	if ok, err := VerifyMultiRangeProofLimited(NewCachedLeafHasher([][]byte{leafHash}), blake, ranges, proof, root, maxLen); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof within limit")
+	}
+
+	// an oversized proof should be rejected without consuming any leaves
+	for _, extra := range []int{1, 1 << 20} {
+		oversized := append(append([][]byte(nil), proof...), make([][]byte, maxLen+extra-len(proof))...)
+		lh := NewCachedLeafHasher([][]byte{leafHash})
+		if _, err := VerifyMultiRangeProofLimited(lh, blake, ranges, oversized, root, maxLen); err != ErrProofTooLarge {
+			t.Fatalf("expected %v, got %v", ErrProofTooLarge, err)
+		} else if len(lh.leafHashes) != 1 {
+			t.Fatal("leaves were consumed before the proof was rejected")
+		}
+	}
+
+	// a limit smaller than the honest proof should also reject it
+	if _, err := VerifyMultiRangeProofLimited(NewCachedLeafHasher([][]byte{leafHash}), blake, ranges, proof, root, len(proof)-1); err != ErrProofTooLarge {
+		t.Fatalf("expected %v, got %v", ErrProofTooLarge, err)
+	}
+}
+
+// TestVerifyInterleavedProof tests that VerifyInterleavedProof verifies proofs
+// whose leaf and proof hashes are interleaved in traversal order.
+func TestVerifyInterleavedProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	th := NewDefaultHasher(blake)
+
+	type tagged struct {
+		isLeaf bool
+		hash   []byte
+	}
+	// interleave places each proof hash before the leaves that follow it
+	interleave := func(ranges []LeafRange, proof [][]byte) []tagged {
+		var items []tagged
+		var leafIndex uint64
+		consumeUntil := func(end uint64) {
+			for leafIndex != end && leafIndex < numLeaves {
+				items = append(items, tagged{false, proof[0]})
+				proof = proof[1:]
+				leafIndex += uint64(nextSubtreeSize(leafIndex, end))
+			}
+		}
+		for _, r := range ranges {
+			consumeUntil(r.Start)
+			for ; leafIndex < r.End; leafIndex++ {
+				items = append(items, tagged{true, th.HashLeaf(leafData[leafIndex*leafSize:][:leafSize])})
+			}
+		}
+		consumeUntil(math.MaxUint64)
+		return items
+	}
+	stream := func(items []tagged) func() (bool, []byte, error) {
+		return func() (bool, []byte, error) {
+			if len(items) == 0 {
+				return false, nil, io.EOF
+			}
+			item := items[0]
+			items = items[1:]
+			return item.isLeaf, item.hash, nil
+		}
+	}
+
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{numLeaves - 1, numLeaves}},
+		{{0, numLeaves}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {50, 70}, {98, 99}},
+	} {
+		proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		items := interleave(ranges, proof)
+		if ok, err := VerifyInterleavedProof(stream(items), blake, ranges, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify interleaved proof for ranges %v", ranges)
+		}
+
+		// flipping a tag should result in an error
+		for i := range items {
+			bad := append([]tagged(nil), items...)
+			bad[i].isLeaf = !bad[i].isLeaf
+			if _, err := VerifyInterleavedProof(stream(bad), blake, ranges, root); err == nil {
+				t.Fatalf("ranges %v: no error after flipping tag %v", ranges, i)
+			}
+		}
+		// truncating the stream should fail
+		if ok, _ := VerifyInterleavedProof(stream(items[:len(items)-1]), blake, ranges, root); ok {
+			t.Fatalf("ranges %v: verified truncated stream", ranges)
+		}
+	}
+}
+
+// TestSingleLeafTree tests that the proof for the only leaf of a one-leaf tree
+// is empty, and that it verifies against the leaf hash, which is the root,
+// for each SubtreeHasher.
+func TestSingleLeafTree(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const leafSize = 64
+	for _, size := range []int{leafSize, 10} { // full and short leaf
+		leaf := fastrand.Bytes(size)
+		leafHash := th.HashLeaf(leaf)
+		if root := bytesRoot(leaf, blake, leafSize); !bytes.Equal(root, leafHash) {
+			t.Fatalf("expected root %x, got %x", leafHash, root)
+		}
+
+		hashers := []struct {
+			name string
+			sh   SubtreeHasher
+		}{
+			{"ReaderSubtreeHasher", NewReaderSubtreeHasher(bytes.NewReader(leaf), leafSize, blake)},
+			{"ReaderSubtreeHasherExpecting", NewReaderSubtreeHasherExpecting(bytes.NewReader(leaf), leafSize, 1, blake)},
+			{"CachedSubtreeHasher", NewCachedSubtreeHasher([][]byte{leafHash}, blake)},
+			{"MixedSubtreeHasher (cached)", NewMixedSubtreeHasher([][]byte{leafHash}, bytes.NewReader(nil), 1, leafSize, blake)},
+			{"MixedSubtreeHasher (reader)", NewMixedSubtreeHasher(nil, bytes.NewReader(leaf), 4, leafSize, blake)},
+		}
+		for _, test := range hashers {
+			proof, err := BuildRangeProof(0, 1, test.sh)
+			if err != nil {
+				t.Fatalf("%v, %v-byte leaf: %v", test.name, size, err)
+			} else if len(proof) != 0 {
+				t.Fatalf("%v, %v-byte leaf: expected empty proof, got %v hashes", test.name, size, len(proof))
+			}
+			if ok, err := VerifyRangeProof(NewCachedLeafHasher([][]byte{leafHash}), blake, 0, 1, proof, leafHash); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("%v, %v-byte leaf: failed to verify empty proof", test.name, size)
+			}
+			if ok, err := VerifyRangeProof(NewReaderLeafHasher(bytes.NewReader(leaf), blake, leafSize), blake, 0, 1, proof, leafHash); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("%v, %v-byte leaf: failed to verify empty proof using ReaderLeafHasher", test.name, size)
+			}
+		}
+
+		// a range beyond the only leaf should fail
+		if _, err := BuildRangeProof(0, 2, NewReaderSubtreeHasher(bytes.NewReader(leaf), leafSize, blake)); err == nil {
+			t.Fatalf("%v-byte leaf: expected error for range [0,2)", size)
+		}
+	}
+}
+
+// TestVerifyRangeProofHashes tests that VerifyRangeProofHashes verifies range
+// proofs and rejects leaf hashes of the wrong length.
+func TestVerifyRangeProofHashes(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	th := NewDefaultHasher(blake)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+
+	proof, err := BuildRangeProof(10, 20, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyRangeProofHashes(leafHashes[10:20], blake, 10, 20, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof")
+	}
+	if ok, err := VerifyRangeProofHashes(leafHashes[11:21], blake, 10, 20, proof, root); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("verified proof with the wrong leaf hashes")
+	}
+	for _, hashes := range [][][]byte{leafHashes[10:19], leafHashes[10:21], nil} {
+		if _, err := VerifyRangeProofHashes(hashes, blake, 10, 20, proof, root); err == nil {
+			t.Fatalf("expected error for %v leaf hashes", len(hashes))
+		}
+	}
+
+	// an illegal range should be reported rather than causing a panic
+	for _, r := range [][2]int{{5, 5}, {20, 10}, {-1, 9}} {
+		if ok, err := VerifyRangeProofHashes(nil, blake, r[0], r[1], proof, root); err != ErrInvalidRangeSet || ok {
+			t.Errorf("range %v: expected %v, got %v", r, ErrInvalidRangeSet, err)
+		}
+	}
+}
+
+// TestVerifyAndCollect tests that VerifyAndCollect returns the leaf hashes
+// that were verified.
+func TestVerifyAndCollect(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	th := NewDefaultHasher(blake)
+
+	for _, ranges := range [][]LeafRange{
+		{{0, 1}},
+		{{0, numLeaves}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {50, 70}, {98, 99}},
+	} {
+		proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exp [][]byte
+		for _, r := range ranges {
+			for i := r.Start; i < r.End; i++ {
+				exp = append(exp, th.HashLeaf(leafData[i*leafSize:][:leafSize]))
+			}
+		}
+		leafHashes, ok, err := VerifyAndCollect(NewCachedLeafHasher(exp), blake, ranges, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify proof for ranges %v", ranges)
+		} else if !ProofsEqual(leafHashes, exp) {
+			t.Fatalf("collected hashes for ranges %v differ: %v", ranges, ProofEqualityReport(leafHashes, exp))
+		}
+
+		// running out of leaves should return an error and no hashes
+		leafHashes, _, err = VerifyAndCollect(NewCachedLeafHasher(exp[:len(exp)-1]), blake, ranges, proof, root)
+		if err != ErrUnexpectedLeafCount || leafHashes != nil {
+			t.Fatalf("expected (nil, %v), got (%v, %v)", ErrUnexpectedLeafCount, leafHashes, err)
+		}
+	}
+}
+
+// TestVerifyLeafSet tests VerifyLeafSet over random sets of leaf indices.
+func TestVerifyLeafSet(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 100
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	root := recNodeRoot(leafHashes, blake)
+
+	for iter := 0; iter < 100; iter++ {
+		set := make(map[uint64][]byte)
+		var ranges []LeafRange
+		for _, i := range fastrand.Perm(numLeaves)[:fastrand.Intn(numLeaves)+1] {
+			set[uint64(i)] = leafHashes[i]
+			ranges = append(ranges, LeafRange{uint64(i), uint64(i) + 1})
+		}
+		proof, err := BuildMultiRangeProof(CoalesceRanges(ranges), NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := VerifyLeafSet(set, proof, numLeaves, root, blake); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify leaf set %v", CoalesceRanges(ranges))
+		}
+
+		// modifying any leaf hash should cause verification to fail
+		for i := range set {
+			set[i] = fastrand.Bytes(32)
+			break
+		}
+		if ok, _ := VerifyLeafSet(set, proof, numLeaves, root, blake); ok {
+			t.Fatal("verified a modified leaf set")
+		}
 	}
-	precalc := newPrecalcSubtreeHasher(precalcRoots, numLeaves/2, blake, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
-	proof, err := BuildRangeProof(numLeaves-1, numLeaves, precalc)
+
+	// a proof for a different tree size should be rejected
+	set := map[uint64][]byte{3: leafHashes[3], 40: leafHashes[40]}
+	proof, _ := BuildMultiRangeProof([]LeafRange{{3, 4}, {40, 41}}, NewCachedSubtreeHasher(leafHashes, blake))
+	if ok, _ := VerifyLeafSet(set, proof, 41, root, blake); ok {
+		t.Fatal("verified a proof for the wrong number of leaves")
+	}
+	// as should indices beyond the tree
+	set[numLeaves] = leafHashes[0]
+	if _, err := VerifyLeafSet(set, proof, numLeaves, root, blake); err == nil {
+		t.Fatal("expected error for index beyond the tree")
+	}
+}
+
+// TestReconstructRangeRootStack tests that reconstructRangeRoot, which uses a
+// Stack, reconstructs the same roots as a Tree would, for both valid and
+// random proofs.
+func TestReconstructRangeRootStack(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	treeRoot := func(leafHashes [][]byte, ranges []LeafRange, proof [][]byte) []byte {
+		tree := New(blake)
+		var leafIndex uint64
+		consumeUntil := func(end uint64) {
+			for leafIndex != end && len(proof) > 0 {
+				subtreeSize := nextSubtreeSize(leafIndex, end)
+				if err := tree.PushSubTree(bits.TrailingZeros64(uint64(subtreeSize)), proof[0]); err != nil {
+					t.Fatal(err)
+				}
+				proof = proof[1:]
+				leafIndex += uint64(subtreeSize)
+			}
+		}
+		for _, r := range ranges {
+			consumeUntil(r.Start)
+			for i := r.Start; i < r.End; i++ {
+				if err := tree.PushSubTree(0, leafHashes[0]); err != nil {
+					t.Fatal(err)
+				}
+				leafHashes = leafHashes[1:]
+			}
+			leafIndex = r.End
+		}
+		consumeUntil(math.MaxUint64)
+		return tree.Root()
+	}
+
+	for iter := 0; iter < 200; iter++ {
+		numLeaves := uint64(fastrand.Intn(100) + 1)
+		leafHashes := make([][]byte, numLeaves)
+		for i := range leafHashes {
+			leafHashes[i] = fastrand.Bytes(32)
+		}
+		var ranges []LeafRange
+		var hashes [][]byte
+		for start := uint64(fastrand.Intn(int(numLeaves))); start < numLeaves; {
+			end := start + uint64(fastrand.Intn(int(numLeaves-start))) + 1
+			ranges = append(ranges, LeafRange{start, end})
+			hashes = append(hashes, leafHashes[start:end]...)
+			start = end + uint64(fastrand.Intn(10))
+		}
+		proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// also try a random proof of a random length
+		random := make([][]byte, fastrand.Intn(20))
+		for i := range random {
+			random[i] = fastrand.Bytes(32)
+		}
+		for _, p := range [][][]byte{proof, random} {
+			root, err := reconstructRangeRoot(NewCachedLeafHasher(hashes), blake, ranges, p)
+			if err != nil {
+				t.Fatal(err)
+			} else if exp := treeRoot(hashes, ranges, p); !bytes.Equal(root, exp) {
+				t.Fatalf("%v leaves, ranges %v, %v proof hashes: expected %x, got %x", numLeaves, ranges, len(p), exp, root)
+			}
+		}
+	}
+}
+
+// TestVerifyFullTreeProof tests verification of proofs whose ranges cover the
+// entire tree, which are empty.
+func TestVerifyFullTreeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	for _, size := range []int{leafSize, 7 * leafSize, 16 * leafSize, 33*leafSize + 5} {
+		leafData := fastrand.Bytes(size)
+		root := bytesRoot(leafData, blake, leafSize)
+		numLeaves := (size + leafSize - 1) / leafSize
+		var leafHashes [][]byte
+		for buf := bytes.NewBuffer(leafData); buf.Len() > 0; {
+			leafHashes = append(leafHashes, NewDefaultHasher(blake).HashLeaf(buf.Next(leafSize)))
+		}
+		proof, err := BuildRangeProof(0, numLeaves, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(proof) != 0 {
+			t.Fatalf("expected empty proof, got %v hashes", len(proof))
+		}
+		if ok, err := VerifyRangeProof(NewReaderLeafHasher(bytes.NewReader(leafData), blake, leafSize), blake, 0, numLeaves, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof for %v bytes", size)
+		}
+		if numLeaves > 1 {
+			// the tree may also be split into several contiguous ranges
+			ranges := []LeafRange{{0, 1}, {1, uint64(numLeaves)}}
+			if ok, err := VerifyMultiRangeProof(NewReaderLeafHasher(bytes.NewReader(leafData), blake, leafSize), blake, ranges, nil, root); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Errorf("failed to verify split proof for %v bytes", size)
+			}
+		}
+		if ok, _ := VerifyRangeProof(NewReaderLeafHasher(bytes.NewReader(fastrand.Bytes(size)), blake, leafSize), blake, 0, numLeaves, proof, root); ok {
+			t.Error("verified proof using the wrong leaf data")
+		}
+		if _, err := VerifyRangeProof(NewReaderLeafHasher(bytes.NewReader(leafData[:size-leafSize]), blake, leafSize), blake, 0, numLeaves, proof, root); err != ErrUnexpectedLeafCount && numLeaves > 1 {
+			t.Errorf("expected %v, got %v", ErrUnexpectedLeafCount, err)
+		}
+	}
+}
+
+// TestMatchRoot tests the MatchRoot function.
+func TestMatchRoot(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 64
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	ranges := []LeafRange{{3, 5}, {40, 41}}
+	proof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
 	if err != nil {
 		t.Fatal(err)
 	}
-	recalcProof, err := BuildRangeProof(numLeaves-1, numLeaves, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
-	if err != nil {
+	lh := func() LeafHasher {
+		return NewReaderLeafHasher(io.MultiReader(
+			bytes.NewReader(leafData[3*leafSize:5*leafSize]),
+			bytes.NewReader(leafData[40*leafSize:41*leafSize]),
+		), blake, leafSize)
+	}
+
+	// candidates that differ from the real root in a single bit
+	candidates := make([][]byte, 5)
+	for i := range candidates {
+		candidates[i] = append([]byte(nil), root...)
+		candidates[i][i] ^= 1
+	}
+	if i, err := MatchRoot(lh(), blake, ranges, proof, candidates); err != nil {
 		t.Fatal(err)
-	} else if !reflect.DeepEqual(proof, recalcProof) {
-		t.Fatal("precalc failed")
+	} else if i != -1 {
+		t.Errorf("expected no match, got %v", i)
+	}
+	for j := range candidates {
+		candidates[j] = root
+		if i, err := MatchRoot(lh(), blake, ranges, proof, candidates); err != nil {
+			t.Fatal(err)
+		} else if i != j {
+			t.Errorf("expected match at %v, got %v", j, i)
+		}
+		candidates[j] = append([]byte(nil), root...)
+		candidates[j][j] ^= 1
+	}
+
+	// errors from the LeafHasher should be reported
+	if _, err := MatchRoot(NewCachedLeafHasher(nil), blake, ranges, proof, candidates); err != ErrUnexpectedLeafCount {
+		t.Errorf("expected %v, got %v", ErrUnexpectedLeafCount, err)
 	}
 }
 
-// TestBuildProofRangeEOF tests that BuildRangeProof behaves correctly in the
-// presence of EOF errors.
-func TestBuildProofRangeEOF(t *testing.T) {
-	// setup proof parameters
+// TestVerifyMultiRangeProofWithKnown tests that VerifyMultiRangeProofWithKnown
+// combines known leaf hashes with those produced by the LeafHasher.
+func TestVerifyMultiRangeProofWithKnown(t *testing.T) {
 	blake, _ := blake2b.New256(nil)
 	th := NewDefaultHasher(blake)
-	leafData := make([]byte, 1<<22)
 	const leafSize = 64
-	numLeaves := len(leafData) / 64
+	const numLeaves = 64
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
 	leafHashes := make([][]byte, numLeaves)
 	for i := range leafHashes {
 		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
 	}
 
-	// build a proof for the middle of the tree, but only supply half of the
-	// leafData. This should trigger an io.ErrUnexpectedEOF when
-	// BuildRangeProof tries to skip over the proof range.
-	midl, midr := numLeaves/2-1, numLeaves/2+1
+	ranges := []LeafRange{{2, 6}, {10, 11}, {40, 44}}
+	proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, knownIndices := range [][]uint64{
+		nil,
+		{2},
+		{5, 10},
+		{2, 3, 4, 5, 10, 40, 41, 42, 43},
+		{3, 41, 63}, // 63 lies outside the ranges
+	} {
+		known := make(map[uint64][]byte)
+		for _, i := range knownIndices {
+			known[i] = leafHashes[i]
+		}
+		var unknown [][]byte
+		for _, r := range ranges {
+			for i := r.Start; i < r.End; i++ {
+				if _, ok := known[i]; !ok {
+					unknown = append(unknown, leafHashes[i])
+				}
+			}
+		}
+		ok, err := VerifyMultiRangeProofWithKnown(NewCachedLeafHasher(unknown), known, blake, ranges, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify proof with known leaves %v", knownIndices)
+		}
 
-	// test with both ReaderSubtreeHasher and CachedSubtreeHasher
-	shs := []SubtreeHasher{
-		NewReaderSubtreeHasher(bytes.NewReader(leafData[:len(leafData)/2]), leafSize, blake),
-		NewCachedSubtreeHasher(leafHashes[:len(leafHashes)/2], blake),
+		// an incorrect known hash should cause verification to fail
+		if len(knownIndices) > 0 {
+			known[knownIndices[0]] = leafHashes[0]
+			ok, err := VerifyMultiRangeProofWithKnown(NewCachedLeafHasher(unknown), known, blake, ranges, proof, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if ok {
+				t.Errorf("verified proof with incorrect known leaf %v", knownIndices[0])
+			}
+		}
 	}
-	for _, sh := range shs {
-		if _, err := BuildRangeProof(midl, midr, sh); err != io.ErrUnexpectedEOF {
-			t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+}
+
+// TestVerifyMultiRangeProofLeafCount tests that VerifyMultiRangeProof accepts a
+// short final leaf, and returns ErrUnexpectedLeafCount when the LeafHasher
+// yields too few leaves.
+func TestVerifyMultiRangeProofLeafCount(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 10
+	// the final leaf is only half full
+	leafData := fastrand.Bytes(leafSize*(numLeaves-1) + leafSize/2)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	th := NewDefaultHasher(blake)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leaf := leafData[i*leafSize:]
+		if len(leaf) > leafSize {
+			leaf = leaf[:leafSize]
+		}
+		leafHashes[i] = th.HashLeaf(leaf)
+	}
+
+	ranges := []LeafRange{{2, 3}, {numLeaves - 2, numLeaves}}
+	proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeData := func(tail []byte) LeafHasher {
+		return NewReaderLeafHasher(io.MultiReader(
+			bytes.NewReader(leafData[2*leafSize:3*leafSize]),
+			bytes.NewReader(tail),
+		), blake, leafSize)
+	}
+	tail := leafData[(numLeaves-2)*leafSize:]
+	if ok, err := VerifyMultiRangeProof(rangeData(tail), blake, ranges, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("failed to verify proof containing a short final leaf")
+	}
+
+	// omitting the final leaf entirely should be reported as missing data
+	if _, err := VerifyMultiRangeProof(rangeData(tail[:leafSize]), blake, ranges, proof, root); err != ErrUnexpectedLeafCount {
+		t.Errorf("expected %v, got %v", ErrUnexpectedLeafCount, err)
+	}
+	// as should supplying too few cached leaf hashes
+	lh := NewCachedLeafHasher(leafHashes[2:3])
+	if _, err := VerifyMultiRangeProof(lh, blake, ranges, proof, root); err != ErrUnexpectedLeafCount {
+		t.Errorf("expected %v, got %v", ErrUnexpectedLeafCount, err)
+	}
+}
+
+// TestReaderLeafHasherError tests that ReaderLeafHasher distinguishes between
+// a stream that ends cleanly and a stream that returns an error.
+func TestReaderLeafHasherError(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const leafSize = 64
+	data := fastrand.Bytes(leafSize*2 + leafSize/2)
+	errTimeout := errors.New("network timeout")
+
+	// a stream that ends cleanly should produce a short final leaf followed
+	// by io.EOF
+	lh := NewReaderLeafHasher(&errReader{data: data, err: io.EOF}, blake, leafSize)
+	for _, exp := range [][]byte{data[:leafSize], data[leafSize : 2*leafSize], data[2*leafSize:]} {
+		if h, err := lh.NextLeafHash(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(h, th.HashLeaf(exp)) {
+			t.Fatal("wrong leaf hash")
+		}
+	}
+	if _, err := lh.NextLeafHash(); err != io.EOF {
+		t.Fatal("expected io.EOF, got", err)
+	}
+
+	// a stream that fails mid-leaf should produce the partial leaf, followed
+	// by the error
+	lh = NewReaderLeafHasher(&errReader{data: data, err: errTimeout}, blake, leafSize)
+	for _, exp := range [][]byte{data[:leafSize], data[leafSize : 2*leafSize], data[2*leafSize:]} {
+		if h, err := lh.NextLeafHash(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(h, th.HashLeaf(exp)) {
+			t.Fatal("wrong leaf hash")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := lh.NextLeafHash(); err != errTimeout {
+			t.Fatal("expected errTimeout, got", err)
+		}
+	}
+
+	// a stream that fails on a leaf boundary should report the error
+	// immediately
+	lh = NewReaderLeafHasher(&errReader{data: data[:leafSize], err: errTimeout}, blake, leafSize)
+	if _, err := lh.NextLeafHash(); err != nil {
+		t.Fatal(err)
+	} else if _, err := lh.NextLeafHash(); err != errTimeout {
+		t.Fatal("expected errTimeout, got", err)
+	}
+}
+
+// A chunkedReader is an io.Reader that reports io.EOF at the end of each
+// chunk, like a message-oriented reader.
+type chunkedReader struct {
+	chunks [][]byte
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if len(cr.chunks) == 0 {
+		return 0, io.EOF
+	} else if len(cr.chunks[0]) == 0 {
+		cr.chunks = cr.chunks[1:]
+		return 0, io.EOF
+	}
+	n := copy(p, cr.chunks[0])
+	cr.chunks[0] = cr.chunks[0][n:]
+	return n, nil
+}
+
+// TestStrictReaderLeafHasher tests that a strict ReaderLeafHasher hashes
+// leaves like a ReaderLeafHasher, but rejects a short leaf that is not the
+// final leaf.
+func TestStrictReaderLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const leafSize = 64
+
+	// well-formed data, including a short final leaf, should hash normally,
+	// even if the reader returns one byte per call to Read
+	for _, size := range []int{3 * leafSize, 2*leafSize + 10, 1} {
+		data := fastrand.Bytes(size)
+		lh := NewStrictReaderLeafHasher(iotest.OneByteReader(bytes.NewReader(data)), blake, leafSize)
+		for i := 0; i < size; i += leafSize {
+			end := i + leafSize
+			if end > size {
+				end = size
+			}
+			if h, err := lh.NextLeafHash(); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(h, th.HashLeaf(data[i:end])) {
+				t.Fatal("wrong leaf hash")
+			}
+		}
+		if _, err := lh.NextLeafHash(); err != io.EOF {
+			t.Fatalf("expected %v, got %v", io.EOF, err)
+		} else if _, err := lh.NextLeafHash(); err != io.EOF {
+			t.Fatalf("expected %v to persist, got %v", io.EOF, err)
 		}
 	}
+
+	// a short leaf followed by more data should be rejected
+	lh := NewStrictReaderLeafHasher(&chunkedReader{chunks: [][]byte{fastrand.Bytes(leafSize + 10), fastrand.Bytes(leafSize)}}, blake, leafSize)
+	for i := 0; i < 2; i++ {
+		if _, err := lh.NextLeafHash(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := lh.NextLeafHash(); err != ErrWrongLeafSize {
+		t.Fatalf("expected %v, got %v", ErrWrongLeafSize, err)
+	} else if _, err := lh.NextLeafHash(); err != ErrWrongLeafSize {
+		t.Fatalf("expected %v to persist, got %v", ErrWrongLeafSize, err)
+	}
+
+	// a proof should verify using a strict ReaderLeafHasher
+	leafData := fastrand.Bytes(leafSize * 10)
+	root := bytesRoot(leafData, blake, leafSize)
+	proof, err := BuildRangeProof(3, 6, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeData := leafData[3*leafSize : 6*leafSize]
+	if ok, err := VerifyRangeProof(NewStrictReaderLeafHasher(iotest.OneByteReader(bytes.NewReader(rangeData)), blake, leafSize), blake, 3, 6, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof")
+	}
+	split := &chunkedReader{chunks: [][]byte{rangeData[:2*leafSize-1], rangeData[2*leafSize-1:]}}
+	if _, err := VerifyRangeProof(NewStrictReaderLeafHasher(split, blake, leafSize), blake, 3, 6, proof, root); err != ErrWrongLeafSize {
+		t.Fatalf("expected %v, got %v", ErrWrongLeafSize, err)
+	}
 }
 
 // TestProofConversion tests that "old" single-leaf Merkle proofs can be
@@ -834,17 +2413,191 @@ func TestProofConversion(t *testing.T) {
 		}
 	}
 
-	// test invalid/untrusted inputs to ensure that they do not panic
-	proof := make([][]byte, 1000)
-	for i := 0; i < 1000; i++ {
-		proof = proof[:1+fastrand.Intn(1000)]
-		proofIndex := fastrand.Intn(len(proof))
-		if fastrand.Intn(4) == 0 {
-			// 25% of the time, use a ridiculous proof index
-			proofIndex = len(proof) + fastrand.Intn(1000)
-		}
-		ConvertRangeProofToSingleProof(proof, proofIndex)
-		ConvertRangeProofToSingleProof(proof, proofIndex)
+	// test invalid/untrusted inputs to ensure that they do not panic
+	proof := make([][]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		proof = proof[:1+fastrand.Intn(1000)]
+		proofIndex := fastrand.Intn(len(proof))
+		if fastrand.Intn(4) == 0 {
+			// 25% of the time, use a ridiculous proof index
+			proofIndex = len(proof) + fastrand.Intn(1000)
+		}
+		ConvertRangeProofToSingleProof(proof, proofIndex)
+		ConvertRangeProofToSingleProof(proof, proofIndex)
+	}
+}
+
+// TestVerifyMultiRangeProofVersioned tests that single-leaf proofs in both the
+// bottom-up and left-to-right formats can be verified.
+func TestVerifyMultiRangeProofVersioned(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	for _, numLeaves := range []int{1, 8, 11, 31} {
+		leafData := fastrand.Bytes(leafSize * numLeaves)
+		root := bytesRoot(leafData, blake, leafSize)
+		for proofIndex := 0; proofIndex < numLeaves; proofIndex++ {
+			tree := New(blake)
+			if err := tree.SetIndex(uint64(proofIndex)); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < numLeaves; i++ {
+				tree.Push(leafData[i*leafSize:][:leafSize])
+			}
+			_, oldProof, _, _ := tree.Prove()
+			oldProof = oldProof[1:]
+			newProof, err := BuildRangeProof(proofIndex, proofIndex+1, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ranges := []LeafRange{{uint64(proofIndex), uint64(proofIndex) + 1}}
+			verify := func(proof [][]byte, root []byte, version ProofFormatVersion) (bool, error) {
+				lh := NewReaderLeafHasher(bytes.NewReader(leafData[proofIndex*leafSize:][:leafSize]), blake, leafSize)
+				return VerifyMultiRangeProofVersioned(lh, blake, ranges, proof, root, version)
+			}
+			for _, test := range []struct {
+				proof   [][]byte
+				version ProofFormatVersion
+			}{
+				{oldProof, ProofFormatBottomUp},
+				{newProof, ProofFormatLeftToRight},
+				{newProof, ProofFormatCurrent},
+			} {
+				if ok, err := verify(test.proof, root, test.version); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatalf("%v leaves: failed to verify proof for leaf %v in format %v", numLeaves, proofIndex, test.version)
+				}
+				if ok, _ := verify(test.proof, fastrand.Bytes(32), test.version); ok {
+					t.Fatalf("%v leaves: verified proof for leaf %v against wrong root", numLeaves, proofIndex)
+				}
+			}
+			// a bottom-up proof of the wrong length should be rejected
+			if len(oldProof) > 0 {
+				if ok, _ := verify(oldProof[1:], root, ProofFormatBottomUp); ok {
+					t.Fatalf("%v leaves: verified truncated proof for leaf %v", numLeaves, proofIndex)
+				}
+			}
+		}
+	}
+
+	// bottom-up proofs only support single leaves, and unknown versions
+	// should be rejected
+	lh := NewCachedLeafHasher([][]byte{make([]byte, 32), make([]byte, 32)})
+	if _, err := VerifyMultiRangeProofVersioned(lh, blake, []LeafRange{{0, 2}}, nil, nil, ProofFormatBottomUp); err == nil {
+		t.Error("expected error for multi-leaf bottom-up proof")
+	}
+	if _, err := VerifyMultiRangeProofVersioned(lh, blake, []LeafRange{{0, 1}}, nil, nil, 0); err == nil {
+		t.Error("expected error for unknown version")
+	}
+}
+
+// TestProofSiblingSides tests the ProofSiblingSides function against the tree
+// from the proofMapping comment.
+func TestProofSiblingSides(t *testing.T) {
+	//                       ┌─────────┴───────*
+	//                 *─────┴─────┐           │
+	//              ┌──┴──┐     *──┴──┐     ┌──┴──┐
+	// Index:       0     1     2     3     4     5
+	const L, R = true, false
+	expected := [][]bool{
+		{R, R, R},
+		{L, R, R},
+		{L, R, R},
+		{L, L, R},
+		{L, R},
+		{L, L},
+	}
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(6 * 64)
+	for i, exp := range expected {
+		proof, err := BuildRangeProof(i, i+1, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sides := ProofSiblingSides(len(proof), i); !reflect.DeepEqual(sides, exp) {
+			t.Errorf("index %v: expected %v, got %v", i, exp, sides)
+		}
+	}
+
+	// impossible inputs should return nil
+	if ProofSiblingSides(3, -1) != nil {
+		t.Error("expected nil for negative proofIndex")
+	} else if ProofSiblingSides(1, 3) != nil {
+		t.Error("expected nil for a proof with too few hashes")
+	}
+}
+
+// TestProofSideCounts tests the ProofSideCounts function against the tree
+// from the manual proof in TestBuildVerifyRangeProof.
+func TestProofSideCounts(t *testing.T) {
+	//               ┌────────┴────────*
+	//         ┌─────┴─────┐           │
+	//      *──┴──┐     ┌──┴──*     ┌──┴──┐
+	//    ┌─┴─┐ *─┴─┐ ┌─┴─* ┌─┴─┐ ┌─┴─┐ ┌─┴─┐
+	//    0   1 2   3 4   5 6   7 8   9 10  11
+	expected := [][2]int{
+		{0, 4}, {1, 3}, {1, 3}, {2, 2}, {1, 3}, {2, 2},
+		{2, 2}, {3, 1}, {1, 2}, {2, 1}, {2, 1}, {3, 0},
+	}
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(12 * leafSize)
+	for i, exp := range expected {
+		proof, err := BuildRangeProof(i, i+1, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, r := ProofSideCounts(len(proof), i); l != exp[0] || r != exp[1] {
+			t.Errorf("index %v: expected %v, got [%v %v]", i, exp, l, r)
+		}
+	}
+
+	// the left-side hashes should come first
+	subtreeRoot := func(i, j int) []byte {
+		return bytesRoot(leafData[i*leafSize:j*leafSize], blake, leafSize)
+	}
+	proof, _ := BuildRangeProof(4, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	l, _ := ProofSideCounts(len(proof), 4)
+	left, right := proof[:l], proof[l:]
+	if !reflect.DeepEqual(left, [][]byte{subtreeRoot(0, 4)}) {
+		t.Error("unexpected left-side hashes")
+	} else if !reflect.DeepEqual(right, [][]byte{subtreeRoot(5, 6), subtreeRoot(6, 8), subtreeRoot(8, 12)}) {
+		t.Error("unexpected right-side hashes")
+	}
+
+	// impossible inputs should return -1
+	if l, r := ProofSideCounts(3, -1); l != -1 || r != -1 {
+		t.Error("expected -1 for negative proofIndex")
+	} else if l, r := ProofSideCounts(1, 3); l != -1 || r != -1 {
+		t.Error("expected -1 for a proof with too few hashes")
+	}
+}
+
+// TestProofMappingHostileIndex tests that proofMapping rejects proof indices
+// for which no proof of the given size could exist.
+func TestProofMappingHostileIndex(t *testing.T) {
+	proof := make([][]byte, 5)
+	for _, proofIndex := range []int{math.MaxInt32, math.MaxInt64, -1, 0x3f} {
+		if m := proofMapping(len(proof), proofIndex); len(m) != 0 {
+			t.Errorf("expected empty mapping for proofIndex %v, got %v", proofIndex, m)
+		}
+		if p := ConvertRangeProofToSingleProof(proof, proofIndex); p != nil {
+			t.Errorf("expected nil proof for proofIndex %v", proofIndex)
+		}
+		if p := ConvertSingleProofToRangeProof(proof, proofIndex); p != nil {
+			t.Errorf("expected nil proof for proofIndex %v", proofIndex)
+		}
+	}
+
+	// large indices with few 1 bits are legal: in a tree of 2^40+1 leaves,
+	// the proof for the last leaf is a single hash.
+	if m := proofMapping(1, 1<<40); !reflect.DeepEqual(m, []int{0}) {
+		t.Errorf("expected mapping [0], got %v", m)
+	}
+	// in a tree of 6 leaves, the proof for index 4 has two hashes
+	if m := proofMapping(2, 4); !reflect.DeepEqual(m, []int{1, 0}) {
+		t.Errorf("expected mapping [1 0], got %v", m)
 	}
 }
 
@@ -965,6 +2718,101 @@ func TestCompressLeafHashes(t *testing.T) {
 	}
 }
 
+// TestCompressLeafHashesParallel tests that CompressLeafHashesParallel
+// produces the same hashes as CompressLeafHashes.
+func TestCompressLeafHashesParallel(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	newHash := func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}
+	const leafSize = 64
+	const numLeaves = 200
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	// the SubtreeHasher for each range reads only that range's leaves
+	factory := func(r LeafRange) SubtreeHasher {
+		return NewReaderSubtreeHasher(bytes.NewReader(leafData[r.Start*leafSize:r.End*leafSize]), leafSize, newHash())
+	}
+
+	for _, ranges := range [][]LeafRange{
+		nil,
+		{{0, numLeaves}},
+		{{3, 5}, {9, 10}},
+		{{1, 2}, {50, 70}, {98, 99}, {101, 180}},
+	} {
+		var rs []io.Reader
+		for _, r := range ranges {
+			rs = append(rs, bytes.NewReader(leafData[r.Start*leafSize:r.End*leafSize]))
+		}
+		expected, err := CompressLeafHashes(ranges, NewReaderSubtreeHasher(io.MultiReader(rs...), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, numWorkers := range []int{0, 1, 3, 16} {
+			compressed, err := CompressLeafHashesParallel(ranges, factory, numWorkers, blake)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ProofsEqual(compressed, expected) {
+				t.Fatalf("ranges %v, %v workers: %v", ranges, numWorkers, ProofEqualityReport(compressed, expected))
+			}
+		}
+	}
+
+	// an error from any range should be returned
+	short := func(r LeafRange) SubtreeHasher {
+		if r.Start == 50 {
+			return NewReaderSubtreeHasher(bytes.NewReader(nil), leafSize, newHash())
+		}
+		return factory(r)
+	}
+	if _, err := CompressLeafHashesParallel([]LeafRange{{1, 2}, {50, 70}, {98, 99}}, short, 2, blake); err == nil {
+		t.Fatal("expected error for a range with no leaves")
+	}
+}
+
+// TestValidateCompressedHashes tests that ValidateCompressedHashes accepts the
+// output of CompressLeafHashes and rejects hashes of the wrong length.
+func TestValidateCompressedHashes(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafHashes := make([][]byte, 64)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	for _, ranges := range [][]LeafRange{
+		{{0, 64}},
+		{{0, 1}},
+		{{1, 3}, {4, 8}},
+		{{0, 3}, {3, 8}},
+		{{5, 17}, {20, 21}, {33, 63}},
+	} {
+		var hashes [][]byte
+		for _, r := range ranges {
+			hashes = append(hashes, leafHashes[r.Start:r.End]...)
+		}
+		compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(hashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateCompressedHashes(ranges, compressed); err != nil {
+			t.Errorf("%v: %v", ranges, err)
+		}
+		if err := ValidateCompressedHashes(ranges, compressed[1:]); err == nil {
+			t.Errorf("%v: accepted too few hashes", ranges)
+		}
+		if err := ValidateCompressedHashes(ranges, append(compressed, compressed[0])); err == nil {
+			t.Errorf("%v: accepted too many hashes", ranges)
+		}
+		// the uncompressed leaf hashes are only valid if no subtrees could be
+		// formed
+		if err := ValidateCompressedHashes(ranges, hashes); (err == nil) != (len(hashes) == len(compressed)) {
+			t.Errorf("%v: expected uncompressed hashes to be rejected", ranges)
+		}
+	}
+	if err := ValidateCompressedHashes([]LeafRange{{3, 5}, {4, 6}}, nil); err != ErrInvalidRangeSet {
+		t.Errorf("expected %v, got %v", ErrInvalidRangeSet, err)
+	}
+}
+
 // TestBuildVerifyDiffProof tests the BuildDiffProof and
 // VerifyDiffProof functions.
 func TestBuildVerifyDiffProof(t *testing.T) {
@@ -1162,19 +3010,292 @@ func TestBuildVerifyDiffProof(t *testing.T) {
 		}
 		return all
 	}
-	for _, rs := range allRangeSets(0, 9) {
-		proof := buildSmallProof(rs, 9)
-		if !verifySmallProof(rs, proof, 9) {
-			t.Errorf("BuildDiffProof constructed an incorrect proof for ranges %v", rs)
-		}
+	for _, rs := range allRangeSets(0, 9) {
+		proof := buildSmallProof(rs, 9)
+		if !verifySmallProof(rs, proof, 9) {
+			t.Errorf("BuildDiffProof constructed an incorrect proof for ranges %v", rs)
+		}
+	}
+}
+
+// checkReconstructDiffRoot checks that ReconstructDiffRoot reconstructs root
+// from the supplied diff proof.
+func checkReconstructDiffRoot(t *testing.T, rangeHashes [][]byte, numLeaves uint64, h hash.Hash, ranges []LeafRange, proof [][]byte, root []byte) {
+	t.Helper()
+	reconstructed, err := ReconstructDiffRoot(rangeHashes, numLeaves, h, ranges, proof)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(reconstructed, root) {
+		t.Fatal("ReconstructDiffRoot reconstructed the wrong root")
+	}
+}
+
+// TestVerifyDiffProofExtraHashes tests that VerifyDiffProof rejects valid
+// proofs with extra hashes appended, using random trees and ranges.
+func TestVerifyDiffProofExtraHashes(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for iter := 0; iter < 500; iter++ {
+		numLeaves := uint64(fastrand.Intn(200) + 1)
+		leafHashes := make([][]byte, numLeaves)
+		for i := range leafHashes {
+			leafHashes[i] = fastrand.Bytes(32)
+		}
+		root := recNodeRoot(leafHashes, blake)
+
+		var ranges []LeafRange
+		var rangeLeafHashes [][]byte
+		for start := uint64(fastrand.Intn(int(numLeaves))); start < numLeaves; {
+			end := start + uint64(fastrand.Intn(int(numLeaves-start))) + 1
+			ranges = append(ranges, LeafRange{start, end})
+			rangeLeafHashes = append(rangeLeafHashes, leafHashes[start:end]...)
+			start = end + uint64(fastrand.Intn(10))
+		}
+		proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeLeafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proof, root); err != nil || !ok {
+			t.Fatalf("failed to verify valid proof for %v leaves, ranges %v: %v", numLeaves, ranges, err)
+		}
+
+		for extra := 1; extra <= 3; extra++ {
+			padded := append(proof[:len(proof):len(proof)], make([][]byte, extra)...)
+			for i := len(proof); i < len(padded); i++ {
+				padded[i] = fastrand.Bytes(32)
+			}
+			if _, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, padded, root); err != ErrProofExtendsBeyondTree {
+				t.Fatalf("%v leaves, ranges %v, %v extra hashes: expected %v, got %v", numLeaves, ranges, extra, ErrProofExtendsBeyondTree, err)
+			}
+		}
+	}
+}
+
+// TestVerifyDiffProofHashSize tests that VerifyDiffProof rejects proof and
+// range hashes whose size doesn't match the hash function.
+func TestVerifyDiffProofHashSize(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 16
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	ranges := []LeafRange{{2, 4}, {9, 10}}
+	proof, err := BuildDiffProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake), numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeHashes, err := CompressLeafHashes(ranges, NewReaderSubtreeHasher(io.MultiReader(
+		bytes.NewReader(leafData[2*leafSize:4*leafSize]),
+		bytes.NewReader(leafData[9*leafSize:10*leafSize]),
+	), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyDiffProof(rangeHashes, numLeaves, blake, ranges, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify valid diff proof")
+	}
+
+	// a 20-byte hash in either the proof or the range hashes should be
+	// rejected
+	truncate := func(hashes [][]byte, i int) [][]byte {
+		hashes = append([][]byte(nil), hashes...)
+		hashes[i] = hashes[i][:20]
+		return hashes
+	}
+	if _, err := VerifyDiffProof(rangeHashes, numLeaves, blake, ranges, truncate(proof, len(proof)-1), root); err != ErrHashSizeMismatch {
+		t.Errorf("expected %v, got %v", ErrHashSizeMismatch, err)
+	}
+	if _, err := VerifyDiffProof(truncate(rangeHashes, 0), numLeaves, blake, ranges, proof, root); err != ErrHashSizeMismatch {
+		t.Errorf("expected %v, got %v", ErrHashSizeMismatch, err)
+	}
+	// as should a proof built with a different hash function
+	if _, err := VerifyDiffProof(rangeHashes, numLeaves, sha1.New(), ranges, proof, root); err != ErrHashSizeMismatch {
+		t.Errorf("expected %v, got %v", ErrHashSizeMismatch, err)
+	}
+}
+
+// TestProofOfModification uses diff proofs to prove arbitrary modifications to
+// a Merkle tree.
+func TestProofOfModification(t *testing.T) {
+	const leafSize = 64
+	const numLeaves = 12
+	const dataSize = leafSize * numLeaves
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	leafData := fastrand.Bytes(dataSize)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
+
+	// The modifications we want to make are:
+	//
+	// - Swap(6,11)
+	// - Trim(6)
+	// - Swap(7, 10)
+	// - Append(12)
+	// - Append(13)
+	//
+	// Using these appended hashes:
+	newLeafHash12 := fastrand.Bytes(32)
+	newLeafHash13 := fastrand.Bytes(32)
+
+	// We begin by constructing a diff proof for the old tree, covering
+	// any affected leaves.
+	ranges := []LeafRange{
+		{6, 7},
+		{7, 8},
+		{10, 11},
+		{11, 12},
+	}
+	proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// We complete the proof by appending the leaves inside the ranges:
+	proof = append(proof, leafHashes[6], leafHashes[7], leafHashes[10], leafHashes[11])
+
+	// Then we apply the modifications and construct the new root:
+	leafHashes[6], leafHashes[11] = leafHashes[11], leafHashes[6] // Swap(6, 11)
+	leafHashes = leafHashes[:len(leafHashes)-1]                   // Trim(6)
+	leafHashes[7], leafHashes[10] = leafHashes[10], leafHashes[7] // Swap(7, 10)
+	leafHashes = append(leafHashes, newLeafHash12)                // Append(12)
+	leafHashes = append(leafHashes, newLeafHash13)                // Append(13)
+	newRoot, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(len(leafHashes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proof and the new root are sent to the verifier. The verifier also
+	// knows newLeafHash12 and newLeafHash13.
+
+	// To verify the proof, we first split the proof into subtree hashes and leaf hashes:
+	var numRangeHashes int
+	for _, r := range ranges {
+		numRangeHashes += int(r.End - r.Start)
+	}
+	proofHashes, rangeHashes := proof[:len(proof)-numRangeHashes], proof[len(proof)-numRangeHashes:]
+	compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReconstructDiffRoot(t, compressed, numLeaves, blake, ranges, proofHashes, root)
+	ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify old root")
+	}
+
+	// Next, we apply the modifications to our hashes and verify the new root:
+	rangeHashes[0], rangeHashes[3] = rangeHashes[3], rangeHashes[0] // Swap(6, 11)
+	rangeHashes = rangeHashes[:len(rangeHashes)-1]                  // Trim(6)
+	rangeHashes[1], rangeHashes[2] = rangeHashes[2], rangeHashes[1] // Swap(7, 10)
+	rangeHashes = append(rangeHashes, newLeafHash12)                // Append(12)
+	rangeHashes = append(rangeHashes, newLeafHash13)                // Append(13)
+	ranges = append(ranges, LeafRange{12, 13})                      // to include appended data
+	compressed, err = CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReconstructDiffRoot(t, compressed, numLeaves, blake, ranges, proofHashes, newRoot)
+	ok, err = VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, newRoot)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify new root")
+	}
+}
+
+// TestProofOfModificationAppend uses diff proofs to prove that data was
+// appended to a Merkle tree.
+func TestProofOfModificationAppend(t *testing.T) {
+	const leafSize = 64
+	const numLeaves = 15
+	const dataSize = leafSize * numLeaves
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	leafData := fastrand.Bytes(dataSize)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
+
+	// The modifications we want to make are:
+	//
+	// - Append(15)
+	// - Swap(3,15)
+	// - Append(16)
+	//
+	// Using these appended hashes:
+	newLeafHash15 := fastrand.Bytes(32)
+	newLeafHash16 := fastrand.Bytes(32)
+	ranges := []LeafRange{{3, 4}}
+
+	// We begin by constructing a diff proof for the old tree
+	proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The swapped leaf is also included in the proof
+	proof = append(proof, leafHashes[3])
+
+	// Then we apply the modifications and construct the new root:
+	leafHashes = append(leafHashes, newLeafHash15)                // Append(15)
+	leafHashes[3], leafHashes[15] = leafHashes[15], leafHashes[3] // Swap(3,15)
+	leafHashes = append(leafHashes, newLeafHash16)                // Append(16)
+	newRoot, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(len(leafHashes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proof and the new root are sent to the verifier. The verifier also
+	// knows newLeafHash15 and newLeafHash16.
+	proofHashes, rangeHashes := proof[:len(proof)-1], proof[len(proof)-1:]
+	compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReconstructDiffRoot(t, compressed, numLeaves, blake, ranges, proofHashes, root)
+	ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify old root")
+	}
+
+	// Next, we apply the modifications to our hashes and verify the new root:
+	rangeHashes = append(rangeHashes, newLeafHash15)
+	ranges = append(ranges, LeafRange{15, 16})
+	rangeHashes[0], rangeHashes[1] = rangeHashes[1], rangeHashes[0]
+	rangeHashes = append(rangeHashes, newLeafHash16)
+	ranges = append(ranges, LeafRange{16, 17})
+	compressed, err = CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReconstructDiffRoot(t, compressed, numLeaves, blake, ranges, proofHashes, newRoot)
+	ok, err = VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, newRoot)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify new root")
 	}
 }
 
-// TestProofOfModification uses diff proofs to prove arbitrary modifications to
-// a Merkle tree.
-func TestProofOfModification(t *testing.T) {
+// TestProofOfModificationTrim uses diff proofs to prove that data was
+// removed from a Merkle tree.
+func TestProofOfModificationTrim(t *testing.T) {
 	const leafSize = 64
-	const numLeaves = 12
+	const numLeaves = 15
 	const dataSize = leafSize * numLeaves
 	blake, _ := blake2b.New256(nil)
 	th := NewDefaultHasher(blake)
@@ -1187,55 +3308,35 @@ func TestProofOfModification(t *testing.T) {
 
 	// The modifications we want to make are:
 	//
-	// - Swap(6,11)
-	// - Trim(6)
-	// - Swap(7, 10)
-	// - Append(12)
-	// - Append(13)
+	// - Swap(3,14)
+	// - Trim(3)
+	// - Trim(13)
 	//
-	// Using these appended hashes:
-	newLeafHash12 := fastrand.Bytes(32)
-	newLeafHash13 := fastrand.Bytes(32)
+	ranges := []LeafRange{{3, 4}, {13, 14}, {14, 15}}
 
-	// We begin by constructing a diff proof for the old tree, covering
-	// any affected leaves.
-	ranges := []LeafRange{
-		{6, 7},
-		{7, 8},
-		{10, 11},
-		{11, 12},
-	}
+	// We begin by constructing a diff proof for the old tree
 	proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), numLeaves)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// We complete the proof by appending the leaves inside the ranges:
-	proof = append(proof, leafHashes[6], leafHashes[7], leafHashes[10], leafHashes[11])
+	// The modified hashes are included in the proof:
+	proof = append(proof, leafHashes[3], leafHashes[13], leafHashes[14])
 
 	// Then we apply the modifications and construct the new root:
-	leafHashes[6], leafHashes[11] = leafHashes[11], leafHashes[6] // Swap(6, 11)
-	leafHashes = leafHashes[:len(leafHashes)-1]                   // Trim(6)
-	leafHashes[7], leafHashes[10] = leafHashes[10], leafHashes[7] // Swap(7, 10)
-	leafHashes = append(leafHashes, newLeafHash12)                // Append(12)
-	leafHashes = append(leafHashes, newLeafHash13)                // Append(13)
+	leafHashes[3], leafHashes[14] = leafHashes[14], leafHashes[3]
+	leafHashes = leafHashes[:numLeaves-2]
 	newRoot, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(len(leafHashes))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// The proof and the new root are sent to the verifier. The verifier also
-	// knows newLeafHash12 and newLeafHash13.
-
-	// To verify the proof, we first split the proof into subtree hashes and leaf hashes:
-	var numRangeHashes int
-	for _, r := range ranges {
-		numRangeHashes += int(r.End - r.Start)
-	}
-	proofHashes, rangeHashes := proof[:len(proof)-numRangeHashes], proof[len(proof)-numRangeHashes:]
+	// The proof and the new root are sent to the verifier.
+	proofHashes, rangeHashes := proof[:len(proof)-3], proof[len(proof)-3:]
 	compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
 	if err != nil {
 		t.Fatal(err)
 	}
+	checkReconstructDiffRoot(t, compressed, numLeaves, blake, ranges, proofHashes, root)
 	ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, root)
 	if err != nil {
 		t.Fatal(err)
@@ -1244,16 +3345,14 @@ func TestProofOfModification(t *testing.T) {
 	}
 
 	// Next, we apply the modifications to our hashes and verify the new root:
-	rangeHashes[0], rangeHashes[3] = rangeHashes[3], rangeHashes[0] // Swap(6, 11)
-	rangeHashes = rangeHashes[:len(rangeHashes)-1]                  // Trim(6)
-	rangeHashes[1], rangeHashes[2] = rangeHashes[2], rangeHashes[1] // Swap(7, 10)
-	rangeHashes = append(rangeHashes, newLeafHash12)                // Append(12)
-	rangeHashes = append(rangeHashes, newLeafHash13)                // Append(13)
-	ranges = append(ranges, LeafRange{12, 13})                      // to include appended data
+	rangeHashes[0], rangeHashes[2] = rangeHashes[2], rangeHashes[0]
+	rangeHashes = rangeHashes[:1]
+	ranges = []LeafRange{ranges[0]}
 	compressed, err = CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
 	if err != nil {
 		t.Fatal(err)
 	}
+	checkReconstructDiffRoot(t, compressed, numLeaves, blake, ranges, proofHashes, newRoot)
 	ok, err = VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, newRoot)
 	if err != nil {
 		t.Fatal(err)
@@ -1262,11 +3361,12 @@ func TestProofOfModification(t *testing.T) {
 	}
 }
 
-// TestProofOfModificationAppend uses diff proofs to prove that data was
-// appended to a Merkle tree.
-func TestProofOfModificationAppend(t *testing.T) {
+// TestProofOfModificationUpdate uses diff proofs to prove that a set of leaves
+// were updated.
+func TestProofOfModificationUpdate(t *testing.T) {
 	const leafSize = 64
-	const numLeaves = 15
+	const numLeaves = 16
+	const leavesPerNode = 4
 	const dataSize = leafSize * numLeaves
 	blake, _ := blake2b.New256(nil)
 	th := NewDefaultHasher(blake)
@@ -1275,216 +3375,663 @@ func TestProofOfModificationAppend(t *testing.T) {
 	for i := range leafHashes {
 		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
 	}
+	nodeHashes := make([][]byte, numLeaves/leavesPerNode)
+	for i := range nodeHashes {
+		nodeHashes[i] = bytesRoot(leafData[i*leafSize*leavesPerNode:][:leafSize*leavesPerNode], blake, leafSize)
+	}
 	root := bytesRoot(leafData, blake, leafSize)
 
 	// The modifications we want to make are:
 	//
-	// - Append(15)
-	// - Swap(3,15)
-	// - Append(16)
+	// - Swap [4,8) [12,16)
+	// - Trim [12,16)
+	// - Update [2,4)
 	//
-	// Using these appended hashes:
-	newLeafHash15 := fastrand.Bytes(32)
-	newLeafHash16 := fastrand.Bytes(32)
-	ranges := []LeafRange{{3, 4}}
+	ranges := []LeafRange{{2, 4}, {4, 8}, {12, 16}}
+
+	// Generate new leaf data for the updated range
+	oldUpdateData := leafData[2*leafSize : 4*leafSize]
+	newUpdateData := fastrand.Bytes(len(oldUpdateData))
 
 	// We begin by constructing a diff proof for the old tree
-	proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), numLeaves)
+	msh := NewMixedSubtreeHasher(nodeHashes[1:], bytes.NewReader(leafData[:4*leafSize]), leavesPerNode, leafSize, blake)
+	proof, err := BuildDiffProof(ranges, msh, numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expProof := [][]byte{bytesRoot(leafData[:2*leafSize], blake, leafSize), nodeHashes[2]}
+	if !reflect.DeepEqual(proof, expProof) {
+		t.Fatal("bad proof")
+	}
+
+	// The modified hashes are also sent along with the proof
+	rangeHashes := [][]byte{nodeHashes[1], nodeHashes[3]}
+
+	// Then we apply the modifications and construct the new root:
+	newLeafData := append([]byte(nil), leafData[:2*leafSize]...)
+	newLeafData = append(newLeafData, newUpdateData...)
+	newLeafData = append(newLeafData, leafData[12*leafSize:16*leafSize]...)
+	newLeafData = append(newLeafData, leafData[8*leafSize:12*leafSize]...)
+	newRoot := bytesRoot(newLeafData, blake, leafSize)
+
+	// The proof, modified hashes, and the new root are sent to the verifier.
+	msh = NewMixedSubtreeHasher(rangeHashes, bytes.NewReader(oldUpdateData), leavesPerNode, leafSize, blake)
+	compressed, err := CompressLeafHashes(ranges, msh)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// The swapped leaf is also included in the proof
-	proof = append(proof, leafHashes[3])
-
-	// Then we apply the modifications and construct the new root:
-	leafHashes = append(leafHashes, newLeafHash15)                // Append(15)
-	leafHashes[3], leafHashes[15] = leafHashes[15], leafHashes[3] // Swap(3,15)
-	leafHashes = append(leafHashes, newLeafHash16)                // Append(16)
-	newRoot, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(len(leafHashes))
-	if err != nil {
-		t.Fatal(err)
+	checkReconstructDiffRoot(t, compressed, numLeaves, blake, ranges, proof, root)
+	ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proof, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify old root")
+	}
+
+	// Next, we apply the modifications to our hashes and verify the new root:
+	rangeHashes[0], rangeHashes[1] = rangeHashes[1], rangeHashes[0]
+	rangeHashes = rangeHashes[:len(rangeHashes)-1]
+	ranges = ranges[:len(ranges)-1]
+	msh = NewMixedSubtreeHasher(rangeHashes, bytes.NewReader(newUpdateData), leavesPerNode, leafSize, blake)
+	compressed, err = CompressLeafHashes(ranges, msh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReconstructDiffRoot(t, compressed, numLeaves-4, blake, ranges, proof, newRoot)
+	ok, err = VerifyDiffProof(compressed, numLeaves-4, blake, ranges, proof, newRoot)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify new root")
+	}
+}
+
+// TestAffectedSubtrees tests that AffectedSubtrees returns exactly the cached
+// subtrees whose roots change when the leaves within a set of ranges are
+// modified.
+func TestAffectedSubtrees(t *testing.T) {
+	for _, test := range []struct {
+		ranges    []LeafRange
+		numLeaves uint64
+		exp       []uint64
+	}{
+		{nil, 50, nil},
+		{[]LeafRange{{5, 6}}, 50, []uint64{1}},                    // within a single subtree
+		{[]LeafRange{{4, 8}}, 50, []uint64{1}},                    // exactly one subtree
+		{[]LeafRange{{3, 9}}, 50, []uint64{0, 1, 2}},              // spanning subtrees
+		{[]LeafRange{{0, 1}, {2, 3}, {7, 8}}, 50, []uint64{0, 1}}, // several ranges per subtree
+		{[]LeafRange{{48, 50}}, 50, []uint64{12}},                 // final, short subtree
+		{[]LeafRange{{45, 50}}, 46, []uint64{11}},                 // trimmed to 46 leaves
+		{[]LeafRange{{44, 50}}, 44, nil},                          // trimmed to 44 leaves
+		{[]LeafRange{{50, 60}}, 60, []uint64{12, 13, 14}},         // appended leaves
+	} {
+		if affected := AffectedSubtrees(test.ranges, test.numLeaves, 2); !reflect.DeepEqual(affected, test.exp) {
+			t.Errorf("%v in %v leaves: expected %v, got %v", test.ranges, test.numLeaves, test.exp, affected)
+		}
+	}
+
+	// compare against recomputing every cached subtree root
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 100
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	subtreeRoots := func(leafHashes [][]byte, cacheHeight int) [][]byte {
+		var roots [][]byte
+		csh := NewCachedSubtreeHasher(leafHashes, blake)
+		for {
+			root, err := csh.NextSubtreeRoot(1 << uint(cacheHeight))
+			if err == io.EOF {
+				return roots
+			}
+			roots = append(roots, root)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		var ranges []LeafRange
+		for start := uint64(fastrand.Intn(20)); start < numLeaves; start += uint64(1 + fastrand.Intn(30)) {
+			end := start + uint64(1+fastrand.Intn(10))
+			if end > numLeaves {
+				end = numLeaves
+			}
+			ranges = append(ranges, LeafRange{start, end})
+			start = end
+		}
+		modified := append([][]byte(nil), leafHashes...)
+		for _, r := range ranges {
+			for j := r.Start; j < r.End; j++ {
+				modified[j] = fastrand.Bytes(32)
+			}
+		}
+		cacheHeight := fastrand.Intn(5)
+		var exp []uint64
+		before, after := subtreeRoots(leafHashes, cacheHeight), subtreeRoots(modified, cacheHeight)
+		for j := range before {
+			if !bytes.Equal(before[j], after[j]) {
+				exp = append(exp, uint64(j))
+			}
+		}
+		if affected := AffectedSubtrees(ranges, numLeaves, cacheHeight); !reflect.DeepEqual(affected, exp) {
+			t.Fatalf("%v at height %v: expected %v, got %v", ranges, cacheHeight, exp, affected)
+		}
+	}
+}
+
+// TestInferNumLeaves tests that InferNumLeaves recovers the size of the tree
+// from a diff proof when possible.
+func TestInferNumLeaves(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafHashes := make([][]byte, 16)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	tests := []struct {
+		ranges    []LeafRange
+		numLeaves uint64
+		exp       uint64
+		ok        bool
+	}{
+		{[]LeafRange{{0, 3}}, 3, 3, true},
+		{[]LeafRange{{0, 3}}, 4, 4, true},
+		{[]LeafRange{{1, 2}, {5, 7}}, 8, 8, true},
+		{[]LeafRange{{0, 4}}, 6, 5, false},  // 5, 6, and 8 yield the same proof length
+		{[]LeafRange{{2, 3}}, 16, 7, false}, // as do 9, 10, 12, and 16
+		{nil, 1, 1, false},                  // as does every power of two
+	}
+	for _, test := range tests {
+		proof, err := BuildDiffProof(test.ranges, NewCachedSubtreeHasher(leafHashes[:test.numLeaves], blake), test.numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, ok := InferNumLeaves(test.ranges, proof); n != test.exp || ok != test.ok {
+			t.Errorf("InferNumLeaves(%v): expected (%v, %v), got (%v, %v)", test.ranges, test.exp, test.ok, n, ok)
+		}
+	}
+
+	// compare against a brute-force search; for these ranges and proof
+	// lengths, all consistent tree sizes are below 1<<14
+	for lastEnd := uint64(1); lastEnd < 64; lastEnd++ {
+		ranges := []LeafRange{{lastEnd - 1, lastEnd}}
+		for size := 0; size < 8; size++ {
+			proof := make([][]byte, size)
+			var smallest uint64
+			var consistent int
+			for n := lastEnd; n < 1<<14; n++ {
+				if diffProofSize(ranges, n) == size {
+					if consistent == 0 {
+						smallest = n
+					}
+					consistent++
+				}
+			}
+			n, ok := InferNumLeaves(ranges, proof)
+			if consistent == 0 && (n != 0 || ok) {
+				t.Errorf("%v, %v hashes: expected no consistent size, got (%v, %v)", ranges, size, n, ok)
+			} else if consistent != 0 && (n != smallest || ok != (consistent == 1)) {
+				t.Errorf("%v, %v hashes: expected (%v, %v), got (%v, %v)", ranges, size, smallest, consistent == 1, n, ok)
+			}
+		}
+	}
+}
+
+// TestStrictPanics tests that the proof-building functions panic on illegal
+// ranges when StrictPanics is set, and return ErrInvalidRangeSet otherwise.
+func TestStrictPanics(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafHashes := make([][]byte, 8)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	build := map[string]func() error{
+		"BuildMultiRangeProof": func() error {
+			_, err := BuildMultiRangeProof([]LeafRange{{3, 5}, {1, 2}}, NewCachedSubtreeHasher(leafHashes, blake))
+			return err
+		},
+		"BuildRangeProof": func() error {
+			_, err := BuildRangeProof(4, 4, NewCachedSubtreeHasher(leafHashes, blake))
+			return err
+		},
+		"CompressLeafHashes": func() error {
+			_, err := CompressLeafHashes([]LeafRange{{1, 3}, {2, 4}}, NewCachedSubtreeHasher(leafHashes, blake))
+			return err
+		},
+	}
+	defer func() { StrictPanics = true }()
+	for name, fn := range build {
+		StrictPanics = true
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: expected panic with StrictPanics set", name)
+				}
+			}()
+			_ = fn()
+		}()
+
+		StrictPanics = false
+		if err := fn(); err != ErrInvalidRangeSet {
+			t.Errorf("%v: expected %v, got %v", name, ErrInvalidRangeSet, err)
+		}
+	}
+}
+
+// TestZeroLeafSize tests that a leafSize of zero is rejected rather than
+// producing an endless stream of empty leaves.
+func TestZeroLeafSize(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	r := bytes.NewReader(fastrand.Bytes(64))
+	for name, fn := range map[string]func(){
+		"NewReaderSubtreeHasher":          func() { NewReaderSubtreeHasher(r, 0, blake) },
+		"NewStreamingReaderSubtreeHasher": func() { NewStreamingReaderSubtreeHasher(r, 0, 8, blake) },
+		"NewReaderLeafHasher":             func() { NewReaderLeafHasher(r, blake, 0) },
+		"NewMixedSubtreeHasher":           func() { NewMixedSubtreeHasher(nil, r, 1, 0, blake) },
+		"NewReaderSubtreeHasher32":        func() { NewReaderSubtreeHasher32(r, 0, blake) },
+		"NewRootWriter":                   func() { NewRootWriter(0, blake) },
+		"NewProofWriter":                  func() { NewProofWriter(0, 0, blake) },
+		"NewBufferedReaderSubtreeHasher":  func() { NewBufferedReaderSubtreeHasher(r, 0, 8, blake) },
+		"NewPooledReaderSubtreeHasher":    func() { NewPooledReaderSubtreeHasher(r, 0, blake) },
+		"NewReverseReaderSubtreeHasher":   func() { NewReverseReaderSubtreeHasher(r, 64, 0, blake) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: expected panic for zero leafSize", name)
+				}
+			}()
+			fn()
+		}()
+	}
+	if _, _, _, err := BuildRangeProofAndRoot(r, 0, blake, 0, 1); err == nil {
+		t.Error("BuildRangeProofAndRoot: expected error for zero leafSize")
+	}
+
+	// a zero-length read should not spin
+	rsh := NewReaderSubtreeHasher(r, 1, blake)
+	rsh.leaf = rsh.leaf[:0]
+	if _, err := rsh.NextSubtreeRoot(4); err != io.ErrNoProgress {
+		t.Fatalf("expected %v, got %v", io.ErrNoProgress, err)
+	}
+}
+
+// TestRangeOverflow tests that proof ranges near the boundaries of int and
+// uint64 are rejected rather than wrapping around.
+func TestRangeOverflow(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 8
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+
+	// int ranges that are negative or empty should never be converted
+	const maxInt = int(^uint(0) >> 1)
+	const minInt = -maxInt - 1
+	defer func() { StrictPanics = true }()
+	StrictPanics = false
+	for _, r := range [][2]int{
+		{-1, 1},
+		{-1, maxInt},
+		{minInt, minInt + 1},
+		{minInt, maxInt},
+		{0, minInt},
+		{maxInt, maxInt},
+		{maxInt, minInt},
+	} {
+		if _, err := BuildRangeProof(r[0], r[1], NewCachedSubtreeHasher(leafHashes, blake)); err != ErrInvalidRangeSet {
+			t.Errorf("BuildRangeProof(%v, %v): expected %v, got %v", r[0], r[1], ErrInvalidRangeSet, err)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("VerifyRangeProof(%v, %v): expected panic", r[0], r[1])
+				}
+			}()
+			_, _ = VerifyRangeProof(NewCachedLeafHasher(leafHashes), blake, r[0], r[1], nil, nil)
+		}()
+	}
+	StrictPanics = true
+
+	// ranges extending far beyond the tree should produce errors, not
+	// negative subtree sizes or proofs for wrapped-around leaves
+	extremes := []uint64{
+		0, 1, numLeaves,
+		1<<31 - 1, 1 << 31, 1<<32 + 1,
+		1<<62 - 1, 1 << 62, 1<<62 + 1,
+		1<<63 - 1, 1 << 63, 1<<63 + 1,
+		math.MaxUint64 - 1, math.MaxUint64,
+	}
+	randomExtreme := func() uint64 {
+		x := extremes[fastrand.Intn(len(extremes))]
+		if fastrand.Intn(4) == 0 {
+			x -= uint64(fastrand.Intn(3))
+		}
+		return x
+	}
+	for i := 0; i < 1000; i++ {
+		r := LeafRange{randomExtreme(), randomExtreme()}
+		if r.End <= r.Start || r.End <= numLeaves {
+			continue
+		}
+		ranges := []LeafRange{r}
+		if _, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)); err == nil {
+			t.Fatalf("BuildMultiRangeProof(%v): expected error with ReaderSubtreeHasher", ranges)
+		}
+		if _, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake)); err == nil {
+			t.Fatalf("BuildMultiRangeProof(%v): expected error with CachedSubtreeHasher", ranges)
+		}
+		if _, err := BuildMultiRangeProof32(ranges, NewReaderSubtreeHasher32(bytes.NewReader(leafData), leafSize, blake)); err == nil {
+			t.Fatalf("BuildMultiRangeProof32(%v): expected error", ranges)
+		}
+		if _, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), numLeaves); err == nil {
+			t.Fatalf("BuildDiffProof(%v): expected error", ranges)
+		}
+		// the SubtreeHasher passed to CompressLeafHashes covers only the
+		// ranges, so it cannot always detect that they are too large, but it
+		// must not panic
+		_, _ = CompressLeafHashes(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+	}
+
+	// a skip that overflows the byte offset should not succeed silently
+	rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	if err := rsh.Skip(1 << 62); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+// TestProofHashPositions tests that ProofHashPositions identifies the
+// subtrees reported by ProofCoverage, and that the hash at each position is
+// the root of the leaves beneath it.
+func TestProofHashPositions(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for i := 0; i < 100; i++ {
+		numLeaves := uint64(fastrand.Intn(100) + 1)
+		leafHashes := make([][]byte, numLeaves)
+		for j := range leafHashes {
+			leafHashes[j] = fastrand.Bytes(32)
+		}
+		var ranges []LeafRange
+		for start := uint64(fastrand.Intn(int(numLeaves))); start < numLeaves; {
+			end := start + uint64(fastrand.Intn(int(numLeaves-start))) + 1
+			ranges = append(ranges, LeafRange{start, end})
+			start = end + uint64(fastrand.Intn(10))
+		}
+		proof, err := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		positions := ProofHashPositions(ranges, numLeaves)
+		coverage := ProofCoverage(ranges, numLeaves)
+		if len(positions) != len(proof) || len(coverage) != len(proof) {
+			t.Fatalf("%v: expected %v positions, got %v (coverage %v)", ranges, len(proof), len(positions), len(coverage))
+		}
+		for j, p := range positions {
+			start := p.Index << uint(p.Height)
+			end := (p.Index + 1) << uint(p.Height)
+			if end > numLeaves {
+				end = numLeaves
+			}
+			if (LeafRange{start, end}) != coverage[j] {
+				t.Fatalf("%v: position %v covers [%v,%v), expected %v", ranges, p, start, end, coverage[j])
+			} else if p.Height > 0 && start+1<<uint(p.Height-1) >= end {
+				t.Fatalf("%v: position %v is not the lowest node covering %v", ranges, p, coverage[j])
+			} else if !bytes.Equal(proof[j], recNodeRoot(leafHashes[start:end], blake)) {
+				t.Fatalf("%v: hash %v is not the root of the leaves at %v", ranges, j, p)
+			}
+		}
+	}
+}
+
+// TestSaltedHashers tests that salted trees over identical data have
+// different roots, and that their proofs only verify with the matching salt.
+func TestSaltedHashers(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	saltA, saltB := []byte("file A"), []byte("file B")
+	saltedRoot := func(salt []byte) []byte {
+		root, err := NewSaltedReaderSubtreeHasher(bytes.NewReader(leafData), salt, leafSize, blake).NextSubtreeRoot(numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+	rootA, rootB := saltedRoot(saltA), saltedRoot(saltB)
+	if bytes.Equal(rootA, rootB) {
+		t.Fatal("different salts produced the same root")
+	} else if bytes.Equal(saltedRoot(nil), bytesRoot(leafData, blake, leafSize)) {
+		t.Fatal("empty salt should not produce the unsalted root")
 	}
 
-	// The proof and the new root are sent to the verifier. The verifier also
-	// knows newLeafHash15 and newLeafHash16.
-	proofHashes, rangeHashes := proof[:len(proof)-1], proof[len(proof)-1:]
-	compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
+	const start, end = 10, 20
+	proof, err := BuildRangeProof(start, end, NewSaltedReaderSubtreeHasher(bytes.NewReader(leafData), saltA, leafSize, blake))
 	if err != nil {
 		t.Fatal(err)
 	}
-	ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, root)
-	if err != nil {
-		t.Fatal(err)
-	} else if !ok {
-		t.Fatal("failed to verify old root")
+	verify := func(salt, root []byte) bool {
+		lh := NewSaltedReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), salt, blake, leafSize)
+		ok, err := VerifyRangeProof(lh, blake, start, end, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !verify(saltA, rootA) {
+		t.Fatal("failed to verify proof with matching salt")
+	} else if verify(saltB, rootA) || verify(saltB, rootB) || verify(nil, rootA) {
+		t.Fatal("verified proof with mismatched salt")
 	}
 
-	// Next, we apply the modifications to our hashes and verify the new root:
-	rangeHashes = append(rangeHashes, newLeafHash15)
-	ranges = append(ranges, LeafRange{15, 16})
-	rangeHashes[0], rangeHashes[1] = rangeHashes[1], rangeHashes[0]
-	rangeHashes = append(rangeHashes, newLeafHash16)
-	ranges = append(ranges, LeafRange{16, 17})
-	compressed, err = CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
-	if err != nil {
-		t.Fatal(err)
+	// moving bytes between the salt and the leaf should change the hash
+	a := NewSaltedHasher(blake, []byte("file A")).HashLeaf([]byte("leaf"))
+	b := NewSaltedHasher(blake, []byte("file ")).HashLeaf([]byte("Aleaf"))
+	if bytes.Equal(a, b) {
+		t.Fatal("salts of different lengths produced colliding leaf hashes")
 	}
-	ok, err = VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, newRoot)
-	if err != nil {
-		t.Fatal(err)
-	} else if !ok {
-		t.Fatal("failed to verify new root")
+
+	// nor should moving the salt, along with its length prefix, into the leaf
+	// of a tree with an empty salt
+	salt, leaf := []byte("file A"), []byte("leaf")
+	var lenBuf [8]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(salt)))
+	moved := append(append(lenBuf[:], salt...), leaf...)
+	if bytes.Equal(NewSaltedHasher(blake, salt).HashLeaf(leaf), NewSaltedHasher(blake, nil).HashLeaf(moved)) {
+		t.Fatal("empty salt produced a leaf hash colliding with a non-empty salt")
 	}
 }
 
-// TestProofOfModificationTrim uses diff proofs to prove that data was
-// removed from a Merkle tree.
-func TestProofOfModificationTrim(t *testing.T) {
-	const leafSize = 64
-	const numLeaves = 15
-	const dataSize = leafSize * numLeaves
-	blake, _ := blake2b.New256(nil)
-	th := NewDefaultHasher(blake)
-	leafData := fastrand.Bytes(dataSize)
-	leafHashes := make([][]byte, numLeaves)
-	for i := range leafHashes {
-		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
-	}
-	root := bytesRoot(leafData, blake, leafSize)
+// closeRecorder is an io.ReadCloser that records whether Close was called.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+	err    error
+}
 
-	// The modifications we want to make are:
-	//
-	// - Swap(3,14)
-	// - Trim(3)
-	// - Trim(13)
-	//
-	ranges := []LeafRange{{3, 4}, {13, 14}, {14, 15}}
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return cr.err
+}
 
-	// We begin by constructing a diff proof for the old tree
-	proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), numLeaves)
+// TestReaderSubtreeHasherClose tests that BuildRangeProof and the other
+// proof builders close a ReaderSubtreeHasher only if SetCloseOnFinish is
+// enabled.
+func TestReaderSubtreeHasherClose(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(leafSize * 10)
+	exp, err := BuildRangeProof(3, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
 	if err != nil {
 		t.Fatal(err)
 	}
-	// The modified hashes are included in the proof:
-	proof = append(proof, leafHashes[3], leafHashes[13], leafHashes[14])
 
-	// Then we apply the modifications and construct the new root:
-	leafHashes[3], leafHashes[14] = leafHashes[14], leafHashes[3]
-	leafHashes = leafHashes[:numLeaves-2]
-	newRoot, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(len(leafHashes))
-	if err != nil {
-		t.Fatal(err)
+	for _, closeOnFinish := range []bool{false, true} {
+		cr := &closeRecorder{Reader: bytes.NewReader(leafData)}
+		sh := NewReaderSubtreeHasher(cr, leafSize, blake)
+		sh.SetCloseOnFinish(closeOnFinish)
+		proof, err := BuildRangeProof(3, 5, sh)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, exp) {
+			t.Fatal("wrong proof")
+		} else if cr.closed != closeOnFinish {
+			t.Fatalf("expected closed = %v, got %v", closeOnFinish, cr.closed)
+		}
+		if !closeOnFinish {
+			if err := sh.Close(); err != nil || !cr.closed {
+				t.Fatal("Close did not close the underlying reader")
+			}
+		}
 	}
 
-	// The proof and the new root are sent to the verifier.
-	proofHashes, rangeHashes := proof[:len(proof)-3], proof[len(proof)-3:]
-	compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
-	if err != nil {
-		t.Fatal(err)
-	}
-	ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, root)
-	if err != nil {
-		t.Fatal(err)
-	} else if !ok {
-		t.Fatal("failed to verify old root")
+	// the reader should be closed even if proof construction fails, and a
+	// failed Close should be reported
+	cr := &closeRecorder{Reader: bytes.NewReader(leafData)}
+	sh := NewReaderSubtreeHasher(cr, leafSize, blake)
+	sh.SetCloseOnFinish(true)
+	if _, err := BuildRangeProof(3, 20, sh); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	} else if !cr.closed {
+		t.Fatal("reader was not closed after failure")
+	}
+	errClose := errors.New("close failed")
+	cr = &closeRecorder{Reader: bytes.NewReader(leafData), err: errClose}
+	sh = NewReaderSubtreeHasher(cr, leafSize, blake)
+	sh.SetCloseOnFinish(true)
+	if _, err := BuildRangeProof(3, 5, sh); err != errClose {
+		t.Fatalf("expected %v, got %v", errClose, err)
 	}
 
-	// Next, we apply the modifications to our hashes and verify the new root:
-	rangeHashes[0], rangeHashes[2] = rangeHashes[2], rangeHashes[0]
-	rangeHashes = rangeHashes[:1]
-	ranges = []LeafRange{ranges[0]}
-	compressed, err = CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
-	if err != nil {
+	// Close on a reader that is not an io.Closer does nothing
+	if err := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake).Close(); err != nil {
 		t.Fatal(err)
 	}
-	ok, err = VerifyDiffProof(compressed, numLeaves, blake, ranges, proofHashes, newRoot)
-	if err != nil {
-		t.Fatal(err)
-	} else if !ok {
-		t.Fatal("failed to verify new root")
+
+	// the other builders should close the hasher as well
+	ranges := []LeafRange{{3, 5}}
+	for name, build := range map[string]func(SubtreeHasher) error{
+		"BuildMultiRangeProofAnnotated": func(sh SubtreeHasher) error {
+			_, err := BuildMultiRangeProofAnnotated(ranges, sh)
+			return err
+		},
+		"BuildDiffProof": func(sh SubtreeHasher) error {
+			_, err := BuildDiffProof(ranges, sh, 10)
+			return err
+		},
+		"CompressLeafHashes": func(sh SubtreeHasher) error {
+			_, err := CompressLeafHashes(ranges, sh)
+			return err
+		},
+		"CompressLeafHashesParallel": func(sh SubtreeHasher) error {
+			_, err := CompressLeafHashesParallel(ranges, func(LeafRange) SubtreeHasher { return sh }, 1, blake)
+			return err
+		},
+	} {
+		cr := &closeRecorder{Reader: bytes.NewReader(leafData)}
+		sh := NewReaderSubtreeHasher(cr, leafSize, blake)
+		sh.SetCloseOnFinish(true)
+		if err := build(sh); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		} else if !cr.closed {
+			t.Errorf("%v did not close the reader", name)
+		}
 	}
 }
 
-// TestProofOfModificationUpdate uses diff proofs to prove that a set of leaves
-// were updated.
-func TestProofOfModificationUpdate(t *testing.T) {
+// TestApplyModifications tests that ApplyModifications computes the same
+// roots as the TestProofOfModification tests.
+func TestApplyModifications(t *testing.T) {
 	const leafSize = 64
-	const numLeaves = 16
-	const leavesPerNode = 4
-	const dataSize = leafSize * numLeaves
 	blake, _ := blake2b.New256(nil)
 	th := NewDefaultHasher(blake)
-	leafData := fastrand.Bytes(dataSize)
-	leafHashes := make([][]byte, numLeaves)
-	for i := range leafHashes {
-		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	leafHashesOf := func(leafData []byte) [][]byte {
+		var leafHashes [][]byte
+		for buf := bytes.NewBuffer(leafData); buf.Len() > 0; {
+			leafHashes = append(leafHashes, th.HashLeaf(buf.Next(leafSize)))
+		}
+		return leafHashes
 	}
-	nodeHashes := make([][]byte, numLeaves/leavesPerNode)
-	for i := range nodeHashes {
-		nodeHashes[i] = bytesRoot(leafData[i*leafSize*leavesPerNode:][:leafSize*leavesPerNode], blake, leafSize)
+	compress := func(ranges []LeafRange, rangeHashes [][]byte) [][]byte {
+		compressed, err := CompressLeafHashes(ranges, NewCachedSubtreeHasher(rangeHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return compressed
+	}
+	rootOf := func(leafHashes [][]byte) []byte {
+		return recNodeRoot(leafHashes, blake)
 	}
-	root := bytesRoot(leafData, blake, leafSize)
-
-	// The modifications we want to make are:
-	//
-	// - Swap [4,8) [12,16)
-	// - Trim [12,16)
-	// - Update [2,4)
-	//
-	ranges := []LeafRange{{2, 4}, {4, 8}, {12, 16}}
-
-	// Generate new leaf data for the updated range
-	oldUpdateData := leafData[2*leafSize : 4*leafSize]
-	newUpdateData := fastrand.Bytes(len(oldUpdateData))
 
-	// We begin by constructing a diff proof for the old tree
-	msh := NewMixedSubtreeHasher(nodeHashes[1:], bytes.NewReader(leafData[:4*leafSize]), leavesPerNode, leafSize, blake)
-	proof, err := BuildDiffProof(ranges, msh, numLeaves)
+	// Append(15), Swap(3,15), Append(16)
+	leafHashes := leafHashesOf(fastrand.Bytes(leafSize * 15))
+	ranges := []LeafRange{{3, 4}}
+	proof, err := BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), 15)
 	if err != nil {
 		t.Fatal(err)
 	}
-	expProof := [][]byte{bytesRoot(leafData[:2*leafSize], blake, leafSize), nodeHashes[2]}
-	if !reflect.DeepEqual(proof, expProof) {
-		t.Fatal("bad proof")
+	newLeafHash15, newLeafHash16 := fastrand.Bytes(32), fastrand.Bytes(32)
+	rangeHashes := [][]byte{leafHashes[3]}
+	newRanges := []LeafRange{{3, 4}, {15, 16}, {16, 17}}
+	newRangeHashes := [][]byte{newLeafHash15, leafHashes[3], newLeafHash16}
+	newLeafHashes := append(append([][]byte(nil), leafHashes...), leafHashes[3], newLeafHash16)
+	newLeafHashes[3] = newLeafHash15
+	newRoot, err := ApplyModifications(proof, compress(ranges, rangeHashes), ranges, 15, 17, newRanges, compress(newRanges, newRangeHashes), blake)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(newRoot, rootOf(newLeafHashes)) {
+		t.Error("wrong root after append")
 	}
 
-	// The modified hashes are also sent along with the proof
-	rangeHashes := [][]byte{nodeHashes[1], nodeHashes[3]}
-
-	// Then we apply the modifications and construct the new root:
-	newLeafData := append([]byte(nil), leafData[:2*leafSize]...)
-	newLeafData = append(newLeafData, newUpdateData...)
-	newLeafData = append(newLeafData, leafData[12*leafSize:16*leafSize]...)
-	newLeafData = append(newLeafData, leafData[8*leafSize:12*leafSize]...)
-	newRoot := bytesRoot(newLeafData, blake, leafSize)
-
-	// The proof, modified hashes, and the new root are sent to the verifier.
-	msh = NewMixedSubtreeHasher(rangeHashes, bytes.NewReader(oldUpdateData), leavesPerNode, leafSize, blake)
-	compressed, err := CompressLeafHashes(ranges, msh)
+	// Swap(3,14), Trim(3), Trim(13)
+	ranges = []LeafRange{{3, 4}, {13, 14}, {14, 15}}
+	proof, err = BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), 15)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ok, err := VerifyDiffProof(compressed, numLeaves, blake, ranges, proof, root)
+	rangeHashes = [][]byte{leafHashes[3], leafHashes[13], leafHashes[14]}
+	newRanges = []LeafRange{{3, 4}}
+	newRangeHashes = [][]byte{leafHashes[14]}
+	newLeafHashes = append([][]byte(nil), leafHashes[:13]...)
+	newLeafHashes[3] = leafHashes[14]
+	newRoot, err = ApplyModifications(proof, compress(ranges, rangeHashes), ranges, 15, 13, newRanges, compress(newRanges, newRangeHashes), blake)
 	if err != nil {
 		t.Fatal(err)
-	} else if !ok {
-		t.Fatal("failed to verify old root")
+	} else if !bytes.Equal(newRoot, rootOf(newLeafHashes)) {
+		t.Error("wrong root after trim")
 	}
 
-	// Next, we apply the modifications to our hashes and verify the new root:
-	rangeHashes[0], rangeHashes[1] = rangeHashes[1], rangeHashes[0]
-	rangeHashes = rangeHashes[:len(rangeHashes)-1]
-	ranges = ranges[:len(ranges)-1]
-	msh = NewMixedSubtreeHasher(rangeHashes, bytes.NewReader(newUpdateData), leavesPerNode, leafSize, blake)
-	compressed, err = CompressLeafHashes(ranges, msh)
+	// Swap [4,8) [12,16), Trim [12,16), Update [2,4)
+	leafHashes = leafHashesOf(fastrand.Bytes(leafSize * 16))
+	ranges = []LeafRange{{2, 4}, {4, 8}, {12, 16}}
+	proof, err = BuildDiffProof(ranges, NewCachedSubtreeHasher(leafHashes, blake), 16)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ok, err = VerifyDiffProof(compressed, numLeaves-4, blake, ranges, proof, newRoot)
+	updated := [][]byte{fastrand.Bytes(32), fastrand.Bytes(32)}
+	rangeHashes = append(append(append([][]byte(nil), leafHashes[2:4]...), leafHashes[4:8]...), leafHashes[12:16]...)
+	newRanges = []LeafRange{{2, 4}, {4, 8}}
+	newRangeHashes = append(append([][]byte(nil), updated...), leafHashes[12:16]...)
+	newLeafHashes = append(append(append([][]byte(nil), leafHashes[:2]...), newRangeHashes...), leafHashes[8:12]...)
+	newRoot, err = ApplyModifications(proof, compress(ranges, rangeHashes), ranges, 16, 12, newRanges, compress(newRanges, newRangeHashes), blake)
 	if err != nil {
 		t.Fatal(err)
-	} else if !ok {
-		t.Fatal("failed to verify new root")
+	} else if !bytes.Equal(newRoot, rootOf(newLeafHashes)) {
+		t.Error("wrong root after update")
+	}
+
+	// a proof that still contains the range hashes should be rejected
+	badProof := append(append([][]byte(nil), proof...), rangeHashes...)
+	if _, err := ApplyModifications(badProof, compress(ranges, rangeHashes), ranges, 16, 12, newRanges, compress(newRanges, newRangeHashes), blake); err == nil {
+		t.Error("ApplyModifications accepted a proof with extra hashes")
+	}
+	if _, err := ApplyModifications(proof, rangeHashes, ranges, 16, 12, newRanges, compress(newRanges, newRangeHashes), blake); err == nil {
+		t.Error("ApplyModifications accepted uncompressed range hashes")
+	}
+	if _, err := ApplyModifications(proof, compress(ranges, rangeHashes), ranges, 16, 7, newRanges, compress(newRanges, newRangeHashes), blake); err == nil {
+		t.Error("ApplyModifications accepted ranges beyond the new tree")
 	}
 }
 
@@ -1587,6 +4134,128 @@ func BenchmarkVerifyRangeProof(b *testing.B) {
 	b.Run("half", benchRange(0, numLeaves/2))
 	b.Run("mid", benchRange(numLeaves/2, 1+numLeaves/2))
 	b.Run("full", benchRange(0, numLeaves-1))
+	b.Run("entire", benchRange(0, numLeaves))
+}
+
+// BenchmarkVerifyMultiRangeProof benchmarks the performance of
+// VerifyMultiRangeProof for the worst-case set of ranges, where every other
+// leaf is proven, as well as for a few ranges.
+func BenchmarkVerifyMultiRangeProof(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 1 << 14
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	root := recNodeRoot(leafHashes, blake)
+
+	benchRanges := func(ranges []LeafRange) func(*testing.B) {
+		proof, _ := BuildMultiRangeProof(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		var hashes [][]byte
+		for _, r := range ranges {
+			hashes = append(hashes, leafHashes[r.Start:r.End]...)
+		}
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ok, err := VerifyMultiRangeProof(NewCachedLeafHasher(hashes), blake, ranges, proof, root)
+				if err != nil || !ok {
+					b.Fatal("failed to verify proof", err)
+				}
+			}
+		}
+	}
+
+	var alternating []LeafRange
+	for i := uint64(0); i < numLeaves; i += 2 {
+		alternating = append(alternating, LeafRange{i, i + 1})
+	}
+	b.Run("alternating", benchRanges(alternating))
+	b.Run("few", benchRanges([]LeafRange{{10, 20}, {5000, 5001}, {9000, 12000}}))
+}
+
+// BenchmarkCompressLeafHashes benchmarks the performance of CompressLeafHashes
+// for the worst-case set of ranges, where every other leaf is modified.
+func BenchmarkCompressLeafHashes(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	leafData := fastrand.Bytes(1 << 16)
+	const leafSize = 64
+	numLeaves := len(leafData) / 64
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = th.HashLeaf(leafData[i*leafSize:][:leafSize])
+	}
+
+	// the SubtreeHasher only supplies the modified leaves, so the alternating
+	// ranges are laid out back-to-back
+	ranges := make([]LeafRange, numLeaves/2)
+	for i := range ranges {
+		ranges[i] = LeafRange{uint64(2 * i), uint64(2*i + 1)}
+	}
+
+	b.Run("reader", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = CompressLeafHashes(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = CompressLeafHashes(ranges, NewCachedSubtreeHasher(leafHashes, blake))
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		factory := func(r LeafRange) SubtreeHasher {
+			h, _ := blake2b.New256(nil)
+			// the leaves of range {2i, 2i+1} are stored at leafHashes[i]
+			i := r.Start / 2
+			return NewCachedSubtreeHasher(leafHashes[i:][:r.End-r.Start], h)
+		}
+		for i := 0; i < b.N; i++ {
+			_, _ = CompressLeafHashesParallel(ranges, factory, 0, blake)
+		}
+	})
+}
+
+// BenchmarkCompressLeafHashesLargeRanges compares CompressLeafHashes and
+// CompressLeafHashesParallel for a few large, unaligned ranges, where the
+// subtree hashing dominates.
+func BenchmarkCompressLeafHashesLargeRanges(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(1 << 22)
+	const leafSize = 64
+	numLeaves := uint64(len(leafData) / leafSize)
+	var ranges []LeafRange
+	for i := uint64(0); i < 8; i++ {
+		ranges = append(ranges, LeafRange{i*numLeaves/8 + 1, (i+1)*numLeaves/8 - 1})
+	}
+	var rs []io.Reader
+	for _, r := range ranges {
+		rs = append(rs, bytes.NewReader(leafData[r.Start*leafSize:r.End*leafSize]))
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		b.SetBytes(int64(len(leafData)))
+		for i := 0; i < b.N; i++ {
+			for _, r := range rs {
+				r.(*bytes.Reader).Seek(0, io.SeekStart)
+			}
+			_, _ = CompressLeafHashes(ranges, NewReaderSubtreeHasher(io.MultiReader(rs...), leafSize, blake))
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.SetBytes(int64(len(leafData)))
+		factory := func(r LeafRange) SubtreeHasher {
+			h, _ := blake2b.New256(nil)
+			return NewReaderSubtreeHasher(bytes.NewReader(leafData[r.Start*leafSize:r.End*leafSize]), leafSize, h)
+		}
+		for i := 0; i < b.N; i++ {
+			_, _ = CompressLeafHashesParallel(ranges, factory, 0, blake)
+		}
+	})
 }
 
 // TestBuildVerifyMixedDiffProof tests building and verifying proofs using the
@@ -1703,6 +4372,73 @@ func TestBuildVerifyMixedDiffProof(t *testing.T) {
 	}
 }
 
+// TestVerifyCachedRangeProof tests that VerifyCachedRangeProof verifies proofs
+// for ranges of cached sector roots, whether the proofs were built from the
+// leaves or from the sector roots via a MixedSubtreeHasher.
+func TestVerifyCachedRangeProof(t *testing.T) {
+	const numSectors = 7
+	const sectorSize = 1 << 14
+	const leafSize = 64
+	const cacheHeight = 8 // 256 leaves per sector
+	const leavesPerSector = sectorSize / leafSize
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(numSectors*sectorSize - sectorSize/2) // final sector is short
+	root := bytesRoot(leafData, blake, leafSize)
+	sectorRoots, err := SubtreeRoots(bytes.NewReader(leafData), leafSize, leavesPerSector, blake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootHasher := func(roots [][]byte) func() []byte {
+		return func() []byte {
+			if len(roots) == 0 {
+				return nil
+			}
+			r := roots[0]
+			roots = roots[1:]
+			return r
+		}
+	}
+
+	for start := 0; start < numSectors; start++ {
+		for end := start + 1; end <= numSectors; end++ {
+			leafEnd := end * leavesPerSector
+			if end == numSectors {
+				leafEnd = len(leafData) / leafSize
+			}
+			proof, err := BuildRangeProof(start*leavesPerSector, leafEnd, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if end < numSectors {
+				mixedProof, err := BuildRangeProof(start*leavesPerSector, leafEnd, NewMixedSubtreeHasher(sectorRoots, bytes.NewReader(nil), leavesPerSector, leafSize, blake))
+				if err != nil {
+					t.Fatal(err)
+				} else if !ProofsEqual(proof, mixedProof) {
+					t.Fatalf("[%v,%v): %v", start, end, ProofEqualityReport(mixedProof, proof))
+				}
+			}
+			if ok, err := VerifyCachedRangeProof(rootHasher(sectorRoots[start:end]), cacheHeight, blake, start, end, proof, root); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("failed to verify proof for sectors [%v,%v)", start, end)
+			}
+
+			// a wrong sector root should fail to verify
+			bad := append([][]byte(nil), sectorRoots[start:end]...)
+			bad[0] = sectorRoots[(start+1)%numSectors]
+			if ok, _ := VerifyCachedRangeProof(rootHasher(bad), cacheHeight, blake, start, end, proof, root); ok {
+				t.Fatalf("verified proof for sectors [%v,%v) with a wrong sector root", start, end)
+			}
+		}
+	}
+
+	// too few sector roots should be reported
+	proof, _ := BuildRangeProof(leavesPerSector, 3*leavesPerSector, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if _, err := VerifyCachedRangeProof(rootHasher(sectorRoots[1:2]), cacheHeight, blake, 1, 3, proof, root); err != ErrUnexpectedLeafCount {
+		t.Fatalf("expected %v, got %v", ErrUnexpectedLeafCount, err)
+	}
+}
+
 // TestBuildVerifyMixedDiffProofManual tests MixedSubtreeHasher against a manual
 // proof.
 func TestBuildVerifyMixedDiffProofManual(t *testing.T) {
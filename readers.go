@@ -2,6 +2,7 @@ package merkletree
 
 import (
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 )
@@ -43,6 +44,40 @@ func ReaderRoot(r io.Reader, h hash.Hash, segmentSize int) (root []byte, err err
 	return
 }
 
+// RootFromReaders returns the Merkle root of the data read from readers in
+// sequence, as if they were concatenated into a single stream of leaves of
+// leafSize bytes. Since a leaf may not span two readers, each reader must
+// contain a multiple of leafSize bytes, except for the last reader containing
+// any data, whose final leaf may be short. The root is computed using a Stack,
+// so memory usage does not depend on the amount of data.
+func RootFromReaders(readers []io.Reader, leafSize int, h hash.Hash) ([]byte, error) {
+	if leafSize <= 0 {
+		return nil, errors.New("leafSize must be positive")
+	}
+	s := NewStack(h)
+	leaf := make([]byte, leafSize)
+	shortReader := -1 // index of the reader that ended with a short leaf
+	for i, r := range readers {
+		for {
+			n, err := io.ReadFull(r, leaf)
+			if n > 0 && shortReader >= 0 {
+				return nil, fmt.Errorf("reader %v ends with a partial leaf, but reader %v contains more data", shortReader, i)
+			}
+			if err == io.EOF {
+				break
+			} else if err == io.ErrUnexpectedEOF {
+				s.AppendLeaf(leaf[:n])
+				shortReader = i
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("reader %v: %w", i, err)
+			}
+			s.AppendLeaf(leaf)
+		}
+	}
+	return s.Root(), nil
+}
+
 // BuildReaderProof returns a proof that certain data is in the merkle tree
 // created by the data in the reader. The merkle root, set of proofs, and the
 // number of leaves in the Merkle tree are all returned. All leaves will we
@@ -68,3 +103,89 @@ func BuildReaderProof(r io.Reader, h hash.Hash, segmentSize int, index uint64) (
 	}
 	return
 }
+
+// rootingSubtreeHasher implements SubtreeHasher by reading leaf data from an
+// underlying stream, like ReaderSubtreeHasher. Every leaf it reads, including
+// skipped leaves, is also appended to a Stack, so that once the stream has
+// been consumed, the Stack holds the root of the entire tree.
+type rootingSubtreeHasher struct {
+	r       io.Reader
+	leaf    []byte
+	th      TreeHasher
+	subtree *Stack
+	all     *Stack
+}
+
+// nextLeaf reads and hashes the next leaf, appending it to the Stack of all
+// leaves. It returns the leaf hash, or nil if no data was read, along with an
+// error with the same semantics as io.ReadFull.
+func (rsh *rootingSubtreeHasher) nextLeaf() ([]byte, error) {
+	n, err := io.ReadFull(rsh.r, rsh.leaf)
+	if n == 0 {
+		return nil, err
+	}
+	leafHash := rsh.th.HashLeaf(rsh.leaf[:n])
+	rsh.all.AppendNode(leafHash)
+	return leafHash, err
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (rsh *rootingSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	rsh.subtree.Reset()
+	for i := 0; i < subtreeSize; i++ {
+		leafHash, err := rsh.nextLeaf()
+		if leafHash != nil {
+			rsh.subtree.AppendNode(leafHash)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // reading a partial leaf is normal at the end of the stream
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	root := rsh.subtree.Root()
+	if root == nil {
+		return nil, io.EOF
+	}
+	return root, nil
+}
+
+// Skip implements SubtreeHasher. The skipped leaves are still hashed, since
+// they contribute to the root of the tree.
+func (rsh *rootingSubtreeHasher) Skip(n int) error {
+	for i := 0; i < n; i++ {
+		leafHash, err := rsh.nextLeaf()
+		if err == io.ErrUnexpectedEOF && leafHash != nil && i == n-1 {
+			return nil // the final leaf was short
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildRangeProofAndRoot constructs a proof for the leaf range [start, end)
+// of the data read from r, like BuildRangeProof with a ReaderSubtreeHasher,
+// while also computing the Merkle root of the data, like ReaderRoot. r is
+// read exactly once, in its entirety. All leaves will be leafSize bytes
+// except the last leaf, which will not be padded out if there are not enough
+// bytes remaining in the reader.
+func BuildRangeProofAndRoot(r io.Reader, leafSize int, h hash.Hash, start, end int) (root []byte, proof [][]byte, numLeaves int, err error) {
+	if leafSize <= 0 {
+		return nil, nil, 0, errors.New("BuildRangeProofAndRoot: leafSize must be positive")
+	}
+	rsh := &rootingSubtreeHasher{
+		r:       r,
+		leaf:    make([]byte, leafSize),
+		th:      NewDefaultHasher(h),
+		subtree: NewStack(h),
+		all:     NewStack(h),
+	}
+	proof, err = BuildRangeProof(start, end, rsh)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return rsh.all.Root(), proof, int(rsh.all.NumLeaves()), nil
+}
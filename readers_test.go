@@ -3,7 +3,10 @@ package merkletree
 import (
 	"bytes"
 	"crypto/sha256"
+	"io"
 	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
 )
 
 // TestReaderRoot calls ReaderRoot on a manually crafted dataset
@@ -109,3 +112,87 @@ func TestEmptyReader(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestRootFromReaders tests that RootFromReaders computes the same root as
+// ReaderRoot over the concatenated data.
+func TestRootFromReaders(t *testing.T) {
+	const leafSize = 64
+	data := fastrand.Bytes(leafSize*50 + 17)
+	root, err := ReaderRoot(bytes.NewReader(data), sha256.New(), leafSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := func(cuts ...int) []io.Reader {
+		var readers []io.Reader
+		prev := 0
+		for _, c := range append(cuts, len(data)) {
+			readers = append(readers, bytes.NewReader(data[prev:c]))
+			prev = c
+		}
+		return readers
+	}
+
+	for _, readers := range [][]io.Reader{
+		split(leafSize*10, leafSize*30),
+		split(0, leafSize*50),         // empty first reader
+		split(leafSize*20, len(data)), // empty last reader
+		split(leafSize, leafSize*2),   // single-leaf readers
+	} {
+		if r, err := RootFromReaders(readers, leafSize, sha256.New()); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(r, root) {
+			t.Fatalf("expected root %x, got %x", root, r)
+		}
+	}
+
+	// a partial leaf anywhere but at the end should be rejected
+	if _, err := RootFromReaders(split(leafSize*10+1, leafSize*30), leafSize, sha256.New()); err == nil {
+		t.Fatal("expected error for a partial leaf in the first reader")
+	}
+	if r, err := RootFromReaders(nil, leafSize, sha256.New()); err != nil || r != nil {
+		t.Fatalf("expected nil root for no readers, got %x, %v", r, err)
+	}
+}
+
+// TestBuildRangeProofAndRoot tests that BuildRangeProofAndRoot produces the
+// same root and proof as separate calls to ReaderRoot and BuildRangeProof.
+func TestBuildRangeProofAndRoot(t *testing.T) {
+	const leafSize = 64
+	for _, size := range []int{leafSize, 7 * leafSize, 100 * leafSize, 100*leafSize + 10} {
+		data := fastrand.Bytes(size)
+		expRoot, err := ReaderRoot(bytes.NewReader(data), sha256.New(), leafSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// hash the leaves separately, since a ReaderSubtreeHasher cannot skip
+		// a short final leaf
+		th := NewDefaultHasher(sha256.New())
+		var leafHashes [][]byte
+		for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+			leafHashes = append(leafHashes, th.HashLeaf(buf.Next(leafSize)))
+		}
+
+		numLeaves := len(leafHashes)
+		for _, r := range [][2]int{{0, 1}, {0, numLeaves}, {numLeaves - 1, numLeaves}, {numLeaves / 2, numLeaves/2 + 1}} {
+			expProof, err := BuildRangeProof(r[0], r[1], NewCachedSubtreeHasher(leafHashes, sha256.New()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			root, proof, n, err := BuildRangeProofAndRoot(bytes.NewReader(data), leafSize, sha256.New(), r[0], r[1])
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(root, expRoot) {
+				t.Errorf("%v bytes, range %v: wrong root", size, r)
+			} else if !ProofsEqual(proof, expProof) {
+				t.Errorf("%v bytes, range %v: proofs differ: %v", size, r, ProofEqualityReport(proof, expProof))
+			} else if n != numLeaves {
+				t.Errorf("%v bytes, range %v: expected %v leaves, got %v", size, r, numLeaves, n)
+			}
+		}
+
+		// a range beyond the end of the data should be rejected
+		if _, _, _, err := BuildRangeProofAndRoot(bytes.NewReader(data), leafSize, sha256.New(), numLeaves, numLeaves+1); err != io.ErrUnexpectedEOF {
+			t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+		}
+	}
+}
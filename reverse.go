@@ -0,0 +1,160 @@
+package merkletree
+
+import (
+	"hash"
+	"io"
+	"math"
+)
+
+// A ReverseSubtreeHasher computes subtree roots in descending order, starting
+// from the end of the tree. This is useful when the underlying storage is most
+// efficiently read back-to-front, or when proving leaves near the end of a
+// large tree.
+type ReverseSubtreeHasher interface {
+	// NumLeaves returns the number of leaves in the tree.
+	NumLeaves() uint64
+	// PrevSubtreeRoot hashes the subtreeSize leaves preceding the current
+	// position, returning their Merkle root and moving the current position
+	// to the first of those leaves. The position is initially NumLeaves.
+	PrevSubtreeRoot(subtreeSize int) ([]byte, error)
+	// SkipBack moves the current position back by n leaves.
+	SkipBack(n int) error
+}
+
+// ReverseReaderSubtreeHasher implements ReverseSubtreeHasher by reading leaf
+// data from an io.ReaderAt.
+type ReverseReaderSubtreeHasher struct {
+	r        io.ReaderAt
+	size     int64
+	leafSize int
+	leaf     []byte
+	stack    *Stack
+	pos      uint64
+}
+
+// NumLeaves implements ReverseSubtreeHasher.
+func (rrsh *ReverseReaderSubtreeHasher) NumLeaves() uint64 {
+	return uint64((rrsh.size + int64(rrsh.leafSize) - 1) / int64(rrsh.leafSize))
+}
+
+// PrevSubtreeRoot implements ReverseSubtreeHasher.
+func (rrsh *ReverseReaderSubtreeHasher) PrevSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if uint64(subtreeSize) > rrsh.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rrsh.pos -= uint64(subtreeSize)
+	rrsh.stack.Reset()
+	off := int64(rrsh.pos) * int64(rrsh.leafSize)
+	for i := 0; i < subtreeSize; i++ {
+		leaf := rrsh.leaf
+		if rem := rrsh.size - off; rem < int64(len(leaf)) {
+			leaf = leaf[:rem] // the final leaf may be short
+		}
+		n, err := rrsh.r.ReadAt(leaf, off)
+		if n != len(leaf) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		rrsh.stack.AppendLeaf(leaf)
+		off += int64(n)
+	}
+	return rrsh.stack.Root(), nil
+}
+
+// SkipBack implements ReverseSubtreeHasher.
+func (rrsh *ReverseReaderSubtreeHasher) SkipBack(n int) error {
+	if uint64(n) > rrsh.pos {
+		return io.ErrUnexpectedEOF
+	}
+	rrsh.pos -= uint64(n)
+	return nil
+}
+
+// NewReverseReaderSubtreeHasher returns a new ReverseReaderSubtreeHasher that
+// reads size bytes of leaf data from r. All leaves are leafSize bytes except
+// the last, which may be shorter.
+func NewReverseReaderSubtreeHasher(r io.ReaderAt, size, leafSize int, h hash.Hash) *ReverseReaderSubtreeHasher {
+	if leafSize <= 0 {
+		panic("NewReverseReaderSubtreeHasher: leafSize must be positive")
+	}
+	rrsh := &ReverseReaderSubtreeHasher{
+		r:        r,
+		size:     int64(size),
+		leafSize: leafSize,
+		leaf:     make([]byte, leafSize),
+		stack:    NewStack(h),
+	}
+	rrsh.pos = rrsh.NumLeaves()
+	return rrsh
+}
+
+// BuildMultiRangeProofReverse is like BuildMultiRangeProof, but computes the
+// subtree roots of the proof in descending order using a ReverseSubtreeHasher.
+// The resulting proof is identical to the one produced by BuildMultiRangeProof,
+// i.e. its hashes are in left-to-right order.
+func BuildMultiRangeProofReverse(ranges []LeafRange, h ReverseSubtreeHasher) (proof [][]byte, err error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	if !validRangeSet(ranges) {
+		panic("BuildMultiRangeProofReverse: illegal set of proof ranges")
+	}
+	numLeaves := h.NumLeaves()
+	if ranges[len(ranges)-1].End > numLeaves {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// First, plan the same walk that BuildMultiRangeProof would make, without
+	// hashing anything. Since the number of leaves is known, the size of the
+	// final subtree can be truncated to the leaves that are actually present.
+	type step struct {
+		size int
+		keep bool
+	}
+	var steps []step
+	var leafIndex uint64
+	walkUntil := func(end uint64, keep bool) {
+		for leafIndex != end && leafIndex < numLeaves {
+			subtreeSize := uint64(nextSubtreeSize(leafIndex, end))
+			if leafIndex+subtreeSize > numLeaves {
+				subtreeSize = numLeaves - leafIndex
+			}
+			steps = append(steps, step{int(subtreeSize), keep})
+			leafIndex += subtreeSize
+		}
+	}
+	for _, r := range ranges {
+		walkUntil(r.Start, true)
+		walkUntil(r.End, false)
+	}
+	walkUntil(math.MaxUint64, true)
+
+	// Then, execute the walk in reverse.
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].keep {
+			root, err := h.PrevSubtreeRoot(steps[i].size)
+			if err != nil {
+				return nil, err
+			}
+			proof = append(proof, root)
+		} else if err := h.SkipBack(steps[i].size); err != nil {
+			return nil, err
+		}
+	}
+	for i, j := 0, len(proof)-1; i < j; i, j = i+1, j-1 {
+		proof[i], proof[j] = proof[j], proof[i]
+	}
+	return proof, nil
+}
+
+// BuildRangeProofReverse constructs a proof for the leaf range [proofStart,
+// proofEnd) using the provided ReverseSubtreeHasher.
+func BuildRangeProofReverse(proofStart, proofEnd int, h ReverseSubtreeHasher) (proof [][]byte, err error) {
+	r, ok := intRange(proofStart, proofEnd)
+	if !ok {
+		panic("BuildRangeProofReverse: illegal proof range")
+	}
+	return BuildMultiRangeProofReverse([]LeafRange{r}, h)
+}
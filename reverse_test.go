@@ -0,0 +1,73 @@
+package merkletree
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestBuildRangeProofReverse tests that BuildRangeProofReverse produces the
+// same proofs as BuildRangeProof.
+func TestBuildRangeProofReverse(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	const leafSize = 64
+	// include trees whose final leaf is short
+	for _, dataSize := range []int{leafSize, 100 * leafSize, 100*leafSize + 10, 128 * leafSize, 1000*leafSize - 1} {
+		leafData := fastrand.Bytes(dataSize)
+		var leafHashes [][]byte
+		for buf := bytes.NewBuffer(leafData); buf.Len() > 0; {
+			leafHashes = append(leafHashes, th.HashLeaf(buf.Next(leafSize)))
+		}
+		numLeaves := len(leafHashes)
+
+		checkRange := func(start, end int) {
+			expected, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsh := NewReverseReaderSubtreeHasher(bytes.NewReader(leafData), dataSize, leafSize, blake)
+			proof, err := BuildRangeProofReverse(start, end, rsh)
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(proof, expected) {
+				t.Fatalf("%v leaves, range [%v,%v): %v", numLeaves, start, end, ProofEqualityReport(proof, expected))
+			}
+		}
+		// every range in the last few leaves, plus some random ranges
+		for start := numLeaves - 5; start < numLeaves; start++ {
+			if start < 0 {
+				continue
+			}
+			for end := start + 1; end <= numLeaves; end++ {
+				checkRange(start, end)
+			}
+		}
+		for i := 0; i < 20; i++ {
+			start := fastrand.Intn(numLeaves)
+			checkRange(start, start+1+fastrand.Intn(numLeaves-start))
+		}
+	}
+
+	// multiple ranges
+	leafData := fastrand.Bytes(100 * leafSize)
+	ranges := []LeafRange{{3, 5}, {9, 10}, {60, 99}}
+	expected, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := BuildMultiRangeProofReverse(ranges, NewReverseReaderSubtreeHasher(bytes.NewReader(leafData), len(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, expected) {
+		t.Fatal(ProofEqualityReport(proof, expected))
+	}
+
+	// ranges beyond the end of the tree should be rejected
+	if _, err := BuildRangeProofReverse(99, 101, NewReverseReaderSubtreeHasher(bytes.NewReader(leafData), len(leafData), leafSize, blake)); err == nil {
+		t.Error("BuildRangeProofReverse accepted a range beyond the end of the tree")
+	}
+}
@@ -0,0 +1,379 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// A RootBuilder incrementally computes a Merkle root from a sequence of leaf
+// hashes and subtree roots. It is implemented by both Stack and Tree, allowing
+// callers to choose between the lean Stack and the proof-capable Tree.
+type RootBuilder interface {
+	// AppendNode appends a leaf hash to the tree.
+	AppendNode(node []byte)
+	// PushSubTree appends the root of a balanced subtree of 2^height leaves.
+	// The subtree must not be larger than the smallest subtree already
+	// appended.
+	PushSubTree(height int, sum []byte) error
+	// Root returns the Merkle root of the nodes appended so far, or nil if
+	// nothing has been appended.
+	Root() []byte
+}
+
+var (
+	_ RootBuilder = &Stack{}
+	_ RootBuilder = &Tree{}
+)
+
+// A Stack is a Merkle tree that stores only one (root) node per level. Nodes
+// are appended in sequential order and the Merkle root can be computed at any
+// time. Unlike Tree, a Stack cannot construct proofs, which allows it to be
+// considerably leaner: appending a node never allocates, aside from the
+// hashing itself.
+type Stack struct {
+	// The Stack is stored as an array of subtree roots, one per height. The
+	// i'th bit of 'used' indicates whether stack[i] holds the root of a
+	// complete subtree of 2^i leaves. Since 'used' is also the number of
+	// leaves that have been appended, a Stack can hold at most 2^64-1 leaves.
+	stack      [64][]byte
+	used       uint64
+	treeHasher TreeHasher
+	padding    TreePaddingMode
+}
+
+// A TreePaddingMode determines how the root of an unbalanced tree, i.e. a tree
+// whose number of leaves is not a power of two, is computed.
+type TreePaddingMode int
+
+const (
+	// PadNone promotes a node without a sibling to the next level without
+	// hashing it, as specified by RFC 6962. This is the default.
+	PadNone TreePaddingMode = iota
+	// PadDuplicate pairs a node without a sibling with a copy of itself, as
+	// in Bitcoin's transaction Merkle trees.
+	PadDuplicate
+)
+
+// SetPaddingMode sets the TreePaddingMode used to compute the root of the
+// Stack. The proofs constructed and verified by this package always assume
+// PadNone.
+func (s *Stack) SetPaddingMode(mode TreePaddingMode) {
+	s.padding = mode
+}
+
+// ErrStackFull is returned by AppendNodeChecked when the Stack already holds
+// the maximum number of leaves.
+var ErrStackFull = errors.New("stack is full")
+
+// checkAppend returns an error if a subtree of 2^height leaves cannot be
+// appended to the Stack, either because the number of leaves would overflow,
+// or because the subtree would not be aligned, i.e. its height would exceed
+// the height of the smallest subtree currently in the Stack.
+func (s *Stack) checkAppend(height uint64) error {
+	if height >= 64 {
+		return errors.New("height must be less than 64")
+	} else if s.used > math.MaxUint64-(1<<height) {
+		return ErrStackFull
+	} else if s.used&(1<<height-1) != 0 {
+		return errors.New("subtree is larger than the smallest subtree in the Stack")
+	}
+	return nil
+}
+
+// appendNodeAtHeight appends node, which must be the root of a subtree of
+// 2^height leaves, to the Stack. The height must not exceed the height of the
+// smallest subtree currently in the Stack.
+func (s *Stack) appendNodeAtHeight(node []byte, height uint64) {
+	if err := s.checkAppend(height); err != nil {
+		panic("appendNodeAtHeight: " + err.Error())
+	}
+
+	// Join subtrees of equal height, moving upwards until an empty slot is
+	// found. The subtree already in the Stack is always the left sibling.
+	i := height
+	for ; s.used&(1<<i) != 0; i++ {
+		node = s.treeHasher.HashNode(s.stack[i], node)
+	}
+	s.stack[i] = node
+	s.used += 1 << height
+}
+
+// AppendNode appends a leaf hash (or the root of a subtree of height 0) to the
+// Stack.
+func (s *Stack) AppendNode(node []byte) {
+	s.appendNodeAtHeight(node, 0)
+}
+
+// AppendNodeChecked is like AppendNode, but returns ErrStackFull rather than
+// panicking if the Stack already holds the maximum number of leaves.
+func (s *Stack) AppendNodeChecked(node []byte) error {
+	if err := s.checkAppend(0); err != nil {
+		return err
+	}
+	s.appendNodeAtHeight(node, 0)
+	return nil
+}
+
+// PushSubTree appends sum, which must be the root of a balanced subtree of
+// 2^height leaves, to the Stack. Like Tree.PushSubTree, it returns an error if
+// the subtree is larger than the smallest subtree currently in the Stack.
+func (s *Stack) PushSubTree(height int, sum []byte) error {
+	if height < 0 {
+		return errors.New("height must not be negative")
+	} else if err := s.checkAppend(uint64(height)); err != nil {
+		return err
+	}
+	s.appendNodeAtHeight(sum, uint64(height))
+	return nil
+}
+
+// AppendAndProve is like AppendNode, but also returns the new root of the
+// Stack along with a proof that the prior root is the root of a prefix of the
+// new tree. The proof consists of the subtree roots stored in the Stack prior
+// to the append, in order of decreasing height, and can be verified with
+// VerifyAppendProof. It assumes PadNone.
+func (s *Stack) AppendAndProve(node []byte) (newRoot []byte, consistencyProof [][]byte) {
+	for i := bits.Len64(s.used) - 1; i >= 0; i-- {
+		if s.used&(1<<uint(i)) != 0 {
+			consistencyProof = append(consistencyProof, append([]byte(nil), s.stack[i]...))
+		}
+	}
+	s.AppendNode(node)
+	return s.Root(), consistencyProof
+}
+
+// VerifyAppendProof verifies a proof produced by AppendAndProve, i.e. that
+// newRoot is the root of the tree formed by appending node to the tree of
+// numLeaves leaves whose root is oldRoot.
+func VerifyAppendProof(node []byte, h hash.Hash, numLeaves uint64, proof [][]byte, oldRoot, newRoot []byte) bool {
+	if len(proof) != bits.OnesCount64(numLeaves) || numLeaves == math.MaxUint64 {
+		return false
+	}
+	// rebuild the prior Stack from its subtree roots
+	s := NewStack(h)
+	for i := bits.Len64(numLeaves) - 1; i >= 0; i-- {
+		if numLeaves&(1<<uint(i)) != 0 {
+			s.appendNodeAtHeight(proof[0], uint64(i))
+			proof = proof[1:]
+		}
+	}
+	if !bytes.Equal(s.Root(), oldRoot) {
+		return false
+	}
+	s.AppendNode(node)
+	return bytes.Equal(s.Root(), newRoot)
+}
+
+// AppendLeaf hashes data to form a leaf and appends it to the Stack.
+func (s *Stack) AppendLeaf(data []byte) {
+	s.appendNodeAtHeight(s.treeHasher.HashLeaf(data), 0)
+}
+
+// NumLeaves returns the number of leaves that have been appended to the
+// Stack.
+func (s *Stack) NumLeaves() uint64 {
+	return s.used
+}
+
+// Root returns the Merkle root of the nodes that have been appended. If the
+// Stack is empty, Root returns nil.
+func (s *Stack) Root() []byte {
+	if s.used == 0 {
+		return nil
+	}
+
+	// The root is formed by hashing together subtrees in order from least in
+	// height to greatest in height. The taller subtree is the left sibling.
+	i := bits.TrailingZeros64(s.used)
+	root, height := s.stack[i], i
+	for i++; i < bits.Len64(s.used); i++ {
+		if s.used&(1<<uint(i)) != 0 {
+			// In PadDuplicate mode, pair the smaller subtree with itself
+			// until it is as tall as its left sibling.
+			for ; s.padding == PadDuplicate && height < i; height++ {
+				root = s.treeHasher.HashNode(root, root)
+			}
+			root, height = s.treeHasher.HashNode(s.stack[i], root), i+1
+		}
+	}
+	// Return a copy to prevent leaking a pointer to internal data.
+	return append(root[:0:0], root...)
+}
+
+// RootAtHeight returns the root of the subtree of 2^height leaves currently
+// stored at the given height, i.e. the most recent complete subtree of that
+// size that has not yet been joined with a sibling. If no such subtree
+// exists, RootAtHeight returns false.
+func (s *Stack) RootAtHeight(height uint64) ([]byte, bool) {
+	if height >= 64 || s.used&(1<<height) == 0 {
+		return nil, false
+	}
+	return append([]byte(nil), s.stack[height]...), true
+}
+
+// Reset removes all nodes from the Stack.
+func (s *Stack) Reset() {
+	// Since 'used' only grows, no slot above its highest set bit has ever
+	// been written, so only the slots below it need to be cleared.
+	for i := 0; i < bits.Len64(s.used); i++ {
+		s.stack[i] = nil
+	}
+	s.used = 0
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding consists of
+// the number of leaves in the Stack and the size of each node, both as 8-byte
+// little-endian integers, followed by the populated nodes in order of
+// increasing height. The hash function is not encoded.
+func (s *Stack) MarshalBinary() ([]byte, error) {
+	var nodeSize int
+	for i := 0; i < 64; i++ {
+		if s.used&(1<<uint(i)) != 0 {
+			nodeSize = len(s.stack[i])
+			break
+		}
+	}
+	buf := make([]byte, 16, 16+nodeSize*bits.OnesCount64(s.used))
+	binary.LittleEndian.PutUint64(buf[0:8], s.used)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(nodeSize))
+	for i := 0; i < 64; i++ {
+		if s.used&(1<<uint(i)) == 0 {
+			continue
+		} else if len(s.stack[i]) != nodeSize {
+			return nil, errors.New("nodes in Stack have differing sizes")
+		}
+		buf = append(buf, s.stack[i]...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The Stack must have
+// been created with the same hash function as the Stack that was marshalled;
+// appending to the restored Stack then produces the same roots as appending to
+// the original.
+func (s *Stack) UnmarshalBinary(data []byte) error {
+	if len(data) < 16 {
+		return errors.New("encoded Stack is too short")
+	}
+	used := binary.LittleEndian.Uint64(data[0:8])
+	nodeSize := binary.LittleEndian.Uint64(data[8:16])
+	data = data[16:]
+	numNodes := uint64(bits.OnesCount64(used))
+	if nodeSize == 0 && numNodes != 0 {
+		return errors.New("encoded Stack has invalid node size")
+	} else if numNodes != 0 && nodeSize > uint64(len(data))/numNodes || uint64(len(data)) != nodeSize*numNodes {
+		return errors.New("encoded Stack has wrong length")
+	}
+	s.Reset()
+	for i := 0; i < 64; i++ {
+		if used&(1<<uint(i)) == 0 {
+			continue
+		}
+		s.stack[i] = append([]byte(nil), data[:nodeSize]...)
+		data = data[nodeSize:]
+	}
+	s.used = used
+	return nil
+}
+
+// NewStack creates a new Stack. The provided hash will be used for all
+// hashing operations within the Stack.
+func NewStack(h hash.Hash) *Stack {
+	return &Stack{
+		treeHasher: NewDefaultHasher(h),
+	}
+}
+
+// StackRootFromChannel appends each node received from ch to a Stack, and
+// returns the Stack's root once ch is closed. If ch is closed without
+// receiving any nodes, StackRootFromChannel returns nil.
+func StackRootFromChannel(ch <-chan []byte, h hash.Hash) []byte {
+	s := NewStack(h)
+	for node := range ch {
+		s.AppendNode(node)
+	}
+	return s.Root()
+}
+
+// RootFromLeafHashes returns the Merkle root of the tree with the specified
+// leaf hashes, combining them using th. Unlike functions that accept a
+// hash.Hash, this allows the root of a tree using a custom node hashing
+// scheme, e.g. one without the RFC 6962 prefixes, to be computed. If
+// leafHashes is empty, RootFromLeafHashes returns nil.
+func RootFromLeafHashes(leafHashes [][]byte, th TreeHasher) []byte {
+	s := &Stack{treeHasher: th}
+	for _, leafHash := range leafHashes {
+		s.AppendNode(leafHash)
+	}
+	return s.Root()
+}
+
+// PrefixRoots returns the Merkle roots of every prefix of the tree with the
+// specified leaf hashes, i.e. element i is the root of the first i+1 leaves.
+// This is useful for transparency logs, which publish the root after each
+// insertion. The leaf hashes are appended to a single Stack, so each root
+// costs O(log n) hashes.
+func PrefixRoots(leafHashes [][]byte, h hash.Hash) [][]byte {
+	s := NewStack(h)
+	roots := make([][]byte, len(leafHashes))
+	for i, leafHash := range leafHashes {
+		s.AppendNode(leafHash)
+		roots[i] = s.Root()
+	}
+	return roots
+}
+
+// RootWithNodeCallback computes the Merkle root of the leaves produced by sh,
+// calling cb with every node of the tree as it is formed: first each leaf hash,
+// then each interior node, with the root last. The position of each node is
+// given as in NodePosition, so the interior nodes along the right edge of an
+// unbalanced tree are reported at the lowest height covering their leaves.
+// This allows a storage layer to persist every node of the tree in a single
+// hashing pass. cb must not modify or retain the hash it is passed unless it
+// copies it. If sh produces no leaves, RootWithNodeCallback returns nil.
+func RootWithNodeCallback(sh SubtreeHasher, h hash.Hash, cb func(height int, index uint64, hash []byte)) ([]byte, error) {
+	th := NewDefaultHasher(h)
+	var stack [64][]byte
+	var used uint64
+	for {
+		node, err := sh.NextSubtreeRoot(1)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if used == math.MaxUint64 {
+			return nil, ErrStackFull
+		}
+		cb(0, used, node)
+		// join subtrees of equal height, as in Stack.appendNodeAtHeight
+		i := 0
+		for ; used&(1<<uint(i)) != 0; i++ {
+			node = th.HashNode(stack[i], node)
+			stack[i] = nil
+			cb(i+1, used>>uint(i+1), node)
+		}
+		stack[i] = node
+		used++
+	}
+	if used == 0 {
+		return nil, nil
+	}
+
+	// join the remaining subtrees, as in Stack.Root; each join covers the
+	// leaves [start, used)
+	i := bits.TrailingZeros64(used)
+	root, start := stack[i], used-1<<uint(i)
+	for i++; i < bits.Len64(used); i++ {
+		if used&(1<<uint(i)) != 0 {
+			root = th.HashNode(stack[i], root)
+			start -= 1 << uint(i)
+			cb(i+1, start>>uint(i+1), root)
+		}
+	}
+	return root, nil
+}
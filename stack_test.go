@@ -0,0 +1,488 @@
+package merkletree
+
+import (
+	"bytes"
+	"hash"
+	"math"
+	"math/bits"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// recNodeRoot is a helper function that recursively calculates the Merkle
+// root of a set of leaf hashes.
+func recNodeRoot(nodes [][]byte, h hash.Hash) []byte {
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	// the left subtree is the largest power of two smaller than len(nodes)
+	mid := 1
+	for mid*2 < len(nodes) {
+		mid *= 2
+	}
+	return sum(h, nodeHashPrefix, recNodeRoot(nodes[:mid], h), recNodeRoot(nodes[mid:], h))
+}
+
+// TestStack tests that a Stack produces the same roots as a Tree and as
+// recNodeRoot.
+func TestStack(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	s := NewStack(blake)
+	if s.Root() != nil {
+		t.Error("empty Stack should have a nil root")
+	}
+
+	tree := New(blake)
+	var leafHashes [][]byte
+	for i := 0; i < 130; i++ {
+		data := fastrand.Bytes(64)
+		leafHashes = append(leafHashes, th.HashLeaf(data))
+		tree.Push(data)
+		if fastrand.Intn(2) == 0 {
+			s.AppendLeaf(data)
+		} else {
+			s.AppendNode(leafHashes[i])
+		}
+		if s.NumLeaves() != uint64(i+1) {
+			t.Fatalf("expected %v leaves, got %v", i+1, s.NumLeaves())
+		}
+		if !bytes.Equal(s.Root(), tree.Root()) {
+			t.Fatalf("Stack root does not match Tree root after %v leaves", i+1)
+		}
+		if !bytes.Equal(s.Root(), recNodeRoot(leafHashes, blake)) {
+			t.Fatalf("Stack root does not match recNodeRoot after %v leaves", i+1)
+		}
+	}
+
+	s.Reset()
+	if s.Root() != nil || s.NumLeaves() != 0 {
+		t.Error("Reset did not empty the Stack")
+	}
+}
+
+// TestStackRootAtHeight tests that RootAtHeight returns the roots of the
+// complete subtrees held by the Stack.
+func TestStackRootAtHeight(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	s := NewStack(blake)
+	if _, ok := s.RootAtHeight(0); ok {
+		t.Error("empty Stack should not have any subtrees")
+	}
+
+	// append 2^k + m leaves
+	const k, m = 5, 11
+	var leafHashes [][]byte
+	for i := 0; i < 1<<k+m; i++ {
+		leafHashes = append(leafHashes, fastrand.Bytes(32))
+		s.AppendNode(leafHashes[i])
+	}
+	// 43 = 0b101011, so subtrees of height 0, 1, 3, and 5 should be present,
+	// covering leaves [42,43), [40,42), [32,40), and [0,32) respectively.
+	expected := map[uint64][]byte{
+		0: recNodeRoot(leafHashes[42:43], blake),
+		1: recNodeRoot(leafHashes[40:42], blake),
+		3: recNodeRoot(leafHashes[32:40], blake),
+		5: recNodeRoot(leafHashes[0:32], blake),
+	}
+	for height := uint64(0); height < 70; height++ {
+		root, ok := s.RootAtHeight(height)
+		if exp, present := expected[height]; ok != present {
+			t.Errorf("height %v: expected presence %v, got %v", height, present, ok)
+		} else if !bytes.Equal(root, exp) {
+			t.Errorf("height %v: incorrect subtree root", height)
+		}
+	}
+}
+
+// TestStackMarshalBinary tests that a Stack restored with UnmarshalBinary
+// produces the same roots as a Stack that was never persisted.
+func TestStackMarshalBinary(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for _, n := range []int{0, 1, 2, 7, 64, 100} {
+		s := NewStack(blake)
+		uninterrupted := NewStack(blake)
+		for i := 0; i < n; i++ {
+			leaf := fastrand.Bytes(32)
+			s.AppendLeaf(leaf)
+			uninterrupted.AppendLeaf(leaf)
+		}
+		data, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := NewStack(blake)
+		if err := restored.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		} else if restored.NumLeaves() != uninterrupted.NumLeaves() {
+			t.Fatalf("restored Stack has %v leaves, expected %v", restored.NumLeaves(), uninterrupted.NumLeaves())
+		} else if !bytes.Equal(restored.Root(), uninterrupted.Root()) {
+			t.Fatal("restored Stack has a different root")
+		}
+		for i := 0; i < 37; i++ {
+			leaf := fastrand.Bytes(32)
+			restored.AppendLeaf(leaf)
+			uninterrupted.AppendLeaf(leaf)
+			if !bytes.Equal(restored.Root(), uninterrupted.Root()) {
+				t.Fatalf("restored Stack diverged after appending %v leaves to a Stack of %v leaves", i+1, n)
+			}
+		}
+	}
+
+	// invalid encodings should be rejected
+	s := NewStack(blake)
+	for i := 0; i < 5; i++ {
+		s.AppendLeaf([]byte{byte(i)})
+	}
+	data, _ := s.MarshalBinary()
+	for _, bad := range [][]byte{
+		nil,
+		data[:15],
+		data[:len(data)-1],
+		append(data[:len(data):len(data)], 0),
+	} {
+		if err := NewStack(blake).UnmarshalBinary(bad); err == nil {
+			t.Errorf("UnmarshalBinary accepted an invalid encoding of length %v", len(bad))
+		}
+	}
+}
+
+// setStackLeaves is a test helper that makes s appear to hold numLeaves
+// leaves, each of whose subtree roots is node.
+func setStackLeaves(s *Stack, numLeaves uint64, node []byte) {
+	s.Reset()
+	s.used = numLeaves
+	for i := range s.stack {
+		if numLeaves&(1<<uint(i)) != 0 {
+			s.stack[i] = node
+		}
+	}
+}
+
+// TestStackAppendNodeChecked tests that AppendNodeChecked refuses to overflow
+// the number of leaves in the Stack.
+func TestStackAppendNodeChecked(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	s := NewStack(blake)
+	node := make([]byte, blake.Size())
+	if err := s.AppendNodeChecked(node); err != nil {
+		t.Fatal(err)
+	} else if s.NumLeaves() != 1 {
+		t.Fatalf("expected %v leaves, got %v", 1, s.NumLeaves())
+	}
+
+	// the last leaf should fit, but no more
+	setStackLeaves(s, math.MaxUint64-1, node)
+	if err := s.AppendNodeChecked(node); err != nil {
+		t.Fatal(err)
+	} else if s.NumLeaves() != math.MaxUint64 {
+		t.Fatalf("expected %v leaves, got %v", uint64(math.MaxUint64), s.NumLeaves())
+	}
+	root := s.Root()
+	if err := s.AppendNodeChecked(node); err != ErrStackFull {
+		t.Fatalf("expected %v, got %v", ErrStackFull, err)
+	} else if s.NumLeaves() != math.MaxUint64 || !bytes.Equal(s.Root(), root) {
+		t.Fatal("failed append modified the Stack")
+	}
+
+	// AppendNode should panic instead
+	defer func() {
+		if recover() == nil {
+			t.Error("expected AppendNode to panic on a full Stack")
+		}
+	}()
+	s.AppendNode(node)
+}
+
+// TestStackPadDuplicate tests that a Stack using PadDuplicate pairs nodes
+// without a sibling with themselves, as in Bitcoin.
+func TestStackPadDuplicate(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	for n := 1; n <= 33; n++ {
+		s := NewStack(blake)
+		s.SetPaddingMode(PadDuplicate)
+		level := make([][]byte, n)
+		for i := range level {
+			level[i] = th.HashLeaf(fastrand.Bytes(64))
+			s.AppendNode(level[i])
+		}
+		// compute the expected root level by level
+		for len(level) > 1 {
+			if len(level)%2 == 1 {
+				level = append(level, level[len(level)-1])
+			}
+			next := make([][]byte, len(level)/2)
+			for i := range next {
+				next[i] = th.HashNode(level[2*i], level[2*i+1])
+			}
+			level = next
+		}
+		if !bytes.Equal(s.Root(), level[0]) {
+			t.Fatalf("PadDuplicate root of %v leaves does not match reference", n)
+		}
+	}
+}
+
+// TestStackRootFromChannel tests that StackRootFromChannel computes the same
+// root as recNodeRoot.
+func TestStackRootFromChannel(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for _, n := range []int{0, 1, 2, 3, 7, 8, 100} {
+		nodes := make([][]byte, n)
+		for i := range nodes {
+			nodes[i] = fastrand.Bytes(32)
+		}
+		ch := make(chan []byte, 4)
+		go func() {
+			for _, node := range nodes {
+				ch <- node
+			}
+			close(ch)
+		}()
+		root := StackRootFromChannel(ch, blake)
+		if exp := recNodeRoot(nodes, blake); !bytes.Equal(root, exp) {
+			t.Errorf("%v nodes: expected %x, got %x", n, exp, root)
+		} else if n == 0 && root != nil {
+			t.Error("expected nil root for empty channel")
+		}
+	}
+}
+
+// TestStackAppendAndProve tests that the proofs returned by AppendAndProve
+// verify with VerifyAppendProof.
+func TestStackAppendAndProve(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	nodes := make([][]byte, 100)
+	for i := range nodes {
+		nodes[i] = fastrand.Bytes(32)
+	}
+	s := NewStack(blake)
+	for n, node := range nodes {
+		oldRoot := s.Root()
+		newRoot, proof := s.AppendAndProve(node)
+		if exp := recNodeRoot(nodes[:n+1], blake); !bytes.Equal(newRoot, exp) {
+			t.Fatalf("%v leaves: expected root %x, got %x", n+1, exp, newRoot)
+		} else if !VerifyAppendProof(node, blake, uint64(n), proof, oldRoot, newRoot) {
+			t.Fatalf("%v leaves: failed to verify append proof", n+1)
+		}
+
+		// any modification should cause verification to fail
+		if VerifyAppendProof(nodes[0], blake, uint64(n), proof, oldRoot, newRoot) && n > 0 {
+			t.Fatalf("%v leaves: verified proof for the wrong node", n+1)
+		} else if VerifyAppendProof(node, blake, uint64(n), append(proof, oldRoot), oldRoot, newRoot) {
+			t.Fatalf("%v leaves: verified proof with too many hashes", n+1)
+		} else if VerifyAppendProof(node, blake, uint64(n), proof, newRoot, newRoot) {
+			t.Fatalf("%v leaves: verified proof for the wrong old root", n+1)
+		}
+		if len(proof) > 0 {
+			proof[len(proof)-1] = fastrand.Bytes(32)
+			if VerifyAppendProof(node, blake, uint64(n), proof, oldRoot, newRoot) {
+				t.Fatalf("%v leaves: verified a corrupted proof", n+1)
+			}
+		}
+	}
+}
+
+// prefixFreeHasher is a TreeHasher that hashes leaves and nodes without the
+// RFC 6962 domain separation prefixes.
+type prefixFreeHasher struct {
+	h hash.Hash
+}
+
+func (p prefixFreeHasher) HashLeaf(leaf []byte) []byte { return sum(p.h, leaf) }
+func (p prefixFreeHasher) HashNode(l, r []byte) []byte { return sum(p.h, l, r) }
+
+// TestRootFromLeafHashes tests that RootFromLeafHashes computes the same root
+// as recNodeRoot, and supports custom TreeHashers.
+func TestRootFromLeafHashes(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	// recPrefixFreeRoot is recNodeRoot without the node prefix
+	var recPrefixFreeRoot func(nodes [][]byte) []byte
+	recPrefixFreeRoot = func(nodes [][]byte) []byte {
+		if len(nodes) == 1 {
+			return nodes[0]
+		}
+		mid := 1
+		for mid*2 < len(nodes) {
+			mid *= 2
+		}
+		return sum(blake, recPrefixFreeRoot(nodes[:mid]), recPrefixFreeRoot(nodes[mid:]))
+	}
+
+	for _, n := range []int{1, 2, 3, 7, 8, 100} {
+		leafHashes := make([][]byte, n)
+		for i := range leafHashes {
+			leafHashes[i] = fastrand.Bytes(32)
+		}
+		if root, exp := RootFromLeafHashes(leafHashes, NewDefaultHasher(blake)), recNodeRoot(leafHashes, blake); !bytes.Equal(root, exp) {
+			t.Errorf("%v leaves: expected %x, got %x", n, exp, root)
+		}
+		if root, exp := RootFromLeafHashes(leafHashes, prefixFreeHasher{blake}), recPrefixFreeRoot(leafHashes); !bytes.Equal(root, exp) {
+			t.Errorf("%v leaves (prefix-free): expected %x, got %x", n, exp, root)
+		}
+	}
+	if RootFromLeafHashes(nil, NewDefaultHasher(blake)) != nil {
+		t.Error("expected nil root for no leaves")
+	}
+}
+
+// TestPrefixRoots tests that each root returned by PrefixRoots matches an
+// independently computed root of the corresponding prefix.
+func TestPrefixRoots(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafHashes := make([][]byte, 100)
+	for i := range leafHashes {
+		leafHashes[i] = fastrand.Bytes(32)
+	}
+	roots := PrefixRoots(leafHashes, blake)
+	if len(roots) != len(leafHashes) {
+		t.Fatalf("expected %v roots, got %v", len(leafHashes), len(roots))
+	}
+	for i, root := range roots {
+		if exp := recNodeRoot(leafHashes[:i+1], blake); !bytes.Equal(root, exp) {
+			t.Fatalf("prefix of %v leaves: expected %x, got %x", i+1, exp, root)
+		}
+	}
+	if roots := PrefixRoots(nil, blake); len(roots) != 0 {
+		t.Fatalf("expected no roots, got %v", len(roots))
+	}
+}
+
+// TestRootBuilder tests that Stack and Tree compute identical roots when used
+// through the RootBuilder interface.
+func TestRootBuilder(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	builders := func() []RootBuilder {
+		return []RootBuilder{NewStack(blake), New(blake)}
+	}
+	nodes := make([][]byte, 37)
+	for i := range nodes {
+		nodes[i] = fastrand.Bytes(32)
+	}
+
+	// append nodes one at a time
+	for n := 0; n <= len(nodes); n++ {
+		exp := recNodeRoot(nodes[:n], blake)
+		for _, rb := range builders() {
+			for _, node := range nodes[:n] {
+				rb.AppendNode(node)
+			}
+			if root := rb.Root(); !bytes.Equal(root, exp) {
+				t.Fatalf("%T, %v nodes: expected root %x, got %x", rb, n, exp, root)
+			}
+		}
+	}
+
+	// push subtrees of decreasing height
+	heights := []int{5, 2, 0}
+	var exp []byte
+	for _, rb := range builders() {
+		for i, height := range heights {
+			if err := rb.PushSubTree(height, nodes[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if exp == nil {
+			exp = rb.Root()
+		} else if root := rb.Root(); !bytes.Equal(root, exp) {
+			t.Fatalf("%T: expected root %x, got %x", rb, exp, root)
+		}
+		// a subtree larger than the smallest subtree should be rejected
+		if err := rb.PushSubTree(1, nodes[0]); err == nil {
+			t.Fatalf("%T: expected error when pushing an oversized subtree", rb)
+		}
+	}
+
+	// subtree hashers should produce identical proofs with either builder
+	const leafSize = 64
+	leafData := fastrand.Bytes(leafSize * len(nodes))
+	ranges := []LeafRange{{3, 5}, {20, 21}}
+	expProof, err := BuildMultiRangeProof(ranges, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTree := func() RootBuilder { return New(blake) }
+	rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	rsh.SetRootBuilder(newTree)
+	if proof, err := BuildMultiRangeProof(ranges, rsh); err != nil {
+		t.Fatal(err)
+	} else if !ProofsEqual(proof, expProof) {
+		t.Fatal(ProofEqualityReport(proof, expProof))
+	}
+	var hashes [][]byte
+	th := NewDefaultHasher(blake)
+	for i := 0; i < len(leafData); i += leafSize {
+		hashes = append(hashes, th.HashLeaf(leafData[i:][:leafSize]))
+	}
+	csh := NewCachedSubtreeHasher(hashes, blake)
+	csh.SetRootBuilder(newTree)
+	if proof, err := BuildMultiRangeProof(ranges, csh); err != nil {
+		t.Fatal(err)
+	} else if !ProofsEqual(proof, expProof) {
+		t.Fatal(ProofEqualityReport(proof, expProof))
+	}
+}
+
+// TestRootWithNodeCallback tests that the nodes reported by
+// RootWithNodeCallback can be reassembled into the root of the tree.
+func TestRootWithNodeCallback(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	th := NewDefaultHasher(blake)
+	for numLeaves := uint64(1); numLeaves <= 40; numLeaves++ {
+		leafHashes := make([][]byte, numLeaves)
+		for i := range leafHashes {
+			leafHashes[i] = fastrand.Bytes(32)
+		}
+		nodes := make(map[NodePosition][]byte)
+		root, err := RootWithNodeCallback(NewCachedSubtreeHasher(leafHashes, blake), blake, func(height int, index uint64, hash []byte) {
+			pos := NodePosition{height, index}
+			if _, ok := nodes[pos]; ok {
+				t.Fatalf("%v leaves: node %v reported twice", numLeaves, pos)
+			}
+			nodes[pos] = append([]byte(nil), hash...)
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if exp := recNodeRoot(leafHashes, blake); !bytes.Equal(root, exp) {
+			t.Fatalf("%v leaves: expected %x, got %x", numLeaves, exp, root)
+		} else if len(nodes) != int(2*numLeaves-1) {
+			t.Fatalf("%v leaves: expected %v nodes, got %v", numLeaves, 2*numLeaves-1, len(nodes))
+		}
+
+		// reassemble the tree from its leaves, checking each reported node
+		var reassemble func(start, end uint64) []byte
+		reassemble = func(start, end uint64) []byte {
+			height := bits.Len64(end - start - 1)
+			node, ok := nodes[NodePosition{height, start >> uint(height)}]
+			if !ok {
+				t.Fatalf("%v leaves: no node reported for leaves [%v,%v)", numLeaves, start, end)
+			} else if height == 0 {
+				if !bytes.Equal(node, leafHashes[start]) {
+					t.Fatalf("%v leaves: wrong hash reported for leaf %v", numLeaves, start)
+				}
+				return node
+			}
+			mid := start + 1<<uint(height-1)
+			if exp := th.HashNode(reassemble(start, mid), reassemble(mid, end)); !bytes.Equal(node, exp) {
+				t.Fatalf("%v leaves: wrong hash reported for leaves [%v,%v)", numLeaves, start, end)
+			}
+			return node
+		}
+		if !bytes.Equal(reassemble(0, numLeaves), root) {
+			t.Fatalf("%v leaves: reassembled root does not match", numLeaves)
+		}
+	}
+
+	// an empty tree has no root
+	if root, err := RootWithNodeCallback(NewCachedSubtreeHasher(nil, blake), blake, func(int, uint64, []byte) {
+		t.Fatal("callback called for empty tree")
+	}); err != nil || root != nil {
+		t.Fatalf("expected nil root, got %x (%v)", root, err)
+	}
+}
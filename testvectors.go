@@ -0,0 +1,91 @@
+package merkletree
+
+import "hash"
+
+// A TestVector is a self-contained multi-range proof, suitable for testing
+// other implementations of the proof format. LeafHashes contains the hashes
+// of the leaves within Ranges, in order; together with Proof, they are
+// sufficient to reconstruct Root.
+type TestVector struct {
+	Name       string      `json:"name"`
+	NumLeaves  uint64      `json:"numLeaves"`
+	Ranges     []LeafRange `json:"ranges"`
+	LeafHashes [][]byte    `json:"leafHashes"`
+	Proof      [][]byte    `json:"proof"`
+	Root       []byte      `json:"root"`
+}
+
+// GenerateTestVectors returns a deterministic set of test vectors for a tree
+// of numLeaves leaves, each leafSize bytes long. The i'th byte of the leaf
+// data is byte(i), so other implementations can easily reproduce the tree.
+// The vectors cover single leaves at the start, middle, and end of the tree,
+// the tail of the tree, the whole tree, multiple disjoint ranges, and the
+// worst case (every other leaf).
+func GenerateTestVectors(leafSize, numLeaves int, h hash.Hash) []TestVector {
+	if leafSize <= 0 || numLeaves <= 0 {
+		panic("GenerateTestVectors: leafSize and numLeaves must be positive")
+	}
+	th := NewDefaultHasher(h)
+	leafHashes := make([][]byte, numLeaves)
+	leaf := make([]byte, leafSize)
+	for i := range leafHashes {
+		for j := range leaf {
+			leaf[j] = byte(i*leafSize + j)
+		}
+		leafHashes[i] = th.HashLeaf(leaf)
+	}
+	root, _ := NewCachedSubtreeHasher(leafHashes, h).NextSubtreeRoot(numLeaves)
+
+	// for small trees, some of the ranges below are empty or overlapping;
+	// rangeSet discards empty ranges and coalesces the rest
+	rangeSet := func(ranges ...LeafRange) []LeafRange {
+		var nonEmpty []LeafRange
+		for _, r := range ranges {
+			if r.Start < r.End {
+				nonEmpty = append(nonEmpty, r)
+			}
+		}
+		return CoalesceRanges(nonEmpty)
+	}
+	n := uint64(numLeaves)
+	var alternating []LeafRange
+	for i := uint64(0); i < n; i += 2 {
+		alternating = append(alternating, LeafRange{i, i + 1})
+	}
+	cases := []struct {
+		name   string
+		ranges []LeafRange
+	}{
+		{"first leaf", rangeSet(LeafRange{0, 1})},
+		{"middle leaf", rangeSet(LeafRange{n / 2, n/2 + 1})},
+		{"last leaf", rangeSet(LeafRange{n - 1, n})},
+		{"tail", rangeSet(LeafRange{n / 2, n})},
+		{"full tree", rangeSet(LeafRange{0, n})},
+		{"first and last leaves", rangeSet(LeafRange{0, 1}, LeafRange{n - 1, n})},
+		{"multiple ranges", rangeSet(LeafRange{n / 4, n/4 + 1}, LeafRange{n / 3, n / 2}, LeafRange{n - n/8 - 1, n - n/8})},
+		{"alternating leaves", alternating},
+	}
+
+	vectors := make([]TestVector, 0, len(cases))
+	for _, c := range cases {
+		proof, err := BuildMultiRangeProof(c.ranges, NewCachedSubtreeHasher(leafHashes, h))
+		if err != nil {
+			// should be unreachable, since CachedSubtreeHasher never returns
+			// an error for ranges within the tree
+			panic(err)
+		}
+		var hashes [][]byte
+		for _, r := range c.ranges {
+			hashes = append(hashes, leafHashes[r.Start:r.End]...)
+		}
+		vectors = append(vectors, TestVector{
+			Name:       c.name,
+			NumLeaves:  n,
+			Ranges:     c.ranges,
+			LeafHashes: hashes,
+			Proof:      proof,
+			Root:       root,
+		})
+	}
+	return vectors
+}
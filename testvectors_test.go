@@ -0,0 +1,95 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestGenerateTestVectors tests that every vector produced by
+// GenerateTestVectors verifies, and that the vectors are deterministic.
+func TestGenerateTestVectors(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for _, test := range []struct {
+		leafSize  int
+		numLeaves int
+	}{
+		{64, 1},
+		{64, 2},
+		{64, 7},
+		{64, 16},
+		{32, 129},
+		{1, 1000},
+	} {
+		leafData := make([]byte, test.leafSize*test.numLeaves)
+		for i := range leafData {
+			leafData[i] = byte(i)
+		}
+		root := bytesRoot(leafData, blake, test.leafSize)
+
+		vectors := GenerateTestVectors(test.leafSize, test.numLeaves, blake)
+		for _, v := range vectors {
+			if !bytes.Equal(v.Root, root) {
+				t.Fatalf("%v (%v leaves): incorrect root", v.Name, test.numLeaves)
+			}
+			ok, err := VerifyMultiRangeProof(NewCachedLeafHasher(v.LeafHashes), blake, v.Ranges, v.Proof, v.Root)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Errorf("%v (%v leaves): failed to verify", v.Name, test.numLeaves)
+			}
+		}
+
+		// vectors should survive a JSON round-trip and be deterministic
+		js, err := json.Marshal(vectors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded []TestVector
+		if err := json.Unmarshal(js, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, GenerateTestVectors(test.leafSize, test.numLeaves, blake)) {
+			t.Error("test vectors did not survive JSON round-trip")
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update golden test vectors in testdata")
+
+// goldenVectors returns the JSON encoding of the test vectors stored in
+// testdata/vectors.json: those for a tree of 37 leaves of 64 bytes, hashed
+// with BLAKE2b-256.
+func goldenVectors() []byte {
+	blake, _ := blake2b.New256(nil)
+	js, err := json.MarshalIndent(GenerateTestVectors(64, 37, blake), "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	return append(js, '\n')
+}
+
+// TestGoldenTestVectors tests that GenerateTestVectors reproduces the vectors
+// in testdata/vectors.json byte-for-byte, so that any change to the proof
+// format is caught. Run with -update to regenerate the file.
+func TestGoldenTestVectors(t *testing.T) {
+	path := filepath.Join("testdata", "vectors.json")
+	js := goldenVectors()
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, js, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(js, golden) {
+		t.Fatalf("generated test vectors do not match %v", path)
+	}
+}
@@ -58,6 +58,39 @@ func sum(h hash.Hash, data ...[]byte) []byte {
 	return h.Sum(nil)
 }
 
+// nodeSumInto writes the hash of the node with children l and r to dst, which
+// may alias r, and returns the written portion of dst. It does not allocate,
+// and panics if dst is too short to hold the hash.
+func nodeSumInto(h hash.Hash, dst, l, r []byte) []byte {
+	if len(dst) < h.Size() {
+		panic("nodeSumInto: destination buffer is too small")
+	}
+	h.Reset()
+	_, _ = h.Write(nodeHashPrefix)
+	_, _ = h.Write(l)
+	_, _ = h.Write(r)
+	return h.Sum(dst[:0])
+}
+
+// A nodeIntoHasher is a TreeHasher that can hash a node without allocating.
+// DefaultTreeHasher and SaltedTreeHasher implement it.
+type nodeIntoHasher interface {
+	hashNodeInto(dst, l, r []byte) []byte
+}
+
+// hashNodeInto is like nodeSumInto, but uses th to hash the node. If th is not
+// a nodeIntoHasher, it falls back to HashNode, which may allocate.
+func hashNodeInto(th TreeHasher, dst, l, r []byte) []byte {
+	if nh, ok := th.(nodeIntoHasher); ok {
+		return nh.hashNodeInto(dst, l, r)
+	}
+	node := th.HashNode(l, r)
+	if len(dst) < len(node) {
+		panic("hashNodeInto: destination buffer is too small")
+	}
+	return dst[:copy(dst, node)]
+}
+
 // joinSubTrees combines two equal sized subTrees into a larger subTree.
 func joinSubTrees(th TreeHasher, a, b *subTree) *subTree {
 	if DEBUG {
@@ -257,7 +290,25 @@ func (t *Tree) PushSubTree(height int, sum []byte) error {
 	return nil
 }
 
-// Root returns the Merkle root of the data that has been pushed.
+// AppendNode appends a leaf hash to the Tree. It is equivalent to
+// PushSubTree(0, node), but panics rather than returning an error; in
+// particular, it must not be used to append the leaf at the proof index.
+func (t *Tree) AppendNode(node []byte) {
+	if err := t.PushSubTree(0, node); err != nil {
+		panic("AppendNode: " + err.Error())
+	}
+}
+
+// EmptyRoot returns the Merkle root of a tree with no leaves. The root of an
+// empty tree is defined to be nil regardless of the hash function, matching the
+// roots reported by an empty Tree or Stack, so EmptyRoot takes no hash
+// function.
+func EmptyRoot() []byte {
+	return nil
+}
+
+// Root returns the Merkle root of the data that has been pushed. If no data
+// has been pushed, Root returns nil (see EmptyRoot).
 func (t *Tree) Root() []byte {
 	// If the Tree is empty, return nil.
 	if t.head == nil {
@@ -275,6 +326,25 @@ func (t *Tree) Root() []byte {
 	return append(current.sum[:0:0], current.sum...)
 }
 
+// RootInto writes the Merkle root of the data that has been pushed to dst and
+// returns the length of the root, or 0 if no data has been pushed. Unlike Root,
+// RootInto does not allocate when the Tree uses one of the TreeHashers
+// provided by this package, which makes it suitable for comparing roots in
+// tight loops. RootInto panics if dst is too short to hold the root.
+func (t *Tree) RootInto(dst []byte) int {
+	if t.head == nil {
+		return 0
+	} else if len(dst) < len(t.head.sum) {
+		panic("RootInto: destination buffer is too small")
+	}
+	// see Root
+	root := dst[:copy(dst, t.head.sum)]
+	for current := t.head.next; current != nil; current = current.next {
+		root = hashNodeInto(t.treeHasher, dst, current.sum, root)
+	}
+	return len(root)
+}
+
 // SetIndex will tell the Tree to create a storage proof for the leaf at the
 // input index. SetIndex must be called on an empty tree.
 func (t *Tree) SetIndex(i uint64) error {
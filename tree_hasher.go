@@ -1,6 +1,9 @@
 package merkletree
 
-import "hash"
+import (
+	"encoding/binary"
+	"hash"
+)
 
 type LeafHasherz interface {
 	HashLeaf(leaf []byte) []byte
@@ -30,3 +33,44 @@ func (d *DefaultTreeHasher) HashLeaf(leaf []byte) []byte {
 func (d *DefaultTreeHasher) HashNode(l, r []byte) []byte {
 	return sum(d.h, nodeHashPrefix, l, r)
 }
+
+// hashNodeInto is like HashNode, but writes the hash to dst without
+// allocating; see nodeSumInto.
+func (d *DefaultTreeHasher) hashNodeInto(dst, l, r []byte) []byte {
+	return nodeSumInto(d.h, dst, l, r)
+}
+
+var _ TreeHasher = &SaltedTreeHasher{}
+
+// SaltedTreeHasher is like DefaultTreeHasher, but writes a salt into the hash
+// before each leaf, so that trees with different salts have different roots
+// even if their leaves are identical. The salt is preceded by its length as an
+// 8-byte little-endian integer, so that no two (salt, leaf) pairs share a
+// preimage. The length is written even if the salt is empty, so an empty salt
+// does not produce the same leaf hashes as DefaultTreeHasher. Node hashes are
+// unaffected.
+type SaltedTreeHasher struct {
+	h    hash.Hash
+	salt []byte // length-prefixed
+}
+
+func NewSaltedHasher(h hash.Hash, salt []byte) *SaltedTreeHasher {
+	prefixed := make([]byte, 8, 8+len(salt))
+	binary.LittleEndian.PutUint64(prefixed, uint64(len(salt)))
+	prefixed = append(prefixed, salt...)
+	return &SaltedTreeHasher{h, prefixed}
+}
+
+func (s *SaltedTreeHasher) HashLeaf(leaf []byte) []byte {
+	return sum(s.h, leafHashPrefix, s.salt, leaf)
+}
+
+func (s *SaltedTreeHasher) HashNode(l, r []byte) []byte {
+	return sum(s.h, nodeHashPrefix, l, r)
+}
+
+// hashNodeInto is like HashNode, but writes the hash to dst without
+// allocating; see nodeSumInto.
+func (s *SaltedTreeHasher) hashNodeInto(dst, l, r []byte) []byte {
+	return nodeSumInto(s.h, dst, l, r)
+}
@@ -3,7 +3,10 @@ package merkletree
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
 	"math/big"
 	"strconv"
 	"testing"
@@ -384,6 +387,61 @@ func TestBadInputs(t *testing.T) {
 	}
 }
 
+// TestEmptyTree pins down the root of an empty tree, and the behavior of the
+// range and diff proof functions for empty trees, so that it can't change
+// silently.
+func TestEmptyTree(t *testing.T) {
+	if EmptyRoot() != nil {
+		t.Error("EmptyRoot should be nil")
+	}
+	// the empty root does not depend on the hash function
+	for _, h := range []hash.Hash{sha1.New(), sha256.New(), sha512.New()} {
+		if New(h).Root() != nil {
+			t.Errorf("root of empty Tree should be nil for %T", h)
+		}
+		if NewStack(h).Root() != nil {
+			t.Errorf("root of empty Stack should be nil for %T", h)
+		}
+		if root, err := ReaderRoot(new(bytes.Reader), h, 64); err != nil {
+			t.Fatal(err)
+		} else if root != nil {
+			t.Errorf("root of empty reader should be nil for %T", h)
+		}
+	}
+	h := sha256.New()
+
+	// proofs for an empty set of ranges are empty, and verify against any
+	// root, including the empty root
+	proof, err := BuildMultiRangeProof(nil, NewReaderSubtreeHasher(new(bytes.Reader), 64, h))
+	if err != nil {
+		t.Fatal(err)
+	} else if proof != nil {
+		t.Error("proof for an empty set of ranges should be nil")
+	}
+	if ok, err := VerifyMultiRangeProof(NewCachedLeafHasher(nil), h, nil, nil, EmptyRoot()); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("empty proof should verify against the empty root")
+	}
+
+	// a diff proof for a tree with no leaves reconstructs the empty root
+	if root, err := ReconstructDiffRoot(nil, 0, h, nil, nil); err != nil {
+		t.Fatal(err)
+	} else if root != nil {
+		t.Error("reconstructed root of empty tree should be nil")
+	}
+	if ok, err := VerifyDiffProof(nil, 0, h, nil, nil, EmptyRoot()); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("empty diff proof should verify against the empty root")
+	}
+	if ok, err := VerifyDiffProof(nil, 0, h, nil, nil, make([]byte, h.Size())); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("empty diff proof should not verify against a non-empty root")
+	}
+}
+
 // TestCompatibility runs BuildProof for a large set of trees, and checks that
 // verify affirms each proof, while rejecting for all other indexes (this
 // second half requires that all input data be unique). The test checks that
@@ -764,6 +822,40 @@ func TestPushSubTreeSimple(t *testing.T) {
 	}
 }
 
+// TestRootInto tests that RootInto writes the same root that Root returns.
+func TestRootInto(t *testing.T) {
+	for _, th := range []TreeHasher{
+		NewDefaultHasher(sha256.New()),
+		NewSaltedHasher(sha256.New(), []byte("salt")),
+		prefixFreeHasher{sha256.New()},
+	} {
+		tree := NewFromTreehasher(th)
+		buf := make([]byte, sha256.Size)
+		if n := tree.RootInto(buf); n != 0 {
+			t.Fatalf("expected 0 bytes for empty tree, got %v", n)
+		}
+		for i := 0; i < 40; i++ {
+			tree.Push(fastrand.Bytes(64))
+			n := tree.RootInto(buf)
+			if root := tree.Root(); !bytes.Equal(buf[:n], root) {
+				t.Fatalf("%T, %v leaves: expected %x, got %x", th, i+1, root, buf[:n])
+			}
+		}
+	}
+
+	// a short buffer should cause a panic
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for short buffer")
+		}
+	}()
+	tree := New(sha256.New())
+	tree.Push([]byte{1})
+	tree.Push([]byte{2})
+	tree.Push([]byte{3})
+	tree.RootInto(make([]byte, sha256.Size-1))
+}
+
 // BenchmarkSha256_4MB uses sha256 to hash 4mb of data.
 func BenchmarkSha256_4MB(b *testing.B) {
 	data := make([]byte, 4*1024*1024)
@@ -817,3 +909,31 @@ func BenchmarkTree4k_4MB(b *testing.B) {
 		tree.Root()
 	}
 }
+
+// BenchmarkRootInto compares the performance and allocations of Root and
+// RootInto for a tree whose root requires joining several subtrees.
+func BenchmarkRootInto(b *testing.B) {
+	tree := New(sha256.New())
+	for i := 0; i < 127; i++ {
+		tree.Push(fastrand.Bytes(64))
+	}
+	expected := tree.Root()
+
+	b.Run("Root", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !bytes.Equal(tree.Root(), expected) {
+				b.Fatal("wrong root")
+			}
+		}
+	})
+	b.Run("RootInto", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, sha256.Size)
+		for i := 0; i < b.N; i++ {
+			if n := tree.RootInto(buf); !bytes.Equal(buf[:n], expected) {
+				b.Fatal("wrong root")
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package merkletree
+
+import "hash"
+
+// A RootWriter computes the Merkle root of the data written to it. Data is
+// split into leaves of a fixed size; leaves may span multiple calls to Write.
+// The memory footprint of a RootWriter is O(log(n)) in the number of leaves.
+type RootWriter struct {
+	s    *Stack
+	leaf []byte
+}
+
+// Write implements io.Writer. It never returns an error.
+func (rw *RootWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// fill the leaf buffer, appending the leaf once it is full
+		m := copy(rw.leaf[len(rw.leaf):cap(rw.leaf)], p)
+		rw.leaf = rw.leaf[:len(rw.leaf)+m]
+		p = p[m:]
+		if len(rw.leaf) == cap(rw.leaf) {
+			rw.s.AppendLeaf(rw.leaf)
+			rw.leaf = rw.leaf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Root returns the Merkle root of the data that has been written. If the
+// amount of data written is not a multiple of the leaf size, the remaining
+// data forms a final, short leaf; it is not padded. Root does not modify the
+// RootWriter, so more data may be written afterwards. If no data has been
+// written, Root returns nil.
+func (rw *RootWriter) Root() []byte {
+	if len(rw.leaf) == 0 {
+		return rw.s.Root()
+	}
+	s := *rw.s
+	s.AppendLeaf(rw.leaf)
+	return s.Root()
+}
+
+// NewRootWriter returns a RootWriter that splits data into leaves of
+// leafSize bytes and uses h for all hashing operations. It panics if leafSize
+// is not positive.
+func NewRootWriter(leafSize int, h hash.Hash) *RootWriter {
+	if leafSize <= 0 {
+		panic("NewRootWriter: leafSize must be positive")
+	}
+	return &RootWriter{
+		s:    NewStack(h),
+		leaf: make([]byte, 0, leafSize),
+	}
+}
+
+// A ProofWriter builds a proof for a single leaf of the data written to it.
+// Like RootWriter, it splits data into leaves of a fixed size, and leaves may
+// span multiple calls to Write.
+type ProofWriter struct {
+	t    *Tree
+	leaf []byte
+}
+
+// Write implements io.Writer. It never returns an error.
+func (pw *ProofWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(pw.leaf[len(pw.leaf):cap(pw.leaf)], p)
+		pw.leaf = pw.leaf[:len(pw.leaf)+m]
+		p = p[m:]
+		if len(pw.leaf) == cap(pw.leaf) {
+			pw.push(pw.t, pw.leaf)
+			pw.leaf = pw.leaf[:0]
+		}
+	}
+	return n, nil
+}
+
+// push pushes leaf into t. Since the Tree retains the data of the leaf at the
+// proof index, that leaf is copied out of the reused leaf buffer.
+func (pw *ProofWriter) push(t *Tree, leaf []byte) {
+	if t.currentIndex == t.proofIndex {
+		leaf = append([]byte(nil), leaf...)
+	}
+	t.Push(leaf)
+}
+
+// Prove returns the Merkle root of the data that has been written, along with
+// a proof for the leaf at the proof index and the number of leaves. As with
+// BuildReaderProof, the first element of the proof is the data of the leaf
+// itself. If the amount of data written is not a multiple of the leaf size,
+// the remaining data forms a final, short leaf. If the proof index has not
+// been reached, the proof is nil. Prove does not modify the ProofWriter, so
+// more data may be written afterwards.
+func (pw *ProofWriter) Prove() (root []byte, proof [][]byte, numLeaves uint64) {
+	t := pw.t
+	if len(pw.leaf) != 0 {
+		// Pushing into a shallow copy of the Tree leaves the original intact,
+		// since subtrees are never modified once created.
+		tc := *pw.t
+		t = &tc
+		pw.push(t, pw.leaf)
+	}
+	root, proof, _, numLeaves = t.Prove()
+	if proof != nil {
+		// the proof may share memory with the Tree's proof set, which later
+		// writes would overwrite
+		proof = append([][]byte(nil), proof...)
+	}
+	return root, proof, numLeaves
+}
+
+// NewProofWriter returns a ProofWriter that splits data into leaves of
+// leafSize bytes, builds a proof for the leaf at proofIndex, and uses h for
+// all hashing operations. It panics if leafSize is not positive.
+func NewProofWriter(leafSize int, proofIndex uint64, h hash.Hash) *ProofWriter {
+	if leafSize <= 0 {
+		panic("NewProofWriter: leafSize must be positive")
+	}
+	t := New(h)
+	if err := t.SetIndex(proofIndex); err != nil {
+		panic(err) // unreachable; the Tree is empty
+	}
+	return &ProofWriter{
+		t:    t,
+		leaf: make([]byte, 0, leafSize),
+	}
+}
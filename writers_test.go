@@ -0,0 +1,142 @@
+package merkletree
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"gitlab.com/NebulousLabs/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestRootWriter tests that RootWriter produces the same roots as ReaderRoot
+// when data is written in chunks that do not line up with leaf boundaries.
+func TestRootWriter(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+
+	tests := []struct {
+		leafSize int
+		dataSize int
+	}{
+		{leafSize: 64, dataSize: 0},
+		{leafSize: 64, dataSize: 1},
+		{leafSize: 64, dataSize: 64},
+		{leafSize: 64, dataSize: 65},
+		{leafSize: 64, dataSize: 64 * 17},
+		{leafSize: 64, dataSize: 64*31 + 7},
+		{leafSize: 1, dataSize: 100},
+		{leafSize: 7, dataSize: 1000},
+	}
+	for _, test := range tests {
+		data := fastrand.Bytes(test.dataSize)
+		root, err := ReaderRoot(bytes.NewReader(data), blake, test.leafSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// write in randomly-sized chunks
+		rw := NewRootWriter(test.leafSize, blake)
+		for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+			rw.Write(buf.Next(1 + fastrand.Intn(2*test.leafSize)))
+		}
+		if !bytes.Equal(rw.Root(), root) {
+			t.Errorf("RootWriter root does not match ReaderRoot for %v bytes of %v-byte leaves", test.dataSize, test.leafSize)
+		}
+		// Root should not modify the writer
+		if !bytes.Equal(rw.Root(), root) {
+			t.Error("calling Root twice produced different results")
+		}
+
+		// io.Copy should work too
+		rw = NewRootWriter(test.leafSize, blake)
+		if _, err := io.Copy(rw, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(rw.Root(), root) {
+			t.Errorf("RootWriter root does not match ReaderRoot after io.Copy")
+		}
+	}
+
+	// writing more data after calling Root should continue the tree
+	data := fastrand.Bytes(1000)
+	rw := NewRootWriter(64, blake)
+	rw.Write(data[:100])
+	rw.Root()
+	rw.Write(data[100:])
+	if !bytes.Equal(rw.Root(), bytesRoot(data, blake, 64)) {
+		t.Error("RootWriter produced wrong root after an intermediate call to Root")
+	}
+}
+
+// TestProofWriter tests that ProofWriter produces the same proofs as
+// BuildReaderProof, including for trees with a short final leaf.
+func TestProofWriter(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+
+	tests := []struct {
+		leafSize int
+		dataSize int
+	}{
+		{leafSize: 64, dataSize: 1},
+		{leafSize: 64, dataSize: 64},
+		{leafSize: 64, dataSize: 65},
+		{leafSize: 64, dataSize: 64 * 17},
+		{leafSize: 64, dataSize: 64*31 + 7},
+		{leafSize: 1, dataSize: 100},
+		{leafSize: 7, dataSize: 1000},
+	}
+	for _, test := range tests {
+		data := fastrand.Bytes(test.dataSize)
+		numLeaves := uint64((test.dataSize + test.leafSize - 1) / test.leafSize)
+		for _, proofIndex := range []uint64{0, numLeaves / 2, numLeaves - 1} {
+			expRoot, expProof, expLeaves, err := BuildReaderProof(bytes.NewReader(data), blake, test.leafSize, proofIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// write in randomly-sized chunks
+			pw := NewProofWriter(test.leafSize, proofIndex, blake)
+			for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+				pw.Write(buf.Next(1 + fastrand.Intn(2*test.leafSize)))
+			}
+			root, proof, n := pw.Prove()
+			if !bytes.Equal(root, expRoot) {
+				t.Fatalf("%v bytes, index %v: expected root %x, got %x", test.dataSize, proofIndex, expRoot, root)
+			} else if !ProofsEqual(proof, expProof) {
+				t.Fatalf("%v bytes, index %v: %v", test.dataSize, proofIndex, ProofEqualityReport(proof, expProof))
+			} else if n != expLeaves {
+				t.Fatalf("%v bytes, index %v: expected %v leaves, got %v", test.dataSize, proofIndex, expLeaves, n)
+			} else if !VerifyProof(blake, root, proof, proofIndex, n) {
+				t.Fatalf("%v bytes, index %v: failed to verify proof", test.dataSize, proofIndex)
+			}
+
+			// io.Copy should work too
+			pw = NewProofWriter(test.leafSize, proofIndex, blake)
+			if _, err := io.Copy(pw, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			} else if root, proof, _ := pw.Prove(); !bytes.Equal(root, expRoot) || !ProofsEqual(proof, expProof) {
+				t.Fatalf("%v bytes, index %v: wrong proof after io.Copy", test.dataSize, proofIndex)
+			}
+		}
+	}
+
+	// writing more data after calling Prove should continue the tree
+	data := fastrand.Bytes(1000)
+	pw := NewProofWriter(64, 3, blake)
+	pw.Write(data[:200])
+	_, early, _ := pw.Prove()
+	earlyCopy := append([][]byte(nil), early...)
+	pw.Write(data[200:])
+	expRoot, expProof, _, _ := BuildReaderProof(bytes.NewReader(data), blake, 64, 3)
+	if root, proof, _ := pw.Prove(); !bytes.Equal(root, expRoot) || !ProofsEqual(proof, expProof) {
+		t.Error("ProofWriter produced wrong proof after an intermediate call to Prove")
+	} else if !ProofsEqual(early, earlyCopy) {
+		t.Error("writing more data modified a previously returned proof")
+	}
+
+	// the proof should be nil if the proof index was not reached
+	pw = NewProofWriter(64, 20, blake)
+	pw.Write(data)
+	if _, proof, _ := pw.Prove(); proof != nil {
+		t.Errorf("expected nil proof, got %v", proof)
+	}
+}